@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
@@ -12,6 +13,8 @@ import (
 	"log"
 	"net/http"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,19 +29,25 @@ const AdminUserCookieName = AdminCookieName("admin_user")
 const AdminTokenCookieName = AdminCookieName("admin_token")
 
 func renderAdminTemplate(w http.ResponseWriter, r *http.Request, tmpl string, data any) {
+	translator := newTranslator(negotiateLocale(r, constants.DEFAULT_LOCALE), nil)
+
 	templateData := struct {
 		CurrentUser *AdminUser
+		Locale      string
 		Data        any
 	}{
 		CurrentUser: getSignedInAdminUserOrNil(r),
+		Locale:      translator.Locale,
 		Data:        data,
 	}
 
 	templatesDir := "templates/admin"
 
-	baseTemplate := template.Must(template.ParseFiles(filepath.Join(templatesDir, "layout.html")))
+	baseTemplate := template.Must(template.New("layout.html").Funcs(translator.Funcs()).ParseFiles(filepath.Join(templatesDir, "layout.html")))
 	actualTemplate := template.Must(baseTemplate.ParseFiles(filepath.Join(templatesDir, tmpl+".html")))
 
+	w.Header().Add("Vary", "Accept-Language")
+
 	err := actualTemplate.Execute(w, templateData)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -223,48 +232,297 @@ func AdminLogout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/admin/signin", http.StatusSeeOther)
 }
 
-func AdminGuestbookList(w http.ResponseWriter, r *http.Request) {
-	adminUser := getSignedInAdminOrFail(r)
+// GuestbookListItem is a guestbook on the admin guestbook list with the
+// numbers of its messages.
+type GuestbookListItem struct {
+	Guestbook       Guestbook
+	TotalMessages   int64
+	PendingMessages int64
+	// messages written in the last 7 days
+	RecentMessages int64
+	// nil when the guestbook has no messages
+	LastMessageAt *time.Time
+}
+
+// guestbookListData is rendered by the admin guestbook list.
+type guestbookListData struct {
+	Items  []GuestbookListItem
+	Search string
+	// one of the guestbookListSorts
+	Sort string
+}
 
+// guestbookListSorts orders the admin guestbook list, by creation unless
+// another sort is picked.
+var guestbookListSorts = map[string]func(a, b GuestbookListItem) int{
+	"created": func(a, b GuestbookListItem) int {
+		return cmp.Compare(a.Guestbook.ID, b.Guestbook.ID)
+	},
+	"activity": func(a, b GuestbookListItem) int {
+		// guestbooks without messages go last
+		switch {
+		case a.LastMessageAt == nil && b.LastMessageAt == nil:
+			return 0
+		case a.LastMessageAt == nil:
+			return 1
+		case b.LastMessageAt == nil:
+			return -1
+		}
+		return b.LastMessageAt.Compare(*a.LastMessageAt)
+	},
+	"messages": func(a, b GuestbookListItem) int {
+		return cmp.Compare(b.TotalMessages, a.TotalMessages)
+	},
+	"pending": func(a, b GuestbookListItem) int {
+		return cmp.Compare(b.PendingMessages, a.PendingMessages)
+	},
+	"name": func(a, b GuestbookListItem) int {
+		return cmp.Compare(strings.ToLower(a.Guestbook.WebsiteURL), strings.ToLower(b.Guestbook.WebsiteURL))
+	},
+}
+
+// loadGuestbookListItems returns the guestbooks of a user whose website
+// contains search, with the numbers of their messages counted by a single
+// grouped query.
+func loadGuestbookListItems(adminUserID uint, search string) ([]GuestbookListItem, error) {
+	query := db.Where(&Guestbook{AdminUserID: adminUserID})
+	if search != "" {
+		query = query.Where(`website_url LIKE ? ESCAPE '\'`, "%"+likeEscaper.Replace(search)+"%")
+	}
 	var guestbooks []Guestbook
-	result := db.Where(&Guestbook{AdminUserID: adminUser.ID}).Find(&guestbooks)
+	if err := query.Find(&guestbooks).Error; err != nil {
+		return nil, err
+	}
+
+	items := make([]GuestbookListItem, len(guestbooks))
+	if len(guestbooks) == 0 {
+		return items, nil
+	}
+	ids := make([]uint, len(guestbooks))
+	for i, g := range guestbooks {
+		ids[i] = g.ID
+		items[i].Guestbook = g
+	}
+
+	// sqlite returns MAX(created_at) as text, so it is turned into a unix
+	// time to be scanned
+	var stats []struct {
+		GuestbookID     uint
+		TotalMessages   int64
+		PendingMessages int64
+		RecentMessages  int64
+		LastMessageAt   int64
+	}
+	result := db.Model(&Message{}).
+		Select(`guestbook_id,
+			COUNT(*) AS total_messages,
+			SUM(CASE WHEN approved THEN 0 ELSE 1 END) AS pending_messages,
+			SUM(CASE WHEN created_at >= ? THEN 1 ELSE 0 END) AS recent_messages,
+			CAST(strftime('%s', MAX(created_at)) AS INTEGER) AS last_message_at`, time.Now().AddDate(0, 0, -7)).
+		Where("guestbook_id IN ?", ids).
+		Group("guestbook_id").
+		Scan(&stats)
 	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	indexes := make(map[uint]int, len(items))
+	for i, item := range items {
+		indexes[item.Guestbook.ID] = i
+	}
+	for _, stat := range stats {
+		item := &items[indexes[stat.GuestbookID]]
+		item.TotalMessages = stat.TotalMessages
+		item.PendingMessages = stat.PendingMessages
+		item.RecentMessages = stat.RecentMessages
+		lastMessageAt := time.Unix(stat.LastMessageAt, 0)
+		item.LastMessageAt = &lastMessageAt
+	}
+	return items, nil
+}
+
+func AdminGuestbookList(w http.ResponseWriter, r *http.Request) {
+	adminUser := getSignedInAdminOrFail(r)
+
+	data := guestbookListData{
+		Search: strings.TrimSpace(r.URL.Query().Get("q")),
+		Sort:   r.URL.Query().Get("sort"),
+	}
+	if len(data.Search) > constants.MAX_SEARCH_LENGTH {
+		http.Error(w, fmt.Sprintf("Search is too long, maximum length is %d characters", constants.MAX_SEARCH_LENGTH), http.StatusBadRequest)
+		return
+	}
+	compare, ok := guestbookListSorts[data.Sort]
+	if !ok {
+		data.Sort = "created"
+		compare = guestbookListSorts[data.Sort]
+	}
+
+	items, err := loadGuestbookListItems(adminUser.ID, data.Search)
+	if err != nil {
 		http.Error(w, "Error fetching guestbooks", http.StatusInternalServerError)
 		return
 	}
+	slices.SortStableFunc(items, compare)
+	data.Items = items
 
-	type GuestbookListItem struct {
-		Guestbook       Guestbook
-		TotalMessages   int64
-		PendingMessages int64
+	renderAdminTemplate(w, r, "guestbook_list", data)
+}
+
+// showGuestbookData is rendered by the admin guestbook view.
+type showGuestbookData struct {
+	Guestbook
+	Filter MessageFilter
+	// "newest" or "oldest"
+	Sort          string
+	Page          int
+	PageSize      int
+	TotalPages    int
+	TotalMessages int64
+}
+
+// PageURL links to another page of the view, keeping the filter and sort.
+func (d showGuestbookData) PageURL(page int) string {
+	values := d.Filter.Values()
+	if d.Sort != messageOrderNewest {
+		values.Set("sort", d.Sort)
+	}
+	if d.CustomPageSize() {
+		values.Set("limit", strconv.Itoa(d.PageSize))
+	}
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if len(values) == 0 {
+		return fmt.Sprintf("/admin/guestbook/%d", d.ID)
 	}
+	return fmt.Sprintf("/admin/guestbook/%d?%s", d.ID, values.Encode())
+}
 
-	items := make([]GuestbookListItem, 0, len(guestbooks))
-	for _, g := range guestbooks {
-		var total int64
-		var pending int64
-		db.Model(&Message{}).Where("guestbook_id = ?", g.ID).Count(&total)
-		db.Model(&Message{}).Where("guestbook_id = ? AND approved = ?", g.ID, false).Count(&pending)
+// CustomPageSize reports whether the page size was picked with the limit
+// parameter, which links have to keep.
+func (d showGuestbookData) CustomPageSize() bool {
+	return d.PageSize != constants.ADMIN_MESSAGES_PAGE_SIZE
+}
 
-		items = append(items, GuestbookListItem{
-			Guestbook:       g,
-			TotalMessages:   total,
-			PendingMessages: pending,
-		})
+// PrevPageURL is empty on the first page.
+func (d showGuestbookData) PrevPageURL() string {
+	if d.Page <= 1 {
+		return ""
+	}
+	return d.PageURL(d.Page - 1)
+}
+
+// NextPageURL is empty on the last page.
+func (d showGuestbookData) NextPageURL() string {
+	if d.Page >= d.TotalPages {
+		return ""
+	}
+	return d.PageURL(d.Page + 1)
+}
+
+// adminMessagesQuery selects the messages listed in the admin guestbook view.
+// Without a filter those are the top-level messages, shown with their replies.
+// With one, matches are listed on their own, replies included, so each shows
+// up once.
+func adminMessagesQuery(guestbookID uint, filter MessageFilter) *gorm.DB {
+	query := db.Model(&Message{}).Where("messages.guestbook_id = ?", guestbookID)
+	if !filter.Active() {
+		query = query.Where("messages.parent_message_id IS NULL")
 	}
+	return filter.apply(query)
+}
 
-	renderAdminTemplate(w, r, "guestbook_list", items)
+// adminMessagesOrder is the order of the admin guestbook view, sort being
+// "newest" or "oldest".
+func adminMessagesOrder(sort string) string {
+	if sort == messageOrderOldest {
+		return "messages.created_at asc, messages.id asc"
+	}
+	return "messages.created_at desc, messages.id desc"
 }
 
 func AdminShowGuestbook(w http.ResponseWriter, r *http.Request) {
 	guestbookID := chi.URLParam(r, "guestbookID")
 
+	filter, err := parseMessageFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data := showGuestbookData{
+		Filter:   filter,
+		Sort:     messageOrderNewest,
+		Page:     1,
+		PageSize: constants.ADMIN_MESSAGES_PAGE_SIZE,
+	}
+	if r.URL.Query().Get("sort") == messageOrderOldest {
+		data.Sort = messageOrderOldest
+	}
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= constants.MAX_PAGE_SIZE {
+		data.PageSize = l
+	}
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 1 {
+		data.Page = p
+	}
+
+	result := db.First(&data.Guestbook, "id = ?", guestbookID)
+	if result.Error != nil {
+		http.Error(w, "Guestbook not found", http.StatusNotFound)
+		return
+	}
+
+	currentUser := getSignedInAdminOrFail(r)
+	if data.AdminUserID != currentUser.ID {
+		http.Error(w, "You don't own this guestbook", http.StatusUnauthorized)
+		return
+	}
+
+	if err := adminMessagesQuery(data.ID, filter).Count(&data.TotalMessages).Error; err != nil {
+		http.Error(w, "Error loading messages", http.StatusInternalServerError)
+		return
+	}
+	data.TotalPages = int((data.TotalMessages + int64(data.PageSize) - 1) / int64(data.PageSize))
+	if data.Page > data.TotalPages && data.TotalPages > 0 {
+		data.Page = data.TotalPages
+	}
+
+	query := adminMessagesQuery(data.ID, filter).Order(adminMessagesOrder(data.Sort))
+	if !filter.Active() {
+		// show every reply, even ones nested deeper than the guestbook allows now
+		query = preloadReplies(query, "Replies", constants.MAX_REPLY_DEPTH, func(db *gorm.DB) *gorm.DB {
+			return db.Order("created_at asc")
+		})
+	}
+	result = query.Offset((data.Page - 1) * data.PageSize).Limit(data.PageSize).Find(&data.Messages)
+	if result.Error != nil {
+		http.Error(w, "Error loading messages", http.StatusInternalServerError)
+		return
+	}
+
+	if err := decorateMessages(&data.Guestbook, data.Messages, publicHostURL(r)); err != nil {
+		http.Error(w, "Error loading messages", http.StatusInternalServerError)
+		return
+	}
+
+	renderAdminTemplate(w, r, "show_guestbook", data)
+}
+
+// AdminMessageIDs returns the IDs of every message the admin guestbook view
+// lists for the filter in the query string, on all of its pages, so they can
+// be selected at once for bulk actions.
+func AdminMessageIDs(w http.ResponseWriter, r *http.Request) {
+	guestbookID := chi.URLParam(r, "guestbookID")
+
+	filter, err := parseMessageFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var guestbook Guestbook
-	result := db.Preload("Messages", func(db *gorm.DB) *gorm.DB {
-		return db.Where("parent_message_id IS NULL").Order("created_at desc")
-	}).Preload("Messages.Replies", func(db *gorm.DB) *gorm.DB {
-		return db.Order("created_at asc")
-	}).First(&guestbook, "id = ?", guestbookID)
+	result := db.First(&guestbook, "id = ?", guestbookID)
 	if result.Error != nil {
 		http.Error(w, "Guestbook not found", http.StatusNotFound)
 		return
@@ -276,12 +534,44 @@ func AdminShowGuestbook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	renderAdminTemplate(w, r, "show_guestbook", guestbook)
+	var ids []uint
+	result = adminMessagesQuery(guestbook.ID, filter).Order(adminMessagesOrder(r.URL.Query().Get("sort"))).Pluck("messages.id", &ids)
+	if result.Error != nil {
+		http.Error(w, "Error loading messages", http.StatusInternalServerError)
+		return
+	}
+
+	// the same shape AdminBulkDeleteMessages takes
+	messageIDs := make([]string, len(ids))
+	for i, id := range ids {
+		messageIDs[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"message_ids": messageIDs})
+}
+
+// guestbookFormData is rendered by the create and edit guestbook pages.
+type guestbookFormData struct {
+	Guestbook
+	Themes               []Theme
+	SelectedThemeID      uint
+	CustomFieldsJSON     string
+	Locales              []LocaleOption
+	StringOverrideFields []StringOverrideField
 }
 
 func AdminCreateGuestbook(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		renderAdminTemplate(w, r, "create_edit_guestbook", nil)
+		themes, err := guestbookThemeOptions(getSignedInAdminOrFail(r).ID, nil)
+		if err != nil {
+			http.Error(w, "Error loading themes", http.StatusInternalServerError)
+			return
+		}
+		renderAdminTemplate(w, r, "create_edit_guestbook", guestbookFormData{
+			Themes:               themes,
+			Locales:              availableLocales(),
+			StringOverrideFields: stringOverrideFields(&Guestbook{}),
+		})
 	} else {
 		adminUser := getSignedInAdminOrFail(r)
 
@@ -292,6 +582,15 @@ func AdminCreateGuestbook(w http.ResponseWriter, r *http.Request) {
 		challengeAnswer := r.FormValue("challengeAnswer")
 		requiresApproval := r.FormValue("requiresApproval") == "on"
 		powEnabled := r.FormValue("powEnabled") == "on"
+		markdownEnabled := r.FormValue("markdownEnabled") == "on"
+		visitorRepliesEnabled := r.FormValue("visitorRepliesEnabled") == "on"
+		publicSearchEnabled := r.FormValue("publicSearchEnabled") == "on"
+		maxReplyDepth := parseMaxReplyDepth(r.FormValue("maxReplyDepth"))
+		editWindowMinutes := parseEditWindowMinutes(r.FormValue("editWindowMinutes"))
+		avatarStyle := normalizeAvatarStyle(r.FormValue("avatarStyle"))
+		drawingsEnabled := r.FormValue("drawingsEnabled") == "on"
+		imagesEnabled := r.FormValue("imagesEnabled") == "on"
+		locale := normalizeLocale(r.FormValue("locale"))
 		customPageCSS := strings.TrimSpace(r.FormValue("customPageCSS"))
 
 		isCssValid, errorMsg := validateCSS(customPageCSS)
@@ -300,26 +599,64 @@ func AdminCreateGuestbook(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// if css is one of our built-in themes, then just store the theme name
-		themeName, err := CompareCSSWithThemes(customPageCSS)
+		customFields, err := parseCustomFieldsForm(r.FormValue("customFields"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		reactionEmojis, err := parseReactionEmojis(r.FormValue("reactionEmojis"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		stringOverrides, err := parseStringOverrides(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		themeID, err := parseThemeIDForm(r.FormValue("themeID"), adminUser.ID, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// if css is one of our built-in themes, then use that theme instead
+		builtInTheme, err := builtInThemeForCSS(customPageCSS)
 		if err != nil {
 			http.Error(w, "Error checking provided CSS with built-in themes", http.StatusInternalServerError)
 			return
 		}
 
-		if themeName != "" {
-			customPageCSS = "<<built__in>>" + themeName + "<</built__in>>"
+		if builtInTheme != nil {
+			themeID = &builtInTheme.ID
+			customPageCSS = ""
 		}
 
 		newGuestbook := Guestbook{
 			WebsiteURL:             websiteURL,
 			RequiresApproval:       requiresApproval,
 			PowEnabled:             powEnabled,
+			MarkdownEnabled:        markdownEnabled,
+			VisitorRepliesEnabled:  visitorRepliesEnabled,
+			PublicSearchEnabled:    publicSearchEnabled,
+			MaxReplyDepth:          maxReplyDepth,
+			EditWindowMinutes:      editWindowMinutes,
+			AvatarStyle:            avatarStyle,
+			DrawingsEnabled:        drawingsEnabled,
+			ImagesEnabled:          imagesEnabled,
 			ChallengeQuestion:      challengeQuestion,
 			ChallengeHint:          challengeHint,
 			ChallengeFailedMessage: challengeFailedMessage,
 			ChallengeAnswer:        challengeAnswer,
+			ThemeID:                themeID,
 			CustomPageCSS:          customPageCSS,
+			CustomFields:           customFields,
+			ReactionEmojis:         reactionEmojis,
+			Locale:                 locale,
+			StringOverrides:        stringOverrides,
 			AdminUserID:            adminUser.ID,
 		}
 		result := db.Create(&newGuestbook)
@@ -346,10 +683,7 @@ func AdminEmbedGuestbook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hostUrl := constants.PUBLIC_URL
-	if constants.DEBUG_MODE {
-		hostUrl = "//" + r.Host
-	}
+	hostUrl := publicHostURL(r)
 
 	data := struct {
 		Guestbook     Guestbook
@@ -380,14 +714,39 @@ func AdminDeleteGuestbook(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("admin=%d username=%q action=delete_guestbook guestbook_id=%d", currentUser.ID, currentUser.Username, guestbook.ID)
 
-	result = db.Delete(&guestbook, guestbookID)
-	if result.Error != nil {
+	files, err := attachedFiles(db.Where("guestbook_id = ?", guestbook.ID))
+	if err != nil {
+		http.Error(w, "Error deleting guestbook", http.StatusInternalServerError)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := clearVisitorEmails(tx.Where("guestbook_id = ?", guestbook.ID)); err != nil {
+			return err
+		}
+		if err := deleteReactions(tx, db.Where("guestbook_id = ?", guestbook.ID)); err != nil {
+			return err
+		}
+
+		// messages of deleted guestbooks are kept, so detach their uploads
+		// before the files are removed
+		result := tx.Model(&Message{}).Where("guestbook_id = ?", guestbook.ID).
+			Updates(map[string]any{"drawing_hash": "", "image_name": "", "image_size": 0})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		return tx.Delete(&guestbook, guestbookID).Error
+	})
+	if err != nil {
 		http.Error(w, "Error deleting guestbook", http.StatusInternalServerError)
 		return
 	}
 
 	// Invalidate cache for this guestbook since it was deleted
 	messageCache.InvalidateGuestbook(guestbook.ID)
+	publishRefresh(guestbook.ID)
+	removeUnreferencedFiles(files)
 
 	http.Redirect(w, r, "/admin", http.StatusSeeOther)
 }
@@ -407,23 +766,27 @@ func AdminEditGuestbook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Determine selected theme; client fetches CSS for built-ins
-	themeName := ""
-	if strings.HasPrefix(guestbook.CustomPageCSS, "<<built__in>>") {
-		themeName = strings.TrimPrefix(guestbook.CustomPageCSS, "<<built__in>>")
-		themeName = strings.TrimSuffix(themeName, "<</built__in>>")
+	themes, err := guestbookThemeOptions(currentUser.ID, guestbook.ThemeID)
+	if err != nil {
+		http.Error(w, "Error loading themes", http.StatusInternalServerError)
+		return
 	}
 
-	// Build view model embedding Guestbook fields and selected theme URL
-	data := struct {
-		Guestbook
-		SelectedTheme string
-	}{
-		guestbook,
-		"",
+	// The field editor works on the JSON definitions
+	customFieldsJSON, err := json.Marshal(guestbook.CustomFields)
+	if err != nil || guestbook.CustomFields == nil {
+		customFieldsJSON = []byte("[]")
+	}
+
+	data := guestbookFormData{
+		Guestbook:            guestbook,
+		Themes:               themes,
+		CustomFieldsJSON:     string(customFieldsJSON),
+		Locales:              availableLocales(),
+		StringOverrideFields: stringOverrideFields(&guestbook),
 	}
-	if themeName != "" {
-		data.SelectedTheme = "/assets/premade_styles/" + themeName
+	if guestbook.ThemeID != nil {
+		data.SelectedThemeID = *guestbook.ThemeID
 	}
 
 	renderAdminTemplate(w, r, "create_edit_guestbook", data)
@@ -438,6 +801,15 @@ func AdminUpdateGuestbook(w http.ResponseWriter, r *http.Request) {
 	challengeAnswer := r.FormValue("challengeAnswer")
 	requiresApproval := r.FormValue("requiresApproval") == "on"
 	powEnabled := r.FormValue("powEnabled") == "on"
+	markdownEnabled := r.FormValue("markdownEnabled") == "on"
+	visitorRepliesEnabled := r.FormValue("visitorRepliesEnabled") == "on"
+	publicSearchEnabled := r.FormValue("publicSearchEnabled") == "on"
+	maxReplyDepth := parseMaxReplyDepth(r.FormValue("maxReplyDepth"))
+	editWindowMinutes := parseEditWindowMinutes(r.FormValue("editWindowMinutes"))
+	avatarStyle := normalizeAvatarStyle(r.FormValue("avatarStyle"))
+	drawingsEnabled := r.FormValue("drawingsEnabled") == "on"
+	imagesEnabled := r.FormValue("imagesEnabled") == "on"
+	locale := normalizeLocale(r.FormValue("locale"))
 	customPageCSS := strings.TrimSpace(r.FormValue("customPageCSS"))
 
 	isCssValid, errorMsg := validateCSS(customPageCSS)
@@ -446,15 +818,22 @@ func AdminUpdateGuestbook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// if css is one of our built-in themes, then just store the theme name
-	themeName, err := CompareCSSWithThemes(customPageCSS)
+	customFields, err := parseCustomFieldsForm(r.FormValue("customFields"))
 	if err != nil {
-		http.Error(w, "Error checking provided CSS with built-in themes", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reactionEmojis, err := parseReactionEmojis(r.FormValue("reactionEmojis"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if themeName != "" {
-		customPageCSS = "<<built__in>>" + themeName + "<</built__in>>"
+	stringOverrides, err := parseStringOverrides(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	var guestbook Guestbook
@@ -470,14 +849,45 @@ func AdminUpdateGuestbook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	themeID, err := parseThemeIDForm(r.FormValue("themeID"), currentUser.ID, guestbook.ThemeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// if css is one of our built-in themes, then use that theme instead
+	builtInTheme, err := builtInThemeForCSS(customPageCSS)
+	if err != nil {
+		http.Error(w, "Error checking provided CSS with built-in themes", http.StatusInternalServerError)
+		return
+	}
+
+	if builtInTheme != nil {
+		themeID = &builtInTheme.ID
+		customPageCSS = ""
+	}
+
 	guestbook.WebsiteURL = websiteURL
 	guestbook.RequiresApproval = requiresApproval
 	guestbook.PowEnabled = powEnabled
+	guestbook.MarkdownEnabled = markdownEnabled
+	guestbook.VisitorRepliesEnabled = visitorRepliesEnabled
+	guestbook.PublicSearchEnabled = publicSearchEnabled
+	guestbook.MaxReplyDepth = maxReplyDepth
+	guestbook.EditWindowMinutes = editWindowMinutes
+	guestbook.AvatarStyle = avatarStyle
+	guestbook.DrawingsEnabled = drawingsEnabled
+	guestbook.ImagesEnabled = imagesEnabled
 	guestbook.ChallengeQuestion = challengeQuestion
 	guestbook.ChallengeHint = challengeHint
 	guestbook.ChallengeFailedMessage = challengeFailedMessage
 	guestbook.ChallengeAnswer = challengeAnswer
+	guestbook.ThemeID = themeID
 	guestbook.CustomPageCSS = customPageCSS
+	guestbook.CustomFields = customFields
+	guestbook.ReactionEmojis = reactionEmojis
+	guestbook.Locale = locale
+	guestbook.StringOverrides = stringOverrides
 
 	result = db.Save(&guestbook)
 	if result.Error != nil {
@@ -485,6 +895,10 @@ func AdminUpdateGuestbook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Invalidate cache for this guestbook since its settings affect how messages are rendered
+	messageCache.InvalidateGuestbook(guestbook.ID)
+	publishRefresh(guestbook.ID)
+
 	http.Redirect(w, r, "/admin/guestbook/"+guestbookID+"/edit", http.StatusSeeOther)
 }
 
@@ -545,6 +959,7 @@ func AdminEditMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		wasApproved := message.Approved
 		message.Name = name
 		message.Text = text
 		message.Website = websitePtr
@@ -558,6 +973,7 @@ func AdminEditMessage(w http.ResponseWriter, r *http.Request) {
 
 		// Invalidate cache for this guestbook since message was edited
 		messageCache.InvalidateGuestbook(guestbook.ID)
+		publishMessageChange(&guestbook, message, wasApproved, publicHostURL(r))
 
 		http.Redirect(w, r, "/admin/guestbook/"+guestbookID, http.StatusSeeOther)
 	}
@@ -595,14 +1011,72 @@ func AdminDeleteMessage(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("admin=%d username=%q action=delete_message guestbook_id=%d message_id=%d", currentUser.ID, currentUser.Username, guestbook.ID, message.ID)
 
-	result = db.Delete(&message, messageID)
-	if result.Error != nil {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := clearVisitorEmails(tx.Where("id = ?", message.ID)); err != nil {
+			return err
+		}
+		if err := deleteReactions(tx, db.Where("id = ?", message.ID)); err != nil {
+			return err
+		}
+		return tx.Delete(&message, messageID).Error
+	})
+	if err != nil {
 		http.Error(w, "Error deleting message", http.StatusInternalServerError)
 		return
 	}
 
 	// Invalidate cache for this guestbook since message was deleted
 	messageCache.InvalidateGuestbook(guestbook.ID)
+	publishDeletedMessages(guestbook.ID, []uint{message.ID})
+	removeUnreferencedFiles(uploadedFiles{Drawings: []string{message.DrawingHash}, Images: []string{message.ImageName}})
+
+	http.Redirect(w, r, "/admin/guestbook/"+guestbookID, http.StatusSeeOther)
+}
+
+func AdminTogglePinMessage(w http.ResponseWriter, r *http.Request) {
+	guestbookID := chi.URLParam(r, "guestbookID")
+	messageID := chi.URLParam(r, "messageID")
+
+	var guestbook Guestbook
+	result := db.First(&guestbook, guestbookID)
+	if result.Error != nil {
+		http.Error(w, "Guestbook not found", http.StatusNotFound)
+		return
+	}
+
+	currentUser := getSignedInAdminOrFail(r)
+	if guestbook.AdminUserID != currentUser.ID {
+		http.Error(w, "You don't own this guestbook", http.StatusUnauthorized)
+		return
+	}
+
+	var message Message
+	result = db.First(&message, messageID)
+	if result.Error != nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	// Ensure the message belongs to the same guestbook scoped in the URL
+	if message.GuestbookID != guestbook.ID {
+		http.Error(w, "Message does not belong to this guestbook", http.StatusBadRequest)
+		return
+	}
+
+	if message.ParentMessageID != nil {
+		http.Error(w, "Replies can't be pinned", http.StatusBadRequest)
+		return
+	}
+
+	result = db.Model(&message).Update("pinned", !message.Pinned)
+	if result.Error != nil {
+		http.Error(w, "Error updating message", http.StatusInternalServerError)
+		return
+	}
+
+	// Invalidate cache for this guestbook since the message order changed
+	messageCache.InvalidateGuestbook(guestbook.ID)
+	publishRefresh(guestbook.ID)
 
 	http.Redirect(w, r, "/admin/guestbook/"+guestbookID, http.StatusSeeOther)
 }
@@ -643,9 +1117,18 @@ func AdminReplyToMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Don't allow replies to replies (only one level deep)
-	if parentMessage.ParentMessageID != nil {
-		http.Error(w, "Cannot reply to a reply", http.StatusBadRequest)
+	// Replies are only one level deep unless visitor replies are enabled
+	parentDepth, err := messageDepth(parentMessage)
+	if err != nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if parentDepth+1 > guestbook.ReplyDepthLimit() {
+		if guestbook.ReplyDepthLimit() == 1 {
+			http.Error(w, "Cannot reply to a reply", http.StatusBadRequest)
+		} else {
+			http.Error(w, "Replies can't be nested this deep on this guestbook", http.StatusBadRequest)
+		}
 		return
 	}
 
@@ -672,6 +1155,9 @@ func AdminReplyToMessage(w http.ResponseWriter, r *http.Request) {
 
 	// Invalidate cache for this guestbook since a reply was added
 	messageCache.InvalidateGuestbook(guestbook.ID)
+	publishNewMessage(&guestbook, replyMessage, publicHostURL(r))
+
+	notifyVisitorOfReply(guestbook, parentMessage, replyMessage)
 
 	http.Redirect(w, r, "/admin/guestbook/"+guestbookID, http.StatusSeeOther)
 }
@@ -731,8 +1217,21 @@ func AdminBulkDeleteMessages(w http.ResponseWriter, r *http.Request) {
 	log.Printf("admin=%d username=%q action=bulk_delete_messages guestbook_id=%d message_count=%d message_ids=%v",
 		currentUser.ID, currentUser.Username, guestbook.ID, len(messageIDs), messageIDs)
 
+	files, err := attachedFiles(db.Where("id IN ? AND guestbook_id = ?", messageIDs, guestbook.ID))
+	if err != nil {
+		http.Error(w, "Error deleting messages", http.StatusInternalServerError)
+		return
+	}
+
 	// Delete messages in a transaction
 	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := clearVisitorEmails(tx.Where("id IN ? AND guestbook_id = ?", messageIDs, guestbook.ID)); err != nil {
+			return err
+		}
+		if err := deleteReactions(tx, db.Where("id IN ? AND guestbook_id = ?", messageIDs, guestbook.ID)); err != nil {
+			return err
+		}
+
 		result := tx.Where("id IN ? AND guestbook_id = ?", messageIDs, guestbook.ID).Delete(&Message{})
 		if result.Error != nil {
 			return result.Error
@@ -750,6 +1249,8 @@ func AdminBulkDeleteMessages(w http.ResponseWriter, r *http.Request) {
 
 	// Invalidate cache for this guestbook since messages were deleted
 	messageCache.InvalidateGuestbook(guestbook.ID)
+	publishDeletedMessages(guestbook.ID, messageIDs)
+	removeUnreferencedFiles(files)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Messages deleted successfully"))
@@ -802,6 +1303,7 @@ func AdminUserSettings(w http.ResponseWriter, r *http.Request) {
 		db.Where("admin_user_id = ?", currentUser.ID).Find(&userGuestbooks)
 		for _, g := range userGuestbooks {
 			messageCache.InvalidateGuestbook(g.ID)
+			publishRefresh(g.ID)
 		}
 
 		http.Redirect(w, r, "/admin/settings", http.StatusSeeOther)
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"guestbook/constants"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// publicMessageOrder puts pinned messages first and then the newest ones. The
+// ID makes the order stable so paging never repeats or skips a message.
+const publicMessageOrder = "pinned DESC, created_at DESC, id DESC"
+
+// PaginationInfo describes the page returned by the v2 messages API.
+type PaginationInfo struct {
+	Page        int   `json:"page"`
+	Limit       int   `json:"limit"`
+	Total       int64 `json:"total"`
+	TotalPages  int   `json:"totalPages"`
+	HasNext     bool  `json:"hasNext"`
+	HasPrevious bool  `json:"hasPrevious"`
+}
+
+// PaginatedMessages is the response body of the v2 messages API.
+type PaginatedMessages struct {
+	Messages   []Message      `json:"messages"`
+	Pagination PaginationInfo `json:"pagination"`
+}
+
+// writeGuestbookLoadError responds with 404 if the guestbook doesn't exist and
+// with 500 for any other database error.
+func writeGuestbookLoadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Guestbook not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+func parseGuestbookIDParam(r *http.Request) (uint, bool) {
+	guestbookIDUint, err := strconv.ParseUint(chi.URLParam(r, "guestbookID"), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint(guestbookIDUint), true
+}
+
+// loadGuestbookForMessages loads the guestbook settings that affect how its
+// messages are returned by the API.
+func loadGuestbookForMessages(guestbookID uint) (Guestbook, error) {
+	var guestbook Guestbook
+	result := db.First(&guestbook, guestbookID)
+	return guestbook, result.Error
+}
+
+// decorateMessages fills in the computed, non-persisted fields of messages
+// and their replies according to the guestbook settings. Links to avatars and
+// uploads start with hostURL.
+func decorateMessages(guestbook *Guestbook, messages []Message, hostURL string) error {
+	allMessages := flattenMessages(messages)
+
+	messageIDs := make([]uint, len(allMessages))
+	for i, message := range allMessages {
+		messageIDs[i] = message.ID
+	}
+	reactionCounts, err := loadReactionCounts(messageIDs, guestbook.ReactionEmojis)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range allMessages {
+		if guestbook.MarkdownEnabled {
+			message.TextHTML = renderLimitedMarkdown(message.Text)
+		}
+		message.CustomFieldAnswers = customFieldAnswers(guestbook.CustomFields, message.CustomFieldValues)
+		message.Reactions = reactionCounts[message.ID]
+		if guestbook.AvatarStyle != "" {
+			message.AvatarURL = avatarURL(hostURL, guestbook.AvatarStyle, *message)
+		}
+		if message.DrawingHash != "" {
+			message.DrawingURL = drawingURL(hostURL, message.DrawingHash)
+		}
+		if message.ImageName != "" {
+			message.ImageURL = imageURL(hostURL, message.ImageName)
+			message.ImageThumbnailURL = imageThumbnailURL(hostURL, message.ImageName)
+		}
+	}
+	markRepliable(messages, 0, guestbook.ReplyDepthLimit())
+	return nil
+}
+
+// flattenMessages returns pointers to the given messages and all of their
+// loaded replies.
+func flattenMessages(messages []Message) []*Message {
+	var result []*Message
+	for i := range messages {
+		result = append(result, &messages[i])
+		result = append(result, flattenMessages(messages[i].Replies)...)
+	}
+	return result
+}
+
+// loadPaginatedMessages returns a page of approved top-level messages (with
+// their tree of approved replies) for a guestbook. A search only keeps the
+// messages matching it, on guestbooks that allow it. The second return value
+// reports whether the response came from the cache.
+func loadPaginatedMessages(guestbookID uint, page, limit int, search, hostURL string) (PaginatedMessages, bool, error) {
+	// Try to get from cache first
+	if cachedResponse, ok := messageCache.GetPaginatedResponse(guestbookID, page, limit, search); ok {
+		return cachedResponse, true, nil
+	}
+
+	guestbook, err := loadGuestbookForMessages(guestbookID)
+	if err != nil {
+		return PaginatedMessages{}, false, err
+	}
+	if search != "" && !guestbook.PublicSearchEnabled {
+		return PaginatedMessages{}, false, errSearchDisabled
+	}
+
+	offset := (page - 1) * limit
+
+	var totalCount int64
+	if search == "" {
+		totalCount, err = loadTopLevelMessageCount(guestbookID)
+	} else {
+		err = searchMessages(db.Model(&Message{}), search).
+			Where(&Message{GuestbookID: guestbookID, Approved: true}).
+			Where("parent_message_id IS NULL").
+			Count(&totalCount).Error
+	}
+	if err != nil {
+		return PaginatedMessages{}, false, err
+	}
+
+	var messages []Message
+	query := searchMessages(db.Model(&Message{}), search).
+		Where(&Message{GuestbookID: guestbookID, Approved: true}).
+		Where("parent_message_id IS NULL").
+		Order(publicMessageOrder)
+	result := preloadReplies(query, "Replies", guestbook.ReplyDepthLimit(), approvedReplies).
+		Limit(limit).
+		Offset(offset).
+		Find(&messages)
+	if result.Error != nil {
+		return PaginatedMessages{}, false, result.Error
+	}
+	if err := decorateMessages(&guestbook, messages, hostURL); err != nil {
+		return PaginatedMessages{}, false, err
+	}
+
+	totalPages := int((totalCount + int64(limit) - 1) / int64(limit))
+
+	response := PaginatedMessages{
+		Messages: messages,
+		Pagination: PaginationInfo{
+			Page:        page,
+			Limit:       limit,
+			Total:       totalCount,
+			TotalPages:  totalPages,
+			HasNext:     page < totalPages,
+			HasPrevious: page > 1,
+		},
+	}
+
+	// Store in cache
+	messageCache.SetPaginatedResponse(guestbookID, page, limit, search, response)
+
+	return response, false, nil
+}
+
+// notModified answers the request with 304 when the client already has the
+// response with this ETag. The ETag comes from MessageCache.ETag, so this
+// needs neither the cached messages nor the database.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag {
+			setMessagesCacheHeaders(w, etag)
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// setMessagesCacheHeaders lets browsers keep the messages but check with us
+// before using them, which is cheap thanks to notModified.
+func setMessagesCacheHeaders(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, no-cache")
+}
+
+// GetGuestbookMessagesV1 returns all approved messages at the top level of the
+// response, without pagination (kept for backward compatibility).
+func GetGuestbookMessagesV1(w http.ResponseWriter, r *http.Request) {
+	guestbookID, ok := parseGuestbookIDParam(r)
+	if !ok {
+		http.Error(w, "Invalid guestbook ID", http.StatusBadRequest)
+		return
+	}
+
+	etag := messageCache.ETag(guestbookID, "all")
+	if notModified(w, r, etag) {
+		return
+	}
+
+	// Try to get from cache first
+	if cachedMessages, ok := messageCache.GetMessages(guestbookID); ok {
+		setMessagesCacheHeaders(w, etag)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Cache", "HIT")
+		json.NewEncoder(w).Encode(cachedMessages)
+		return
+	}
+
+	guestbook, err := loadGuestbookForMessages(guestbookID)
+	if err != nil {
+		writeGuestbookLoadError(w, err)
+		return
+	}
+
+	var messages []Message
+	query := db.Where(&Message{GuestbookID: guestbookID, Approved: true}).
+		Where("parent_message_id IS NULL").
+		Order(publicMessageOrder)
+	result := preloadReplies(query, "Replies", guestbook.ReplyDepthLimit(), approvedReplies).
+		Find(&messages)
+	if result.Error != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := decorateMessages(&guestbook, messages, publicHostURL(r)); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Store in cache
+	messageCache.SetMessages(guestbookID, messages)
+
+	setMessagesCacheHeaders(w, etag)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Cache", "MISS")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// GetGuestbookMessagesV2 returns a page of approved messages together with
+// pagination metadata. On guestbooks that allow it, q only returns the
+// messages that contain its words, like in v3.
+func GetGuestbookMessagesV2(w http.ResponseWriter, r *http.Request) {
+	guestbookID, ok := parseGuestbookIDParam(r)
+	if !ok {
+		http.Error(w, "Invalid guestbook ID", http.StatusBadRequest)
+		return
+	}
+
+	pageStr := r.URL.Query().Get("page")
+	limitStr := r.URL.Query().Get("limit")
+
+	page := 1
+	limit := constants.DEFAULT_PAGE_SIZE
+
+	if pageStr != "" {
+		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
+			page = p
+		}
+	}
+
+	if limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= constants.MAX_PAGE_SIZE {
+			limit = l
+		}
+	}
+
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len(search) > constants.MAX_SEARCH_LENGTH {
+		http.Error(w, fmt.Sprintf("Search is too long, maximum length is %d characters", constants.MAX_SEARCH_LENGTH), http.StatusBadRequest)
+		return
+	}
+
+	etag := messageCache.ETag(guestbookID, fmt.Sprintf("p%d-l%d-q%s", page, limit, url.QueryEscape(search)))
+	if notModified(w, r, etag) {
+		return
+	}
+
+	response, cached, err := loadPaginatedMessages(guestbookID, page, limit, search, publicHostURL(r))
+	if errors.Is(err, errSearchDisabled) {
+		http.Error(w, "Search is not enabled for this guestbook", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeGuestbookLoadError(w, err)
+		return
+	}
+
+	setMessagesCacheHeaders(w, etag)
+	w.Header().Set("Content-Type", "application/json")
+	if cached {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
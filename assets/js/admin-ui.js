@@ -1,4 +1,23 @@
 // Admin UI Enhancements
+
+// Text in the admin's locale, layout.html sets the admin.ui. strings
+var adminStrings = window.guestbooksAdminStrings || {};
+
+function t(key, args) {
+    var text = adminStrings['admin.ui.' + key] || key;
+    if (args) {
+        Object.keys(args).forEach(function(name) {
+            text = text.split('{' + name + '}').join(args[name]);
+        });
+    }
+    return text;
+}
+
+// tCount picks the _one or _other form of key for count
+function tCount(key, count) {
+    return t(key + (count === 1 ? '_one' : '_other'), { count: count });
+}
+
 document.addEventListener('DOMContentLoaded', function() {
     
     // Bulk message deletion functionality
@@ -9,41 +28,83 @@ document.addEventListener('DOMContentLoaded', function() {
         const bulkActions = document.getElementById('bulk-actions');
         const selectedCountSpan = document.getElementById('selected-count');
         const bulkDeleteBtn = document.getElementById('bulk-delete-btn');
+        const selectAllMatchingBtn = document.getElementById('select-all-matching');
+        const clearSelectionBtn = document.getElementById('clear-selection-btn');
+        const guestbookId = window.location.pathname.split('/')[3];
         
-        // Track selected message IDs
+        // Track selected message IDs, kept for the session so the selection
+        // survives moving between pages
+        const storageKey = `guestbooks-selected-messages-${guestbookId}`;
         let selectedMessageIds = new Set();
+        try {
+            selectedMessageIds = new Set(JSON.parse(sessionStorage.getItem(storageKey)) || []);
+        } catch (e) {
+            selectedMessageIds = new Set();
+        }
+        
+        function saveSelection() {
+            try {
+                if (selectedMessageIds.size > 0) {
+                    sessionStorage.setItem(storageKey, JSON.stringify(Array.from(selectedMessageIds)));
+                } else {
+                    sessionStorage.removeItem(storageKey);
+                }
+            } catch (e) {
+                // the selection just won't outlive the page
+            }
+        }
+        
+        function setChecked(checkbox, isChecked) {
+            const messageId = checkbox.getAttribute('data-message-id');
+            const messageCard = checkbox.closest('.message-card');
+            
+            checkbox.checked = isChecked;
+            if (isChecked) {
+                selectedMessageIds.add(messageId);
+                messageCard.style.background = 'var(--primary-light)';
+            } else {
+                selectedMessageIds.delete(messageId);
+                messageCard.style.background = 'var(--gray-50)';
+            }
+        }
         
         // Update UI based on selection
         function updateBulkActionsUI() {
             const count = selectedMessageIds.size;
             if (count > 0) {
+                const onPage = Array.from(messageCheckboxes).filter(checkbox => checkbox.checked).length;
+                let text = tCount('selected', count);
+                if (count > onPage) {
+                    text += ' ' + t('selected_elsewhere', { count: count - onPage });
+                }
                 bulkActions.style.display = 'block';
-                selectedCountSpan.textContent = `${count} message${count !== 1 ? 's' : ''} selected`;
+                selectedCountSpan.textContent = text;
             } else {
                 bulkActions.style.display = 'none';
             }
             
-            // Update select all checkbox state
+            // Update select all checkbox state for this page
             if (selectAllCheckbox) {
-                selectAllCheckbox.checked = count === messageCheckboxes.length && count > 0;
-                selectAllCheckbox.indeterminate = count > 0 && count < messageCheckboxes.length;
+                const checkedCount = Array.from(messageCheckboxes).filter(checkbox => checkbox.checked).length;
+                selectAllCheckbox.checked = checkedCount === messageCheckboxes.length && checkedCount > 0;
+                selectAllCheckbox.indeterminate = checkedCount > 0 && checkedCount < messageCheckboxes.length;
             }
+            
+            saveSelection();
         }
         
+        // Restore the selection made on other pages
+        messageCheckboxes.forEach(checkbox => {
+            if (selectedMessageIds.has(checkbox.getAttribute('data-message-id'))) {
+                setChecked(checkbox, true);
+            }
+        });
+        updateBulkActionsUI();
+        
         // Handle individual checkbox change
         messageCheckboxes.forEach(checkbox => {
             checkbox.addEventListener('change', function() {
-                const messageId = this.getAttribute('data-message-id');
-                const messageCard = this.closest('.message-card');
-                
-                if (this.checked) {
-                    selectedMessageIds.add(messageId);
-                    messageCard.style.background = 'var(--primary-light)';
-                } else {
-                    selectedMessageIds.delete(messageId);
-                    messageCard.style.background = 'var(--gray-50)';
-                }
-                
+                setChecked(this, this.checked);
                 updateBulkActionsUI();
             });
         });
@@ -52,25 +113,58 @@ document.addEventListener('DOMContentLoaded', function() {
         if (selectAllCheckbox) {
             selectAllCheckbox.addEventListener('change', function() {
                 const isChecked = this.checked;
-                
-                messageCheckboxes.forEach(checkbox => {
-                    checkbox.checked = isChecked;
-                    const messageId = checkbox.getAttribute('data-message-id');
-                    const messageCard = checkbox.closest('.message-card');
-                    
-                    if (isChecked) {
-                        selectedMessageIds.add(messageId);
-                        messageCard.style.background = 'var(--primary-light)';
-                    } else {
-                        selectedMessageIds.delete(messageId);
-                        messageCard.style.background = 'var(--gray-50)';
-                    }
-                });
-                
+                messageCheckboxes.forEach(checkbox => setChecked(checkbox, isChecked));
                 updateBulkActionsUI();
             });
         }
         
+        // Select every message matching the filter, on all pages
+        if (selectAllMatchingBtn) {
+            selectAllMatchingBtn.addEventListener('click', function() {
+                selectAllMatchingBtn.disabled = true;
+                fetch(`/admin/guestbook/${guestbookId}/messages/ids${window.location.search}`)
+                    .then(response => {
+                        if (!response.ok) {
+                            throw new Error('Failed to load messages');
+                        }
+                        return response.json();
+                    })
+                    .then(data => {
+                        data.message_ids.forEach(id => selectedMessageIds.add(id));
+                        messageCheckboxes.forEach(checkbox => setChecked(checkbox, true));
+                        updateBulkActionsUI();
+                    })
+                    .catch(error => {
+                        console.error('Error:', error);
+                        if (window.showToast) {
+                            window.showToast(t('select_failed'), 'error');
+                        }
+                    })
+                    .finally(() => {
+                        selectAllMatchingBtn.disabled = false;
+                    });
+            });
+        }
+        
+        if (clearSelectionBtn) {
+            clearSelectionBtn.addEventListener('click', function() {
+                selectedMessageIds.clear();
+                messageCheckboxes.forEach(checkbox => setChecked(checkbox, false));
+                updateBulkActionsUI();
+            });
+        }
+        
+        // Messages deleted one at a time can't stay selected
+        messagesContainer.querySelectorAll('form[action$="/delete"]').forEach(form => {
+            form.addEventListener('submit', function() {
+                const match = form.getAttribute('action').match(/\/message\/(\d+)\/delete$/);
+                if (match) {
+                    selectedMessageIds.delete(match[1]);
+                    saveSelection();
+                }
+            });
+        });
+        
         // Handle bulk delete button
         if (bulkDeleteBtn) {
             bulkDeleteBtn.addEventListener('click', function() {
@@ -105,11 +199,11 @@ document.addEventListener('DOMContentLoaded', function() {
                 `;
                 
                 dialog.innerHTML = `
-                    <h3 style="margin-top: 0; color: var(--error-color);">⚠️ Confirm Bulk Deletion</h3>
-                    <p style="color: var(--gray-700);">Are you sure you want to delete <strong>${count} message${count !== 1 ? 's' : ''}</strong>? This action cannot be undone.</p>
+                    <h3 style="margin-top: 0; color: var(--error-color);">${t('bulk_confirm_title')}</h3>
+                    <p style="color: var(--gray-700);">${t('bulk_confirm_before')} <strong>${tCount('bulk_confirm_count', count)}</strong>${t('bulk_confirm_after')}</p>
                     <div style="display: flex; gap: 1rem; justify-content: flex-end; margin-top: 1.5rem;">
-                        <button class="btn btn-outline" id="cancel-bulk-delete">Cancel</button>
-                        <button class="btn btn-danger" id="confirm-bulk-delete">Delete ${count} Message${count !== 1 ? 's' : ''}</button>
+                        <button class="btn btn-outline" id="cancel-bulk-delete">${t('cancel')}</button>
+                        <button class="btn btn-danger" id="confirm-bulk-delete">${tCount('bulk_delete', count)}</button>
                     </div>
                 `;
                 
@@ -124,12 +218,11 @@ document.addEventListener('DOMContentLoaded', function() {
                     modal.remove();
                     
                     // Perform bulk delete
-                    const guestbookId = window.location.pathname.split('/')[3];
                     const messageIds = Array.from(selectedMessageIds);
                     
                     // Show loading state
                     bulkDeleteBtn.disabled = true;
-                    bulkDeleteBtn.innerHTML = '<span class="spinner"></span> Deleting...';
+                    bulkDeleteBtn.innerHTML = '<span class="spinner"></span> ' + t('deleting');
                     
                     fetch(`/admin/guestbook/${guestbookId}/messages/bulk-delete`, {
                         method: 'POST',
@@ -155,7 +248,7 @@ document.addEventListener('DOMContentLoaded', function() {
                             
                             // Show success message
                             if (window.showToast) {
-                                window.showToast(`Successfully deleted ${count} message${count !== 1 ? 's' : ''}`, 'success');
+                                window.showToast(tCount('deleted', count), 'success');
                             }
                             
                             // Reload page after animation
@@ -169,10 +262,10 @@ document.addEventListener('DOMContentLoaded', function() {
                     .catch(error => {
                         console.error('Error:', error);
                         if (window.showToast) {
-                            window.showToast('Failed to delete messages. Please try again.', 'error');
+                            window.showToast(t('delete_failed'), 'error');
                         }
                         bulkDeleteBtn.disabled = false;
-                        bulkDeleteBtn.innerHTML = 'Delete Selected';
+                        bulkDeleteBtn.innerHTML = t('delete_selected');
                     });
                 };
                 
@@ -209,9 +302,9 @@ document.addEventListener('DOMContentLoaded', function() {
                 
                 // Add loading spinner
                 if (isInput) {
-                    submitBtn.value = 'Loading...';
+                    submitBtn.value = t('loading');
                 } else {
-                    submitBtn.innerHTML = '<span class="spinner"></span> Processing...';
+                    submitBtn.innerHTML = '<span class="spinner"></span> ' + t('processing');
                 }
                 submitBtn.disabled = true;
                 
@@ -239,7 +332,7 @@ document.addEventListener('DOMContentLoaded', function() {
                 const text = targetElement.textContent || targetElement.value;
                 navigator.clipboard.writeText(text).then(() => {
                     const originalText = btn.textContent;
-                    btn.textContent = '✓ Copied!';
+                    btn.textContent = t('copied');
                     btn.classList.add('btn-success');
                     
                     setTimeout(() => {
@@ -286,11 +379,11 @@ document.addEventListener('DOMContentLoaded', function() {
             `;
             
             dialog.innerHTML = `
-                <h3 style="margin-top: 0; color: var(--error-color);">⚠️ Confirm Deletion</h3>
-                <p style="color: var(--gray-700);">Are you sure you want to delete this? This action cannot be undone.</p>
+                <h3 style="margin-top: 0; color: var(--error-color);">${t('confirm_title')}</h3>
+                <p style="color: var(--gray-700);">${t('confirm_text')}</p>
                 <div style="display: flex; gap: 1rem; justify-content: flex-end; margin-top: 1.5rem;">
-                    <button class="btn btn-outline" id="cancel-btn">Cancel</button>
-                    <button class="btn btn-danger" id="confirm-btn">Delete</button>
+                    <button class="btn btn-outline" id="cancel-btn">${t('cancel')}</button>
+                    <button class="btn btn-danger" id="confirm-btn">${t('delete')}</button>
                 </div>
             `;
             
@@ -329,11 +422,11 @@ document.addEventListener('DOMContentLoaded', function() {
         textarea.parentNode.appendChild(indicator);
         
         textarea.addEventListener('input', function() {
-            indicator.textContent = 'Typing...';
+            indicator.textContent = t('typing');
             clearTimeout(saveTimeout);
             
             saveTimeout = setTimeout(() => {
-                indicator.innerHTML = '<span style="color: var(--success-color);">✓ Ready to save</span>';
+                indicator.innerHTML = '<span style="color: var(--success-color);">' + t('ready_to_save') + '</span>';
             }, 1000);
         });
     });
@@ -382,13 +475,13 @@ document.addEventListener('DOMContentLoaded', function() {
             if (/\d/.test(password)) strength++;
             if (/[^a-zA-Z\d]/.test(password)) strength++;
             
-            const strengthLevels = ['Very Weak', 'Weak', 'Fair', 'Good', 'Strong'];
+            const strengthLevels = ['very_weak', 'weak', 'fair', 'good', 'strong'];
             const strengthColors = ['var(--error-color)', 'var(--warning-color)', '#F59E0B', '#10B981', 'var(--success-color)'];
             
             if (password.length > 0) {
                 strengthIndicator.innerHTML = `
-                    <span style="color: ${strengthColors[strength]}">
-                        Password strength: ${strengthLevels[strength]}
+                    <span style="color: ${strengthColors[Math.min(strength, 4)]}">
+                        ${t('password_strength', { strength: t('strength_' + strengthLevels[Math.min(strength, 4)]) })}
                     </span>
                 `;
             } else {
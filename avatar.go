@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Supported avatar styles, an empty style disables avatars.
+const (
+	AvatarStyleIdenticon = "identicon"
+	AvatarStyleRings     = "rings"
+)
+
+var avatarStyles = []string{AvatarStyleIdenticon, AvatarStyleRings}
+
+var avatarHashPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// normalizeAvatarStyle returns the style if it is supported, or "" to
+// disable avatars.
+func normalizeAvatarStyle(style string) string {
+	if slices.Contains(avatarStyles, style) {
+		return style
+	}
+	return ""
+}
+
+// avatarHash identifies an author by their name and website. It is keyed with
+// the app secret so the avatar URL can't be used to recover or confirm either.
+func avatarHash(name string, website *string) string {
+	mac := hmac.New(sha256.New, deriveKey("avatar"))
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(name))))
+	mac.Write([]byte{0})
+	if website != nil {
+		mac.Write([]byte(strings.ToLower(strings.TrimSpace(*website))))
+	}
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func avatarURL(hostURL, style string, message Message) string {
+	return fmt.Sprintf("%s/resources/avatar/%s/%s.svg", hostURL, style, avatarHash(message.Name, message.Website))
+}
+
+// renderAvatarSVG draws the avatar for a hash. The output only depends on the
+// style and the hash.
+func renderAvatarSVG(style string, hash []byte) string {
+	hue := int(hash[0]) * 360 / 256
+	foreground := fmt.Sprintf("hsl(%d, 55%%, 50%%)", hue)
+	background := fmt.Sprintf("hsl(%d, 40%%, 92%%)", hue)
+
+	var svg strings.Builder
+	svg.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 50 50" width="50" height="50">`)
+	fmt.Fprintf(&svg, `<rect width="50" height="50" fill="%s"/>`, background)
+
+	switch style {
+	case AvatarStyleRings:
+		for i := 0; i < 4; i++ {
+			ringHue := (hue + int(hash[i+1])%120) % 360
+			radius := 22 - i*5
+			width := 1 + int(hash[i+5])%4
+			fmt.Fprintf(&svg, `<circle cx="25" cy="25" r="%d" fill="none" stroke="hsl(%d, 55%%, 50%%)" stroke-width="%d"/>`, radius, ringHue, width)
+		}
+	default:
+		// 5x5 grid mirrored around the middle column
+		for row := 0; row < 5; row++ {
+			for col := 0; col < 3; col++ {
+				if hash[1+row*3+col]%2 == 0 {
+					continue
+				}
+				fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`, col*10, row*10, foreground)
+				if col < 2 {
+					fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`, (4-col)*10, row*10, foreground)
+				}
+			}
+		}
+	}
+
+	svg.WriteString(`</svg>`)
+	return svg.String()
+}
+
+// AvatarHandler serves the avatar for an author hash. Avatars never change,
+// so they can be cached forever.
+func AvatarHandler(w http.ResponseWriter, r *http.Request) {
+	style := normalizeAvatarStyle(chi.URLParam(r, "style"))
+	hash := chi.URLParam(r, "hash")
+	if style == "" || !avatarHashPattern.MatchString(hash) {
+		http.Error(w, "Avatar not found", http.StatusNotFound)
+		return
+	}
+
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		http.Error(w, "Avatar not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write([]byte(renderAvatarSVG(style, hashBytes)))
+}
@@ -22,7 +22,13 @@ type CachedCount struct {
 
 // CachedPaginatedResponse stores the full paginated API response
 type CachedPaginatedResponse struct {
-	Response  map[string]any
+	Response  PaginatedMessages
+	Timestamp time.Time
+}
+
+// CachedCursorPage stores a cached page of the v3 API
+type CachedCursorPage struct {
+	Page      CursorPage
 	Timestamp time.Time
 }
 
@@ -31,8 +37,16 @@ type MessageCache struct {
 	messagesCache  *lru.Cache[string, CachedMessages]
 	countsCache    *lru.Cache[uint, CachedCount]
 	paginatedCache *lru.Cache[string, CachedPaginatedResponse]
+	cursorCache    *lru.Cache[string, CachedCursorPage]
 	ttl            time.Duration
 	mu             sync.RWMutex
+
+	// versions counts the invalidations of each guestbook. Unlike the
+	// cached data they are never evicted, so ETags built from them stay
+	// valid for as long as the messages don't change. epoch tells apart
+	// versions counted by different runs of the server.
+	versions map[uint]uint64
+	epoch    int64
 }
 
 // NewMessageCache creates a new message cache with specified size and TTL
@@ -52,11 +66,19 @@ func NewMessageCache(size int, ttl time.Duration) (*MessageCache, error) {
 		return nil, err
 	}
 
+	cursorCache, err := lru.New[string, CachedCursorPage](size)
+	if err != nil {
+		return nil, err
+	}
+
 	return &MessageCache{
 		messagesCache:  messagesCache,
 		countsCache:    countsCache,
 		paginatedCache: paginatedCache,
+		cursorCache:    cursorCache,
 		ttl:            ttl,
+		versions:       map[uint]uint64{},
+		epoch:          time.Now().UnixNano(),
 	}, nil
 }
 
@@ -97,14 +119,14 @@ func (c *MessageCache) SetMessages(guestbookID uint, messages []Message) {
 }
 
 // GetPaginatedResponse retrieves cached paginated response (v2 API)
-func (c *MessageCache) GetPaginatedResponse(guestbookID uint, page, limit int) (map[string]any, bool) {
+func (c *MessageCache) GetPaginatedResponse(guestbookID uint, page, limit int, search string) (PaginatedMessages, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	key := fmt.Sprintf("paginated_messages_%d_p%d_l%d", guestbookID, page, limit)
+	key := fmt.Sprintf("paginated_messages_%d_p%d_l%d_q%s", guestbookID, page, limit, search)
 	cached, ok := c.paginatedCache.Get(key)
 	if !ok {
-		return nil, false
+		return PaginatedMessages{}, false
 	}
 
 	// Check if cache entry has expired
@@ -114,24 +136,60 @@ func (c *MessageCache) GetPaginatedResponse(guestbookID uint, page, limit int) (
 		c.paginatedCache.Remove(key)
 		c.mu.Unlock()
 		c.mu.RLock()
-		return nil, false
+		return PaginatedMessages{}, false
 	}
 
 	return cached.Response, true
 }
 
 // SetPaginatedResponse stores paginated response in cache (v2 API)
-func (c *MessageCache) SetPaginatedResponse(guestbookID uint, page, limit int, response map[string]any) {
+func (c *MessageCache) SetPaginatedResponse(guestbookID uint, page, limit int, search string, response PaginatedMessages) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	key := fmt.Sprintf("paginated_messages_%d_p%d_l%d", guestbookID, page, limit)
+	key := fmt.Sprintf("paginated_messages_%d_p%d_l%d_q%s", guestbookID, page, limit, search)
 	c.paginatedCache.Add(key, CachedPaginatedResponse{
 		Response:  response,
 		Timestamp: time.Now(),
 	})
 }
 
+// GetCursorPage retrieves a cached page of the v3 API
+func (c *MessageCache) GetCursorPage(guestbookID uint, cursor, order, search string, limit int) (CursorPage, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	key := fmt.Sprintf("cursor_messages_%d_%s_l%d_c%s_q%s", guestbookID, order, limit, cursor, search)
+	cached, ok := c.cursorCache.Get(key)
+	if !ok {
+		return CursorPage{}, false
+	}
+
+	// Check if cache entry has expired
+	if time.Since(cached.Timestamp) > c.ttl {
+		c.mu.RUnlock()
+		c.mu.Lock()
+		c.cursorCache.Remove(key)
+		c.mu.Unlock()
+		c.mu.RLock()
+		return CursorPage{}, false
+	}
+
+	return cached.Page, true
+}
+
+// SetCursorPage stores a page of the v3 API in cache
+func (c *MessageCache) SetCursorPage(guestbookID uint, cursor, order, search string, limit int, page CursorPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := fmt.Sprintf("cursor_messages_%d_%s_l%d_c%s_q%s", guestbookID, order, limit, cursor, search)
+	c.cursorCache.Add(key, CachedCursorPage{
+		Page:      page,
+		Timestamp: time.Now(),
+	})
+}
+
 // GetCount retrieves cached message count for a guestbook
 func (c *MessageCache) GetCount(guestbookID uint) (int64, bool) {
 	c.mu.RLock()
@@ -166,11 +224,23 @@ func (c *MessageCache) SetCount(guestbookID uint, count int64) {
 	})
 }
 
+// ETag returns a strong ETag for a response of the message APIs. variant
+// tells apart the responses for the same guestbook, like different pages.
+// The ETag changes whenever the guestbook is invalidated.
+func (c *MessageCache) ETag(guestbookID uint, variant string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return fmt.Sprintf(`"%d-%x-%d-%s"`, guestbookID, c.epoch, c.versions[guestbookID], variant)
+}
+
 // InvalidateGuestbook clears all cached data for a specific guestbook
 func (c *MessageCache) InvalidateGuestbook(guestbookID uint) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.versions[guestbookID]++
+
 	// Remove all messages cache
 	allMessagesKey := fmt.Sprintf("all_messages_%d", guestbookID)
 	c.messagesCache.Remove(allMessagesKey)
@@ -187,6 +257,12 @@ func (c *MessageCache) InvalidateGuestbook(guestbookID uint) {
 			c.paginatedCache.Remove(key)
 		}
 	}
+	cursorPrefix := fmt.Sprintf("cursor_messages_%d_", guestbookID)
+	for _, key := range c.cursorCache.Keys() {
+		if len(key) >= len(cursorPrefix) && key[:len(cursorPrefix)] == cursorPrefix {
+			c.cursorCache.Remove(key)
+		}
+	}
 }
 
 // Clear removes all entries from the cache
@@ -197,4 +273,6 @@ func (c *MessageCache) Clear() {
 	c.messagesCache.Purge()
 	c.countsCache.Purge()
 	c.paginatedCache.Purge()
+	c.cursorCache.Purge()
+	c.epoch = time.Now().UnixNano()
 }
@@ -7,9 +7,76 @@ const (
 	MAX_MESSAGE_LENGTH   = 2500
 	BUILT_IN_THEMES_DIR  = "assets/premade_styles"
 	MAX_CSS_LENGTH       = 10_000
+	DEFAULT_PAGE_SIZE    = 20
+	MAX_PAGE_SIZE        = 100
 
 	// Proof of Work: number of leading zero bits required in SHA-256(challenge + nonce).
 	POW_DIFFICULTY = 19
 	// How long a PoW challenge remains valid.
 	POW_CHALLENGE_TTL_MINUTES = 10
+
+	// File where the generated app secret is stored when none is configured.
+	APP_SECRET_FILE = "app_secret.key"
+	// Maximum length of the optional visitor email used for reply notifications.
+	MAX_VISITOR_EMAIL_LENGTH = 254
+
+	// Limits for the custom form fields owners can add to their guestbooks.
+	MAX_CUSTOM_FIELDS             = 10
+	MAX_CUSTOM_FIELD_LABEL_LENGTH = 100
+	MAX_CUSTOM_FIELD_OPTIONS      = 20
+	MAX_CUSTOM_FIELD_VALUE_LENGTH = 200
+
+	// Limits for the reaction emoji owners can enable on their guestbooks.
+	MAX_REACTION_EMOJIS      = 8
+	MAX_REACTION_EMOJI_BYTES = 32
+
+	// Deepest reply nesting a guestbook can allow when visitor replies are on.
+	MAX_REPLY_DEPTH = 5
+
+	// Longest window a guestbook can give visitors to edit their own messages.
+	MAX_EDIT_WINDOW_MINUTES = 24 * 60
+
+	// Uploaded files are stored on disk next to the database.
+	UPLOADS_DIR = "uploads"
+
+	// Limits for visitor drawings.
+	MAX_DRAWING_BYTES  = 512 * 1024
+	MAX_DRAWING_WIDTH  = 600
+	MAX_DRAWING_HEIGHT = 400
+
+	// Limits for image attachments on messages.
+	MAX_IMAGE_BYTES      = 4 * 1024 * 1024
+	MAX_IMAGE_DIMENSION  = 4096
+	IMAGE_THUMBNAIL_SIZE = 200
+
+	// Largest font or image a user can upload for their themes.
+	MAX_THEME_ASSET_BYTES = 1024 * 1024
+
+	// Longest name of a theme published to the gallery.
+	MAX_THEME_NAME_LENGTH = 60
+
+	// Uploads on all guestbooks of a user count against this quota.
+	USER_STORAGE_QUOTA_BYTES = 100 * 1024 * 1024
+
+	// Message catalogs, one <language tag>.json file per locale.
+	LOCALES_DIR    = "locales"
+	DEFAULT_LOCALE = "en"
+	// Longest text an owner can replace a catalog string with.
+	MAX_STRING_OVERRIDE_LENGTH = 300
+
+	// Live updates: events a subscriber can fall behind by before it is
+	// dropped, how often idle streams get a keepalive and how many streams a
+	// single client address can keep open at once.
+	LIVE_EVENTS_BUFFER_SIZE            = 32
+	LIVE_EVENTS_KEEPALIVE_SECONDS      = 25
+	LIVE_EVENTS_MAX_STREAMS_PER_CLIENT = 10
+
+	// Longest search accepted by the message search.
+	MAX_SEARCH_LENGTH = 100
+
+	// Messages per page of the admin guestbook view.
+	ADMIN_MESSAGES_PAGE_SIZE = 50
+
+	// Largest request body accepted when submitting a message.
+	MAX_SUBMIT_BODY_BYTES = MAX_IMAGE_BYTES + MAX_DRAWING_BYTES + 64*1024
 )
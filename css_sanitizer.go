@@ -0,0 +1,620 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"guestbook/constants"
+)
+
+// CSSViolation is something the sanitizer removed from a stylesheet.
+type CSSViolation struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+func (v CSSViolation) String() string {
+	return fmt.Sprintf("line %d, column %d: %s", v.Line, v.Column, v.Message)
+}
+
+var cssAllowedProperties = map[string]bool{}
+
+func init() {
+	for _, property := range strings.Fields(`
+		accent-color align-content align-items align-self all animation animation-delay
+		animation-direction animation-duration animation-fill-mode animation-iteration-count
+		animation-name animation-play-state animation-timing-function appearance aspect-ratio
+		backdrop-filter backface-visibility background background-attachment
+		background-blend-mode background-clip background-color background-image
+		background-origin background-position background-position-x background-position-y
+		background-repeat background-size block-size border border-block border-block-end
+		border-block-start border-bottom border-bottom-color border-bottom-left-radius
+		border-bottom-right-radius border-bottom-style border-bottom-width border-collapse
+		border-color border-image border-inline border-inline-end border-inline-start
+		border-left border-left-color border-left-style border-left-width border-radius
+		border-right border-right-color border-right-style border-right-width border-spacing
+		border-style border-top border-top-color border-top-left-radius border-top-right-radius
+		border-top-style border-top-width border-width bottom box-decoration-break box-shadow
+		box-sizing break-after break-before break-inside caption-side caret-color clear
+		clip-path color color-scheme column-count column-gap column-rule column-span
+		column-width columns content counter-increment counter-reset cursor direction display
+		empty-cells filter flex flex-basis flex-direction flex-flow flex-grow flex-shrink
+		flex-wrap float font font-family font-feature-settings font-kerning font-size
+		font-size-adjust font-stretch font-style font-variant font-variant-ligatures
+		font-variant-numeric font-variation-settings font-weight gap grid grid-area
+		grid-auto-columns grid-auto-flow grid-auto-rows grid-column grid-column-end
+		grid-column-start grid-row grid-row-end grid-row-start grid-template
+		grid-template-areas grid-template-columns grid-template-rows height hyphens
+		image-rendering inline-size inset isolation justify-content justify-items justify-self
+		left letter-spacing line-break line-height list-style list-style-image
+		list-style-position list-style-type margin margin-block margin-block-end
+		margin-block-start margin-bottom margin-inline margin-inline-end margin-inline-start
+		margin-left margin-right margin-top max-block-size max-height max-inline-size max-width
+		min-block-size min-height min-inline-size min-width mix-blend-mode object-fit
+		object-position opacity order outline outline-color outline-offset outline-style
+		outline-width overflow overflow-wrap overflow-x overflow-y padding padding-block
+		padding-block-end padding-block-start padding-bottom padding-inline padding-inline-end
+		padding-inline-start padding-left padding-right padding-top place-content place-items
+		place-self pointer-events position quotes resize right rotate row-gap scale
+		scroll-behavior scrollbar-color scrollbar-width tab-size table-layout text-align
+		text-align-last text-decoration text-decoration-color text-decoration-line
+		text-decoration-style text-decoration-thickness text-emphasis text-indent
+		text-overflow text-rendering text-shadow text-size-adjust text-transform
+		text-underline-offset top transform transform-origin transition transition-delay
+		transition-duration transition-property transition-timing-function translate
+		unicode-bidi user-select vertical-align visibility white-space width will-change
+		word-break word-spacing word-wrap writing-mode z-index`) {
+		cssAllowedProperties[property] = true
+	}
+}
+
+var cssFontFaceDescriptors = []string{
+	"ascent-override", "descent-override", "font-display", "font-family", "font-feature-settings",
+	"font-stretch", "font-style", "font-variation-settings", "font-weight", "line-gap-override",
+	"size-adjust", "src", "unicode-range",
+}
+
+var cssAllowedFunctions = []string{
+	"attr", "blur", "brightness", "calc", "circle", "clamp", "color", "color-mix", "conic-gradient",
+	"contrast", "counter", "counters", "cubic-bezier", "drop-shadow", "ellipse", "fit-content",
+	"format", "grayscale", "hsl", "hsla", "hue-rotate", "hwb", "inset", "invert", "lab", "lch",
+	"linear-gradient", "local", "matrix", "matrix3d", "max", "min", "minmax", "oklab", "oklch",
+	"opacity", "perspective", "polygon", "radial-gradient", "repeat", "repeating-conic-gradient",
+	"repeating-linear-gradient", "repeating-radial-gradient", "rgb", "rgba", "rotate", "rotate3d",
+	"rotatex", "rotatey", "rotatez", "saturate", "scale", "scale3d", "scalex", "scaley", "scalez",
+	"sepia", "skew", "skewx", "skewy", "steps", "translate", "translate3d", "translatex",
+	"translatey", "translatez", "url", "var",
+}
+
+var cssSelectorFunctions = []string{
+	"dir", "has", "is", "lang", "not", "nth-child", "nth-last-child", "nth-last-of-type",
+	"nth-of-type", "where",
+}
+
+// deepest nesting of @media and @supports blocks
+const cssMaxNesting = 4
+
+// cssStream walks a token list, treating blocks and functions as a single
+// component value.
+type cssStream struct {
+	tokens []cssToken
+	pos    int
+}
+
+func (s *cssStream) peek() cssToken {
+	if s.pos < len(s.tokens) {
+		return s.tokens[s.pos]
+	}
+	return cssToken{Type: cssEOF}
+}
+
+func (s *cssStream) next() cssToken {
+	token := s.peek()
+	if s.pos < len(s.tokens) {
+		s.pos++
+	}
+	return token
+}
+
+func (s *cssStream) skipWhitespace() {
+	for t := s.peek().Type; t == cssWhitespace || t == cssComment; t = s.peek().Type {
+		s.pos++
+	}
+}
+
+func closingCSSToken(t cssTokenType) (cssTokenType, bool) {
+	switch t {
+	case cssOpenCurly:
+		return cssCloseCurly, true
+	case cssOpenSquare:
+		return cssCloseSquare, true
+	case cssOpenParen, cssFunction:
+		return cssCloseParen, true
+	}
+	return cssEOF, false
+}
+
+// consumeComponent returns the next component value, a whole block or
+// function including its closing token.
+func (s *cssStream) consumeComponent() []cssToken {
+	start := s.pos
+	closing, isBlock := closingCSSToken(s.next().Type)
+	if isBlock {
+		s.consumeUntilClosing(closing)
+	}
+	return s.tokens[start:s.pos]
+}
+
+// consumeUntilClosing consumes tokens up to and including the closing token
+// of a block that was just opened. It returns the tokens inside the block.
+func (s *cssStream) consumeUntilClosing(closing cssTokenType) []cssToken {
+	start := s.pos
+	for {
+		switch s.peek().Type {
+		case cssEOF:
+			return s.tokens[start:s.pos]
+		case closing:
+			inner := s.tokens[start:s.pos]
+			s.pos++
+			return inner
+		}
+		s.consumeComponent()
+	}
+}
+
+type cssSanitizer struct {
+	out        strings.Builder
+	violations []CSSViolation
+}
+
+func (c *cssSanitizer) violation(token cssToken, format string, args ...any) {
+	c.violations = append(c.violations, CSSViolation{Line: token.Line, Column: token.Column, Message: fmt.Sprintf(format, args...)})
+}
+
+// sanitizeCSS rewrites a stylesheet keeping only whitelisted rules,
+// properties, functions and URLs. Everything else is dropped and reported.
+// The result is safe to place inside a <style> element.
+func sanitizeCSS(css string) (string, []CSSViolation) {
+	c := &cssSanitizer{}
+	c.ruleList(&cssStream{tokens: tokenizeCSS(css)}, 0)
+	return c.out.String(), c.violations
+}
+
+func (c *cssSanitizer) ruleList(s *cssStream, depth int) {
+	for {
+		token := s.peek()
+		switch token.Type {
+		case cssEOF:
+			return
+		case cssWhitespace, cssComment, cssCDO, cssCDC, cssSemicolon:
+			s.next()
+		case cssAtKeyword:
+			c.atRule(s, depth)
+		default:
+			c.qualifiedRule(s)
+		}
+	}
+}
+
+// rulePrelude consumes everything up to the block of a rule. It returns
+// false if the rule has no block.
+func rulePrelude(s *cssStream) ([]cssToken, []cssToken, bool) {
+	start := s.pos
+	for {
+		switch s.peek().Type {
+		case cssEOF:
+			return s.tokens[start:s.pos], nil, false
+		case cssSemicolon:
+			prelude := s.tokens[start:s.pos]
+			s.next()
+			return prelude, nil, false
+		case cssOpenCurly:
+			prelude := s.tokens[start:s.pos]
+			s.next()
+			return prelude, s.consumeUntilClosing(cssCloseCurly), true
+		}
+		s.consumeComponent()
+	}
+}
+
+func (c *cssSanitizer) qualifiedRule(s *cssStream) {
+	first := s.peek()
+	prelude, block, ok := rulePrelude(s)
+	if !ok {
+		c.violation(first, "expected a '{' after the selector")
+		return
+	}
+	if !c.selector(first, prelude) {
+		return
+	}
+
+	c.out.WriteString(serializeCSSTokens(trimCSSWhitespace(prelude)))
+	c.out.WriteString(" {\n")
+	c.declarations(block, func(name string) bool { return cssAllowedProperties[name] })
+	c.out.WriteString("}\n")
+}
+
+func (c *cssSanitizer) atRule(s *cssStream, depth int) {
+	at := s.next()
+	name := strings.ToLower(at.Value)
+	prelude, block, hasBlock := rulePrelude(s)
+
+	switch name {
+	case "media", "supports":
+		if !hasBlock {
+			c.violation(at, "@%s needs a block", name)
+			return
+		}
+		if depth >= cssMaxNesting {
+			c.violation(at, "@%s is nested too deeply", name)
+			return
+		}
+		if name == "media" && !c.mediaQuery(prelude) || name == "supports" && !c.value(prelude, "selector") {
+			return
+		}
+		c.out.WriteString("@" + name + " " + serializeCSSTokens(trimCSSWhitespace(prelude)) + " {\n")
+		c.ruleList(&cssStream{tokens: block}, depth+1)
+		c.out.WriteString("}\n")
+	case "font-face":
+		if !hasBlock || len(trimCSSWhitespace(prelude)) > 0 {
+			c.violation(at, "@font-face must be followed by a block of descriptors")
+			return
+		}
+		c.out.WriteString("@font-face {\n")
+		c.declarations(block, func(name string) bool { return slices.Contains(cssFontFaceDescriptors, name) })
+		c.out.WriteString("}\n")
+	case "keyframes", "-webkit-keyframes":
+		animationName := trimCSSWhitespace(prelude)
+		if !hasBlock || len(animationName) != 1 || (animationName[0].Type != cssIdent && animationName[0].Type != cssString) {
+			c.violation(at, "@%s needs a name and a block", name)
+			return
+		}
+		c.out.WriteString("@" + name + " " + serializeCSSTokens(animationName) + " {\n")
+		c.keyframes(&cssStream{tokens: block})
+		c.out.WriteString("}\n")
+	default:
+		c.violation(at, "@%s is not allowed", at.Value)
+	}
+}
+
+func (c *cssSanitizer) keyframes(s *cssStream) {
+	for {
+		token := s.peek()
+		switch token.Type {
+		case cssEOF:
+			return
+		case cssWhitespace, cssComment, cssSemicolon:
+			s.next()
+			continue
+		}
+
+		prelude, block, ok := rulePrelude(s)
+		if !ok {
+			c.violation(token, "expected a '{' after the keyframe selector")
+			continue
+		}
+
+		valid := len(trimCSSWhitespace(prelude)) > 0
+		for _, t := range prelude {
+			switch {
+			case t.Type == cssPercentage, t.Type == cssComma, t.Type == cssWhitespace, t.Type == cssComment:
+			case t.Type == cssIdent && (strings.EqualFold(t.Value, "from") || strings.EqualFold(t.Value, "to")):
+			default:
+				valid = false
+			}
+		}
+		if !valid {
+			c.violation(token, "keyframe selectors can only be percentages, from or to")
+			continue
+		}
+
+		c.out.WriteString(serializeCSSTokens(trimCSSWhitespace(prelude)) + " {\n")
+		c.declarations(block, func(name string) bool { return cssAllowedProperties[name] })
+		c.out.WriteString("}\n")
+	}
+}
+
+func (c *cssSanitizer) declarations(tokens []cssToken, allowed func(string) bool) {
+	s := &cssStream{tokens: tokens}
+	for {
+		s.skipWhitespace()
+		token := s.peek()
+		switch token.Type {
+		case cssEOF:
+			return
+		case cssSemicolon:
+			s.next()
+			continue
+		}
+
+		// a declaration runs up to the next semicolon outside of any block
+		start := s.pos
+		for t := s.peek().Type; t != cssSemicolon && t != cssEOF; t = s.peek().Type {
+			s.consumeComponent()
+		}
+		declaration := s.tokens[start:s.pos]
+
+		if token.Type != cssIdent {
+			c.violation(token, "expected a property name")
+			continue
+		}
+
+		rest := &cssStream{tokens: declaration[1:]}
+		rest.skipWhitespace()
+		if rest.next().Type != cssColon {
+			c.violation(token, "expected ':' after '%s'", token.Value)
+			continue
+		}
+
+		name := strings.ToLower(token.Value)
+		if !strings.HasPrefix(name, "--") && !allowed(unprefixedCSSProperty(name)) {
+			c.violation(token, "property '%s' is not allowed", token.Value)
+			continue
+		}
+
+		value := trimCSSWhitespace(rest.tokens[rest.pos:])
+		if len(value) == 0 {
+			c.violation(token, "'%s' has no value", token.Value)
+			continue
+		}
+		if !c.value(value) {
+			continue
+		}
+
+		c.out.WriteString("  " + serializeCSSIdent(token.Value) + ": " + serializeCSSTokens(value) + ";\n")
+	}
+}
+
+func unprefixedCSSProperty(name string) string {
+	for _, prefix := range []string{"-webkit-", "-moz-", "-ms-", "-o-"} {
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix)
+		}
+	}
+	return name
+}
+
+// value checks a property value (or @supports condition), extraFunctions are
+// allowed in addition to cssAllowedFunctions.
+func (c *cssSanitizer) value(tokens []cssToken, extraFunctions ...string) bool {
+	valid := true
+	for i, token := range tokens {
+		switch token.Type {
+		case cssFunction:
+			name := strings.ToLower(token.Value)
+			if !slices.Contains(cssAllowedFunctions, name) && !slices.Contains(extraFunctions, name) {
+				c.violation(token, "function '%s()' is not allowed", token.Value)
+				valid = false
+			} else if name == "url" && !c.quotedURL(token, tokens[i+1:]) {
+				valid = false
+			}
+		case cssURL:
+			if !c.url(token, token.Value) {
+				valid = false
+			}
+		case cssBadURL, cssBadString:
+			c.violation(token, "malformed url or string")
+			valid = false
+		case cssAtKeyword, cssOpenCurly, cssCloseCurly, cssCDO, cssCDC:
+			c.violation(token, "unexpected '%s' in value", describeCSSToken(token))
+			valid = false
+		case cssDelim:
+			if token.Value == "<" || token.Value == "\\" {
+				c.violation(token, "unexpected '%s' in value", token.Value)
+				valid = false
+			}
+		}
+	}
+	return valid
+}
+
+// quotedURL checks url("...") whose arguments follow the function token.
+func (c *cssSanitizer) quotedURL(function cssToken, args []cssToken) bool {
+	s := &cssStream{tokens: args}
+	s.skipWhitespace()
+	argument := s.next()
+	s.skipWhitespace()
+	if argument.Type != cssString || s.peek().Type != cssCloseParen {
+		c.violation(function, "url() must contain a single URL")
+		return false
+	}
+	return c.url(argument, argument.Value)
+}
+
+func (c *cssSanitizer) url(token cssToken, rawURL string) bool {
+	if !allowedCSSURL(rawURL) {
+		c.violation(token, "url(%q) is not allowed, only assets uploaded under Theme assets can be used", rawURL)
+		return false
+	}
+	return true
+}
+
+// allowedCSSURL reports whether a stylesheet may load rawURL. Only uploaded
+// theme assets are allowed, either server relative or on PUBLIC_URL.
+func allowedCSSURL(rawURL string) bool {
+	rawURL = strings.TrimSpace(rawURL)
+	if strings.HasPrefix(rawURL, constants.PUBLIC_URL+"/") {
+		rawURL = strings.TrimPrefix(rawURL, constants.PUBLIC_URL)
+	}
+	return themeAssetURLPattern.MatchString(rawURL)
+}
+
+func (c *cssSanitizer) selector(first cssToken, tokens []cssToken) bool {
+	if len(trimCSSWhitespace(tokens)) == 0 {
+		c.violation(first, "empty selector")
+		return false
+	}
+
+	valid := true
+	for _, token := range tokens {
+		switch token.Type {
+		case cssIdent, cssHash, cssColon, cssComma, cssWhitespace, cssComment, cssString,
+			cssOpenSquare, cssCloseSquare, cssCloseParen, cssNumber, cssDimension:
+		case cssDelim:
+			if !strings.Contains(".*>+~|=^$&!-", token.Value) {
+				c.violation(token, "unexpected '%s' in selector", token.Value)
+				valid = false
+			}
+		case cssFunction:
+			if !slices.Contains(cssSelectorFunctions, strings.ToLower(token.Value)) {
+				c.violation(token, "':%s()' is not allowed in selectors", token.Value)
+				valid = false
+			}
+		default:
+			c.violation(token, "unexpected '%s' in selector", describeCSSToken(token))
+			valid = false
+		}
+	}
+	return valid
+}
+
+func (c *cssSanitizer) mediaQuery(tokens []cssToken) bool {
+	valid := true
+	for _, token := range tokens {
+		switch token.Type {
+		case cssIdent, cssNumber, cssDimension, cssColon, cssComma, cssWhitespace, cssComment,
+			cssOpenParen, cssCloseParen:
+		case cssDelim:
+			if !strings.Contains("/<>=", token.Value) {
+				c.violation(token, "unexpected '%s' in media query", token.Value)
+				valid = false
+			}
+		default:
+			c.violation(token, "unexpected '%s' in media query", describeCSSToken(token))
+			valid = false
+		}
+	}
+	return valid
+}
+
+func trimCSSWhitespace(tokens []cssToken) []cssToken {
+	isSpace := func(t cssToken) bool { return t.Type == cssWhitespace || t.Type == cssComment }
+	for len(tokens) > 0 && isSpace(tokens[0]) {
+		tokens = tokens[1:]
+	}
+	for len(tokens) > 0 && isSpace(tokens[len(tokens)-1]) {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+func describeCSSToken(token cssToken) string {
+	switch token.Type {
+	case cssAtKeyword:
+		return "@" + token.Value
+	case cssOpenCurly:
+		return "{"
+	case cssCloseCurly:
+		return "}"
+	case cssSemicolon:
+		return ";"
+	case cssString:
+		return "string"
+	case cssURL, cssBadURL:
+		return "url()"
+	case cssFunction:
+		return token.Value + "()"
+	case cssCDO:
+		return "<!--"
+	case cssCDC:
+		return "-->"
+	}
+	return token.Value
+}
+
+// serializeCSSIdent writes a name so it reads back as the same identifier,
+// escaping anything outside of plain name characters.
+func serializeCSSIdent(name string) string {
+	var out strings.Builder
+	for i, r := range name {
+		leadingDigit := isCSSDigit(r) && (i == 0 || (i == 1 && name[0] == '-'))
+		if isCSSNameChar(r) && !leadingDigit {
+			out.WriteRune(r)
+		} else {
+			fmt.Fprintf(&out, "\\%x ", r)
+		}
+	}
+	return out.String()
+}
+
+// serializeCSSString quotes a string. '<' is always escaped so the output
+// can never close the surrounding <style> element.
+func serializeCSSString(value string) string {
+	var out strings.Builder
+	out.WriteByte('"')
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\\' || r == '<' || r == '>' || r == '&' || r < 0x20 || r == 0x7F:
+			fmt.Fprintf(&out, "\\%x ", r)
+		default:
+			out.WriteRune(r)
+		}
+	}
+	out.WriteByte('"')
+	return out.String()
+}
+
+func serializeCSSTokens(tokens []cssToken) string {
+	var out strings.Builder
+	for i, token := range tokens {
+		switch token.Type {
+		case cssWhitespace:
+			out.WriteByte(' ')
+		case cssComment:
+			// keeps tokens apart without carrying the comment along
+			out.WriteString("/**/")
+		case cssIdent:
+			out.WriteString(serializeCSSIdent(token.Value))
+		case cssFunction:
+			out.WriteString(serializeCSSIdent(token.Value) + "(")
+		case cssAtKeyword:
+			out.WriteString("@" + serializeCSSIdent(token.Value))
+		case cssHash:
+			out.WriteByte('#')
+			for _, r := range token.Value {
+				if isCSSNameChar(r) {
+					out.WriteRune(r)
+				} else {
+					fmt.Fprintf(&out, "\\%x ", r)
+				}
+			}
+		case cssString:
+			out.WriteString(serializeCSSString(token.Value))
+		case cssURL:
+			out.WriteString("url(" + serializeCSSString(token.Value) + ")")
+		case cssNumber:
+			out.WriteString(token.Value)
+		case cssPercentage:
+			out.WriteString(token.Value + "%")
+		case cssDimension:
+			out.WriteString(token.Value + serializeCSSIdent(token.Unit))
+		case cssDelim:
+			out.WriteString(token.Value)
+			if token.Value == "<" && (i+1 == len(tokens) || tokens[i+1].Type != cssWhitespace) {
+				// never let '<' touch what follows it
+				out.WriteByte(' ')
+			}
+		case cssColon:
+			out.WriteByte(':')
+		case cssSemicolon:
+			out.WriteByte(';')
+		case cssComma:
+			out.WriteByte(',')
+		case cssOpenSquare:
+			out.WriteByte('[')
+		case cssCloseSquare:
+			out.WriteByte(']')
+		case cssOpenParen:
+			out.WriteByte('(')
+		case cssCloseParen:
+			out.WriteByte(')')
+		case cssOpenCurly:
+			out.WriteByte('{')
+		case cssCloseCurly:
+			out.WriteByte('}')
+		}
+	}
+	return out.String()
+}
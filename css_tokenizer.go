@@ -0,0 +1,426 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// A small tokenizer following the CSS Syntax Module Level 3 rules closely
+// enough that escapes, comments and broken strings can't be used to hide
+// anything from the sanitizer.
+
+type cssTokenType int
+
+const (
+	cssEOF cssTokenType = iota
+	cssWhitespace
+	cssComment
+	cssIdent
+	cssFunction
+	cssAtKeyword
+	cssHash
+	cssString
+	cssBadString
+	cssURL
+	cssBadURL
+	cssDelim
+	cssNumber
+	cssPercentage
+	cssDimension
+	cssCDO
+	cssCDC
+	cssColon
+	cssSemicolon
+	cssComma
+	cssOpenSquare
+	cssCloseSquare
+	cssOpenParen
+	cssCloseParen
+	cssOpenCurly
+	cssCloseCurly
+)
+
+type cssToken struct {
+	Type cssTokenType
+	// Value is the decoded name, string or URL. For numeric tokens it is the
+	// number as written and Unit holds the decoded unit of dimensions.
+	Value  string
+	Unit   string
+	Line   int
+	Column int
+}
+
+type cssTokenizer struct {
+	input  []rune
+	pos    int
+	line   int
+	column int
+}
+
+// tokenizeCSS splits a stylesheet into tokens, the last token is always cssEOF.
+func tokenizeCSS(css string) []cssToken {
+	css = strings.ReplaceAll(css, "\r\n", "\n")
+	css = strings.NewReplacer("\r", "\n", "\f", "\n", "\x00", "�").Replace(css)
+
+	t := &cssTokenizer{input: []rune(css), line: 1, column: 1}
+	var tokens []cssToken
+	for {
+		token := t.next()
+		tokens = append(tokens, token)
+		if token.Type == cssEOF {
+			return tokens
+		}
+	}
+}
+
+func (t *cssTokenizer) peekAt(offset int) rune {
+	if t.pos+offset < len(t.input) {
+		return t.input[t.pos+offset]
+	}
+	return -1
+}
+
+func (t *cssTokenizer) advance() rune {
+	if t.pos >= len(t.input) {
+		return -1
+	}
+	r := t.input[t.pos]
+	t.pos++
+	if r == '\n' {
+		t.line++
+		t.column = 1
+	} else {
+		t.column++
+	}
+	return r
+}
+
+func isCSSWhitespace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n'
+}
+
+func isCSSDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isCSSHexDigit(r rune) bool {
+	return isCSSDigit(r) || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
+
+func isCSSNameStart(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_' || r >= 0x80
+}
+
+func isCSSNameChar(r rune) bool {
+	return isCSSNameStart(r) || isCSSDigit(r) || r == '-'
+}
+
+func isValidCSSEscape(first, second rune) bool {
+	return first == '\\' && second != '\n' && second != -1
+}
+
+func startsCSSIdent(first, second, third rune) bool {
+	switch {
+	case first == '-':
+		return isCSSNameStart(second) || second == '-' || isValidCSSEscape(second, third)
+	case isCSSNameStart(first):
+		return true
+	case first == '\\':
+		return isValidCSSEscape(first, second)
+	}
+	return false
+}
+
+func startsCSSNumber(first, second, third rune) bool {
+	switch {
+	case first == '+' || first == '-':
+		return isCSSDigit(second) || (second == '.' && isCSSDigit(third))
+	case first == '.':
+		return isCSSDigit(second)
+	}
+	return isCSSDigit(first)
+}
+
+func (t *cssTokenizer) next() cssToken {
+	token := cssToken{Line: t.line, Column: t.column}
+
+	r := t.peekAt(0)
+	switch {
+	case r == -1:
+		token.Type = cssEOF
+	case r == '/' && t.peekAt(1) == '*':
+		t.advance()
+		t.advance()
+		for t.peekAt(0) != -1 && !(t.peekAt(0) == '*' && t.peekAt(1) == '/') {
+			t.advance()
+		}
+		t.advance()
+		t.advance()
+		token.Type = cssComment
+	case isCSSWhitespace(r):
+		for isCSSWhitespace(t.peekAt(0)) {
+			t.advance()
+		}
+		token.Type = cssWhitespace
+	case r == '"' || r == '\'':
+		t.advance()
+		token.Type, token.Value = t.consumeString(r)
+	case r == '#':
+		t.advance()
+		if isCSSNameChar(t.peekAt(0)) || isValidCSSEscape(t.peekAt(0), t.peekAt(1)) {
+			token.Type = cssHash
+			token.Value = t.consumeName()
+		} else {
+			token.Type, token.Value = cssDelim, "#"
+		}
+	case r == '(':
+		t.advance()
+		token.Type = cssOpenParen
+	case r == ')':
+		t.advance()
+		token.Type = cssCloseParen
+	case r == '[':
+		t.advance()
+		token.Type = cssOpenSquare
+	case r == ']':
+		t.advance()
+		token.Type = cssCloseSquare
+	case r == '{':
+		t.advance()
+		token.Type = cssOpenCurly
+	case r == '}':
+		t.advance()
+		token.Type = cssCloseCurly
+	case r == ',':
+		t.advance()
+		token.Type = cssComma
+	case r == ':':
+		t.advance()
+		token.Type = cssColon
+	case r == ';':
+		t.advance()
+		token.Type = cssSemicolon
+	case startsCSSNumber(r, t.peekAt(1), t.peekAt(2)):
+		t.consumeNumeric(&token)
+	case r == '-' && t.peekAt(1) == '-' && t.peekAt(2) == '>':
+		t.advance()
+		t.advance()
+		t.advance()
+		token.Type = cssCDC
+	case startsCSSIdent(r, t.peekAt(1), t.peekAt(2)):
+		t.consumeIdentLike(&token)
+	case r == '<' && t.peekAt(1) == '!' && t.peekAt(2) == '-' && t.peekAt(3) == '-':
+		for i := 0; i < 4; i++ {
+			t.advance()
+		}
+		token.Type = cssCDO
+	case r == '@':
+		t.advance()
+		if startsCSSIdent(t.peekAt(0), t.peekAt(1), t.peekAt(2)) {
+			token.Type = cssAtKeyword
+			token.Value = t.consumeName()
+		} else {
+			token.Type, token.Value = cssDelim, "@"
+		}
+	default:
+		t.advance()
+		token.Type, token.Value = cssDelim, string(r)
+	}
+	return token
+}
+
+func (t *cssTokenizer) consumeEscape() rune {
+	r := t.advance()
+	if !isCSSHexDigit(r) {
+		if r == -1 {
+			return utf8.RuneError
+		}
+		return r
+	}
+
+	value := hexValue(r)
+	for i := 0; i < 5 && isCSSHexDigit(t.peekAt(0)); i++ {
+		value = value*16 + hexValue(t.advance())
+	}
+	if isCSSWhitespace(t.peekAt(0)) {
+		t.advance()
+	}
+	if value == 0 || (value >= 0xD800 && value <= 0xDFFF) || value > utf8.MaxRune {
+		return utf8.RuneError
+	}
+	return rune(value)
+}
+
+func hexValue(r rune) int {
+	switch {
+	case isCSSDigit(r):
+		return int(r - '0')
+	case r >= 'a' && r <= 'f':
+		return int(r-'a') + 10
+	default:
+		return int(r-'A') + 10
+	}
+}
+
+func (t *cssTokenizer) consumeName() string {
+	var name strings.Builder
+	for {
+		r := t.peekAt(0)
+		switch {
+		case isCSSNameChar(r):
+			name.WriteRune(t.advance())
+		case isValidCSSEscape(r, t.peekAt(1)):
+			t.advance()
+			name.WriteRune(t.consumeEscape())
+		default:
+			return name.String()
+		}
+	}
+}
+
+func (t *cssTokenizer) consumeString(quote rune) (cssTokenType, string) {
+	var value strings.Builder
+	for {
+		r := t.peekAt(0)
+		switch {
+		case r == -1:
+			return cssString, value.String()
+		case r == quote:
+			t.advance()
+			return cssString, value.String()
+		case r == '\n':
+			return cssBadString, value.String()
+		case r == '\\':
+			t.advance()
+			switch t.peekAt(0) {
+			case -1:
+			case '\n':
+				t.advance()
+			default:
+				value.WriteRune(t.consumeEscape())
+			}
+		default:
+			value.WriteRune(t.advance())
+		}
+	}
+}
+
+func (t *cssTokenizer) consumeNumeric(token *cssToken) {
+	var number strings.Builder
+	if r := t.peekAt(0); r == '+' || r == '-' {
+		number.WriteRune(t.advance())
+	}
+	for isCSSDigit(t.peekAt(0)) {
+		number.WriteRune(t.advance())
+	}
+	if t.peekAt(0) == '.' && isCSSDigit(t.peekAt(1)) {
+		number.WriteRune(t.advance())
+		for isCSSDigit(t.peekAt(0)) {
+			number.WriteRune(t.advance())
+		}
+	}
+	if r := t.peekAt(0); r == 'e' || r == 'E' {
+		if isCSSDigit(t.peekAt(1)) || ((t.peekAt(1) == '+' || t.peekAt(1) == '-') && isCSSDigit(t.peekAt(2))) {
+			number.WriteRune(t.advance())
+			number.WriteRune(t.advance())
+			for isCSSDigit(t.peekAt(0)) {
+				number.WriteRune(t.advance())
+			}
+		}
+	}
+	token.Value = number.String()
+
+	switch {
+	case startsCSSIdent(t.peekAt(0), t.peekAt(1), t.peekAt(2)):
+		token.Type = cssDimension
+		token.Unit = t.consumeName()
+	case t.peekAt(0) == '%':
+		t.advance()
+		token.Type = cssPercentage
+	default:
+		token.Type = cssNumber
+	}
+}
+
+func (t *cssTokenizer) consumeIdentLike(token *cssToken) {
+	name := t.consumeName()
+	token.Value = name
+
+	if t.peekAt(0) != '(' {
+		token.Type = cssIdent
+		return
+	}
+	t.advance()
+
+	if !strings.EqualFold(name, "url") {
+		token.Type = cssFunction
+		return
+	}
+
+	// url( followed by a quoted string is a regular function
+	offset := 0
+	for isCSSWhitespace(t.peekAt(offset)) {
+		offset++
+	}
+	if r := t.peekAt(offset); r == '"' || r == '\'' {
+		token.Type = cssFunction
+		return
+	}
+
+	token.Type, token.Value = t.consumeURL()
+}
+
+func (t *cssTokenizer) consumeURL() (cssTokenType, string) {
+	var value strings.Builder
+	for isCSSWhitespace(t.peekAt(0)) {
+		t.advance()
+	}
+	for {
+		r := t.peekAt(0)
+		switch {
+		case r == ')':
+			t.advance()
+			return cssURL, value.String()
+		case r == -1:
+			return cssURL, value.String()
+		case isCSSWhitespace(r):
+			for isCSSWhitespace(t.peekAt(0)) {
+				t.advance()
+			}
+			if t.peekAt(0) == ')' || t.peekAt(0) == -1 {
+				t.advance()
+				return cssURL, value.String()
+			}
+			t.consumeBadURLRemnants()
+			return cssBadURL, ""
+		case r == '"' || r == '\'' || r == '(' || r < 0x20 || r == 0x7F:
+			t.consumeBadURLRemnants()
+			return cssBadURL, ""
+		case r == '\\':
+			if !isValidCSSEscape(r, t.peekAt(1)) {
+				t.consumeBadURLRemnants()
+				return cssBadURL, ""
+			}
+			t.advance()
+			value.WriteRune(t.consumeEscape())
+		default:
+			value.WriteRune(t.advance())
+		}
+	}
+}
+
+func (t *cssTokenizer) consumeBadURLRemnants() {
+	for {
+		r := t.peekAt(0)
+		switch {
+		case r == ')' || r == -1:
+			t.advance()
+			return
+		case isValidCSSEscape(r, t.peekAt(1)):
+			t.advance()
+			t.consumeEscape()
+		default:
+			t.advance()
+		}
+	}
+}
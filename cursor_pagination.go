@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"guestbook/constants"
+)
+
+const (
+	messageOrderNewest = "newest"
+	messageOrderOldest = "oldest"
+)
+
+// errInvalidCursor is returned for cursors that weren't made by
+// encodeMessageCursor.
+var errInvalidCursor = errors.New("invalid cursor")
+
+// CursorPage is the response body of the v3 messages API. Pass NextCursor
+// back as the cursor parameter to get the messages after this page.
+type CursorPage struct {
+	Messages   []Message `json:"messages"`
+	Total      int64     `json:"total"`
+	Order      string    `json:"order"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+	HasNext    bool      `json:"hasNext"`
+}
+
+// messageCursor points right after a top-level message in the public order,
+// pinned messages first and then by date. Unlike an offset it keeps pointing
+// at the same place when new messages arrive.
+type messageCursor struct {
+	Order     string `json:"o"`
+	Pinned    bool   `json:"p"`
+	CreatedAt int64  `json:"t"`
+	ID        uint   `json:"i"`
+}
+
+func encodeMessageCursor(order string, message Message) string {
+	data, _ := json.Marshal(messageCursor{
+		Order:     order,
+		Pinned:    message.Pinned,
+		CreatedAt: message.CreatedAt.UnixNano(),
+		ID:        message.ID,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeMessageCursor(value string) (messageCursor, error) {
+	var cursor messageCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, errInvalidCursor
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, errInvalidCursor
+	}
+	if cursor.Order != messageOrderNewest && cursor.Order != messageOrderOldest {
+		return cursor, errInvalidCursor
+	}
+	return cursor, nil
+}
+
+// loadTopLevelMessageCount returns the number of approved messages that
+// aren't replies, which is what the message APIs page through.
+func loadTopLevelMessageCount(guestbookID uint) (int64, error) {
+	if count, ok := messageCache.GetCount(guestbookID); ok {
+		return count, nil
+	}
+
+	var count int64
+	result := db.Model(&Message{}).
+		Where(&Message{GuestbookID: guestbookID, Approved: true}).
+		Where("parent_message_id IS NULL").
+		Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	messageCache.SetCount(guestbookID, count)
+	return count, nil
+}
+
+// loadCursorPage returns up to limit approved top-level messages (with their
+// tree of approved replies) after the cursor, or from the start when cursor
+// is empty. A search only keeps the messages matching it, on guestbooks that
+// allow it. The second return value reports whether the response came from
+// the cache.
+func loadCursorPage(guestbookID uint, cursor, order, search string, limit int, hostURL string) (CursorPage, bool, error) {
+	if cachedPage, ok := messageCache.GetCursorPage(guestbookID, cursor, order, search, limit); ok {
+		return cachedPage, true, nil
+	}
+
+	guestbook, err := loadGuestbookForMessages(guestbookID)
+	if err != nil {
+		return CursorPage{}, false, err
+	}
+	if search != "" && !guestbook.PublicSearchEnabled {
+		return CursorPage{}, false, errSearchDisabled
+	}
+
+	var totalCount int64
+	if search == "" {
+		totalCount, err = loadTopLevelMessageCount(guestbookID)
+	} else {
+		err = searchMessages(db.Model(&Message{}), search).
+			Where(&Message{GuestbookID: guestbookID, Approved: true}).
+			Where("parent_message_id IS NULL").
+			Count(&totalCount).Error
+	}
+	if err != nil {
+		return CursorPage{}, false, err
+	}
+
+	query := searchMessages(db.Model(&Message{}), search).
+		Where(&Message{GuestbookID: guestbookID, Approved: true}).
+		Where("parent_message_id IS NULL")
+	if order == messageOrderOldest {
+		query = query.Order("pinned DESC, created_at ASC, id ASC")
+	} else {
+		query = query.Order(publicMessageOrder)
+	}
+
+	if cursor != "" {
+		after, err := decodeMessageCursor(cursor)
+		if err != nil {
+			return CursorPage{}, false, err
+		}
+		createdAt := time.Unix(0, after.CreatedAt)
+		comparison := "<"
+		if order == messageOrderOldest {
+			comparison = ">"
+		}
+		query = query.Where(
+			fmt.Sprintf("(pinned < ? OR (pinned = ? AND (created_at %[1]s ? OR (created_at = ? AND id %[1]s ?))))", comparison),
+			after.Pinned, after.Pinned, createdAt, createdAt, after.ID,
+		)
+	}
+
+	// one extra message tells whether there is a next page
+	var messages []Message
+	result := preloadReplies(query, "Replies", guestbook.ReplyDepthLimit(), approvedReplies).
+		Limit(limit + 1).
+		Find(&messages)
+	if result.Error != nil {
+		return CursorPage{}, false, result.Error
+	}
+
+	page := CursorPage{Total: totalCount, Order: order}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		page.HasNext = true
+		page.NextCursor = encodeMessageCursor(order, messages[limit-1])
+	}
+	if err := decorateMessages(&guestbook, messages, hostURL); err != nil {
+		return CursorPage{}, false, err
+	}
+	page.Messages = messages
+	if page.Messages == nil {
+		page.Messages = []Message{}
+	}
+
+	messageCache.SetCursorPage(guestbookID, cursor, order, search, limit, page)
+
+	return page, false, nil
+}
+
+// GetGuestbookMessagesV3 returns approved messages a page at a time, like v2,
+// but pages are linked by cursors so scrolling never repeats or skips a
+// message while new ones arrive. order is either "newest" (the default) or
+// "oldest", pinned messages always come first. A cursor keeps the order it
+// was made with. On guestbooks that allow it, q only returns the messages
+// that contain its words.
+func GetGuestbookMessagesV3(w http.ResponseWriter, r *http.Request) {
+	guestbookID, ok := parseGuestbookIDParam(r)
+	if !ok {
+		http.Error(w, "Invalid guestbook ID", http.StatusBadRequest)
+		return
+	}
+
+	limit := constants.DEFAULT_PAGE_SIZE
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= constants.MAX_PAGE_SIZE {
+		limit = l
+	}
+
+	order := messageOrderNewest
+	if r.URL.Query().Get("order") == messageOrderOldest {
+		order = messageOrderOldest
+	}
+
+	cursor := r.URL.Query().Get("cursor")
+	if cursor != "" {
+		after, err := decodeMessageCursor(cursor)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		order = after.Order
+	}
+
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len(search) > constants.MAX_SEARCH_LENGTH {
+		http.Error(w, fmt.Sprintf("Search is too long, maximum length is %d characters", constants.MAX_SEARCH_LENGTH), http.StatusBadRequest)
+		return
+	}
+
+	etag := messageCache.ETag(guestbookID, fmt.Sprintf("%s-l%d-c%s-q%s", order, limit, cursor, url.QueryEscape(search)))
+	if notModified(w, r, etag) {
+		return
+	}
+
+	page, cached, err := loadCursorPage(guestbookID, cursor, order, search, limit, publicHostURL(r))
+	if errors.Is(err, errSearchDisabled) {
+		http.Error(w, "Search is not enabled for this guestbook", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeGuestbookLoadError(w, err)
+		return
+	}
+
+	setMessagesCacheHeaders(w, etag)
+	w.Header().Set("Content-Type", "application/json")
+	if cached {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"guestbook/constants"
+
+	"gorm.io/datatypes"
+)
+
+// Supported custom field types.
+const (
+	CustomFieldText     = "text"
+	CustomFieldSelect   = "select"
+	CustomFieldCheckbox = "checkbox"
+	CustomFieldEmoji    = "emoji"
+)
+
+var defaultEmojiOptions = []string{"😀", "😍", "😎", "🤔", "😢", "🎉"}
+
+var customFieldIDPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// CustomField is an extra question a guestbook owner adds to the public form.
+type CustomField struct {
+	ID        string   `json:"id"`
+	Type      string   `json:"type"`
+	Label     string   `json:"label"`
+	Required  bool     `json:"required"`
+	MaxLength int      `json:"maxLength,omitempty"`
+	Options   []string `json:"options,omitempty"`
+}
+
+// CustomFieldAnswer is a visitor's answer to a custom field, resolved with
+// the field label so it can be displayed directly.
+type CustomFieldAnswer struct {
+	FieldID string `json:"fieldId"`
+	Type    string `json:"type"`
+	Label   string `json:"label"`
+	Value   string `json:"value"`
+}
+
+// FormName is the name of the form input holding the answer to this field.
+func (f CustomField) FormName() string {
+	return "custom_" + f.ID
+}
+
+func generateCustomFieldID() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return "f" + hex.EncodeToString(buf)
+}
+
+// parseCustomFieldsForm parses and validates the JSON field definitions
+// submitted from the guestbook editor.
+func parseCustomFieldsForm(raw string) (datatypes.JSONSlice[CustomField], error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return datatypes.JSONSlice[CustomField]{}, nil
+	}
+
+	var fields []CustomField
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return nil, errors.New("custom fields are malformed")
+	}
+
+	if len(fields) > constants.MAX_CUSTOM_FIELDS {
+		return nil, fmt.Errorf("a guestbook can have at most %d custom fields", constants.MAX_CUSTOM_FIELDS)
+	}
+
+	seenIDs := map[string]bool{}
+	result := make(datatypes.JSONSlice[CustomField], 0, len(fields))
+	for _, field := range fields {
+		field.Label = strings.TrimSpace(field.Label)
+		if field.Label == "" {
+			return nil, errors.New("every custom field needs a label")
+		}
+		if utf8.RuneCountInString(field.Label) > constants.MAX_CUSTOM_FIELD_LABEL_LENGTH {
+			return nil, fmt.Errorf("custom field label '%s' is too long", field.Label)
+		}
+
+		// keep existing IDs so that answers stay attached to their field
+		if !customFieldIDPattern.MatchString(field.ID) || seenIDs[field.ID] {
+			field.ID = generateCustomFieldID()
+		}
+		seenIDs[field.ID] = true
+
+		options := make([]string, 0, len(field.Options))
+		for _, option := range field.Options {
+			option = strings.TrimSpace(option)
+			if option != "" && !slices.Contains(options, option) {
+				options = append(options, option)
+			}
+		}
+		if len(options) > constants.MAX_CUSTOM_FIELD_OPTIONS {
+			return nil, fmt.Errorf("custom field '%s' has too many options", field.Label)
+		}
+
+		switch field.Type {
+		case CustomFieldText:
+			if field.MaxLength <= 0 || field.MaxLength > constants.MAX_CUSTOM_FIELD_VALUE_LENGTH {
+				field.MaxLength = constants.MAX_CUSTOM_FIELD_VALUE_LENGTH
+			}
+			options = nil
+		case CustomFieldSelect:
+			if len(options) == 0 {
+				return nil, fmt.Errorf("custom field '%s' needs at least one option", field.Label)
+			}
+			field.MaxLength = 0
+		case CustomFieldEmoji:
+			if len(options) == 0 {
+				options = defaultEmojiOptions
+			}
+			field.MaxLength = 0
+		case CustomFieldCheckbox:
+			options = nil
+			field.MaxLength = 0
+		default:
+			return nil, fmt.Errorf("custom field '%s' has an unknown type", field.Label)
+		}
+		field.Options = options
+
+		result = append(result, field)
+	}
+
+	return result, nil
+}
+
+// readCustomFieldValues validates the answers to the guestbook custom fields
+// from a submitted form. Only non-empty answers are returned.
+func readCustomFieldValues(fields []CustomField, r *http.Request) (datatypes.JSONMap, error) {
+	values := datatypes.JSONMap{}
+
+	for _, field := range fields {
+		value := strings.TrimSpace(r.FormValue(field.FormName()))
+
+		switch field.Type {
+		case CustomFieldText:
+			if utf8.RuneCountInString(value) > field.MaxLength {
+				return nil, fmt.Errorf("'%s' is too long, maximum length is %d characters", field.Label, field.MaxLength)
+			}
+		case CustomFieldSelect, CustomFieldEmoji:
+			if value != "" && !slices.Contains(field.Options, value) {
+				return nil, fmt.Errorf("'%s' has an invalid value", field.Label)
+			}
+		case CustomFieldCheckbox:
+			if value == "on" || value == "true" {
+				value = "true"
+			} else {
+				value = ""
+			}
+		}
+
+		if value == "" {
+			if field.Required {
+				return nil, fmt.Errorf("'%s' is required", field.Label)
+			}
+			continue
+		}
+
+		values[field.ID] = value
+	}
+
+	return values, nil
+}
+
+// customFieldAnswers resolves the stored answers of a message against the
+// current field definitions, in the order the owner defined them. Answers to
+// fields that were since removed are skipped.
+func customFieldAnswers(fields []CustomField, values datatypes.JSONMap) []CustomFieldAnswer {
+	if len(values) == 0 {
+		return nil
+	}
+
+	var answers []CustomFieldAnswer
+	for _, field := range fields {
+		value, ok := values[field.ID].(string)
+		if !ok || value == "" {
+			continue
+		}
+		if field.Type == CustomFieldCheckbox {
+			value = "✓"
+		}
+		answers = append(answers, CustomFieldAnswer{
+			FieldID: field.ID,
+			Type:    field.Type,
+			Label:   field.Label,
+			Value:   value,
+		})
+	}
+	return answers
+}
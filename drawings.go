@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"regexp"
+
+	"guestbook/constants"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var drawingHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Drawing is a validated visitor doodle, re-encoded and ready to be stored.
+type Drawing struct {
+	Hash string
+	PNG  []byte
+}
+
+func drawingKey(hash string) string {
+	return "drawings/" + hash + ".png"
+}
+
+func drawingURL(hostURL, hash string) string {
+	return fmt.Sprintf("%s/resources/drawings/%s.png", hostURL, hash)
+}
+
+// readDrawing validates the optional drawing of a submission. The PNG is
+// decoded and re-encoded so that only pixel data is ever stored. It returns
+// nil if no drawing was submitted.
+func readDrawing(guestbook Guestbook, r *http.Request) (*Drawing, error) {
+	file, _, err := r.FormFile("drawing")
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("The drawing could not be read")
+	}
+	defer file.Close()
+
+	if !guestbook.DrawingsEnabled {
+		return nil, errors.New("Drawings are not enabled on this guestbook")
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(file, constants.MAX_DRAWING_BYTES+1))
+	if err != nil {
+		return nil, errors.New("The drawing could not be read")
+	}
+	if len(raw) > constants.MAX_DRAWING_BYTES {
+		return nil, fmt.Errorf("The drawing is too large, maximum size is %d KB", constants.MAX_DRAWING_BYTES/1024)
+	}
+
+	// check the dimensions before decoding the whole image
+	config, err := png.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.New("The drawing must be a PNG image")
+	}
+	if config.Width > constants.MAX_DRAWING_WIDTH || config.Height > constants.MAX_DRAWING_HEIGHT {
+		return nil, fmt.Errorf("The drawing can be at most %dx%d pixels", constants.MAX_DRAWING_WIDTH, constants.MAX_DRAWING_HEIGHT)
+	}
+
+	img, err := png.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.New("The drawing must be a PNG image")
+	}
+
+	var encoded bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&encoded, img); err != nil {
+		return nil, errors.New("The drawing could not be processed")
+	}
+
+	sum := sha256.Sum256(encoded.Bytes())
+	return &Drawing{Hash: hex.EncodeToString(sum[:]), PNG: encoded.Bytes()}, nil
+}
+
+// DrawingHandler serves a drawing as long as an approved message uses it.
+func DrawingHandler(w http.ResponseWriter, r *http.Request) {
+	hash := chi.URLParam(r, "hash")
+	if !drawingHashPattern.MatchString(hash) {
+		http.Error(w, "Drawing not found", http.StatusNotFound)
+		return
+	}
+
+	var count int64
+	result := db.Model(&Message{}).Where("drawing_hash = ? AND approved = ?", hash, true).Count(&count)
+	if result.Error != nil || count == 0 {
+		http.Error(w, "Drawing not found", http.StatusNotFound)
+		return
+	}
+
+	serveUpload(w, r, drawingKey(hash), "image/png", "public, max-age=3600")
+}
+
+// AdminDrawingHandler lets owners see drawings on their guestbook, including
+// the ones waiting for approval.
+func AdminDrawingHandler(w http.ResponseWriter, r *http.Request) {
+	guestbookID := chi.URLParam(r, "guestbookID")
+	hash := chi.URLParam(r, "hash")
+	if !drawingHashPattern.MatchString(hash) {
+		http.Error(w, "Drawing not found", http.StatusNotFound)
+		return
+	}
+
+	var guestbook Guestbook
+	result := db.First(&guestbook, guestbookID)
+	if result.Error != nil {
+		http.Error(w, "Guestbook not found", http.StatusNotFound)
+		return
+	}
+
+	currentUser := getSignedInAdminOrFail(r)
+	if guestbook.AdminUserID != currentUser.ID {
+		http.Error(w, "You don't own this guestbook", http.StatusUnauthorized)
+		return
+	}
+
+	var count int64
+	result = db.Model(&Message{}).Where("drawing_hash = ? AND guestbook_id = ?", hash, guestbook.ID).Count(&count)
+	if result.Error != nil || count == 0 {
+		http.Error(w, "Drawing not found", http.StatusNotFound)
+		return
+	}
+
+	serveUpload(w, r, drawingKey(hash), "image/png", "private, max-age=3600")
+}
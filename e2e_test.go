@@ -1,15 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"guestbook/constants"
+
 	"github.com/go-rod/rod"
 	"github.com/go-rod/rod/lib/launcher"
 	"github.com/spf13/viper"
@@ -56,11 +73,19 @@ func setupTestEnvironment() error {
 	}
 
 	// Migrate the schema
-	err = db.AutoMigrate(&Guestbook{}, &Message{}, &AdminUser{})
+	err = db.AutoMigrate(&Guestbook{}, &Message{}, &AdminUser{}, &Reaction{}, &ThemeAsset{}, &Theme{})
 	if err != nil {
 		return fmt.Errorf("failed to migrate test database: %w", err)
 	}
 
+	if err := syncBuiltInThemes(); err != nil {
+		return fmt.Errorf("failed to sync built-in themes: %w", err)
+	}
+
+	if err := setupMessageSearch(db); err != nil {
+		return fmt.Errorf("failed to set up message search: %w", err)
+	}
+
 	// Initialize cache
 	messageCache, err = NewMessageCache(1000, 5*time.Minute)
 	if err != nil {
@@ -71,8 +96,13 @@ func setupTestEnvironment() error {
 	viper.SetDefault("mail.smtp_host", "localhost")
 	viper.SetDefault("mail.smtp_port", 587)
 
-	// Start test server
-	r := initRouter()
+	// Start test server. The whole suite comes from one address, far more
+	// requests than the general per-IP limit allows. The other limits are
+	// the production ones, tests that exercise them set X-Forwarded-For to an
+	// address of their own.
+	limits := defaultRateLimits
+	limits.General = 100000
+	r := initRouter(limits)
 	testServer = &http.Server{
 		Addr:    testPort,
 		Handler: r,
@@ -1420,3 +1450,3057 @@ func TestDisplayNameOnReplies(t *testing.T) {
 
 	t.Log("Display name test passed!")
 }
+
+// TestVisitorReplyNotificationEmail tests the double opt-in flow for visitor
+// reply notifications and that the email is dropped when the message is deleted.
+func TestVisitorReplyNotificationEmail(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("visitoremail_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("visitoremailtoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	guestbook := Guestbook{
+		WebsiteURL:  "https://visitoremail.com",
+		AdminUserID: user.ID,
+	}
+	db.Create(&guestbook)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// Step 1: Invalid emails are rejected
+	submitURL := fmt.Sprintf("%s/guestbook/%d/submit", testBaseURL, guestbook.ID)
+	resp, err := client.PostForm(submitURL, map[string][]string{
+		"name":  {"Visitor"},
+		"text":  {"Bad email"},
+		"email": {"not-an-email"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid email, got %d", resp.StatusCode)
+	}
+
+	// Step 2: Submit a message with an email
+	visitorEmail := "visitor@example.com"
+	resp, err = client.PostForm(submitURL, map[string][]string{
+		"name":  {"Visitor"},
+		"text":  {"Please tell me when you reply"},
+		"email": {visitorEmail},
+	})
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected redirect after submit, got %d", resp.StatusCode)
+	}
+
+	var message Message
+	db.Where("guestbook_id = ?", guestbook.ID).First(&message)
+	if message.VisitorEmailEncrypted == "" || strings.Contains(message.VisitorEmailEncrypted, visitorEmail) {
+		t.Fatal("Visitor email should be stored encrypted")
+	}
+	if decrypted, err := decryptVisitorEmail(message.VisitorEmailEncrypted); err != nil || decrypted != visitorEmail {
+		t.Errorf("Expected email to decrypt to %q, got %q (err: %v)", visitorEmail, decrypted, err)
+	}
+	if message.VisitorEmailConfirmed {
+		t.Error("Visitor email should not be confirmed before clicking the link")
+	}
+
+	// Step 3: The email is never part of the public API
+	apiResp, err := http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	body, _ := io.ReadAll(apiResp.Body)
+	apiResp.Body.Close()
+	if strings.Contains(string(body), "VisitorEmail") || strings.Contains(string(body), visitorEmail) {
+		t.Error("API response should not contain visitor email data")
+	}
+
+	// Step 4: Opening the confirmation link only asks for confirmation
+	confirmURL := fmt.Sprintf("%s/guestbook/%d/notifications/confirm?token=%s", testBaseURL, guestbook.ID, url.QueryEscape(message.VisitorEmailToken))
+	resp, err = client.Get(confirmURL)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `method="post"`) {
+		t.Errorf("Expected a confirmation form, got %d: %s", resp.StatusCode, body)
+	}
+	db.First(&message, message.ID)
+	if message.VisitorEmailConfirmed {
+		t.Error("Opening the confirmation link must not confirm the email")
+	}
+
+	resp, err = client.Post(confirmURL, "application/x-www-form-urlencoded", nil)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 when confirming, got %d", resp.StatusCode)
+	}
+	db.First(&message, message.ID)
+	if !message.VisitorEmailConfirmed {
+		t.Error("Visitor email should be confirmed after submitting the form")
+	}
+
+	// Step 5: Deleting the message drops the email
+	deleteURL := fmt.Sprintf("%s/admin/guestbook/%d/message/%d/delete", testBaseURL, guestbook.ID, message.ID)
+	req, _ := http.NewRequest("POST", deleteURL, nil)
+	req.Header.Set("Cookie", fmt.Sprintf("admin_token=%s", user.SessionToken))
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+
+	var deleted Message
+	db.Unscoped().First(&deleted, message.ID)
+	if deleted.VisitorEmailEncrypted != "" || deleted.VisitorEmailToken != "" {
+		t.Error("Visitor email should be dropped when the message is deleted")
+	}
+
+	// Step 6: Opening the unsubscribe link only asks for confirmation
+	encrypted, _ := encryptVisitorEmail(visitorEmail)
+	subscribed := Message{
+		Name:                  "Subscriber",
+		Text:                  "Keep me posted",
+		GuestbookID:           guestbook.ID,
+		Approved:              true,
+		VisitorEmailEncrypted: encrypted,
+		VisitorEmailConfirmed: true,
+		VisitorEmailToken:     fmt.Sprintf("unsubscribetoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&subscribed)
+	unsubscribeURL := fmt.Sprintf("%s/guestbook/%d/notifications/unsubscribe?token=%s", testBaseURL, guestbook.ID, url.QueryEscape(subscribed.VisitorEmailToken))
+	resp, err = client.Get(unsubscribeURL)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `method="post"`) {
+		t.Errorf("Expected an unsubscribe form, got %d: %s", resp.StatusCode, body)
+	}
+	db.First(&subscribed, subscribed.ID)
+	if subscribed.VisitorEmailEncrypted == "" {
+		t.Error("Opening the unsubscribe link must not delete the email")
+	}
+
+	// Step 7: Confirming (or a one-click unsubscribe) deletes it
+	resp, err = client.PostForm(unsubscribeURL, url.Values{"List-Unsubscribe": {"One-Click"}})
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	db.First(&subscribed, subscribed.ID)
+	if resp.StatusCode != http.StatusOK || subscribed.VisitorEmailEncrypted != "" || subscribed.VisitorEmailToken != "" {
+		t.Errorf("Expected the email to be deleted after confirming, got %d", resp.StatusCode)
+	}
+
+	t.Log("Visitor reply notification test passed!")
+}
+
+// TestServerRenderedMessages tests that the public guestbook page renders
+// messages and pagination links without JavaScript.
+func TestServerRenderedMessages(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("ssr_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("ssrtoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	guestbook := Guestbook{
+		WebsiteURL:  "https://ssr.com",
+		AdminUserID: user.ID,
+	}
+	db.Create(&guestbook)
+
+	baseTime := time.Now().Add(-time.Hour)
+	for i := 1; i <= 25; i++ {
+		msg := Message{
+			Name:        fmt.Sprintf("SSR User %d", i),
+			Text:        fmt.Sprintf("SSR message number %d", i),
+			GuestbookID: guestbook.ID,
+			Approved:    true,
+		}
+		msg.CreatedAt = baseTime.Add(time.Duration(i) * time.Minute)
+		db.Create(&msg)
+	}
+
+	getPage := func(query string) string {
+		resp, err := http.Get(fmt.Sprintf("%s/guestbook/%d%s", testBaseURL, guestbook.ID, query))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	firstPage := getPage("")
+	if !strings.Contains(firstPage, "SSR message number 25") {
+		t.Error("Newest message should be rendered on the first page")
+	}
+	if strings.Contains(firstPage, "SSR message number 1<") {
+		t.Error("Oldest message should not be rendered on the first page")
+	}
+	if !strings.Contains(firstPage, "?page=2") {
+		t.Error("First page should link to the second page")
+	}
+
+	secondPage := getPage("?page=2")
+	if !strings.Contains(secondPage, "SSR message number 1<") {
+		t.Error("Oldest message should be rendered on the second page")
+	}
+	if !strings.Contains(secondPage, "?page=1") {
+		t.Error("Second page should link back to the first page")
+	}
+
+	t.Log("Server rendered messages test passed!")
+}
+
+// TestMarkdownTextHTML tests that guestbooks with Markdown enabled return a
+// sanitized TextHTML field while keeping Text unchanged.
+func TestMarkdownTextHTML(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("markdown_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("markdowntoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	markdownGuestbook := Guestbook{WebsiteURL: "https://markdown.com", AdminUserID: user.ID, MarkdownEnabled: true}
+	db.Create(&markdownGuestbook)
+	plainGuestbook := Guestbook{WebsiteURL: "https://plain.com", AdminUserID: user.ID}
+	db.Create(&plainGuestbook)
+
+	text := "Hi *there* and **friends**!\n> quoted `code`\n[site](https://example.com) <script>alert(1)</script> [bad](javascript:alert(1))"
+	db.Create(&Message{Name: "Visitor", Text: text, GuestbookID: markdownGuestbook.ID, Approved: true})
+	db.Create(&Message{Name: "Visitor", Text: text, GuestbookID: plainGuestbook.ID, Approved: true})
+
+	fetchMessages := func(guestbookID uint) []Message {
+		resp, err := http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d", testBaseURL, guestbookID))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var body PaginatedMessages
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(body.Messages) != 1 {
+			t.Fatalf("Expected 1 message, got %d", len(body.Messages))
+		}
+		return body.Messages
+	}
+
+	markdownMessage := fetchMessages(markdownGuestbook.ID)[0]
+	if markdownMessage.Text != text {
+		t.Error("Text should be returned unchanged")
+	}
+	for _, expected := range []string{
+		"<em>there</em>",
+		"<strong>friends</strong>",
+		"<blockquote>quoted <code>code</code></blockquote>",
+		`<a href="https://example.com" rel="ugc nofollow" target="_blank">site</a>`,
+		"&lt;script&gt;",
+	} {
+		if !strings.Contains(markdownMessage.TextHTML, expected) {
+			t.Errorf("Expected TextHTML to contain %q, got %q", expected, markdownMessage.TextHTML)
+		}
+	}
+	if strings.Contains(markdownMessage.TextHTML, "<script>") || strings.Contains(markdownMessage.TextHTML, `href="javascript:`) {
+		t.Errorf("TextHTML must not contain unsafe markup, got %q", markdownMessage.TextHTML)
+	}
+
+	plainMessage := fetchMessages(plainGuestbook.ID)[0]
+	if plainMessage.TextHTML != "" {
+		t.Error("TextHTML should be empty when Markdown is disabled")
+	}
+
+	t.Log("Markdown test passed!")
+}
+
+// TestCustomFormFields tests validation of custom field answers on submit and
+// that they're included in the v2 API.
+func TestCustomFormFields(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("customfields_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("customfieldstoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	customFields, err := parseCustomFieldsForm(`[
+		{"id": "color", "type": "select", "label": "Favorite color", "required": true, "options": ["red", "blue"]},
+		{"id": "from", "type": "text", "label": "Where are you from?", "maxLength": 10},
+		{"id": "mood", "type": "emoji", "label": "Mood"},
+		{"id": "human", "type": "checkbox", "label": "I am a human"}
+	]`)
+	if err != nil {
+		t.Fatalf("Failed to parse custom fields: %v", err)
+	}
+	if len(customFields[2].Options) == 0 {
+		t.Error("Emoji fields without options should get the default emoji")
+	}
+
+	if _, err := parseCustomFieldsForm(`[{"type": "select", "label": "No options"}]`); err == nil {
+		t.Error("Select fields without options should be rejected")
+	}
+
+	guestbook := Guestbook{
+		WebsiteURL:   "https://customfields.com",
+		AdminUserID:  user.ID,
+		CustomFields: customFields,
+	}
+	db.Create(&guestbook)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	submitURL := fmt.Sprintf("%s/guestbook/%d/submit", testBaseURL, guestbook.ID)
+
+	invalidSubmissions := map[string]url.Values{
+		"missing required field": {"name": {"Visitor"}, "text": {"Hi"}},
+		"invalid select option":  {"name": {"Visitor"}, "text": {"Hi"}, "custom_color": {"green"}},
+		"text too long":          {"name": {"Visitor"}, "text": {"Hi"}, "custom_color": {"red"}, "custom_from": {"far far away from here"}},
+		"invalid emoji":          {"name": {"Visitor"}, "text": {"Hi"}, "custom_color": {"red"}, "custom_mood": {"x"}},
+	}
+	for name, form := range invalidSubmissions {
+		resp, err := client.PostForm(submitURL, form)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", name, resp.StatusCode)
+		}
+	}
+
+	resp, err := client.PostForm(submitURL, url.Values{
+		"name":         {"Visitor"},
+		"text":         {"Hi"},
+		"custom_color": {"blue"},
+		"custom_from":  {"Lisbon"},
+		"custom_human": {"true"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected redirect after valid submit, got %d", resp.StatusCode)
+	}
+
+	apiResp, err := http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer apiResp.Body.Close()
+
+	var body PaginatedMessages
+	if err := json.NewDecoder(apiResp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(body.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(body.Messages))
+	}
+
+	message := body.Messages[0]
+	if message.CustomFieldValues["color"] != "blue" || message.CustomFieldValues["from"] != "Lisbon" {
+		t.Errorf("Unexpected custom field values: %v", message.CustomFieldValues)
+	}
+	if _, ok := message.CustomFieldValues["mood"]; ok {
+		t.Error("Empty optional answers should not be stored")
+	}
+
+	expectedAnswers := []CustomFieldAnswer{
+		{FieldID: "color", Type: CustomFieldSelect, Label: "Favorite color", Value: "blue"},
+		{FieldID: "from", Type: CustomFieldText, Label: "Where are you from?", Value: "Lisbon"},
+		{FieldID: "human", Type: CustomFieldCheckbox, Label: "I am a human", Value: "✓"},
+	}
+	if fmt.Sprint(message.CustomFieldAnswers) != fmt.Sprint(expectedAnswers) {
+		t.Errorf("Expected answers %v, got %v", expectedAnswers, message.CustomFieldAnswers)
+	}
+
+	pageResp, err := http.Get(fmt.Sprintf("%s/guestbook/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	page, _ := io.ReadAll(pageResp.Body)
+	pageResp.Body.Close()
+	for _, expected := range []string{`name="custom_color"`, `name="custom_mood"`, "Where are you from?: </span>Lisbon"} {
+		if !strings.Contains(string(page), expected) {
+			t.Errorf("Expected guestbook page to contain %q", expected)
+		}
+	}
+
+	t.Log("Custom form fields test passed!")
+}
+
+// TestMessageReactions tests that reactions are deduplicated per visitor and
+// that the cached message responses pick up new counts.
+func TestMessageReactions(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("reactions_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("reactionstoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	reactionEmojis, err := parseReactionEmojis("❤️ ⭐ ❤️")
+	if err != nil || len(reactionEmojis) != 2 {
+		t.Fatalf("Expected 2 unique reaction emoji, got %v (err: %v)", reactionEmojis, err)
+	}
+	if _, err := parseReactionEmojis("like"); err == nil {
+		t.Error("Plain words should not be accepted as reactions")
+	}
+
+	guestbook := Guestbook{
+		WebsiteURL:     "https://reactions.com",
+		AdminUserID:    user.ID,
+		ReactionEmojis: reactionEmojis,
+	}
+	db.Create(&guestbook)
+
+	message := Message{Name: "Visitor", Text: "React to me", GuestbookID: guestbook.ID, Approved: true}
+	db.Create(&message)
+	pending := Message{Name: "Visitor", Text: "Not approved", GuestbookID: guestbook.ID, Approved: false}
+	db.Create(&pending)
+
+	fetchReactions := func(version string) map[string]int64 {
+		resp, err := http.Get(fmt.Sprintf("%s/api/%s/get-guestbook-messages/%d", testBaseURL, version, guestbook.ID))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var messages []Message
+		if version == "v1" {
+			err = json.NewDecoder(resp.Body).Decode(&messages)
+		} else {
+			var body PaginatedMessages
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			messages = body.Messages
+		}
+		if err != nil || len(messages) != 1 {
+			t.Fatalf("Expected 1 message from %s (err: %v)", version, err)
+		}
+		return messages[0].Reactions
+	}
+
+	react := func(messageID uint, emoji, visitorIP string) *http.Response {
+		req, _ := http.NewRequest("POST",
+			fmt.Sprintf("%s/guestbook/%d/message/%d/react", testBaseURL, guestbook.ID, messageID),
+			strings.NewReader(url.Values{"emoji": {emoji}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", visitorIP)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		return resp
+	}
+
+	// Prime the caches
+	if reactions := fetchReactions("v1"); len(reactions) != 0 {
+		t.Errorf("Expected no reactions yet, got %v", reactions)
+	}
+	fetchReactions("v2")
+
+	if resp := react(message.ID, "❤️", "203.0.113.1"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 for reaction, got %d", resp.StatusCode)
+	}
+	react(message.ID, "❤️", "203.0.113.1")
+	react(message.ID, "❤️", "203.0.113.2")
+	react(message.ID, "⭐", "203.0.113.1")
+
+	if resp := react(message.ID, "👎", "203.0.113.1"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a reaction that isn't allowed, got %d", resp.StatusCode)
+	}
+	if resp := react(pending.ID, "❤️", "203.0.113.1"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for reacting to an unapproved message, got %d", resp.StatusCode)
+	}
+
+	for _, version := range []string{"v1", "v2"} {
+		reactions := fetchReactions(version)
+		if reactions["❤️"] != 2 || reactions["⭐"] != 1 {
+			t.Errorf("Unexpected reaction counts from %s: %v", version, reactions)
+		}
+	}
+
+	var stored []Reaction
+	db.Where("message_id = ?", message.ID).Find(&stored)
+	for _, reaction := range stored {
+		if strings.Contains(reaction.VisitorHash, "203.0.113") {
+			t.Error("Visitor IP addresses should not be stored")
+		}
+	}
+
+	// the reactions go with their message
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/admin/guestbook/%d/message/%d/delete", testBaseURL, guestbook.ID, message.ID), nil)
+	req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	var remaining int64
+	db.Model(&Reaction{}).Where("message_id = ?", message.ID).Count(&remaining)
+	if resp.StatusCode != http.StatusSeeOther || remaining != 0 {
+		t.Errorf("Expected the reactions to be deleted with the message, got %d and %d reactions left", resp.StatusCode, remaining)
+	}
+
+	t.Log("Message reactions test passed!")
+}
+
+// TestPinnedMessages tests that pinned messages come first in both APIs and
+// are not repeated when paging.
+func TestPinnedMessages(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("pinned_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("pinnedtoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	guestbook := Guestbook{WebsiteURL: "https://pinned.com", AdminUserID: user.ID}
+	db.Create(&guestbook)
+
+	baseTime := time.Now().Add(-time.Hour)
+	var messages []Message
+	for i := 0; i < 5; i++ {
+		message := Message{
+			Name:        fmt.Sprintf("Visitor %d", i),
+			Text:        "Hello",
+			GuestbookID: guestbook.ID,
+			Approved:    true,
+		}
+		message.CreatedAt = baseTime.Add(time.Duration(i) * time.Minute)
+		db.Create(&message)
+		messages = append(messages, message)
+	}
+
+	// Prime the cache, then pin the oldest message through the admin UI
+	http.Get(fmt.Sprintf("%s/api/v1/get-guestbook-messages/%d", testBaseURL, guestbook.ID))
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/admin/guestbook/%d/message/%d/pin", testBaseURL, guestbook.ID, messages[0].ID), nil)
+	req.Header.Set("Cookie", fmt.Sprintf("admin_token=%s", user.SessionToken))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected redirect after pinning, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("%s/api/v1/get-guestbook-messages/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	var v1Messages []Message
+	json.NewDecoder(resp.Body).Decode(&v1Messages)
+	resp.Body.Close()
+	if len(v1Messages) != 5 || v1Messages[0].ID != messages[0].ID || !v1Messages[0].Pinned {
+		t.Fatalf("Expected the pinned message first in v1")
+	}
+	if v1Messages[1].ID != messages[4].ID {
+		t.Errorf("Expected the newest message after the pinned one")
+	}
+
+	// Page through v2 two messages at a time
+	seen := map[uint]bool{}
+	var order []uint
+	for page := 1; page <= 3; page++ {
+		resp, err := http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d?page=%d&limit=2", testBaseURL, guestbook.ID, page))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		var body PaginatedMessages
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		for _, message := range body.Messages {
+			if seen[message.ID] {
+				t.Errorf("Message %d was returned twice while paging", message.ID)
+			}
+			seen[message.ID] = true
+			order = append(order, message.ID)
+		}
+	}
+	if len(order) != 5 || order[0] != messages[0].ID {
+		t.Errorf("Expected all 5 messages with the pinned one first, got %v", order)
+	}
+
+	t.Log("Pinned messages test passed!")
+}
+
+// TestVisitorThreadedReplies tests that visitors can reply to messages up to
+// the configured depth, and that the API returns the nested tree.
+func TestVisitorThreadedReplies(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("threads_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("threadstoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	guestbook := Guestbook{
+		WebsiteURL:            "https://threads.com",
+		AdminUserID:           user.ID,
+		VisitorRepliesEnabled: true,
+		MaxReplyDepth:         2,
+		ChallengeQuestion:     "What color is the sky?",
+		ChallengeAnswer:       "blue",
+	}
+	db.Create(&guestbook)
+
+	closedGuestbook := Guestbook{WebsiteURL: "https://nothreads.com", AdminUserID: user.ID}
+	db.Create(&closedGuestbook)
+
+	topMessage := Message{Name: "Visitor", Text: "First!", GuestbookID: guestbook.ID, Approved: true}
+	db.Create(&topMessage)
+	closedMessage := Message{Name: "Visitor", Text: "First!", GuestbookID: closedGuestbook.ID, Approved: true}
+	db.Create(&closedMessage)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	reply := func(guestbookID, parentID uint, answer string) int {
+		resp, err := client.PostForm(fmt.Sprintf("%s/guestbook/%d/submit", testBaseURL, guestbookID), url.Values{
+			"name":                    {"Replier"},
+			"text":                    {"A reply"},
+			"parentMessageID":         {fmt.Sprint(parentID)},
+			"challengeQuestionAnswer": {answer},
+		})
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := reply(closedGuestbook.ID, closedMessage.ID, ""); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 when visitor replies are disabled, got %d", status)
+	}
+	if status := reply(guestbook.ID, topMessage.ID, "green"); status != http.StatusUnauthorized {
+		t.Errorf("Expected replies to go through the challenge question, got %d", status)
+	}
+	if status := reply(guestbook.ID, closedMessage.ID, "blue"); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 when replying to a message from another guestbook, got %d", status)
+	}
+
+	if status := reply(guestbook.ID, topMessage.ID, "blue"); status != http.StatusSeeOther {
+		t.Fatalf("Expected reply to be accepted, got %d", status)
+	}
+	var firstReply Message
+	db.Where("parent_message_id = ?", topMessage.ID).First(&firstReply)
+
+	if status := reply(guestbook.ID, firstReply.ID, "blue"); status != http.StatusSeeOther {
+		t.Fatalf("Expected nested reply to be accepted, got %d", status)
+	}
+	var secondReply Message
+	db.Where("parent_message_id = ?", firstReply.ID).First(&secondReply)
+
+	if status := reply(guestbook.ID, secondReply.ID, "blue"); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a reply deeper than the limit, got %d", status)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body PaginatedMessages
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(body.Messages) != 1 {
+		t.Fatalf("Expected only the top-level message at the top level, got %d", len(body.Messages))
+	}
+
+	top := body.Messages[0]
+	if !top.CanReply || len(top.Replies) != 1 || len(top.Replies[0].Replies) != 1 {
+		t.Fatalf("Expected a two level reply tree, got %+v", top.Replies)
+	}
+	if !top.Replies[0].CanReply || top.Replies[0].Replies[0].CanReply {
+		t.Error("Only messages above the depth limit should be repliable")
+	}
+
+	t.Log("Threaded visitor replies test passed!")
+}
+
+// TestVisitorEditToken tests that visitors can edit and delete their own
+// message with the token returned on submit, only within the edit window.
+func TestVisitorEditToken(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("edittoken_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("edittokentoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	guestbook := Guestbook{WebsiteURL: "https://edittoken.com", AdminUserID: user.ID, EditWindowMinutes: 10}
+	db.Create(&guestbook)
+	closedGuestbook := Guestbook{WebsiteURL: "https://noedits.com", AdminUserID: user.ID}
+	db.Create(&closedGuestbook)
+
+	submit := func(guestbookID uint) (SubmitResponse, *http.Response) {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/guestbook/%d/submit", testBaseURL, guestbookID),
+			strings.NewReader(url.Values{"name": {"Visitor"}, "text": {"Helo!"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var body SubmitResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Expected a JSON response, got error: %v", err)
+		}
+		return body, resp
+	}
+
+	change := func(messageID uint, action string, form url.Values, cookie string) int {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/guestbook/%d/message/%d/%s", testBaseURL, guestbook.ID, messageID, action),
+			strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if body, _ := submit(closedGuestbook.ID); body.EditToken != "" {
+		t.Error("No edit token should be issued when the edit window is disabled")
+	}
+
+	submitted, resp := submit(guestbook.ID)
+	if submitted.EditToken == "" || submitted.EditableUntil == nil {
+		t.Fatal("Expected an edit token in the submit response")
+	}
+	var editCookie string
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == editTokenCookieName(submitted.ID) && cookie.Value == submitted.EditToken {
+			editCookie = cookie.Name + "=" + cookie.Value
+		}
+	}
+	if editCookie == "" {
+		t.Error("Expected the edit token to also be set as a cookie")
+	}
+
+	// Prime the cache
+	http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d", testBaseURL, guestbook.ID))
+
+	if status := change(submitted.ID, "edit", url.Values{"editToken": {"wrong"}, "text": {"Hacked"}}, ""); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a wrong token, got %d", status)
+	}
+	if status := change(submitted.ID, "edit", url.Values{"editToken": {submitted.EditToken}, "text": {"Hello!"}}, ""); status != http.StatusOK {
+		t.Fatalf("Expected edit to succeed, got %d", status)
+	}
+
+	apiResp, err := http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	var body PaginatedMessages
+	json.NewDecoder(apiResp.Body).Decode(&body)
+	apiResp.Body.Close()
+	if len(body.Messages) != 1 || body.Messages[0].Text != "Hello!" {
+		t.Errorf("Expected the edited text after cache invalidation, got %+v", body.Messages)
+	}
+
+	// Edits go back into the approval queue when approval is required
+	db.Model(&Guestbook{}).Where("id = ?", guestbook.ID).Update("requires_approval", true)
+	change(submitted.ID, "edit", url.Values{"editToken": {submitted.EditToken}, "text": {"Hello again!"}}, "")
+	var edited Message
+	db.First(&edited, submitted.ID)
+	if edited.Approved {
+		t.Error("Edited message should need approval again")
+	}
+
+	// The window closes
+	db.Model(&Message{}).Where("id = ?", submitted.ID).Update("created_at", time.Now().Add(-11*time.Minute))
+	if status := change(submitted.ID, "delete", nil, editCookie); status != http.StatusForbidden {
+		t.Errorf("Expected 403 after the edit window, got %d", status)
+	}
+
+	// The cookie works as well as the form token
+	db.Model(&Message{}).Where("id = ?", submitted.ID).Update("created_at", time.Now())
+	if status := change(submitted.ID, "delete", nil, editCookie); status != http.StatusNoContent {
+		t.Errorf("Expected delete with the cookie to succeed, got %d", status)
+	}
+	if result := db.First(&Message{}, submitted.ID); result.Error == nil {
+		t.Error("Message should have been deleted")
+	}
+
+	t.Log("Visitor edit token test passed!")
+}
+
+// TestAuthorAvatars tests that avatar URLs are deterministic per author and
+// don't contain the author details, and that avatars are cacheable.
+func TestAuthorAvatars(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("avatars_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("avatarstoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	guestbook := Guestbook{WebsiteURL: "https://avatars.com", AdminUserID: user.ID, AvatarStyle: AvatarStyleIdenticon}
+	db.Create(&guestbook)
+
+	website := "https://alice.example"
+	db.Create(&Message{Name: "Alice", Text: "One", Website: &website, GuestbookID: guestbook.ID, Approved: true})
+	db.Create(&Message{Name: "Alice", Text: "Two", Website: &website, GuestbookID: guestbook.ID, Approved: true})
+	db.Create(&Message{Name: "Bob", Text: "Three", GuestbookID: guestbook.ID, Approved: true})
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	var body PaginatedMessages
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if len(body.Messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(body.Messages))
+	}
+
+	avatars := map[string]string{}
+	for _, message := range body.Messages {
+		if message.AvatarURL == "" {
+			t.Fatal("Expected an avatar URL on every message")
+		}
+		if !strings.HasPrefix(message.AvatarURL, "//localhost"+testPort+"/") {
+			t.Errorf("Expected the avatar to be served by the test server, got %s", message.AvatarURL)
+		}
+		lowerURL := strings.ToLower(message.AvatarURL)
+		if strings.Contains(lowerURL, "alice") || strings.Contains(lowerURL, "bob") {
+			t.Errorf("Avatar URL must not reveal the author: %s", message.AvatarURL)
+		}
+		if previous, ok := avatars[message.Name]; ok && previous != message.AvatarURL {
+			t.Error("The same author should always get the same avatar")
+		}
+		avatars[message.Name] = message.AvatarURL
+	}
+	if avatars["Alice"] == avatars["Bob"] {
+		t.Error("Different authors should get different avatars")
+	}
+
+	avatarPath := avatars["Alice"][strings.Index(avatars["Alice"], "/resources/avatar/"):]
+	avatarResp, err := http.Get(testBaseURL + avatarPath)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	svg, _ := io.ReadAll(avatarResp.Body)
+	avatarResp.Body.Close()
+	if avatarResp.StatusCode != http.StatusOK || !strings.HasPrefix(string(svg), "<svg") {
+		t.Fatalf("Expected an SVG avatar, got %d", avatarResp.StatusCode)
+	}
+	if !strings.Contains(avatarResp.Header.Get("Cache-Control"), "immutable") {
+		t.Errorf("Expected long-lived caching headers, got %q", avatarResp.Header.Get("Cache-Control"))
+	}
+
+	for _, path := range []string{"/resources/avatar/unknown/00112233445566778899aabbccddeeff.svg", "/resources/avatar/identicon/not-a-hash.svg"} {
+		resp, err := http.Get(testBaseURL + path)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+
+	t.Log("Author avatars test passed!")
+}
+
+func TestVisitorDrawings(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("drawings_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("drawingstoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	guestbook := Guestbook{WebsiteURL: "https://drawings.com", AdminUserID: user.ID, RequiresApproval: true, DrawingsEnabled: true}
+	db.Create(&guestbook)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	drawingPNG := func(width, height int) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		img.Set(1, 1, color.RGBA{R: 255, A: 255})
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+		return buf.Bytes()
+	}
+
+	submit := func(guestbookID uint, drawing []byte) *http.Response {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		writer.WriteField("name", "Doodler")
+		writer.WriteField("text", "Look at my drawing")
+		part, _ := writer.CreateFormFile("drawing", "drawing.png")
+		part.Write(drawing)
+		writer.Close()
+
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/guestbook/%d/submit", testBaseURL, guestbookID), &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// invalid drawings are rejected
+	if resp := submit(guestbook.ID, []byte("not a png")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a non-PNG drawing, got %d", resp.StatusCode)
+	}
+	if resp := submit(guestbook.ID, drawingPNG(constants.MAX_DRAWING_WIDTH+1, 10)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an oversized drawing, got %d", resp.StatusCode)
+	}
+	if resp := submit(guestbook.ID, bytes.Repeat([]byte{0}, constants.MAX_SUBMIT_BODY_BYTES+1)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a huge submission, got %d", resp.StatusCode)
+	}
+
+	noDrawings := Guestbook{WebsiteURL: "https://nodrawings.com", AdminUserID: user.ID}
+	db.Create(&noDrawings)
+	if resp := submit(noDrawings.ID, drawingPNG(10, 10)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 when drawings are disabled, got %d", resp.StatusCode)
+	}
+
+	if resp := submit(guestbook.ID, drawingPNG(100, 50)); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after submitting, got %d", resp.StatusCode)
+	}
+
+	var message Message
+	db.Where("guestbook_id = ?", guestbook.ID).First(&message)
+	if message.DrawingHash == "" {
+		t.Fatal("Expected the drawing to be stored with the message")
+	}
+	storedFile, err := uploadStorage.Open(drawingKey(message.DrawingHash))
+	if err != nil {
+		t.Fatalf("Expected the drawing file to exist: %v", err)
+	}
+	stored, _ := io.ReadAll(storedFile)
+	storedFile.Close()
+	if config, err := png.DecodeConfig(bytes.NewReader(stored)); err != nil || config.Width != 100 || config.Height != 50 {
+		t.Errorf("Expected the stored drawing to be a 100x50 PNG, got %+v (%v)", config, err)
+	}
+
+	drawingURLPath := fmt.Sprintf("/resources/drawings/%s.png", message.DrawingHash)
+	getDrawing := func(path string, withSession bool) *http.Response {
+		req, _ := http.NewRequest("GET", testBaseURL+path, nil)
+		if withSession {
+			req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// pending drawings are only visible to the owner
+	if resp := getDrawing(drawingURLPath, false); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a drawing on a pending message, got %d", resp.StatusCode)
+	}
+	adminPath := fmt.Sprintf("/admin/guestbook/%d/drawing/%s.png", guestbook.ID, message.DrawingHash)
+	if resp := getDrawing(adminPath, true); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the owner to see the pending drawing, got %d", resp.StatusCode)
+	}
+
+	db.Model(&message).Update("approved", true)
+	resp := getDrawing(drawingURLPath, false)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Expected the approved drawing to be served as PNG, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	apiResp, err := http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	var body PaginatedMessages
+	json.NewDecoder(apiResp.Body).Decode(&body)
+	apiResp.Body.Close()
+	if len(body.Messages) != 1 || !strings.HasSuffix(body.Messages[0].DrawingURL, drawingURLPath) {
+		t.Errorf("Expected the API to include the drawing URL, got %+v", body.Messages)
+	}
+
+	// deleting the message deletes the drawing
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/admin/guestbook/%d/message/%d/delete", testBaseURL, guestbook.ID, message.ID), nil)
+	req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+	deleteResp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	deleteResp.Body.Close()
+	if _, err := os.Stat(filepath.Join(constants.UPLOADS_DIR, "drawings", message.DrawingHash+".png")); !os.IsNotExist(err) {
+		t.Error("Expected the drawing file to be removed with its message")
+	}
+	if resp := getDrawing(drawingURLPath, false); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 after the message was deleted, got %d", resp.StatusCode)
+	}
+
+	// a submission that can't be saved leaves no file behind
+	drawingsDir := filepath.Join(constants.UPLOADS_DIR, "drawings")
+	before, _ := os.ReadDir(drawingsDir)
+	db.Callback().Create().Before("gorm:create").Register("test:fail_create", func(tx *gorm.DB) {
+		tx.AddError(errors.New("insert failed"))
+	})
+	failedResp := submit(guestbook.ID, drawingPNG(120, 60))
+	db.Callback().Create().Remove("test:fail_create")
+	if failedResp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when the message can't be saved, got %d", failedResp.StatusCode)
+	}
+	if after, _ := os.ReadDir(drawingsDir); len(after) != len(before) {
+		t.Errorf("Expected no drawing to be stored for a failed submission, had %d files and now %d", len(before), len(after))
+	}
+
+	t.Log("Visitor drawings test passed!")
+}
+
+func TestImageAttachments(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("images_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("imagestoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	guestbook := Guestbook{WebsiteURL: "https://images.com", AdminUserID: user.ID, ImagesEnabled: true}
+	db.Create(&guestbook)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// a JPEG with an EXIF segment that must not survive the upload
+	photo := image.NewRGBA(image.Rect(0, 0, 800, 400))
+	for x := 0; x < 800; x++ {
+		photo.Set(x, x%400, color.RGBA{B: 255, A: 255})
+	}
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, photo, nil)
+	exifPayload := append([]byte("Exif\x00\x00"), []byte("SECRET-GPS-LOCATION")...)
+	exifSegment := append([]byte{0xFF, 0xE1, byte((len(exifPayload) + 2) >> 8), byte(len(exifPayload) + 2)}, exifPayload...)
+	photoWithExif := append(append([]byte{0xFF, 0xD8}, exifSegment...), encoded.Bytes()[2:]...)
+
+	submit := func(guestbookID uint, filename string, data []byte) *http.Response {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		writer.WriteField("name", "Photographer")
+		writer.WriteField("text", "Here is a photo")
+		part, _ := writer.CreateFormFile("image", filename)
+		part.Write(data)
+		writer.Close()
+
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/guestbook/%d/submit", testBaseURL, guestbookID), &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// the type is checked by decoding, not by the file name
+	if resp := submit(guestbook.ID, "photo.jpg", []byte("<script>alert(1)</script>")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a file that isn't an image, got %d", resp.StatusCode)
+	}
+
+	if resp := submit(guestbook.ID, "photo.jpg", photoWithExif); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after submitting, got %d", resp.StatusCode)
+	}
+
+	var message Message
+	db.Where("guestbook_id = ?", guestbook.ID).First(&message)
+	if !strings.HasSuffix(message.ImageName, ".jpg") || message.ImageSize <= 0 {
+		t.Fatalf("Expected the image to be stored with the message, got %q (%d bytes)", message.ImageName, message.ImageSize)
+	}
+
+	readUpload := func(key string) []byte {
+		file, err := uploadStorage.Open(key)
+		if err != nil {
+			t.Fatalf("Expected %s to be stored: %v", key, err)
+		}
+		defer file.Close()
+		data, _ := io.ReadAll(file)
+		return data
+	}
+
+	stored := readUpload(imageKey(message.ImageName))
+	if bytes.Contains(stored, []byte("SECRET-GPS-LOCATION")) {
+		t.Error("Expected EXIF data to be stripped from the stored image")
+	}
+	thumbConfig, err := jpeg.DecodeConfig(bytes.NewReader(readUpload(imageThumbnailKey(message.ImageName))))
+	if err != nil || thumbConfig.Width != constants.IMAGE_THUMBNAIL_SIZE || thumbConfig.Height != constants.IMAGE_THUMBNAIL_SIZE/2 {
+		t.Errorf("Expected a %dx%d thumbnail, got %+v (%v)", constants.IMAGE_THUMBNAIL_SIZE, constants.IMAGE_THUMBNAIL_SIZE/2, thumbConfig, err)
+	}
+
+	apiResp, err := http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	var body PaginatedMessages
+	json.NewDecoder(apiResp.Body).Decode(&body)
+	apiResp.Body.Close()
+	if len(body.Messages) != 1 || body.Messages[0].ImageURL == "" || body.Messages[0].ImageThumbnailURL == "" {
+		t.Fatalf("Expected the API to include the image URLs, got %+v", body.Messages)
+	}
+
+	thumbURL := body.Messages[0].ImageThumbnailURL
+	thumbResp, err := http.Get("http:" + thumbURL)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	thumbResp.Body.Close()
+	if thumbResp.StatusCode != http.StatusOK || thumbResp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Expected the thumbnail to be served as JPEG, got %d %q", thumbResp.StatusCode, thumbResp.Header.Get("Content-Type"))
+	}
+
+	// the server rendered page shows the thumbnail once
+	pageResp, err := http.Get(fmt.Sprintf("%s/guestbook/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	page, _ := io.ReadAll(pageResp.Body)
+	pageResp.Body.Close()
+	if count := strings.Count(string(page), thumbURL); count != 1 {
+		t.Errorf("Expected the page to show the image thumbnail once, found it %d times", count)
+	}
+
+	// a submission that can't be saved leaves no image behind
+	other := image.NewRGBA(image.Rect(0, 0, 300, 300))
+	other.Set(10, 10, color.RGBA{G: 255, A: 255})
+	var otherPNG bytes.Buffer
+	png.Encode(&otherPNG, other)
+	imagesDir := filepath.Join(constants.UPLOADS_DIR, "images")
+	before, _ := os.ReadDir(imagesDir)
+	db.Callback().Create().Before("gorm:create").Register("test:fail_create", func(tx *gorm.DB) {
+		tx.AddError(errors.New("insert failed"))
+	})
+	failedResp := submit(guestbook.ID, "other.png", otherPNG.Bytes())
+	db.Callback().Create().Remove("test:fail_create")
+	if failedResp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when the message can't be saved, got %d", failedResp.StatusCode)
+	}
+	if after, _ := os.ReadDir(imagesDir); len(after) != len(before) {
+		t.Errorf("Expected no image to be stored for a failed submission, had %d files and now %d", len(before), len(after))
+	}
+
+	// uploads are refused once the owner's quota is used up
+	db.Create(&Message{Name: "Big", Text: "Big", GuestbookID: guestbook.ID, ImageSize: constants.USER_STORAGE_QUOTA_BYTES})
+	if resp := submit(guestbook.ID, "photo.jpg", photoWithExif); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 once the storage quota is used up, got %d", resp.StatusCode)
+	}
+
+	// deleting the message deletes the image and its thumbnail
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/admin/guestbook/%d/message/%d/delete", testBaseURL, guestbook.ID, message.ID), nil)
+	req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+	deleteResp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	deleteResp.Body.Close()
+	for _, key := range []string{imageKey(message.ImageName), imageThumbnailKey(message.ImageName)} {
+		if file, err := uploadStorage.Open(key); err == nil {
+			file.Close()
+			t.Errorf("Expected %s to be removed with its message", key)
+		}
+	}
+
+	t.Log("Image attachments test passed!")
+}
+
+func TestCustomCSSSanitizer(t *testing.T) {
+	// every built-in theme must pass the sanitizer unchanged in meaning
+	themes, _ := filepath.Glob(filepath.Join(constants.BUILT_IN_THEMES_DIR, "*.css"))
+	if len(themes) == 0 {
+		t.Fatal("Expected built-in themes to check")
+	}
+	for _, theme := range themes {
+		css, _ := os.ReadFile(theme)
+		if ok, msg := validateCSS(string(css)); !ok {
+			t.Errorf("Built-in theme %s was rejected: %s", theme, msg)
+		}
+	}
+
+	allowed := []string{
+		`body { background: url("/assets/user/1/` + strings.Repeat("a", 64) + `.png") no-repeat; }`,
+		`@font-face { font-family: Mine; src: url(` + constants.PUBLIC_URL + `/assets/user/1/` + strings.Repeat("b", 64) + `.woff2) format("woff2"); }`,
+		`@media (max-width: 600px) { .a:not(.b) > p::before { content: "</style>"; color: var(--x) !important; } }`,
+		`@keyframes fade { from { opacity: 0 } to { opacity: 1 } }`,
+	}
+	for _, css := range allowed {
+		out, violations := sanitizeCSS(css)
+		if len(violations) > 0 {
+			t.Errorf("Expected %q to be allowed, got %v", css, violations)
+		}
+		if strings.Contains(out, "</") {
+			t.Errorf("Sanitized CSS must never contain '</': %q", out)
+		}
+	}
+
+	rejected := map[string]CSSViolation{
+		"a {\n  color: red;\n  behavior: url(x.htc);\n}":                                    {Line: 3, Column: 3},
+		`a { width: expression(alert(1)); }`:                                                {Line: 1, Column: 12},
+		`a { background: url("https://evil.example/x.png"); }`:                              {Line: 1, Column: 21},
+		`a { background: u\72l(javascript:alert(1)); }`:                                     {Line: 1, Column: 17},
+		`a { background: url(/**/"javascript:alert(1)"); }`:                                 {Line: 1, Column: 17},
+		"@import url(https://evil.example/x.css);\na { color: red; }":                       {Line: 1, Column: 1},
+		"a { color: red; }\n</style><script>alert(1)</script>":                              {Line: 2, Column: 1},
+		`a { background: url("data:image/svg+xml;base64,PHN2Zz4="); }`:                      {Line: 1, Column: 21},
+		`a { background-image: url(data:image/png;base64,iVBORw0KGgo=); }`:                  {Line: 1, Column: 23},
+		`a { background: url("https://fonts.gstatic.com/s/mine.woff2"); }`:                  {Line: 1, Column: 21},
+		`a { background: url("/assets/css/admin-styles.css"); }`:                            {Line: 1, Column: 21},
+		`a { background: url("/assets/user/1/../2/` + strings.Repeat("a", 64) + `.png"); }`: {Line: 1, Column: 21},
+	}
+	for css, expected := range rejected {
+		out, violations := sanitizeCSS(css)
+		if len(violations) == 0 {
+			t.Errorf("Expected %q to be rejected", css)
+			continue
+		}
+		if violations[0].Line != expected.Line || violations[0].Column != expected.Column {
+			t.Errorf("Expected the violation in %q at %d:%d, got %v", css, expected.Line, expected.Column, violations[0])
+		}
+		for _, banned := range []string{"behavior", "expression", "evil", "javascript", "<script", "svg"} {
+			if strings.Contains(out, banned) {
+				t.Errorf("Sanitized CSS of %q still contains %q: %q", css, banned, out)
+			}
+		}
+	}
+
+	// saving rejected CSS reports where the problem is
+	user := AdminUser{
+		Username:     fmt.Sprintf("css_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("csstoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+	guestbook := Guestbook{WebsiteURL: "https://css.com", AdminUserID: user.ID}
+	db.Create(&guestbook)
+
+	form := url.Values{"websiteURL": {"https://css.com"}, "customPageCSS": {"a {\n  color: red;\n  behavior: url(x.htc);\n}"}}
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/admin/guestbook/%d/edit", testBaseURL, guestbook.ID), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "line 3, column 3") {
+		t.Errorf("Expected a 400 pointing at line 3, column 3, got %d: %s", resp.StatusCode, body)
+	}
+
+	// CSS stored before the sanitizer existed is still cleaned when rendered
+	db.Model(&guestbook).Update("custom_page_css", "body { color: red; behavior: url(x.htc); }")
+	pageResp, err := http.Get(fmt.Sprintf("%s/guestbook/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	page, _ := io.ReadAll(pageResp.Body)
+	pageResp.Body.Close()
+	if strings.Contains(string(page), "behavior") || !strings.Contains(string(page), "color: red") {
+		t.Error("Expected the guestbook page to only include the sanitized CSS")
+	}
+
+	t.Log("Custom CSS sanitizer test passed!")
+}
+
+func TestThemeAssets(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("assets_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("assetstoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	upload := func(filename string, data []byte) *http.Response {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		part, _ := writer.CreateFormFile("asset", filename)
+		part.Write(data)
+		writer.Close()
+
+		req, _ := http.NewRequest("POST", testBaseURL+"/admin/assets", &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	var background bytes.Buffer
+	png.Encode(&background, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	font := append([]byte("wOF2"), bytes.Repeat([]byte{1}, 64)...)
+
+	// the type is checked from the content, not the file name
+	if resp := upload("evil.woff2", []byte("<svg onload=alert(1)>")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a file that isn't a font or image, got %d", resp.StatusCode)
+	}
+	if resp := upload("bg.png", background.Bytes()); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after uploading, got %d", resp.StatusCode)
+	}
+	if resp := upload("font.bin", font); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after uploading, got %d", resp.StatusCode)
+	}
+
+	var assets []ThemeAsset
+	db.Where("admin_user_id = ?", user.ID).Order("id").Find(&assets)
+	if len(assets) != 2 || assets[0].Extension != "png" || assets[1].Extension != "woff2" {
+		t.Fatalf("Expected a png and a woff2 asset, got %+v", assets)
+	}
+
+	// the list shows the paths to use in CSS
+	req, _ := http.NewRequest("GET", testBaseURL+"/admin/assets", nil)
+	req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+	listResp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	list, _ := io.ReadAll(listResp.Body)
+	listResp.Body.Close()
+	if !strings.Contains(string(list), assets[0].Path()) || !strings.Contains(string(list), "bg.png") {
+		t.Error("Expected the asset list to show the uploaded assets")
+	}
+
+	fontResp, err := http.Get(testBaseURL + assets[1].Path())
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	served, _ := io.ReadAll(fontResp.Body)
+	fontResp.Body.Close()
+	if fontResp.StatusCode != http.StatusOK || !bytes.Equal(served, font) {
+		t.Fatalf("Expected the font to be served, got %d", fontResp.StatusCode)
+	}
+	if fontResp.Header.Get("Content-Type") != "font/woff2" || fontResp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("Unexpected headers for the font: %v", fontResp.Header)
+	}
+	if !strings.Contains(fontResp.Header.Get("Cache-Control"), "immutable") {
+		t.Errorf("Expected content addressed assets to be cached forever, got %q", fontResp.Header.Get("Cache-Control"))
+	}
+
+	// uploaded assets can be used from custom CSS, nothing else can
+	css := fmt.Sprintf("@font-face { font-family: Mine; src: url(%s) format(\"woff2\"); }\nbody { background: url(%q); }", assets[1].Path(), constants.PUBLIC_URL+assets[0].Path())
+	if ok, msg := validateCSS(css); !ok {
+		t.Errorf("Expected CSS using uploaded assets to be valid: %s", msg)
+	}
+	if ok, _ := validateCSS(`body { background: url("https://example.com/bg.png"); }`); ok {
+		t.Error("Expected CSS loading other URLs to be rejected")
+	}
+
+	// uploads count towards the storage quota
+	filler := ThemeAsset{AdminUserID: user.ID, Name: "filler", Hash: strings.Repeat("f", 64), Extension: "png", Size: constants.USER_STORAGE_QUOTA_BYTES}
+	db.Create(&filler)
+	if resp := upload("bg2.png", background.Bytes()); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 once the quota is used up, got %d", resp.StatusCode)
+	}
+	db.Unscoped().Delete(&filler)
+
+	// other users can't delete the asset
+	other := AdminUser{
+		Username:     fmt.Sprintf("assets_other_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("assetsothertoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&other)
+	req, _ = http.NewRequest("POST", fmt.Sprintf("%s/admin/assets/%d/delete", testBaseURL, assets[1].ID), nil)
+	req.Header.Set("Cookie", "admin_token="+other.SessionToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 when deleting another user's asset, got %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("POST", fmt.Sprintf("%s/admin/assets/%d/delete", testBaseURL, assets[1].ID), nil)
+	req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after deleting, got %d", resp.StatusCode)
+	}
+
+	goneResp, err := http.Get(testBaseURL + assets[1].Path())
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	goneResp.Body.Close()
+	if goneResp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a deleted asset, got %d", goneResp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(constants.UPLOADS_DIR, assets[1].key())); !os.IsNotExist(err) {
+		t.Error("Expected the deleted asset's file to be removed")
+	}
+
+	// an upload that can't be saved leaves no file behind
+	db.Callback().Create().Before("gorm:create").Register("test:fail_create", func(tx *gorm.DB) {
+		tx.AddError(errors.New("insert failed"))
+	})
+	failedResp := upload("font.bin", font)
+	db.Callback().Create().Remove("test:fail_create")
+	if failedResp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when the asset can't be saved, got %d", failedResp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(constants.UPLOADS_DIR, assets[1].key())); !os.IsNotExist(err) {
+		t.Error("Expected no file to be stored for a failed upload")
+	}
+
+	t.Log("Theme assets test passed!")
+}
+
+func TestThemeGallery(t *testing.T) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	newUser := func(prefix string) AdminUser {
+		user := AdminUser{
+			Username:     fmt.Sprintf("%s_%d", prefix, time.Now().UnixNano()),
+			PasswordHash: []byte("password"),
+			SessionToken: fmt.Sprintf("%stoken_%d", prefix, time.Now().UnixNano()),
+		}
+		db.Create(&user)
+		return user
+	}
+	post := func(user AdminUser, path string, form url.Values) (*http.Response, string) {
+		req, _ := http.NewRequest("POST", testBaseURL+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(testBaseURL + path)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	// built-in themes are in the gallery
+	grayBear, err := builtInThemeByFile("gray-bear.css")
+	if err != nil || grayBear.Name != "Gray Bear" || !grayBear.Published || !grayBear.IsBuiltIn() {
+		t.Fatalf("Expected the built-in themes to be synced, got %+v (%v)", grayBear, err)
+	}
+
+	// guestbooks that stored a built-in marker now reference the theme
+	author := newUser("themeauthor")
+	legacy := Guestbook{WebsiteURL: "https://legacy-theme.com", AdminUserID: author.ID, CustomPageCSS: "<<built__in>>gray-bear.css<</built__in>>"}
+	db.Create(&legacy)
+	if err := migrateBuiltInThemeMarkers(); err != nil {
+		t.Fatalf("Failed to migrate built-in theme markers: %v", err)
+	}
+	db.First(&legacy, legacy.ID)
+	if legacy.ThemeID == nil || *legacy.ThemeID != grayBear.ID || legacy.CustomPageCSS != "" {
+		t.Fatalf("Expected the marker to become a reference to the theme, got %v %q", legacy.ThemeID, legacy.CustomPageCSS)
+	}
+	_, page := get(fmt.Sprintf("/guestbook/%d", legacy.ID))
+	if !strings.Contains(page, grayBear.StylesheetURL()) || strings.Contains(page, "chota") {
+		t.Error("Expected the guestbook page to link the theme stylesheet")
+	}
+
+	styleResp, style := get(grayBear.StylesheetURL())
+	if styleResp.StatusCode != http.StatusOK || !strings.HasPrefix(styleResp.Header.Get("Content-Type"), "text/css") || !strings.Contains(style, "--background-color") {
+		t.Fatalf("Expected the theme stylesheet to be served, got %d", styleResp.StatusCode)
+	}
+	if !strings.Contains(styleResp.Header.Get("Cache-Control"), "immutable") {
+		t.Errorf("Expected versioned stylesheets to be cached forever, got %q", styleResp.Header.Get("Cache-Control"))
+	}
+
+	// pasting the CSS of a built-in theme still uses it by reference
+	builtInCSS, _ := os.ReadFile(filepath.Join(constants.BUILT_IN_THEMES_DIR, "gray-bear.css"))
+	other := Guestbook{WebsiteURL: "https://pasted-theme.com", AdminUserID: author.ID}
+	db.Create(&other)
+	if resp, body := post(author, fmt.Sprintf("/admin/guestbook/%d/edit", other.ID), url.Values{"websiteURL": {other.WebsiteURL}, "customPageCSS": {string(builtInCSS)}}); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after saving, got %d: %s", resp.StatusCode, body)
+	}
+	db.First(&other, other.ID)
+	if other.ThemeID == nil || *other.ThemeID != grayBear.ID || other.CustomPageCSS != "" {
+		t.Errorf("Expected pasted built-in CSS to reference the theme, got %v", other.ThemeID)
+	}
+
+	// publishing checks the CSS and the preview
+	if resp, _ := post(author, "/admin/themes", url.Values{"name": {"Broken"}, "css": {"a { behavior: url(x.htc); }"}, "published": {"on"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a theme with disallowed CSS, got %d", resp.StatusCode)
+	}
+	if resp, _ := post(author, "/admin/themes", url.Values{"name": {"Stolen"}, "css": {"a { color: red; }"}, "previewURL": {"/assets/user/1/" + strings.Repeat("a", 64) + ".png"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a preview that isn't one of the user's images, got %d", resp.StatusCode)
+	}
+	if resp, body := post(author, "/admin/themes", url.Values{"name": {"Midnight"}, "css": {"body { color: #123456; }"}, "published": {"on"}}); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after publishing, got %d: %s", resp.StatusCode, body)
+	}
+	var midnight Theme
+	db.Where("admin_user_id = ? AND name = ?", author.ID, "Midnight").First(&midnight)
+	if !midnight.Published || midnight.Author != author.Username || midnight.Version != 1 {
+		t.Fatalf("Expected the theme to be published by its author, got %+v", midnight)
+	}
+
+	// the publish form starts from a guestbook's custom CSS
+	customGuestbook := Guestbook{WebsiteURL: "https://custom-theme.com", AdminUserID: author.ID, CustomPageCSS: "p { color: #abcdef; }"}
+	db.Create(&customGuestbook)
+	for path, expected := range map[string]string{
+		fmt.Sprintf("/admin/themes/new?guestbookID=%d", customGuestbook.ID): "#abcdef",
+		"/admin/guestbook/new": "Midnight by " + author.Username,
+	} {
+		req, _ := http.NewRequest("GET", testBaseURL+path, nil)
+		req.Header.Set("Cookie", "admin_token="+author.SessionToken)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), expected) {
+			t.Errorf("Expected %s to contain %q, got %d", path, expected, resp.StatusCode)
+		}
+	}
+
+	// someone else applies it by reference
+	visitor := newUser("themeuser")
+	visitorGuestbook := Guestbook{WebsiteURL: "https://theme-user.com", AdminUserID: visitor.ID, CustomPageCSS: "h1 { color: green; }"}
+	db.Create(&visitorGuestbook)
+	req, _ := http.NewRequest("GET", testBaseURL+"/admin/themes", nil)
+	req.Header.Set("Cookie", "admin_token="+visitor.SessionToken)
+	galleryResp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	gallery, _ := io.ReadAll(galleryResp.Body)
+	galleryResp.Body.Close()
+	if !strings.Contains(string(gallery), "Midnight") || !strings.Contains(string(gallery), "Gray Bear") {
+		t.Error("Expected the gallery to list published and built-in themes")
+	}
+	if resp, body := post(visitor, fmt.Sprintf("/admin/themes/%d/apply", midnight.ID), url.Values{"guestbookID": {fmt.Sprint(visitorGuestbook.ID)}}); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after applying the theme, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := post(visitor, fmt.Sprintf("/admin/themes/%d/apply", midnight.ID), url.Values{"guestbookID": {fmt.Sprint(legacy.ID)}}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 when applying a theme to someone else's guestbook, got %d", resp.StatusCode)
+	}
+	_, page = get(fmt.Sprintf("/guestbook/%d", visitorGuestbook.ID))
+	if !strings.Contains(page, midnight.StylesheetURL()) || !strings.Contains(page, "color: green") {
+		t.Error("Expected the page to link the theme and keep the guestbook's own CSS on top")
+	}
+
+	// only the author can revise it, and revisions reach everyone using it
+	if resp, _ := post(visitor, fmt.Sprintf("/admin/themes/%d/edit", midnight.ID), url.Values{"name": {"Mine now"}, "css": {"body { color: red; }"}}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 when editing someone else's theme, got %d", resp.StatusCode)
+	}
+	if resp, body := post(author, fmt.Sprintf("/admin/themes/%d/edit", midnight.ID), url.Values{"name": {"Midnight"}, "css": {"body { color: #654321; }"}}); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after revising, got %d: %s", resp.StatusCode, body)
+	}
+	db.First(&midnight, midnight.ID)
+	if midnight.Version != 2 || midnight.Published {
+		t.Fatalf("Expected the revision to bump the version and unpublish the theme, got %+v", midnight)
+	}
+	_, page = get(fmt.Sprintf("/guestbook/%d", visitorGuestbook.ID))
+	if !strings.Contains(page, midnight.StylesheetURL()) {
+		t.Error("Expected the page to link the revised stylesheet")
+	}
+	if _, style := get(midnight.StylesheetURL()); !strings.Contains(style, "#654321") {
+		t.Errorf("Expected the revised CSS to be served, got %q", style)
+	}
+
+	// unpublished themes keep working where they are used, but can't be
+	// applied anywhere else
+	if resp, body := post(visitor, fmt.Sprintf("/admin/guestbook/%d/edit", visitorGuestbook.ID), url.Values{"websiteURL": {visitorGuestbook.WebsiteURL}, "themeID": {fmt.Sprint(midnight.ID)}}); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("Expected the guestbook to keep its unpublished theme, got %d: %s", resp.StatusCode, body)
+	}
+	secondGuestbook := Guestbook{WebsiteURL: "https://theme-user-2.com", AdminUserID: visitor.ID}
+	db.Create(&secondGuestbook)
+	if resp, _ := post(visitor, fmt.Sprintf("/admin/themes/%d/apply", midnight.ID), url.Values{"guestbookID": {fmt.Sprint(secondGuestbook.ID)}}); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 when applying an unpublished theme, got %d", resp.StatusCode)
+	}
+	if resp, _ := post(visitor, fmt.Sprintf("/admin/guestbook/%d/edit", secondGuestbook.ID), url.Values{"websiteURL": {secondGuestbook.WebsiteURL}, "themeID": {fmt.Sprint(midnight.ID)}}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 when picking an unpublished theme, got %d", resp.StatusCode)
+	}
+
+	// assets a theme uses can't be deleted until the theme stops using them
+	preview := ThemeAsset{AdminUserID: author.ID, Name: "preview.png", Hash: strings.Repeat("b", 64), Extension: "png"}
+	db.Create(&preview)
+	font := ThemeAsset{AdminUserID: author.ID, Name: "font.woff2", Hash: strings.Repeat("c", 64), Extension: "woff2"}
+	db.Create(&font)
+	if resp, body := post(author, fmt.Sprintf("/admin/themes/%d/edit", midnight.ID), url.Values{"name": {"Midnight"}, "previewURL": {preview.Path()}, "css": {fmt.Sprintf("@font-face { font-family: Night; src: url(%q); }", font.Path())}, "published": {"on"}}); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after revising, got %d: %s", resp.StatusCode, body)
+	}
+	for _, asset := range []ThemeAsset{preview, font} {
+		if resp, body := post(author, fmt.Sprintf("/admin/assets/%d/delete", asset.ID), nil); resp.StatusCode != http.StatusConflict || !strings.Contains(body, "Midnight") {
+			t.Errorf("Expected 409 when deleting %s while the theme uses it, got %d: %s", asset.Name, resp.StatusCode, body)
+		}
+	}
+
+	// only the author can delete it, guestbooks using it go back to their own CSS
+	if resp, _ := post(visitor, fmt.Sprintf("/admin/themes/%d/delete", midnight.ID), nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 when deleting someone else's theme, got %d", resp.StatusCode)
+	}
+	if resp, body := post(author, fmt.Sprintf("/admin/themes/%d/delete", midnight.ID), nil); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after deleting the theme, got %d: %s", resp.StatusCode, body)
+	}
+	if err := db.First(&Theme{}, midnight.ID).Error; err == nil {
+		t.Error("Expected the theme to be deleted")
+	}
+	db.First(&visitorGuestbook, visitorGuestbook.ID)
+	if visitorGuestbook.ThemeID != nil {
+		t.Errorf("Expected the guestbook to stop using the deleted theme, got %v", *visitorGuestbook.ThemeID)
+	}
+	if resp, _ := get(midnight.StylesheetURL()); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the stylesheet of a deleted theme to be gone, got %d", resp.StatusCode)
+	}
+	for _, asset := range []ThemeAsset{preview, font} {
+		if resp, body := post(author, fmt.Sprintf("/admin/assets/%d/delete", asset.ID), nil); resp.StatusCode != http.StatusSeeOther {
+			t.Errorf("Expected %s to be deletable once the theme is gone, got %d: %s", asset.Name, resp.StatusCode, body)
+		}
+	}
+
+	t.Log("Theme gallery test passed!")
+}
+
+func TestStylePreview(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("preview_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("previewtoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+	guestbook := Guestbook{WebsiteURL: "https://preview.com", AdminUserID: user.ID, CustomPageCSS: "p { color: blue; }"}
+	db.Create(&guestbook)
+	grayBear, _ := builtInThemeByFile("gray-bear.css")
+
+	preview := func(form url.Values) guestbookPreview {
+		req, _ := http.NewRequest("POST", testBaseURL+"/admin/guestbook/preview", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("Expected a JSON preview, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		var result guestbookPreview
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode the preview: %v", err)
+		}
+		return result
+	}
+
+	// unsaved settings are rendered with sample messages
+	result := preview(url.Values{
+		"guestbookID":     {fmt.Sprint(guestbook.ID)},
+		"websiteURL":      {"https://unsaved.com"},
+		"themeID":         {fmt.Sprint(grayBear.ID)},
+		"customPageCSS":   {"h1#title { color: #ff00ff; }"},
+		"markdownEnabled": {"on"},
+		"reactionEmojis":  {"👍"},
+	})
+	if !result.Valid || result.Violations == nil || len(result.Violations) != 0 {
+		t.Errorf("Expected valid CSS without violations, got %+v", result.Violations)
+	}
+	for _, expected := range []string{"https://unsaved.com", "#ff00ff", grayBear.StylesheetURL(), "<em>lovely</em>", "👍 3", user.Username} {
+		if !strings.Contains(result.HTML, expected) {
+			t.Errorf("Expected the preview to contain %q", expected)
+		}
+	}
+
+	// problems are reported with their position before anything is saved
+	result = preview(url.Values{
+		"guestbookID":   {fmt.Sprint(guestbook.ID)},
+		"customPageCSS": {"a {\n  color: red;\n  behavior: url(x.htc);\n}"},
+	})
+	if result.Valid || len(result.Violations) != 1 || result.Violations[0].Line != 3 || result.Violations[0].Column != 3 {
+		t.Fatalf("Expected one violation at 3:3, got %+v", result.Violations)
+	}
+	if strings.Contains(result.HTML, "behavior") || !strings.Contains(result.HTML, "color: red") {
+		t.Error("Expected the preview to render only the sanitized CSS")
+	}
+
+	tooLong := preview(url.Values{"customPageCSS": {strings.Repeat("a{}", constants.MAX_CSS_LENGTH)}})
+	if tooLong.Valid || !strings.Contains(tooLong.Message, "too long") {
+		t.Errorf("Expected CSS over the length limit to be reported, got %+v", tooLong.Message)
+	}
+
+	db.First(&guestbook, guestbook.ID)
+	if guestbook.CustomPageCSS != "p { color: blue; }" || guestbook.WebsiteURL != "https://preview.com" {
+		t.Error("Expected previews to never change the saved guestbook")
+	}
+
+	t.Log("Style preview test passed!")
+}
+
+// TestInternationalization tests locale negotiation, localized dates and owner
+// overrides on the guestbook page, the embed script and the admin UI.
+func TestInternationalization(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("i18n_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("i18ntoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+	guestbook := Guestbook{WebsiteURL: "https://i18n.com", AdminUserID: user.ID, Locale: "es"}
+	db.Create(&guestbook)
+	emptyGuestbook := Guestbook{WebsiteURL: "https://i18n-empty.com", AdminUserID: user.ID}
+	db.Create(&emptyGuestbook)
+
+	message := Message{Name: "Visitor", Text: "Hola", GuestbookID: guestbook.ID, Approved: true, VisitorEmailToken: fmt.Sprintf("i18ntoken_%d", time.Now().UnixNano())}
+	message.CreatedAt = time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC)
+	db.Create(&message)
+
+	get := func(path, acceptLanguage string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", testBaseURL+path, nil)
+		req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+		if acceptLanguage != "" {
+			req.Header.Set("Accept-Language", acceptLanguage)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	pagePath := fmt.Sprintf("/guestbook/%d", guestbook.ID)
+
+	// visitors without a preference get the guestbook's locale
+	resp, page := get(pagePath, "")
+	for _, expected := range []string{`lang="es"`, "Libro de visitas de https://i18n.com", `placeholder="Nombre"`, "5 mar 2024"} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("Expected the Spanish page to contain %q", expected)
+		}
+	}
+	if !slices.Contains(resp.Header.Values("Vary"), "Accept-Language") {
+		t.Error("Expected the page to vary by Accept-Language")
+	}
+
+	// a shipped locale the browser asks for wins, regional variants included
+	_, page = get(pagePath, "fr-CA, en-GB;q=0.8, es;q=0.5")
+	for _, expected := range []string{`lang="en"`, "Guestbook for https://i18n.com", "Mar 5, 2024"} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("Expected the English page to contain %q", expected)
+		}
+	}
+	_, page = get(fmt.Sprintf("/guestbook/%d", emptyGuestbook.ID), "")
+	if !strings.Contains(page, "There are no messages on this guestbook.") {
+		t.Error("Expected guestbooks without a locale to default to English")
+	}
+
+	// owners can override strings, in the guestbook's locale only
+	form := url.Values{
+		"websiteURL":           {"https://i18n.com"},
+		"locale":               {"es"},
+		"string_form.submit":   {"¡Firma!"},
+		"string_messages.page": {strings.Repeat("x", constants.MAX_STRING_OVERRIDE_LENGTH+1)},
+	}
+	post := func(form url.Values) *http.Response {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/admin/guestbook/%d/edit", testBaseURL, guestbook.ID), strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", "admin_token="+user.SessionToken)
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := post(form); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected overrides over the length limit to be rejected, got %d", resp.StatusCode)
+	}
+	form.Del("string_messages.page")
+	if resp := post(form); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected the guestbook to be saved, got %d", resp.StatusCode)
+	}
+
+	_, page = get(pagePath, "es-ES")
+	if !strings.Contains(page, `value="¡Firma!"`) {
+		t.Error("Expected the override to be shown to visitors of the guestbook's locale")
+	}
+	_, page = get(pagePath, "en")
+	if strings.Contains(page, "¡Firma!") || !strings.Contains(page, `value="Submit"`) {
+		t.Error("Expected the override to not be shown to visitors of other locales")
+	}
+
+	// the embed script gets the same catalog
+	resp, script := get(fmt.Sprintf("/resources/js/embed_script/%d/script.js", guestbook.ID), "")
+	for _, expected := range []string{`"pow.label":"No soy un robot"`, `"form.submit":"¡Firma!"`} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("Expected the embed script to contain %q", expected)
+		}
+	}
+	if !slices.Contains(resp.Header.Values("Vary"), "Accept-Language") {
+		t.Error("Expected the embed script to vary by Accept-Language")
+	}
+
+	// the admin UI follows the browser
+	_, admin := get("/admin", "es")
+	if !strings.Contains(admin, "Mis libros de visitas") || !strings.Contains(admin, "Cerrar sesión") {
+		t.Error("Expected the admin UI in Spanish")
+	}
+	if !strings.Contains(admin, `"admin.ui.cancel":"Cancelar"`) {
+		t.Error("Expected the admin UI script strings in Spanish")
+	}
+	adminPages := []struct {
+		path     string
+		expected string
+	}{
+		{fmt.Sprintf("/admin/guestbook/%d", guestbook.ID), "Del libro de visitas de https://i18n.com"},
+		{fmt.Sprintf("/admin/guestbook/%d/edit", guestbook.ID), "Guardar libro de visitas"},
+		{"/admin/guestbook/new", "Crear un libro de visitas"},
+		{fmt.Sprintf("/admin/guestbook/%d/message/%d/edit", guestbook.ID, message.ID), "Editar mensaje"},
+		{"/admin/settings", "Cambiar contraseña"},
+		{"/admin/themes", "Galería de temas"},
+		{"/admin/themes/new", "Publica un tema"},
+		{"/admin/assets", "Todavía no has subido ningún recurso."},
+		{fmt.Sprintf("/admin/guestbook/%d/embed", guestbook.ID), "Inserta tu libro de visitas"},
+	}
+	for _, adminPage := range adminPages {
+		resp, body := get(adminPage.path, "es")
+		if resp.StatusCode != http.StatusOK || !strings.Contains(body, adminPage.expected) {
+			t.Errorf("Expected %s in Spanish to contain %q, got %d", adminPage.path, adminPage.expected, resp.StatusCode)
+		}
+	}
+	publicPages := map[string]string{
+		"/admin/signin":         "¿No tienes cuenta?",
+		"/admin/signup":         "Crea tu cuenta",
+		"/forgot-password":      "Restablece tu contraseña",
+		"/terms-and-conditions": "Privacidad y condiciones de uso",
+	}
+	for path, expected := range publicPages {
+		req, _ := http.NewRequest("GET", testBaseURL+path, nil)
+		req.Header.Set("Accept-Language", "es")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected %s in Spanish to contain %q", path, expected)
+		}
+	}
+
+	// the reply notification pages fall back to the guestbook's locale
+	resp, err := http.Get(fmt.Sprintf("%s/guestbook/%d/notifications/unsubscribe?token=%s", testBaseURL, guestbook.ID, message.VisitorEmailToken))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `<html lang="es">`) || !strings.Contains(string(body), "Darme de baja") {
+		t.Errorf("Expected the unsubscribe page in Spanish, got: %s", body)
+	}
+
+	t.Log("Internationalization test passed!")
+}
+
+// TestGuestbookWidget tests the web component script and the config it builds
+// the form from.
+func TestGuestbookWidget(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("widget_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("widgettoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+	grayBear, _ := builtInThemeByFile("gray-bear.css")
+	guestbook := Guestbook{
+		WebsiteURL:        "https://widget.com",
+		AdminUserID:       user.ID,
+		PowEnabled:        true,
+		ChallengeQuestion: "What color is the sky?",
+		ChallengeAnswer:   "blue",
+		ThemeID:           &grayBear.ID,
+		CustomFields:      []CustomField{{ID: "color", Type: CustomFieldText, Label: "Favorite color"}},
+	}
+	db.Create(&guestbook)
+
+	resp, err := http.Get(testBaseURL + "/resources/js/guestbook-widget.js")
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	script, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/javascript") {
+		t.Fatalf("Expected the widget script, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	for _, expected := range []string{`customElements.define("guestbook-widget"`, "attachShadow", "/api/v2/get-guestbook-config/"} {
+		if !strings.Contains(string(script), expected) {
+			t.Errorf("Expected the widget script to contain %q", expected)
+		}
+	}
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" || resp.Header.Get("Cache-Control") == "" {
+		t.Errorf("Expected the widget script to be cacheable, got ETag %q, Last-Modified %q and Cache-Control %q",
+			etag, lastModified, resp.Header.Get("Cache-Control"))
+	}
+	for name, value := range map[string]string{"If-None-Match": etag, "If-Modified-Since": lastModified} {
+		req, _ := http.NewRequest("GET", testBaseURL+"/resources/js/guestbook-widget.js", nil)
+		req.Header.Set(name, value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotModified {
+			t.Errorf("Expected 304 for a request with %s, got %d", name, resp.StatusCode)
+		}
+	}
+
+	getConfig := func(query string) map[string]any {
+		resp, err := http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-config/%d%s", testBaseURL, guestbook.ID, query))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the config, got %d", resp.StatusCode)
+		}
+		var config map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+			t.Fatalf("Failed to decode the config: %v", err)
+		}
+		return config
+	}
+
+	config := getConfig("")
+	if config["challengeQuestion"] != "What color is the sky?" || config["powEnabled"] != true {
+		t.Errorf("Expected the verification settings in the config, got %v", config)
+	}
+	if _, ok := config["challengeAnswer"]; ok {
+		t.Error("The challenge answer must never be sent to visitors")
+	}
+	if config["themeURL"] != grayBear.StylesheetURL() {
+		t.Errorf("Expected the guestbook's theme, got %v", config["themeURL"])
+	}
+	if fields, _ := config["customFields"].([]any); len(fields) != 1 {
+		t.Errorf("Expected the custom fields in the config, got %v", config["customFields"])
+	}
+	if reactions, ok := config["reactionEmojis"].([]any); !ok || len(reactions) != 0 {
+		t.Errorf("Expected an empty list of reactions, got %v", config["reactionEmojis"])
+	}
+
+	// the locale attribute is sent as a query parameter
+	config = getConfig("?locale=es")
+	catalog, _ := config["strings"].(map[string]any)
+	if config["locale"] != "es" || catalog["form.submit"] != "Enviar" {
+		t.Errorf("Expected the Spanish strings, got %v %v", config["locale"], catalog["form.submit"])
+	}
+
+	resp, _ = http.Get(testBaseURL + "/api/v2/get-guestbook-config/999999")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing guestbook, got %d", resp.StatusCode)
+	}
+
+	t.Log("Guestbook widget test passed!")
+}
+
+// TestMultipleEmbedsOnOnePage embeds two guestbooks side by side on a page of
+// another site and checks that each one only shows and posts its own messages.
+func TestMultipleEmbedsOnOnePage(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("multiembed_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("multiembedtoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+	left := Guestbook{WebsiteURL: "https://left.com", AdminUserID: user.ID}
+	right := Guestbook{WebsiteURL: "https://right.com", AdminUserID: user.ID}
+	db.Create(&left)
+	db.Create(&right)
+	db.Create(&Message{Name: "Lefty", Text: "Hello from the left", GuestbookID: left.ID, Approved: true})
+	db.Create(&Message{Name: "Righty", Text: "Hello from the right", GuestbookID: right.ID, Approved: true})
+
+	// each script only sets up the containers of its own guestbook
+	resp, err := http.Get(fmt.Sprintf("%s/resources/js/embed_script/%d/script.js", testBaseURL, left.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	script, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(script), fmt.Sprintf(`[data-guestbook-id="%d"]`, left.ID)) {
+		t.Error("Expected the embed script to look up its guestbook's containers")
+	}
+	if strings.Contains(string(script), "window.guestbooks___") {
+		t.Error("Expected the embed script to keep its state out of the global scope")
+	}
+
+	embed := func(guestbook Guestbook) string {
+		return fmt.Sprintf(`<script async src="%[1]s/resources/js/embed_script/%[2]d/script.js"></script>
+<div data-guestbook-id="%[2]d">
+  <form id="guestbooks___guestbook-form" action="%[1]s/guestbook/%[2]d/submit" method="post">
+    <input type="text" id="name" name="name" required>
+    <input type="url" id="website" name="website">
+    <div id="guestbooks___challenge-answer-container"></div>
+    <textarea id="text" name="text" required></textarea>
+    <input type="submit" value="Sign">
+  </form>
+  <div id="guestbooks___guestbook-messages-container"></div>
+</div>`, testBaseURL, guestbook.ID)
+	}
+	hostPage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<!DOCTYPE html><html><body>
+<div id="left">%s</div>
+<div id="right">%s</div>
+</body></html>`, embed(left), embed(right))
+	}))
+	defer hostPage.Close()
+
+	page := browser.MustPage(hostPage.URL)
+	defer page.MustClose()
+	page.MustWaitLoad()
+	page.MustWaitStable()
+	time.Sleep(500 * time.Millisecond) // Wait for both scripts to render messages
+
+	leftText := page.MustElement("#left #guestbooks___guestbook-messages-container").MustText()
+	rightText := page.MustElement("#right #guestbooks___guestbook-messages-container").MustText()
+	if !strings.Contains(leftText, "Hello from the left") || strings.Contains(leftText, "Hello from the right") {
+		t.Errorf("Expected only the left guestbook's messages on the left, got %q", leftText)
+	}
+	if !strings.Contains(rightText, "Hello from the right") || strings.Contains(rightText, "Hello from the left") {
+		t.Errorf("Expected only the right guestbook's messages on the right, got %q", rightText)
+	}
+
+	// signing the right guestbook leaves the left one alone
+	page.MustElement("#right input[name='name']").MustInput("Visitor")
+	page.MustElement("#right textarea[name='text']").MustInput("Signed on the right")
+	page.MustElement("#right input[type='submit']").MustClick()
+	time.Sleep(500 * time.Millisecond) // Wait for the submission and reload
+
+	var count int64
+	db.Model(&Message{}).Where("guestbook_id = ? AND text = ?", right.ID, "Signed on the right").Count(&count)
+	if count != 1 {
+		t.Errorf("Expected the message in the right guestbook, found %d", count)
+	}
+	db.Model(&Message{}).Where("guestbook_id = ? AND text = ?", left.ID, "Signed on the right").Count(&count)
+	if count != 0 {
+		t.Error("The message must not be posted to the left guestbook")
+	}
+	if strings.Contains(page.MustElement("#left #guestbooks___guestbook-messages-container").MustText(), "Signed on the right") {
+		t.Error("The left guestbook must not show the right one's messages")
+	}
+
+	t.Log("Multiple embeds test passed!")
+}
+
+// TestEmbedScriptCaching checks that the embed script can be revalidated
+// instead of downloaded again, until the guestbook settings change.
+func TestEmbedScriptCaching(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("embedcache_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("embedcachetoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+	guestbook := Guestbook{WebsiteURL: "https://embedcache.com", AdminUserID: user.ID}
+	db.Create(&guestbook)
+	scriptURL := fmt.Sprintf("%s/resources/js/embed_script/%d/script.js", testBaseURL, guestbook.ID)
+
+	get := func(headers map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", scriptURL, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := get(nil)
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "guestbooks___init") {
+		t.Fatalf("Expected the embed script, got %d", resp.StatusCode)
+	}
+	if etag == "" || lastModified == "" {
+		t.Fatalf("Expected an ETag and Last-Modified, got %q and %q", etag, lastModified)
+	}
+	if resp.Header.Get("Cache-Control") == "" {
+		t.Error("Expected a Cache-Control header")
+	}
+	// the script includes catalog text, so editing a catalog changes it
+	if !strings.Contains(etag, localesVersion) {
+		t.Errorf("Expected the ETag to include the catalogs version %q, got %q", localesVersion, etag)
+	}
+
+	resp, body = get(map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("Expected 304 for a matching ETag, got %d", resp.StatusCode)
+	}
+	resp, _ = get(map[string]string{"If-Modified-Since": lastModified})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for an unchanged script, got %d", resp.StatusCode)
+	}
+
+	// every language gets its own copy
+	resp, _ = get(map[string]string{"Accept-Language": "es", "If-None-Match": etag})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("Expected a different script for another locale, got %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	// changing the settings changes the script
+	db.Model(&guestbook).Update("pow_enabled", true)
+	resp, body = get(map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("Expected a new script after the settings changed, got %d %q", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if !strings.Contains(body, "guestbooks___powEnabled = true") {
+		t.Error("Expected the new settings in the script")
+	}
+
+	resp, _ = http.Get(testBaseURL + "/resources/js/embed_script/999999/script.js")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing guestbook, got %d", resp.StatusCode)
+	}
+
+	t.Log("Embed script caching test passed!")
+}
+
+// TestMessageAPIConditionalRequests checks that polling the message APIs with
+// the last ETag gets a 304 until a new message arrives.
+func TestMessageAPIConditionalRequests(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("conditional_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("conditionaltoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+	guestbook := Guestbook{WebsiteURL: "https://conditional.com", AdminUserID: user.ID}
+	db.Create(&guestbook)
+	db.Create(&Message{Name: "First", Text: "First message", GuestbookID: guestbook.ID, Approved: true})
+
+	v1URL := fmt.Sprintf("%s/api/v1/get-guestbook-messages/%d", testBaseURL, guestbook.ID)
+	v2URL := fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d", testBaseURL, guestbook.ID)
+	get := func(url, etag string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", url, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	etags := map[string]string{}
+	for _, url := range []string{v1URL, v2URL, v2URL + "?page=2&limit=1"} {
+		resp, _ := get(url, "")
+		etag := resp.Header.Get("ETag")
+		if resp.StatusCode != http.StatusOK || etag == "" || strings.HasPrefix(etag, "W/") {
+			t.Fatalf("Expected a strong ETag from %s, got %d %q", url, resp.StatusCode, etag)
+		}
+		if resp.Header.Get("Cache-Control") == "" {
+			t.Errorf("Expected a Cache-Control header from %s", url)
+		}
+		for otherURL, other := range etags {
+			if other == etag {
+				t.Errorf("Expected %s and %s to have different ETags", url, otherURL)
+			}
+		}
+		etags[url] = etag
+
+		resp, body := get(url, etag)
+		if resp.StatusCode != http.StatusNotModified || body != "" {
+			t.Errorf("Expected 304 from %s for a matching ETag, got %d", url, resp.StatusCode)
+		}
+		if resp.Header.Get("ETag") != etag {
+			t.Errorf("Expected the 304 to repeat the ETag, got %q", resp.Header.Get("ETag"))
+		}
+	}
+
+	// a new message changes every response of the guestbook
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.PostForm(fmt.Sprintf("%s/guestbook/%d/submit", testBaseURL, guestbook.ID), map[string][]string{
+		"name": {"Second"},
+		"text": {"Second message"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+
+	for _, url := range []string{v1URL, v2URL} {
+		resp, body := get(url, etags[url])
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etags[url] {
+			t.Errorf("Expected a new response from %s after a new message, got %d", url, resp.StatusCode)
+		}
+		if !strings.Contains(body, "Second message") {
+			t.Errorf("Expected the new message from %s", url)
+		}
+	}
+
+	t.Log("Message API conditional requests test passed!")
+}
+
+// TestCursorPagination pages through the v3 messages API while a new message
+// arrives and checks that every message is seen exactly once.
+func TestCursorPagination(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("cursor_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("cursortoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+	guestbook := Guestbook{WebsiteURL: "https://cursor.com", AdminUserID: user.ID}
+	db.Create(&guestbook)
+
+	// five messages a minute apart, two of them at the same time, and an old
+	// pinned one
+	start := time.Now().Add(-time.Hour)
+	var oldest Message
+	for i := 0; i < 5; i++ {
+		createdAt := start.Add(time.Duration(i) * time.Minute)
+		if i == 4 {
+			createdAt = start.Add(3 * time.Minute)
+		}
+		message := Message{Name: "Visitor", Text: fmt.Sprintf("Message %d", i), GuestbookID: guestbook.ID, Approved: true}
+		message.CreatedAt = createdAt
+		db.Create(&message)
+		if i == 0 {
+			oldest = message
+		}
+	}
+	pinned := Message{Name: "Owner", Text: "Pinned", GuestbookID: guestbook.ID, Approved: true, Pinned: true}
+	pinned.CreatedAt = start.Add(-time.Hour)
+	db.Create(&pinned)
+	db.Create(&Message{Name: "Replier", Text: "A reply", GuestbookID: guestbook.ID, Approved: true, ParentMessageID: &oldest.ID})
+
+	getPage := func(query string) CursorPage {
+		resp, err := http.Get(fmt.Sprintf("%s/api/v3/get-guestbook-messages/%d?%s", testBaseURL, guestbook.ID, query))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected a page for %q, got %d", query, resp.StatusCode)
+		}
+		var page CursorPage
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatalf("Failed to decode the page: %v", err)
+		}
+		return page
+	}
+
+	// Step 1: the first page starts with the pinned message and only counts
+	// top-level messages
+	first := getPage("limit=2")
+	if first.Total != 6 {
+		t.Errorf("Expected 6 top-level messages, got %d", first.Total)
+	}
+	if len(first.Messages) != 2 || first.Messages[0].ID != pinned.ID || !first.HasNext || first.NextCursor == "" {
+		t.Fatalf("Unexpected first page: %+v", first)
+	}
+
+	// Step 2: a new message arrives while scrolling
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.PostForm(fmt.Sprintf("%s/guestbook/%d/submit", testBaseURL, guestbook.ID), map[string][]string{
+		"name": {"Latecomer"},
+		"text": {"Arrived while scrolling"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+
+	// Step 3: the following pages carry on where the first one stopped
+	seen := map[uint]int{}
+	for _, message := range first.Messages {
+		seen[message.ID]++
+	}
+	page := first
+	for page.HasNext {
+		page = getPage("limit=2&cursor=" + url.QueryEscape(page.NextCursor))
+		for _, message := range page.Messages {
+			seen[message.ID]++
+			if message.Text == "Arrived while scrolling" {
+				t.Error("A newer message must not show up further down")
+			}
+		}
+	}
+	if len(seen) != 6 {
+		t.Errorf("Expected to see all 6 messages, saw %d", len(seen))
+	}
+	for id, count := range seen {
+		if count != 1 {
+			t.Errorf("Expected message %d once, saw it %d times", id, count)
+		}
+	}
+	if page.Total != 7 {
+		t.Errorf("Expected the new message in the total, got %d", page.Total)
+	}
+
+	// Step 4: the oldest messages can come first, after the pinned one
+	oldestFirst := getPage("limit=2&order=oldest")
+	if oldestFirst.Order != "oldest" || len(oldestFirst.Messages) != 2 || oldestFirst.Messages[1].ID != oldest.ID {
+		t.Errorf("Expected the pinned and then the oldest message, got %+v", oldestFirst.Messages)
+	}
+	if len(oldestFirst.Messages[1].Replies) != 1 {
+		t.Error("Expected the replies with their message")
+	}
+	next := getPage("cursor=" + url.QueryEscape(oldestFirst.NextCursor))
+	if next.Order != "oldest" || len(next.Messages) == 0 || next.Messages[0].Text != "Message 1" {
+		t.Errorf("Expected the cursor to keep the oldest first order, got %+v", next)
+	}
+
+	// Step 5: the v2 total no longer counts replies either
+	resp, err = http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	var paginated PaginatedMessages
+	json.NewDecoder(resp.Body).Decode(&paginated)
+	resp.Body.Close()
+	if paginated.Pagination.Total != 7 {
+		t.Errorf("Expected 7 top-level messages in v2, got %d", paginated.Pagination.Total)
+	}
+
+	resp, _ = http.Get(fmt.Sprintf("%s/api/v3/get-guestbook-messages/%d?cursor=not-a-cursor", testBaseURL, guestbook.ID))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid cursor, got %d", resp.StatusCode)
+	}
+
+	t.Log("Cursor pagination test passed!")
+}
+
+// TestLiveUpdates follows the event stream of a guestbook while visitors post,
+// reply and delete.
+func TestLiveUpdates(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("live_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("livetoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+	guestbook := Guestbook{
+		WebsiteURL:            "https://live.com",
+		AdminUserID:           user.ID,
+		VisitorRepliesEnabled: true,
+		MaxReplyDepth:         2,
+		EditWindowMinutes:     10,
+		ReactionEmojis:        []string{"❤️"},
+	}
+	db.Create(&guestbook)
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/v3/guestbook-events/%d", testBaseURL, guestbook.ID))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// events are read in the background so a missing one fails the test
+	// instead of hanging it
+	type event struct{ name, data string }
+	events := make(chan event, 10)
+	go func() {
+		var current event
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				current.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				current.data = strings.TrimPrefix(line, "data: ")
+			case line == "" && current.name != "":
+				events <- current
+				current = event{}
+			}
+		}
+	}()
+	nextEvent := func() event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for an event")
+			return event{}
+		}
+	}
+
+	submit := func(guestbookID uint, form url.Values) SubmitResponse {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/guestbook/%d/submit", testBaseURL, guestbookID), strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		var body SubmitResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		return body
+	}
+
+	// Step 1: a new message
+	submitted := submit(guestbook.ID, url.Values{"name": {"Visitor"}, "text": {"Live hello"}})
+	e := nextEvent()
+	var message Message
+	json.Unmarshal([]byte(e.data), &message)
+	if e.name != "message" || message.ID != submitted.ID || message.Text != "Live hello" {
+		t.Errorf("Expected the new message, got %s %s", e.name, e.data)
+	}
+
+	// Step 2: a reply to it
+	submit(guestbook.ID, url.Values{"name": {"Replier"}, "text": {"Live reply"}, "parentMessageID": {fmt.Sprint(submitted.ID)}})
+	e = nextEvent()
+	var reply Message
+	json.Unmarshal([]byte(e.data), &reply)
+	if e.name != "message" || reply.ParentMessageID == nil || *reply.ParentMessageID != submitted.ID {
+		t.Errorf("Expected the reply, got %s %s", e.name, e.data)
+	}
+
+	// Step 3: the author deletes their message
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/guestbook/%d/message/%d/delete", testBaseURL, guestbook.ID, submitted.ID),
+		strings.NewReader(url.Values{"editToken": {submitted.EditToken}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	deleteResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	deleteResp.Body.Close()
+	e = nextEvent()
+	if e.name != "delete" || e.data != fmt.Sprintf("[%d]", submitted.ID) {
+		t.Errorf("Expected the deletion, got %s %s", e.name, e.data)
+	}
+
+	// Step 4: a reaction changes the counts visitors see
+	submitted = submit(guestbook.ID, url.Values{"name": {"Visitor"}, "text": {"React to me"}})
+	if e = nextEvent(); e.name != "message" {
+		t.Errorf("Expected the new message, got %s %s", e.name, e.data)
+	}
+	req, _ = http.NewRequest("POST", fmt.Sprintf("%s/guestbook/%d/message/%d/react", testBaseURL, guestbook.ID, submitted.ID),
+		strings.NewReader(url.Values{"emoji": {"❤️"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	reactResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	reactResp.Body.Close()
+	if e = nextEvent(); e.name != "refresh" {
+		t.Errorf("Expected a refresh after the reaction, got %s %s", e.name, e.data)
+	}
+
+	resp, _ = http.Get(testBaseURL + "/api/v3/guestbook-events/999999")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing guestbook, got %d", resp.StatusCode)
+	}
+
+	// Step 5: subscribers that fall behind are dropped rather than slowing
+	// everyone else down
+	hub := NewLiveHub(2, 10)
+	slow, _ := hub.Subscribe(guestbook.ID, "192.0.2.1")
+	fast, _ := hub.Subscribe(guestbook.ID, "192.0.2.2")
+	for i := 0; i < 2; i++ {
+		hub.Publish(guestbook.ID, LiveEvent{Type: liveEventRefresh})
+		<-fast.events
+	}
+	hub.Publish(guestbook.ID, LiveEvent{Type: liveEventRefresh})
+	received := 0
+	for range slow.events {
+		received++
+	}
+	if received != 2 {
+		t.Errorf("Expected the slow subscriber to get its buffered events and be dropped, got %d", received)
+	}
+	if _, ok := <-fast.events; !ok {
+		t.Error("The subscriber keeping up should still be subscribed")
+	}
+	hub.Unsubscribe(slow)
+	hub.Unsubscribe(fast)
+
+	// Step 6: a client can only keep a few streams open
+	openStream := func(visitorIP string) *http.Response {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/v3/guestbook-events/%d", testBaseURL, guestbook.ID), nil)
+		req.Header.Set("X-Forwarded-For", visitorIP)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		return resp
+	}
+	var streams []*http.Response
+	for range constants.LIVE_EVENTS_MAX_STREAMS_PER_CLIENT {
+		stream := openStream("198.51.100.7")
+		defer stream.Body.Close()
+		if stream.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the stream to open, got %d", stream.StatusCode)
+		}
+		streams = append(streams, stream)
+	}
+	extra := openStream("198.51.100.7")
+	extra.Body.Close()
+	if extra.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 once the client has too many streams open, got %d", extra.StatusCode)
+	}
+	extra = openStream("198.51.100.8")
+	extra.Body.Close()
+	if extra.StatusCode != http.StatusOK {
+		t.Errorf("Expected another client to be able to open a stream, got %d", extra.StatusCode)
+	}
+
+	// closed streams free their slot
+	streams[0].Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		extra = openStream("198.51.100.7")
+		extra.Body.Close()
+		if extra.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a closed stream to free its slot")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Log("Live updates test passed!")
+}
+
+// TestMessageSearch searches and filters messages in the admin view and
+// through the messages API.
+func TestMessageSearch(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("search_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("searchtoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+	guestbook := Guestbook{WebsiteURL: "https://search.com", AdminUserID: user.ID}
+	db.Create(&guestbook)
+
+	website := "https://alice.example"
+	alice := Message{Name: "Alicia", Text: "I love sourdough bread", Website: &website, GuestbookID: guestbook.ID, Approved: true}
+	alice.CreatedAt = time.Now().AddDate(0, 0, -10)
+	db.Create(&alice)
+	db.Create(&Message{Name: "Bartholomew", Text: "Pizza party tonight", GuestbookID: guestbook.ID, Approved: false})
+	carol := Message{Name: "Caroline", Text: "Bread and butter", GuestbookID: guestbook.ID, Approved: true}
+	db.Create(&carol)
+	db.Create(&Message{Name: "Dorothea", Text: "Sourdough starter tips", GuestbookID: guestbook.ID, Approved: true, ParentMessageID: &carol.ID})
+	db.Create(&Message{Name: "Evangeline", Text: "100% awesome", GuestbookID: guestbook.ID, Approved: true})
+	everyone := []string{"Alicia", "Bartholomew", "Caroline", "Dorothea", "Evangeline"}
+
+	adminView := func(query url.Values) (int, string) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/admin/guestbook/%d?%s", testBaseURL, guestbook.ID, query.Encode()), nil)
+		req.Header.Set("Cookie", fmt.Sprintf("admin_token=%s", user.SessionToken))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	today := time.Now().Format(time.DateOnly)
+	cases := []struct {
+		name     string
+		query    url.Values
+		expected []string
+	}{
+		{"no filter", url.Values{}, []string{"Alicia", "Bartholomew", "Caroline", "Dorothea", "Evangeline"}},
+		{"search", url.Values{"q": {"bread"}}, []string{"Alicia", "Caroline"}},
+		{"search matches replies and prefixes", url.Values{"q": {"sourdo"}}, []string{"Alicia", "Dorothea"}},
+		{"every word must match", url.Values{"q": {"bread butter"}}, []string{"Caroline"}},
+		{"wildcards are literal", url.Values{"q": {"_"}}, nil},
+		{"pending", url.Values{"status": {"pending"}}, []string{"Bartholomew"}},
+		{"has website", url.Values{"website": {"yes"}}, []string{"Alicia"}},
+		{"date range", url.Values{"from": {today}, "to": {today}, "q": {"bread"}}, []string{"Caroline"}},
+	}
+	for _, c := range cases {
+		status, body := adminView(c.query)
+		if status != http.StatusOK {
+			t.Errorf("%s: expected the admin view, got %d", c.name, status)
+			continue
+		}
+		for _, name := range everyone {
+			if strings.Contains(body, name) != slices.Contains(c.expected, name) {
+				t.Errorf("%s: expected only %v, but %s is shown: %v", c.name, c.expected, name, strings.Contains(body, name))
+			}
+		}
+	}
+	if status, _ := adminView(url.Values{"from": {"yesterday"}}); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid date, got %d", status)
+	}
+
+	// visitors can only search when the owner allows it
+	search := func(q string) (int, CursorPage) {
+		resp, err := http.Get(fmt.Sprintf("%s/api/v3/get-guestbook-messages/%d?q=%s", testBaseURL, guestbook.ID, url.QueryEscape(q)))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		var page CursorPage
+		json.NewDecoder(resp.Body).Decode(&page)
+		return resp.StatusCode, page
+	}
+	if status, _ := search("bread"); status != http.StatusForbidden {
+		t.Errorf("Expected 403 while search is disabled, got %d", status)
+	}
+
+	db.Model(&guestbook).Update("public_search_enabled", true)
+	messageCache.InvalidateGuestbook(guestbook.ID)
+	status, page := search("bread")
+	if status != http.StatusOK || page.Total != 2 || len(page.Messages) != 2 {
+		t.Fatalf("Expected the 2 approved messages about bread, got %d %+v", status, page)
+	}
+	if page.Messages[0].ID != carol.ID || len(page.Messages[0].Replies) != 1 {
+		t.Errorf("Expected the newest match first with its replies, got %+v", page.Messages[0])
+	}
+	if _, page := search("pizza"); len(page.Messages) != 0 {
+		t.Error("Pending messages must not be found by visitors")
+	}
+
+	// v2 searches the same way, each search with its own cache and ETag
+	searchV2 := func(q string) (int, PaginatedMessages, string) {
+		resp, err := http.Get(fmt.Sprintf("%s/api/v2/get-guestbook-messages/%d?q=%s", testBaseURL, guestbook.ID, url.QueryEscape(q)))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		var page PaginatedMessages
+		json.NewDecoder(resp.Body).Decode(&page)
+		return resp.StatusCode, page, resp.Header.Get("ETag")
+	}
+	_, all, allETag := searchV2("")
+	status, found, foundETag := searchV2("bread")
+	if status != http.StatusOK || found.Pagination.Total != 2 || len(found.Messages) != 2 || found.Messages[0].ID != carol.ID {
+		t.Fatalf("Expected v2 to find the 2 approved messages about bread, got %d %+v", status, found)
+	}
+	if all.Pagination.Total != 3 || allETag == foundETag {
+		t.Errorf("Expected the unfiltered v2 page to be cached apart from the search, got %d messages and ETags %q %q", all.Pagination.Total, allETag, foundETag)
+	}
+	db.Model(&guestbook).Update("public_search_enabled", false)
+	messageCache.InvalidateGuestbook(guestbook.ID)
+	if status, _, _ := searchV2("bread"); status != http.StatusForbidden {
+		t.Errorf("Expected 403 from v2 while search is disabled, got %d", status)
+	}
+
+	t.Log("Message search test passed!")
+}
+
+// TestAdminMessagePagination tests that the admin guestbook view is paginated,
+// sorted and filtered on the server
+func TestAdminMessagePagination(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("adminpages_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("adminpagestoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+	guestbook := Guestbook{WebsiteURL: "https://adminpages.com", AdminUserID: user.ID}
+	db.Create(&guestbook)
+
+	// Message 1 is the oldest, message 7 the newest
+	var messages []Message
+	for i := 1; i <= 7; i++ {
+		msg := Message{Name: fmt.Sprintf("Writer%02d", i), Text: fmt.Sprintf("Message %d", i), GuestbookID: guestbook.ID, Approved: i != 3}
+		msg.CreatedAt = time.Now().Add(time.Duration(i-10) * time.Hour)
+		db.Create(&msg)
+		messages = append(messages, msg)
+	}
+	reply := Message{Name: "Replier", Text: "A reply", GuestbookID: guestbook.ID, Approved: true, ParentMessageID: &messages[1].ID}
+	db.Create(&reply)
+
+	get := func(path string, query url.Values) (int, string) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/admin/guestbook/%d%s?%s", testBaseURL, guestbook.ID, path, query.Encode()), nil)
+		req.Header.Set("Cookie", fmt.Sprintf("admin_token=%s", user.SessionToken))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	shown := func(body string) []int {
+		var numbers []int
+		for i := 1; i <= 7; i++ {
+			if strings.Contains(body, fmt.Sprintf("Writer%02d", i)) {
+				numbers = append(numbers, i)
+			}
+		}
+		return numbers
+	}
+
+	cases := []struct {
+		name     string
+		query    url.Values
+		expected []int
+	}{
+		{"first page", url.Values{"limit": {"3"}}, []int{5, 6, 7}},
+		{"second page", url.Values{"limit": {"3"}, "page": {"2"}}, []int{2, 3, 4}},
+		{"past the last page", url.Values{"limit": {"3"}, "page": {"9"}}, []int{1}},
+		{"oldest first", url.Values{"limit": {"3"}, "sort": {"oldest"}}, []int{1, 2, 3}},
+		{"pending only", url.Values{"status": {"pending"}}, []int{3}},
+		{"has replies", url.Values{"replies": {"yes"}}, []int{2}},
+		{"author", url.Values{"author": {"writer04"}}, []int{4}},
+		// filtered views list replies too, the reply being the newest message
+		{"filtered pages", url.Values{"replies": {"no"}, "status": {"approved"}, "limit": {"2"}, "page": {"2"}}, []int{5, 6}},
+	}
+	for _, c := range cases {
+		status, body := get("", c.query)
+		if status != http.StatusOK {
+			t.Errorf("%s: expected the admin view, got %d", c.name, status)
+			continue
+		}
+		if numbers := shown(body); !slices.Equal(numbers, c.expected) {
+			t.Errorf("%s: expected messages %v, got %v", c.name, c.expected, numbers)
+		}
+	}
+
+	// Page links keep the filter and sort
+	_, body := get("", url.Values{"limit": {"2"}, "sort": {"oldest"}, "status": {"approved"}})
+	if !strings.Contains(body, "Page 1 of 4") {
+		t.Error("Expected the page count of the filtered messages")
+	}
+	if !strings.Contains(body, fmt.Sprintf(`href="/admin/guestbook/%d?limit=2&amp;page=2&amp;sort=oldest&amp;status=approved"`, guestbook.ID)) {
+		t.Error("Expected the next page link to keep the filter and sort")
+	}
+
+	// The IDs of every page can be selected for bulk actions
+	status, body := get("/messages/ids", url.Values{"status": {"approved"}, "sort": {"oldest"}})
+	var ids struct {
+		MessageIDs []string `json:"message_ids"`
+	}
+	json.Unmarshal([]byte(body), &ids)
+	expected := []string{}
+	for _, i := range []int{0, 1, 3, 4, 5, 6} {
+		expected = append(expected, fmt.Sprint(messages[i].ID))
+	}
+	expected = append(expected, fmt.Sprint(reply.ID))
+	if status != http.StatusOK || !slices.Equal(ids.MessageIDs, expected) {
+		t.Errorf("Expected the IDs %v, got %d %v", expected, status, ids.MessageIDs)
+	}
+
+	reqBody, _ := json.Marshal(map[string][]string{"message_ids": ids.MessageIDs})
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/admin/guestbook/%d/messages/bulk-delete", testBaseURL, guestbook.ID), bytes.NewReader(reqBody))
+	req.Header.Set("Cookie", fmt.Sprintf("admin_token=%s", user.SessionToken))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the selected messages to be deleted, got %d", resp.StatusCode)
+	}
+	if _, body := get("", nil); !slices.Equal(shown(body), []int{3}) {
+		t.Errorf("Expected only the pending message to be left, got %v", shown(body))
+	}
+
+	// Other owners can't list the messages
+	other := AdminUser{
+		Username:     fmt.Sprintf("adminpages_other_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("adminpagesother_%d", time.Now().UnixNano()),
+	}
+	db.Create(&other)
+	req, _ = http.NewRequest("GET", fmt.Sprintf("%s/admin/guestbook/%d/messages/ids", testBaseURL, guestbook.ID), nil)
+	req.Header.Set("Cookie", fmt.Sprintf("admin_token=%s", other.SessionToken))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for another owner, got %d", resp.StatusCode)
+	}
+
+	t.Log("Admin message pagination test passed!")
+}
+
+// TestGuestbookListAggregates tests that the admin guestbook list counts the
+// messages of many guestbooks without a query per guestbook, and can be
+// sorted and searched
+func TestGuestbookListAggregates(t *testing.T) {
+	newUser := func(name string) AdminUser {
+		user := AdminUser{
+			Username:     fmt.Sprintf("%s_%d", name, time.Now().UnixNano()),
+			PasswordHash: []byte("password"),
+			SessionToken: fmt.Sprintf("%stoken_%d", name, time.Now().UnixNano()),
+		}
+		db.Create(&user)
+		return user
+	}
+
+	// count the queries made while the list is rendered
+	var queries atomic.Int64
+	countQuery := func(*gorm.DB) { queries.Add(1) }
+	db.Callback().Query().After("gorm:query").Register("test:count_queries", countQuery)
+	db.Callback().Row().After("gorm:row").Register("test:count_rows", countQuery)
+	defer db.Callback().Query().Remove("test:count_queries")
+	defer db.Callback().Row().Remove("test:count_rows")
+
+	list := func(user AdminUser, query url.Values) (string, int64) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/admin/?%s", testBaseURL, query.Encode()), nil)
+		req.Header.Set("Cookie", fmt.Sprintf("admin_token=%s", user.SessionToken))
+		queries.Store(0)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the guestbook list, got %d: %s", resp.StatusCode, body)
+		}
+		return string(body), queries.Load()
+	}
+
+	single := newUser("listsingle")
+	singleGuestbook := Guestbook{WebsiteURL: "https://single.example", AdminUserID: single.ID}
+	db.Create(&singleGuestbook)
+	db.Create(&Message{Name: "Visitor", Text: "Hi", GuestbookID: singleGuestbook.ID, Approved: true})
+	_, singleQueries := list(single, nil)
+
+	// guestbook i has i messages, the even ones pending, written i days ago
+	user := newUser("listmany")
+	const guestbookCount = 40
+	guestbooks := make([]Guestbook, guestbookCount)
+	for i := range guestbooks {
+		guestbooks[i] = Guestbook{WebsiteURL: fmt.Sprintf("https://site%02d.example", i), AdminUserID: user.ID}
+		db.Create(&guestbooks[i])
+		for j := 0; j < i; j++ {
+			msg := Message{Name: "Visitor", Text: "Hello", GuestbookID: guestbooks[i].ID, Approved: j%2 == 1}
+			msg.CreatedAt = time.Now().AddDate(0, 0, -i).Add(-time.Duration(j) * time.Minute)
+			db.Create(&msg)
+		}
+	}
+	deleted := Message{Name: "Visitor", Text: "Deleted", GuestbookID: guestbooks[3].ID, Approved: false}
+	db.Create(&deleted)
+	db.Delete(&deleted)
+
+	body, manyQueries := list(user, nil)
+	if manyQueries != singleQueries {
+		t.Errorf("Expected the same number of queries for %d guestbooks as for one, got %d and %d", guestbookCount, manyQueries, singleQueries)
+	}
+
+	card := func(body string, i int) string {
+		start := strings.Index(body, fmt.Sprintf(`id="gb-%d"`, guestbooks[i].ID))
+		if start < 0 {
+			return ""
+		}
+		end := strings.Index(body[start:], `class="gb-actions"`)
+		return body[start : start+end]
+	}
+	stats := func(card string) []string {
+		var values []string
+		for _, part := range strings.Split(card, `class="stat-value"`)[1:] {
+			value := part[strings.Index(part, ">")+1 : strings.Index(part, "</div>")]
+			values = append(values, strings.TrimSpace(value))
+		}
+		return values
+	}
+	cases := []struct {
+		guestbook int
+		expected  []string
+	}{
+		{0, []string{"0", "0", "0", "None yet"}},
+		{3, []string{"3", "2", "3"}},
+		{6, []string{"6", "3", "6"}},
+		{12, []string{"12", "6", "0"}},
+	}
+	for _, c := range cases {
+		values := stats(card(body, c.guestbook))
+		if len(values) != 4 || !slices.Equal(values[:len(c.expected)], c.expected) {
+			t.Errorf("Guestbook %d: expected total, pending, recent and last message %v, got %v", c.guestbook, c.expected, values)
+		}
+	}
+	if values := stats(card(body, 3)); len(values) == 4 && !strings.Contains(values[3], fmt.Sprint(time.Now().AddDate(0, 0, -3).Year())) {
+		t.Errorf("Expected the date of the last message, got %q", values[3])
+	}
+
+	order := func(body string) []int {
+		var numbers []int
+		for _, part := range strings.Split(body, "https://site")[1:] {
+			var n int
+			if _, err := fmt.Sscanf(part, "%02d.example", &n); err == nil && !slices.Contains(numbers, n) {
+				numbers = append(numbers, n)
+			}
+		}
+		return numbers
+	}
+	sorts := []struct {
+		sort     string
+		expected []int
+	}{
+		{"", []int{0, 1, 2}},
+		{"messages", []int{39, 38, 37}},
+		{"activity", []int{1, 2, 3}},
+		{"name", []int{0, 1, 2}},
+	}
+	for _, s := range sorts {
+		body, _ := list(user, url.Values{"sort": {s.sort}})
+		numbers := order(body)
+		if len(numbers) != guestbookCount || !slices.Equal(numbers[:3], s.expected) {
+			t.Errorf("Sort %q: expected to start with %v, got %v", s.sort, s.expected, numbers)
+		}
+	}
+	if body, _ := list(user, url.Values{"sort": {"activity"}}); order(body)[guestbookCount-1] != 0 {
+		t.Error("Expected the guestbook without messages last when sorting by activity")
+	}
+
+	body, _ = list(user, url.Values{"q": {"site1"}, "sort": {"pending"}})
+	if numbers := order(body); !slices.Equal(numbers, []int{19, 17, 18, 15, 16, 13, 14, 11, 12, 10}) {
+		t.Errorf("Expected the guestbooks matching the search by pending messages, got %v", numbers)
+	}
+	if body, _ := list(user, url.Values{"q": {"nowhere"}}); !strings.Contains(body, "No Matching Guestbooks") {
+		t.Error("Expected the empty search state")
+	}
+
+	t.Log("Guestbook list aggregates test passed!")
+}
+
+func TestSubmitRateLimit(t *testing.T) {
+	user := AdminUser{
+		Username:     fmt.Sprintf("ratelimit_%d", time.Now().UnixNano()),
+		PasswordHash: []byte("password"),
+		SessionToken: fmt.Sprintf("ratelimittoken_%d", time.Now().UnixNano()),
+	}
+	db.Create(&user)
+
+	guestbook := Guestbook{WebsiteURL: "https://ratelimit.com", AdminUserID: user.ID}
+	db.Create(&guestbook)
+
+	submit := func(n int, visitorIP string) int {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/guestbook/%d/submit", testBaseURL, guestbook.ID),
+			strings.NewReader(url.Values{"name": {"Visitor"}, "text": {fmt.Sprintf("Message %d", n)}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("X-Forwarded-For", visitorIP)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for i := range defaultRateLimits.Submit {
+		if status := submit(i, "198.51.100.1"); status != http.StatusOK {
+			t.Fatalf("Expected submission %d to be accepted, got %d", i+1, status)
+		}
+	}
+	if status := submit(defaultRateLimits.Submit, "198.51.100.1"); status != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 once the submit limit is reached, got %d", status)
+	}
+	if status := submit(defaultRateLimits.Submit+1, "198.51.100.2"); status != http.StatusOK {
+		t.Errorf("Expected another visitor to be unaffected by the limit, got %d", status)
+	}
+
+	t.Log("Submit rate limit test passed!")
+}
+
+// TestMailHeaderEncoding checks that user controlled text in a mail header
+// can't start a header of its own.
+func TestMailHeaderEncoding(t *testing.T) {
+	subject := encodeMailHeader("[Guestbooks] New reply to your message on 'https://evil.com\r\nBcc: victim@example.com'")
+	if strings.ContainsAny(subject, "\r\n") {
+		t.Errorf("Expected the subject on a single line, got %q", subject)
+	}
+
+	if plain := encodeMailHeader("[Guestbooks] Password Reset Request"); plain != "[Guestbooks] Password Reset Request" {
+		t.Errorf("Expected plain ASCII subjects to be kept as they are, got %q", plain)
+	}
+	if encoded := encodeMailHeader("[Guestbooks] New reply on 'https://café.com'"); !strings.HasPrefix(encoded, "=?utf-8?q?") {
+		t.Errorf("Expected a non-ASCII subject to be encoded, got %q", encoded)
+	}
+
+	t.Log("Mail header encoding test passed!")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	textTemplate "text/template"
+	"time"
+
+	"guestbook/constants"
+)
+
+const embedScriptFile = "templates/resources/embed_javascript.js"
+
+// scriptTemplate is a parsed script template. Its version is a hash of the
+// template source, so every deploy that changes the script changes the ETag
+// of every copy rendered from it.
+type scriptTemplate struct {
+	template *textTemplate.Template
+	version  string
+	modTime  time.Time
+}
+
+var embedScriptTemplate *scriptTemplate = mustLoadScriptTemplate(embedScriptFile)
+
+func loadScriptTemplate(file string) (*scriptTemplate, error) {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading script template %s: %w", file, err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading script template %s: %w", file, err)
+	}
+	tmpl, err := textTemplate.New(filepath.Base(file)).Parse(string(source))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing script template %s: %w", file, err)
+	}
+
+	hash := sha256.Sum256(source)
+	return &scriptTemplate{
+		template: tmpl,
+		version:  hex.EncodeToString(hash[:8]),
+		modTime:  info.ModTime(),
+	}, nil
+}
+
+func mustLoadScriptTemplate(file string) *scriptTemplate {
+	script, err := loadScriptTemplate(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return script
+}
+
+// currentScriptTemplate returns the parsed script, re-reading the template in
+// debug mode so edits show up without a restart.
+func currentScriptTemplate(script *scriptTemplate, file string) (*scriptTemplate, error) {
+	if !constants.DEBUG_MODE {
+		return script, nil
+	}
+	return loadScriptTemplate(file)
+}
+
+// EmbedScript serves the script that brings a guestbook embedded with plain
+// HTML to life. The script only changes when the guestbook settings or the
+// template do, so browsers revalidate it with its ETag and get a 304 back.
+func EmbedScript(w http.ResponseWriter, r *http.Request) {
+	script, err := currentScriptTemplate(embedScriptTemplate, embedScriptFile)
+	if err != nil {
+		log.Printf("Error loading embed script: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	guestbookID, ok := parseGuestbookIDParam(r)
+	if !ok {
+		http.Error(w, "Invalid guestbook ID", http.StatusBadRequest)
+		return
+	}
+
+	var guestbook Guestbook
+	if result := db.First(&guestbook, guestbookID); result.Error != nil {
+		writeGuestbookLoadError(w, result.Error)
+		return
+	}
+
+	hostUrl := publicHostURL(r)
+
+	customFieldsJSON, err := json.Marshal(guestbook.CustomFields)
+	if err != nil || guestbook.CustomFields == nil {
+		customFieldsJSON = []byte("[]")
+	}
+
+	reactionEmojisJSON, err := json.Marshal(guestbook.ReactionEmojis)
+	if err != nil || guestbook.ReactionEmojis == nil {
+		reactionEmojisJSON = []byte("[]")
+	}
+
+	translator := guestbookTranslator(r, &guestbook)
+	templateData := struct {
+		Guestbook          Guestbook
+		HostUrl            string
+		CustomFieldsJSON   string
+		ReactionEmojisJSON string
+		StringsJSON        string
+	}{
+		Guestbook:          guestbook,
+		HostUrl:            hostUrl,
+		CustomFieldsJSON:   string(customFieldsJSON),
+		ReactionEmojisJSON: string(reactionEmojisJSON),
+		StringsJSON:        translator.JSON(),
+	}
+
+	var body bytes.Buffer
+	if err := script.template.Execute(&body, templateData); err != nil {
+		log.Printf("Error rendering embed script for guestbook %d: %v", guestbook.ID, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// the locale is part of the ETag as the same URL is served in every
+	// language the visitors ask for, and the catalogs version as their text
+	// is rendered into the script
+	lastModified := guestbook.UpdatedAt
+	for _, modTime := range []time.Time{script.modTime, localesModTime} {
+		if modTime.After(lastModified) {
+			lastModified = modTime
+		}
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, no-cache")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%s-%d-%d-%s"`, script.version, localesVersion, guestbook.ID, guestbook.UpdatedAt.UnixNano(), translator.Locale))
+	w.Header().Add("Vary", "Accept-Language")
+	http.ServeContent(w, r, "", lastModified, bytes.NewReader(body.Bytes()))
+}
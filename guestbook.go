@@ -2,28 +2,33 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
-	"time"
 
 	"html/template"
 
 	"guestbook/constants"
 
 	"github.com/go-chi/chi/v5"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
 )
 
 var guestbookTemplate *template.Template = loadGuestbookTemplate()
 
-func formatDate(t time.Time) string {
-	return t.Format("Jan 2, 2006")
-}
-
 func loadGuestbookTemplate() *template.Template {
-	tmpl, err := template.New("guestbook_page.html").Funcs(template.FuncMap{
-		"formatDate": formatDate,
+	// t and formatDate are replaced with the visitor's locale in
+	// executeGuestbookTemplate
+	tmpl, err := template.New("guestbook_page.html").Funcs(newTranslator(constants.DEFAULT_LOCALE, nil).Funcs()).Funcs(template.FuncMap{
+		// only used for Message.TextHTML, which is produced by our own
+		// Markdown renderer and never contains unescaped user input
+		"sanitizedHTML": func(s string) template.HTML { return template.HTML(s) },
 	}).ParseFiles("templates/guestbook_page.html")
 
 	if err != nil {
@@ -33,19 +38,59 @@ func loadGuestbookTemplate() *template.Template {
 	return tmpl
 }
 
+// executeGuestbookTemplate renders the guestbook page with text and dates in
+// the translator's locale.
+func executeGuestbookTemplate(w io.Writer, data guestbookPageData, translator *Translator) error {
+	if constants.DEBUG_MODE {
+		guestbookTemplate = loadGuestbookTemplate()
+	}
+
+	tmpl, err := guestbookTemplate.Clone()
+	if err != nil {
+		return err
+	}
+	return tmpl.Funcs(translator.Funcs()).Execute(w, data)
+}
+
+// guestbookPageData is rendered by guestbook_page.html.
+type guestbookPageData struct {
+	ID              string
+	Locale          string
+	WebsiteURL      string
+	CustomPageCSS   template.CSS
+	ThemeURL        string
+	PowEnabled      bool
+	MarkdownEnabled bool
+	CustomFields    []CustomField
+	Messages        []Message
+	Pagination      PaginationInfo
+	PreviousPage    int
+	NextPage        int
+}
+
 func GuestbookPage(w http.ResponseWriter, r *http.Request) {
 	guestbookID := chi.URLParam(r, "guestbookID")
+	guestbookIDUint, ok := parseGuestbookIDParam(r)
+	if !ok {
+		http.Error(w, "Guestbook not found. It may have been deleted or the URL is incorrect.", http.StatusNotFound)
+		return
+	}
 
 	type GuestbookPageData struct {
-		WebsiteURL    string
-		CustomPageCSS string
-		PowEnabled    bool
+		WebsiteURL      string
+		ThemeID         *uint
+		CustomPageCSS   string
+		PowEnabled      bool
+		MarkdownEnabled bool
+		CustomFields    datatypes.JSONSlice[CustomField]
+		Locale          string
+		StringOverrides datatypes.JSONMap
 	}
 
 	var guestbookData GuestbookPageData
 	result := db.Model(&Guestbook{}).
-		Select("website_url, custom_page_css, pow_enabled").
-		Where("id = ?", guestbookID).
+		Select("website_url, theme_id, custom_page_css, pow_enabled, markdown_enabled, custom_fields, locale, string_overrides").
+		Where("id = ?", guestbookIDUint).
 		Scan(&guestbookData)
 
 	if result.Error != nil {
@@ -58,31 +103,51 @@ func GuestbookPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if constants.DEBUG_MODE {
-		guestbookTemplate = loadGuestbookTemplate()
+	// Render the requested page of messages on the server so that visitors
+	// without JavaScript (and search engines) can read them. The embed script
+	// replaces this list when it runs.
+	page := 1
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		page = p
+	}
+
+	messagesPage, _, err := loadPaginatedMessages(guestbookIDUint, page, constants.DEFAULT_PAGE_SIZE, "", publicHostURL(r))
+	if err != nil {
+		http.Error(w, "Error querying the database", http.StatusInternalServerError)
+		return
 	}
 
-	selectedBuiltInTheme := ""
-	if strings.HasPrefix(guestbookData.CustomPageCSS, "<<built__in>>") {
-		selectedBuiltInTheme = strings.TrimPrefix(guestbookData.CustomPageCSS, "<<built__in>>")
-		selectedBuiltInTheme = strings.TrimSuffix(selectedBuiltInTheme, "<</built__in>>")
+	themeURL := ""
+	if guestbookData.ThemeID != nil {
+		var theme Theme
+		if err := db.First(&theme, *guestbookData.ThemeID).Error; err == nil {
+			themeURL = theme.StylesheetURL()
+		}
 	}
 
-	data := struct {
-		ID                   string
-		WebsiteURL           string
-		CustomPageCSS        template.CSS
-		SelectedBuiltInTheme string
-		PowEnabled           bool
-	}{
-		ID:                   guestbookID,
-		WebsiteURL:           guestbookData.WebsiteURL,
-		CustomPageCSS:        template.CSS(guestbookData.CustomPageCSS),
-		SelectedBuiltInTheme: selectedBuiltInTheme,
-		PowEnabled:           guestbookData.PowEnabled,
+	// only what passes the sanitizer ends up on the page, even for CSS saved
+	// before the current rules
+	pageCSS, _ := sanitizeCSS(guestbookData.CustomPageCSS)
+
+	translator := guestbookTranslator(r, &Guestbook{Locale: guestbookData.Locale, StringOverrides: guestbookData.StringOverrides})
+
+	data := guestbookPageData{
+		ID:              guestbookID,
+		Locale:          translator.Locale,
+		WebsiteURL:      guestbookData.WebsiteURL,
+		CustomPageCSS:   template.CSS(pageCSS),
+		ThemeURL:        themeURL,
+		PowEnabled:      guestbookData.PowEnabled,
+		MarkdownEnabled: guestbookData.MarkdownEnabled,
+		CustomFields:    guestbookData.CustomFields,
+		Messages:        messagesPage.Messages,
+		Pagination:      messagesPage.Pagination,
+		PreviousPage:    page - 1,
+		NextPage:        page + 1,
 	}
 
-	err := guestbookTemplate.Execute(w, data)
+	w.Header().Add("Vary", "Accept-Language")
+	err = executeGuestbookTemplate(w, data, translator)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -98,6 +163,19 @@ func GuestbookSubmit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// submissions with a drawing or image are sent as multipart forms, cap the whole
+	// body before anything is read from it
+	r.Body = http.MaxBytesReader(w, r.Body, constants.MAX_SUBMIT_BODY_BYTES)
+	if err := r.ParseMultipartForm(constants.MAX_SUBMIT_BODY_BYTES); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Your submission is too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Invalid form submission", http.StatusBadRequest)
+		}
+		return
+	}
+
 	// check that the form has the expected challenge if necesary
 	if strings.TrimSpace(guestbook.ChallengeQuestion) != "" {
 		challengeQuestionAnswer := strings.TrimSpace(r.FormValue("challengeQuestionAnswer"))
@@ -136,21 +214,105 @@ func GuestbookSubmit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	visitorEmail, err := normalizeVisitorEmail(r.FormValue("email"))
+	if err != nil {
+		http.Error(w, "The provided "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	customFieldValues, err := readCustomFieldValues(guestbook.CustomFields, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	parentMessageID, err := readParentMessageID(guestbook, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	drawing, err := readDrawing(guestbook, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	attachedImage, err := readImage(guestbook, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if attachedImage != nil {
+		used, err := userStorageUsage(guestbook.AdminUserID)
+		if err != nil {
+			http.Error(w, "Error submitting message", http.StatusInternalServerError)
+			return
+		}
+		if used+attachedImage.Size() > constants.USER_STORAGE_QUOTA_BYTES {
+			http.Error(w, "This guestbook has no storage left for images", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
 	message := Message{
-		Name:        name,
-		Text:        text,
-		Website:     websitePtr,
-		GuestbookID: guestbook.ID,
-		Approved:    !guestbook.RequiresApproval,
+		Name:              name,
+		Text:              text,
+		Website:           websitePtr,
+		GuestbookID:       guestbook.ID,
+		Approved:          !guestbook.RequiresApproval,
+		CustomFieldValues: customFieldValues,
+		ParentMessageID:   parentMessageID,
 	}
-	result = db.Create(&message)
-	if result.Error != nil {
+	var files uploadedFiles
+	if drawing != nil {
+		message.DrawingHash = drawing.Hash
+		files.Drawings = append(files.Drawings, drawing.Hash)
+	}
+	if attachedImage != nil {
+		message.ImageName = attachedImage.Name
+		message.ImageSize = attachedImage.Size()
+		files.Images = append(files.Images, attachedImage.Name)
+	}
+	// uploads are stored once the message row exists, and removed again if
+	// it can't be saved, so a failed submission never leaves files behind
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		if drawing != nil {
+			if err := uploadStorage.Put(drawingKey(drawing.Hash), drawing.PNG); err != nil {
+				return fmt.Errorf("could not store drawing: %w", err)
+			}
+		}
+		if attachedImage != nil {
+			if err := saveImage(attachedImage); err != nil {
+				return fmt.Errorf("could not store image: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: could not submit message: %v", err)
+		removeUnreferencedFiles(files)
 		http.Error(w, "Error submitting message", http.StatusInternalServerError)
 		return
 	}
 
 	// Invalidate cache for this guestbook since we added a new message
 	messageCache.InvalidateGuestbook(guestbook.ID)
+	publishNewMessage(&guestbook, message, publicHostURL(r))
+
+	editToken, err := issueEditToken(w, guestbook, &message)
+	if err != nil {
+		log.Printf("WARN: could not issue edit token for message %d: %v", message.ID, err)
+	}
+
+	if visitorEmail != "" {
+		if err := requestVisitorEmailConfirmation(guestbook, &message, visitorEmail); err != nil {
+			log.Printf("WARN: could not store visitor email for message %d: %v", message.ID, err)
+		}
+	}
 
 	// now send an email to the user if necessary
 	var adminUser AdminUser
@@ -228,6 +390,18 @@ If you do need some help then please reach out through here https://meadow.cafe/
 		}
 	}
 
+	// the embed script wants the message details (and edit token) instead
+	if wantsJSON(r) {
+		response := SubmitResponse{ID: message.ID, Approved: message.Approved, EditToken: editToken}
+		if editToken != "" {
+			editableUntil := guestbook.editableUntil(message)
+			response.EditableUntil = &editableUntil
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	//	if user provided a redirect URL, redirect to that URL, otherwise
 	//	redirect to the guestbook page
 	if redirectToUrl != "" {
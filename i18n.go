@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"guestbook/constants"
+
+	"gorm.io/datatypes"
+)
+
+// Catalog maps message keys to the text shown for them. Placeholders like
+// {name} are filled in by Translator.T.
+type Catalog map[string]string
+
+// locales holds every catalog in constants.LOCALES_DIR, keyed by its
+// lowercase language tag.
+var locales map[string]Catalog = loadLocales()
+
+// localesVersion is a hash of the catalog files and localesModTime is when
+// the newest of them changed, so responses that include catalog text are
+// revalidated when a deploy only edits a catalog. Both are set by
+// loadLocales.
+var (
+	localesVersion string
+	localesModTime time.Time
+)
+
+func loadLocales() map[string]Catalog {
+	files, err := filepath.Glob(filepath.Join(constants.LOCALES_DIR, "*.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	catalogs := map[string]Catalog{}
+	hash := sha256.New()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatalf("failed to read locale %s: %v", file, err)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Fatalf("failed to read locale %s: %v", file, err)
+		}
+		if info.ModTime().After(localesModTime) {
+			localesModTime = info.ModTime()
+		}
+		hash.Write([]byte(filepath.Base(file)))
+		hash.Write(data)
+
+		var catalog Catalog
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			log.Fatalf("failed to parse locale %s: %v", file, err)
+		}
+		catalogs[strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))] = catalog
+	}
+
+	if _, ok := catalogs[constants.DEFAULT_LOCALE]; !ok {
+		log.Fatalf("missing the default locale %q in %s", constants.DEFAULT_LOCALE, constants.LOCALES_DIR)
+	}
+	localesVersion = hex.EncodeToString(hash.Sum(nil)[:8])
+	return catalogs
+}
+
+// LocaleOption is a locale owners can pick for their guestbook.
+type LocaleOption struct {
+	Tag  string
+	Name string
+}
+
+// availableLocales lists the shipped locales, default locale first.
+func availableLocales() []LocaleOption {
+	options := make([]LocaleOption, 0, len(locales))
+	for tag, catalog := range locales {
+		options = append(options, LocaleOption{Tag: tag, Name: catalog["locale.name"]})
+	}
+	sort.Slice(options, func(i, j int) bool {
+		if (options[i].Tag == constants.DEFAULT_LOCALE) != (options[j].Tag == constants.DEFAULT_LOCALE) {
+			return options[i].Tag == constants.DEFAULT_LOCALE
+		}
+		return options[i].Tag < options[j].Tag
+	})
+	return options
+}
+
+// normalizeLocale returns the locale if it is shipped, or "" to use the
+// default locale.
+func normalizeLocale(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if _, ok := locales[tag]; ok {
+		return tag
+	}
+	return ""
+}
+
+// matchLocale returns the shipped locale for a language tag, falling back
+// from regional variants like es-MX to their base language.
+func matchLocale(tag string) string {
+	tag = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+	if locale := normalizeLocale(tag); locale != "" {
+		return locale
+	}
+	if base, _, found := strings.Cut(tag, "-"); found {
+		return normalizeLocale(base)
+	}
+	return ""
+}
+
+// negotiateLocale picks the locale the request's Accept-Language header
+// prefers most out of the shipped ones, or fallback when none of them is
+// acceptable.
+func negotiateLocale(r *http.Request, fallback string) string {
+	type languageRange struct {
+		tag     string
+		quality float64
+	}
+
+	var ranges []languageRange
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if quality > 0 {
+			ranges = append(ranges, languageRange{tag: tag, quality: quality})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].quality > ranges[j].quality })
+
+	for _, languageRange := range ranges {
+		if locale := matchLocale(languageRange.tag); locale != "" {
+			return locale
+		}
+	}
+	if locale := normalizeLocale(fallback); locale != "" {
+		return locale
+	}
+	return constants.DEFAULT_LOCALE
+}
+
+// overridableStringKeys are the keys owners can replace the text of, which is
+// everything visitors see on the guestbook page and the embed script. The
+// reply notification pages are shared by every guestbook and keep the
+// catalog text.
+func overridableStringKeys() []string {
+	var keys []string
+	for key := range locales[constants.DEFAULT_LOCALE] {
+		if key != "locale.name" && !strings.HasPrefix(key, "admin.") && !strings.HasPrefix(key, "notifications.") {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// parseStringOverrides reads the owner's replacements for individual strings
+// from the string_<key> form values. Empty values keep the catalog text.
+func parseStringOverrides(r *http.Request) (datatypes.JSONMap, error) {
+	overrides := datatypes.JSONMap{}
+	for _, key := range overridableStringKeys() {
+		value := strings.TrimSpace(r.FormValue("string_" + key))
+		if value == "" {
+			continue
+		}
+		if len(value) > constants.MAX_STRING_OVERRIDE_LENGTH {
+			return nil, fmt.Errorf("the text for %q is too long, maximum length is %d characters", key, constants.MAX_STRING_OVERRIDE_LENGTH)
+		}
+		overrides[key] = value
+	}
+	return overrides, nil
+}
+
+// StringOverrideField is a string owners can replace in the guestbook editor.
+type StringOverrideField struct {
+	Key     string
+	Default string
+	Value   string
+}
+
+// stringOverrideFields lists the overridable strings with their text in the
+// guestbook's locale and the owner's replacement, if any.
+func stringOverrideFields(guestbook *Guestbook) []StringOverrideField {
+	catalog := locales[guestbook.defaultLocale()]
+	var fields []StringOverrideField
+	for _, key := range overridableStringKeys() {
+		value, _ := guestbook.StringOverrides[key].(string)
+		fields = append(fields, StringOverrideField{Key: key, Default: catalog[key], Value: value})
+	}
+	return fields
+}
+
+// Translator looks up text in one locale.
+type Translator struct {
+	Locale  string
+	catalog Catalog
+}
+
+// newTranslator returns a translator for the locale, with overrides taking
+// precedence over the catalog.
+func newTranslator(locale string, overrides datatypes.JSONMap) *Translator {
+	locale = normalizeLocale(locale)
+	if locale == "" {
+		locale = constants.DEFAULT_LOCALE
+	}
+
+	catalog := Catalog{}
+	for key, text := range locales[locale] {
+		catalog[key] = text
+	}
+	for key, value := range overrides {
+		if text, ok := value.(string); ok && text != "" {
+			catalog[key] = text
+		}
+	}
+	return &Translator{Locale: locale, catalog: catalog}
+}
+
+// guestbookTranslator picks the locale for a visitor of the guestbook, a
+// locale query parameter (like the one the widget sends) wins over the
+// browser's preference. The owner's overrides are written in the guestbook's
+// own locale, so they only apply to visitors who get that one.
+func guestbookTranslator(r *http.Request, guestbook *Guestbook) *Translator {
+	locale := matchLocale(r.URL.Query().Get("locale"))
+	if locale == "" {
+		locale = negotiateLocale(r, guestbook.Locale)
+	}
+	if locale == guestbook.defaultLocale() {
+		return newTranslator(locale, guestbook.StringOverrides)
+	}
+	return newTranslator(locale, nil)
+}
+
+// defaultLocale returns the locale of the guestbook, or the app default if
+// the owner didn't pick a shipped one.
+func (g *Guestbook) defaultLocale() string {
+	if locale := normalizeLocale(g.Locale); locale != "" {
+		return locale
+	}
+	return constants.DEFAULT_LOCALE
+}
+
+// T returns the text for key with its placeholders filled in from args, given
+// as name and value pairs. Missing keys fall back to the default locale, and
+// then to the key itself.
+func (t *Translator) T(key string, args ...any) string {
+	text, ok := t.catalog[key]
+	if !ok {
+		text, ok = locales[constants.DEFAULT_LOCALE][key]
+	}
+	if !ok {
+		return key
+	}
+
+	for i := 0; i+1 < len(args); i += 2 {
+		text = strings.ReplaceAll(text, "{"+fmt.Sprint(args[i])+"}", fmt.Sprint(args[i+1]))
+	}
+	return text
+}
+
+// FormatDate renders a date with the locale's date.format and month names.
+func (t *Translator) FormatDate(date time.Time) string {
+	months := strings.Fields(t.T("date.months"))
+	if len(months) != 12 {
+		months = strings.Fields(locales[constants.DEFAULT_LOCALE]["date.months"])
+	}
+	return t.T("date.format", "month", months[date.Month()-1], "day", date.Day(), "year", date.Year())
+}
+
+// JSON returns the whole catalog for the embed script, which formats its
+// strings the same way as T.
+func (t *Translator) JSON() string {
+	data, err := json.Marshal(t.catalog)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// Strings returns the entries of the catalog whose key starts with prefix,
+// for scripts that only need part of it.
+func (t *Translator) Strings(prefix string) Catalog {
+	subset := Catalog{}
+	for key, text := range t.catalog {
+		if strings.HasPrefix(key, prefix) {
+			subset[key] = text
+		}
+	}
+	return subset
+}
+
+// Funcs returns the template functions that render text in this locale.
+func (t *Translator) Funcs() map[string]any {
+	return map[string]any{
+		"t":          t.T,
+		"formatDate": t.FormatDate,
+		"strings":    t.Strings,
+	}
+}
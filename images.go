@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // registered for image.Decode, GIFs are stored as PNG
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"guestbook/constants"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var imageNamePattern = regexp.MustCompile(`^[0-9a-f]{64}\.(png|jpg)$`)
+
+// Image is a validated image attachment. It is re-encoded from its pixels,
+// which drops EXIF and any other metadata of the upload.
+type Image struct {
+	Name      string
+	Data      []byte
+	Thumbnail []byte
+}
+
+// Size is what the image counts against the owner's storage quota.
+func (i *Image) Size() int64 {
+	return int64(len(i.Data) + len(i.Thumbnail))
+}
+
+func imageKey(name string) string {
+	return "images/" + name
+}
+
+func imageThumbnailKey(name string) string {
+	return "images/thumbs/" + name
+}
+
+func imageURL(hostURL, name string) string {
+	return fmt.Sprintf("%s/resources/images/%s", hostURL, name)
+}
+
+func imageThumbnailURL(hostURL, name string) string {
+	return fmt.Sprintf("%s/resources/images/thumbs/%s", hostURL, name)
+}
+
+func imageContentType(name string) string {
+	if strings.HasSuffix(name, ".jpg") {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// readImage validates the optional image attachment of a submission. It
+// returns nil if no image was attached.
+func readImage(guestbook Guestbook, r *http.Request) (*Image, error) {
+	file, _, err := r.FormFile("image")
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("The image could not be read")
+	}
+	defer file.Close()
+
+	if !guestbook.ImagesEnabled {
+		return nil, errors.New("Images are not enabled on this guestbook")
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(file, constants.MAX_IMAGE_BYTES+1))
+	if err != nil {
+		return nil, errors.New("The image could not be read")
+	}
+	if len(raw) > constants.MAX_IMAGE_BYTES {
+		return nil, fmt.Errorf("The image is too large, maximum size is %d MB", constants.MAX_IMAGE_BYTES/(1024*1024))
+	}
+
+	// the type is whatever the image decodes as, not what the client claims
+	config, format, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.New("The image must be a PNG, JPEG or GIF")
+	}
+	if config.Width > constants.MAX_IMAGE_DIMENSION || config.Height > constants.MAX_IMAGE_DIMENSION {
+		return nil, fmt.Errorf("The image can be at most %dx%d pixels", constants.MAX_IMAGE_DIMENSION, constants.MAX_IMAGE_DIMENSION)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.New("The image must be a PNG, JPEG or GIF")
+	}
+
+	extension := "png"
+	encode := func(w io.Writer, img image.Image) error { return png.Encode(w, img) }
+	if format == "jpeg" {
+		extension = "jpg"
+		encode = func(w io.Writer, img image.Image) error {
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+		}
+	}
+
+	var data, thumbnail bytes.Buffer
+	if err := encode(&data, img); err != nil {
+		return nil, errors.New("The image could not be processed")
+	}
+	if err := encode(&thumbnail, resizeToFit(img, constants.IMAGE_THUMBNAIL_SIZE)); err != nil {
+		return nil, errors.New("The image could not be processed")
+	}
+
+	sum := sha256.Sum256(data.Bytes())
+	return &Image{
+		Name:      hex.EncodeToString(sum[:]) + "." + extension,
+		Data:      data.Bytes(),
+		Thumbnail: thumbnail.Bytes(),
+	}, nil
+}
+
+// saveImage stores an image and its thumbnail.
+func saveImage(img *Image) error {
+	if err := uploadStorage.Put(imageKey(img.Name), img.Data); err != nil {
+		return err
+	}
+	return uploadStorage.Put(imageThumbnailKey(img.Name), img.Thumbnail)
+}
+
+// resizeToFit scales img down to fit in a size x size square by averaging
+// the pixels each thumbnail pixel covers. Smaller images are returned as is.
+func resizeToFit(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+
+	thumbWidth, thumbHeight := size, size
+	if width > height {
+		thumbHeight = max(1, height*size/width)
+	} else {
+		thumbWidth = max(1, width*size/height)
+	}
+
+	// averaging reads the pixel bytes directly, going through img.At for
+	// every pixel of a large upload is far too slow
+	src, ok := img.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for ty := 0; ty < thumbHeight; ty++ {
+		y0 := ty * height / thumbHeight
+		y1 := max(y0+1, (ty+1)*height/thumbHeight)
+		for tx := 0; tx < thumbWidth; tx++ {
+			x0 := tx * width / thumbWidth
+			x1 := max(x0+1, (tx+1)*width/thumbWidth)
+
+			var sum [4]uint64
+			var n uint64
+			for y := y0; y < y1; y++ {
+				row := src.Pix[y*src.Stride+x0*4 : y*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += uint64(row[i])
+					sum[1] += uint64(row[i+1])
+					sum[2] += uint64(row[i+2])
+					sum[3] += uint64(row[i+3])
+					n++
+				}
+			}
+			pixel := thumb.Pix[ty*thumb.Stride+tx*4:]
+			for i := range sum {
+				pixel[i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return thumb
+}
+
+func serveImage(w http.ResponseWriter, r *http.Request, thumbnail bool) {
+	name := chi.URLParam(r, "name")
+	if !imageNamePattern.MatchString(name) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	var count int64
+	result := db.Model(&Message{}).Where("image_name = ? AND approved = ?", name, true).Count(&count)
+	if result.Error != nil || count == 0 {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	key := imageKey(name)
+	if thumbnail {
+		key = imageThumbnailKey(name)
+	}
+	serveUpload(w, r, key, imageContentType(name), "public, max-age=3600")
+}
+
+// ImageHandler serves an image attachment as long as an approved message
+// uses it.
+func ImageHandler(w http.ResponseWriter, r *http.Request) {
+	serveImage(w, r, false)
+}
+
+// ImageThumbnailHandler serves the thumbnail of an image attachment.
+func ImageThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	serveImage(w, r, true)
+}
+
+// AdminImageHandler lets owners see the images on their guestbook, including
+// the ones waiting for approval. ?size=thumb serves the thumbnail.
+func AdminImageHandler(w http.ResponseWriter, r *http.Request) {
+	guestbookID := chi.URLParam(r, "guestbookID")
+	name := chi.URLParam(r, "name")
+	if !imageNamePattern.MatchString(name) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	var guestbook Guestbook
+	result := db.First(&guestbook, guestbookID)
+	if result.Error != nil {
+		http.Error(w, "Guestbook not found", http.StatusNotFound)
+		return
+	}
+
+	currentUser := getSignedInAdminOrFail(r)
+	if guestbook.AdminUserID != currentUser.ID {
+		http.Error(w, "You don't own this guestbook", http.StatusUnauthorized)
+		return
+	}
+
+	var count int64
+	result = db.Model(&Message{}).Where("image_name = ? AND guestbook_id = ?", name, guestbook.ID).Count(&count)
+	if result.Error != nil || count == 0 {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	key := imageKey(name)
+	if r.URL.Query().Get("size") == "thumb" {
+		key = imageThumbnailKey(name)
+	}
+	serveUpload(w, r, key, imageContentType(name), "private, max-age=3600")
+}
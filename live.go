@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"guestbook/constants"
+
+	"github.com/go-chi/httprate"
+)
+
+// Live event types sent to visitors watching a guestbook.
+const (
+	// A new approved message or reply, with the message as data.
+	liveEventMessage = "message"
+	// Messages that are gone, with their IDs as data.
+	liveEventDelete = "delete"
+	// Anything else that changed the messages, like edits or pins. Clients
+	// load the messages again.
+	liveEventRefresh = "refresh"
+)
+
+// LiveEvent is a change to the messages of a guestbook.
+type LiveEvent struct {
+	Type string
+	Data any
+}
+
+// liveSubscriber receives the events of one guestbook until its buffer
+// overflows, then events is closed so the client reconnects and catches up
+// instead of missing changes.
+type liveSubscriber struct {
+	guestbookID uint
+	client      string
+	events      chan LiveEvent
+}
+
+// LiveHub passes events from the handlers that change messages to the
+// visitors streaming them, within this process.
+type LiveHub struct {
+	mu                  sync.Mutex
+	subscribers         map[uint]map[*liveSubscriber]struct{}
+	clientStreams       map[string]int
+	bufferSize          int
+	maxStreamsPerClient int
+}
+
+var liveHub = NewLiveHub(constants.LIVE_EVENTS_BUFFER_SIZE, constants.LIVE_EVENTS_MAX_STREAMS_PER_CLIENT)
+
+// NewLiveHub creates a hub whose subscribers can fall behind by bufferSize
+// events, with at most maxStreamsPerClient subscribers per client address.
+func NewLiveHub(bufferSize, maxStreamsPerClient int) *LiveHub {
+	return &LiveHub{
+		subscribers:         map[uint]map[*liveSubscriber]struct{}{},
+		clientStreams:       map[string]int{},
+		bufferSize:          bufferSize,
+		maxStreamsPerClient: maxStreamsPerClient,
+	}
+}
+
+// Subscribe starts receiving the events of a guestbook for a client address,
+// it returns false when the client already has too many streams open.
+func (h *LiveHub) Subscribe(guestbookID uint, client string) (*liveSubscriber, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clientStreams[client] >= h.maxStreamsPerClient {
+		return nil, false
+	}
+	h.clientStreams[client]++
+
+	subscriber := &liveSubscriber{guestbookID: guestbookID, client: client, events: make(chan LiveEvent, h.bufferSize)}
+	if h.subscribers[guestbookID] == nil {
+		h.subscribers[guestbookID] = map[*liveSubscriber]struct{}{}
+	}
+	h.subscribers[guestbookID][subscriber] = struct{}{}
+	return subscriber, true
+}
+
+// Unsubscribe stops sending events to the subscriber and frees its slot for
+// the client address. Every subscriber has to be unsubscribed exactly once,
+// even after it was dropped.
+func (h *LiveHub) Unsubscribe(subscriber *liveSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(subscriber)
+	h.clientStreams[subscriber.client]--
+	if h.clientStreams[subscriber.client] <= 0 {
+		delete(h.clientStreams, subscriber.client)
+	}
+}
+
+func (h *LiveHub) remove(subscriber *liveSubscriber) {
+	subscribers := h.subscribers[subscriber.guestbookID]
+	if _, ok := subscribers[subscriber]; !ok {
+		return
+	}
+	delete(subscribers, subscriber)
+	if len(subscribers) == 0 {
+		delete(h.subscribers, subscriber.guestbookID)
+	}
+	close(subscriber.events)
+}
+
+// Publish sends an event to everyone watching the guestbook without waiting
+// for any of them. Subscribers with a full buffer are dropped.
+func (h *LiveHub) Publish(guestbookID uint, event LiveEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for subscriber := range h.subscribers[guestbookID] {
+		select {
+		case subscriber.events <- event:
+		default:
+			h.remove(subscriber)
+		}
+	}
+}
+
+// publishNewMessage tells visitors about a message or reply once it is
+// approved.
+func publishNewMessage(guestbook *Guestbook, message Message, hostURL string) {
+	if !message.Approved {
+		return
+	}
+	messages := []Message{message}
+	if err := decorateMessages(guestbook, messages, hostURL); err != nil {
+		log.Printf("WARN: could not publish message %d: %v", message.ID, err)
+		publishRefresh(guestbook.ID)
+		return
+	}
+	liveHub.Publish(guestbook.ID, LiveEvent{Type: liveEventMessage, Data: messages[0]})
+}
+
+// publishDeletedMessages tells visitors to remove messages, replies to them
+// included.
+func publishDeletedMessages(guestbookID uint, messageIDs []uint) {
+	liveHub.Publish(guestbookID, LiveEvent{Type: liveEventDelete, Data: messageIDs})
+}
+
+// publishRefresh tells visitors to load the messages again.
+func publishRefresh(guestbookID uint) {
+	liveHub.Publish(guestbookID, LiveEvent{Type: liveEventRefresh, Data: struct{}{}})
+}
+
+// publishMessageChange publishes an edited message depending on whether
+// visitors could see it before and can see it now.
+func publishMessageChange(guestbook *Guestbook, message Message, wasApproved bool, hostURL string) {
+	switch {
+	case message.Approved && !wasApproved:
+		publishNewMessage(guestbook, message, hostURL)
+	case !message.Approved && wasApproved:
+		publishDeletedMessages(guestbook.ID, []uint{message.ID})
+	case message.Approved:
+		publishRefresh(guestbook.ID)
+	}
+}
+
+// GuestbookEvents streams the changes to the messages of a guestbook as
+// server-sent events until the visitor leaves. Each client address can only
+// keep a few streams open, as every one of them holds a connection.
+func GuestbookEvents(w http.ResponseWriter, r *http.Request) {
+	guestbookID, ok := parseGuestbookIDParam(r)
+	if !ok {
+		http.Error(w, "Invalid guestbook ID", http.StatusBadRequest)
+		return
+	}
+
+	var guestbook Guestbook
+	if result := db.Select("id").First(&guestbook, guestbookID); result.Error != nil {
+		writeGuestbookLoadError(w, result.Error)
+		return
+	}
+
+	client, _ := httprate.KeyByIP(r)
+	subscriber, ok := liveHub.Subscribe(guestbook.ID, client)
+	if !ok {
+		http.Error(w, "Too many open streams", http.StatusTooManyRequests)
+		return
+	}
+	defer liveHub.Unsubscribe(subscriber)
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// an opening comment lets the client know the stream is up
+	fmt.Fprint(w, ": connected\n\n")
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(constants.LIVE_EVENTS_KEEPALIVE_SECONDS * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event, ok := <-subscriber.events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event.Data)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
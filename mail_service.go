@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"guestbook/constants"
 	"log"
+	"mime"
 	"net/mail"
+	"sort"
+	"strings"
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
@@ -15,7 +18,23 @@ import (
 	"github.com/karim-w/go-azure-communication-services/emails"
 )
 
+// headerLineBreaks turns line breaks into spaces, so values that come from
+// users (like a guestbook's website URL in a subject) can't add headers.
+var headerLineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// encodeMailHeader returns value as a single header line, encoded as
+// RFC 2047 words if it isn't plain ASCII.
+func encodeMailHeader(value string) string {
+	return mime.QEncoding.Encode("utf-8", headerLineBreaks.Replace(value))
+}
+
 func SendMail(recepients []string, subject, body string) error {
+	return SendMailWithHeaders(recepients, subject, body, nil)
+}
+
+// SendMailWithHeaders sends a mail with extra headers, like List-Unsubscribe.
+// The Azure client can't set custom headers, so they are only sent over SMTP.
+func SendMailWithHeaders(recepients []string, subject, body string, headers map[string]string) error {
 	mailerToUse := viper.GetString("mailer.mailer_name")
 	if mailerToUse == "azure_communication_service" {
 		from := viper.GetString("mailer.azure_communication_service.from_email")
@@ -28,7 +47,7 @@ func SendMail(recepients []string, subject, body string) error {
 			payload := emails.Payload{
 				SenderAddress: from,
 				Content: emails.Content{
-					Subject:   subject,
+					Subject:   headerLineBreaks.Replace(subject),
 					PlainText: body,
 				},
 				Recipients: emails.Recipients{
@@ -61,11 +80,22 @@ func SendMail(recepients []string, subject, body string) error {
 
 		auth := sasl.NewLoginClient(username, password)
 
+		names := make([]string, 0, len(headers))
+		for name := range headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		extraHeaders := ""
+		for _, name := range names {
+			extraHeaders += name + ": " + encodeMailHeader(headers[name]) + "\n"
+		}
+
 		var err error
 		for _, recipient := range recepients {
 			message := "From: " + from + "\n" +
 				"To: " + recipient + "\n" +
-				"Subject: " + subject + "\n\n" +
+				"Subject: " + encodeMailHeader(subject) + "\n" +
+				extraHeaders + "\n" +
 				body
 
 			to := []string{recipient}
@@ -114,3 +144,45 @@ The Guestbooks Team`, resetLink)
 
 	return SendMail([]string{recipient}, subject, body)
 }
+
+func SendVisitorConfirmationEmail(recipient, guestbookURL, confirmLink string) error {
+	subject := "[Guestbooks] Please confirm you want to be notified about replies"
+	body := fmt.Sprintf(`Hello,
+
+You left a message on the guestbook of '%s' and asked to be notified when the owner replies.
+Please click the link below to confirm:
+
+%s
+
+If you did not sign this guestbook, just ignore this email and your address will never be used.
+
+Regards,
+The Guestbooks Team`, guestbookURL, confirmLink)
+
+	return SendMail([]string{recipient}, subject, body)
+}
+
+func SendVisitorReplyEmail(recipient, guestbookURL, guestbookLink, unsubscribeLink, replyName, replyText string) error {
+	subject := "[Guestbooks] New reply to your message on '" + guestbookURL + "'"
+	body := fmt.Sprintf(`Hello,
+
+%s replied to the message you left on the guestbook of '%s':
+
+===BEGIN REPLY===
+%s
+===END REPLY===
+
+You can see the full conversation here: %s
+
+To stop receiving these notifications and delete your email address, click here: %s
+
+This is an autogenerated message from %s . Please don't answer since this mailbox is not monitored.`,
+		replyName, guestbookURL, replyText, guestbookLink, unsubscribeLink, constants.PUBLIC_URL)
+
+	// lets mail clients offer a one-click unsubscribe (RFC 8058)
+	headers := map[string]string{
+		"List-Unsubscribe":      "<" + unsubscribeLink + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+	return SendMailWithHeaders([]string{recipient}, subject, body, headers)
+}
@@ -1,17 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"guestbook/constants"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
-	textTemplate "text/template"
 	"time"
 
 	"github.com/fatih/color"
@@ -50,7 +47,7 @@ func main() {
 	// Notify signals channel on SIGINT and SIGTERM
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	r := initRouter()
+	r := initRouter(defaultRateLimits)
 
 	const portNum = ":6235"
 	go func() {
@@ -83,10 +80,20 @@ func initDatabase() {
 	}
 
 	// Migrate the schema
-	err = db.AutoMigrate(&Guestbook{}, &Message{}, &AdminUser{})
+	err = db.AutoMigrate(&Guestbook{}, &Message{}, &AdminUser{}, &Reaction{}, &ThemeAsset{}, &Theme{})
 	if err != nil {
 		log.Fatalf("failed to migrate database: %v", err)
 	}
+
+	if err := syncBuiltInThemes(); err != nil {
+		log.Fatalf("failed to sync built-in themes: %v", err)
+	}
+	if err := migrateBuiltInThemeMarkers(); err != nil {
+		log.Fatalf("failed to migrate built-in theme markers: %v", err)
+	}
+	if err := setupMessageSearch(db); err != nil {
+		log.Fatalf("failed to set up message search: %v", err)
+	}
 }
 
 func initCache() {
@@ -99,7 +106,16 @@ func initCache() {
 	log.Println("Message cache initialized (size: 1000, TTL: 10m)")
 }
 
-func initRouter() *chi.Mux {
+// rateLimits are how many requests per minute the rate limiters let through.
+type rateLimits struct {
+	General int // all routes, per IP
+	Submit  int // submitting, editing and deleting messages, per IP and endpoint
+	React   int // reactions, per IP
+}
+
+var defaultRateLimits = rateLimits{General: 100, Submit: 20, React: 30}
+
+func initRouter(limits rateLimits) *chi.Mux {
 
 	r := chi.NewRouter()
 
@@ -115,7 +131,7 @@ func initRouter() *chi.Mux {
 	r.Use(CORSMiddleware.Handler)
 	r.Use(RealIPMiddleware)
 	r.Use(Logger)
-	r.Use(httprate.LimitByIP(100, time.Minute)) // general rate limiter for all routes (shared across all routes)
+	r.Use(httprate.LimitByIP(limits.General, time.Minute)) // general rate limiter for all routes (shared across all routes)
 	r.Use(middleware.Recoverer)
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
@@ -167,6 +183,18 @@ func initRouter() *chi.Mux {
 		r.Get("/settings", AdminUserSettings)
 
 		r.Post("/settings", AdminUserSettings)
+
+		r.Get("/assets", AdminThemeAssets)
+		r.Post("/assets", AdminUploadThemeAsset)
+		r.Post("/assets/{assetID}/delete", AdminDeleteThemeAsset)
+
+		r.Get("/themes", AdminThemeGallery)
+		r.Get("/themes/new", AdminNewTheme)
+		r.Post("/themes", AdminCreateTheme)
+		r.Get("/themes/{themeID}/edit", AdminEditTheme)
+		r.Post("/themes/{themeID}/edit", AdminUpdateTheme)
+		r.Post("/themes/{themeID}/apply", AdminApplyTheme)
+		r.Post("/themes/{themeID}/delete", AdminDeleteTheme)
 		r.Post("/change-password", AdminChangePassword)
 
 		r.Get("/signin", AdminSignIn)
@@ -179,6 +207,7 @@ func initRouter() *chi.Mux {
 
 		r.Get("/guestbook/new", AdminCreateGuestbook)
 		r.Post("/guestbook/new", AdminCreateGuestbook)
+		r.Post("/guestbook/preview", AdminPreviewGuestbook)
 
 		r.Route("/guestbook/{guestbookID}", func(r chi.Router) {
 			r.Get("/", AdminShowGuestbook)
@@ -189,14 +218,19 @@ func initRouter() *chi.Mux {
 
 			r.Post("/delete", AdminDeleteGuestbook)
 
+			r.Get("/messages/ids", AdminMessageIDs)
 			r.Post("/messages/bulk-delete", AdminBulkDeleteMessages)
 
 			r.Route("/message/{messageID}", func(r chi.Router) {
 				r.Get("/edit", AdminEditMessage)
 				r.Post("/edit", AdminEditMessage)
 				r.Post("/delete", AdminDeleteMessage)
+				r.Post("/pin", AdminTogglePinMessage)
 				r.Post("/reply", AdminReplyToMessage)
 			})
+
+			r.Get("/drawing/{hash}.png", AdminDrawingHandler)
+			r.Get("/image/{name}", AdminImageHandler)
 		})
 	})
 
@@ -205,8 +239,8 @@ func initRouter() *chi.Mux {
 
 		// this means the user has at most N attempts to submit a message to a given guestbook in a minute
 		submitRateLimiter := httprate.Limit(
-			20,          // requests
-			time.Minute, // per duration
+			limits.Submit, // requests
+			time.Minute,   // per duration
 			httprate.WithKeyFuncs(httprate.KeyByIP, httprate.KeyByEndpoint),
 			httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, `Rate limited. Please slow down.`, http.StatusTooManyRequests)
@@ -215,43 +249,44 @@ func initRouter() *chi.Mux {
 
 		r.With(submitRateLimiter).
 			Post("/{guestbookID}/submit", GuestbookSubmit)
+		r.With(submitRateLimiter).
+			Post("/{guestbookID}/message/{messageID}/edit", VisitorEditMessage)
+		r.With(submitRateLimiter).
+			Post("/{guestbookID}/message/{messageID}/delete", VisitorDeleteMessage)
+
+		// reactions are cheap to send, so limit them per visitor across all messages
+		reactRateLimiter := httprate.Limit(
+			limits.React, // requests
+			time.Minute,  // per duration
+			httprate.WithKeyFuncs(httprate.KeyByIP),
+			httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `Rate limited. Please slow down.`, http.StatusTooManyRequests)
+			}),
+		)
+
+		r.With(reactRateLimiter).
+			Post("/{guestbookID}/message/{messageID}/react", MessageReact)
+
+		r.Get("/{guestbookID}/notifications/confirm", VisitorEmailConfirmHandler)
+		r.Post("/{guestbookID}/notifications/confirm", VisitorEmailConfirmHandler)
+		r.Get("/{guestbookID}/notifications/unsubscribe", VisitorEmailUnsubscribeHandler)
+		r.Post("/{guestbookID}/notifications/unsubscribe", VisitorEmailUnsubscribeHandler)
 	})
 
+	r.Get("/theme/{themeID}/style.css", ThemeStylesheet)
+	r.Get("/assets/user/{userID}/{file}", ThemeAssetHandler)
 	fileServer := http.FileServer(http.Dir("./assets"))
 	r.Handle("/assets/*", http.StripPrefix("/assets", fileServer))
 
 	r.Route("/resources", func(r chi.Router) {
-		r.Route("/js", func(r chi.Router) {
-			r.Get("/embed_script/{guestbookID}/script.js", func(w http.ResponseWriter, r *http.Request) {
-				guestbookID := chi.URLParam(r, "guestbookID")
-				template, err := textTemplate.ParseFiles("templates/resources/embed_javascript.js")
-				if err != nil {
-					log.Fatalf("Error parsing guestbook page template: %v", err)
-				}
-
-				hostUrl := constants.PUBLIC_URL
-				if constants.DEBUG_MODE {
-					hostUrl = "//" + r.Host
-				}
-
-				var guestbook Guestbook
-				result := db.First(&guestbook, guestbookID)
-				if result.Error != nil {
-					http.Error(w, "Guestbook not found", http.StatusInternalServerError)
-					return
-				}
+		r.Get("/avatar/{style}/{hash}.svg", AvatarHandler)
+		r.Get("/drawings/{hash}.png", DrawingHandler)
+		r.Get("/images/{name}", ImageHandler)
+		r.Get("/images/thumbs/{name}", ImageThumbnailHandler)
 
-				templateData := struct {
-					Guestbook Guestbook
-					HostUrl   string
-				}{
-					Guestbook: guestbook,
-					HostUrl:   hostUrl,
-				}
-
-				w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
-				template.Execute(w, templateData)
-			})
+		r.Route("/js", func(r chi.Router) {
+			r.Get("/guestbook-widget.js", GuestbookWidgetScript)
+			r.Get("/embed_script/{guestbookID}/script.js", EmbedScript)
 		})
 	})
 
@@ -259,123 +294,17 @@ func initRouter() *chi.Mux {
 
 	r.Route("/api", func(r chi.Router) {
 		r.Route("/v1", func(r chi.Router) {
-			r.Get("/get-guestbook-messages/{guestbookID}", func(w http.ResponseWriter, r *http.Request) {
-				guestbookID := chi.URLParam(r, "guestbookID")
-				guestbookIDUint, err := strconv.ParseUint(guestbookID, 10, 32)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				// Try to get from cache first
-				if cachedMessages, ok := messageCache.GetMessages(uint(guestbookIDUint)); ok {
-					w.Header().Set("Content-Type", "application/json")
-					w.Header().Set("X-Cache", "HIT")
-					json.NewEncoder(w).Encode(cachedMessages)
-					return
-				}
-
-				// v1 API - return all messages at top level of response, without pagination (backward compatibility)
-				var messages []Message
-				result := db.Where(&Message{GuestbookID: uint(guestbookIDUint), Approved: true, ParentMessageID: nil}).
-					Order("created_at DESC").
-					Preload("Replies", "approved = ?", true).
-					Find(&messages)
-				if result.Error != nil {
-					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-					return
-				}
-
-				// Store in cache
-				messageCache.SetMessages(uint(guestbookIDUint), messages)
-
-				w.Header().Set("Content-Type", "application/json")
-				w.Header().Set("X-Cache", "MISS")
-				json.NewEncoder(w).Encode(messages)
-			})
+			r.Get("/get-guestbook-messages/{guestbookID}", GetGuestbookMessagesV1)
 		})
 
 		r.Route("/v2", func(r chi.Router) {
-			r.Get("/get-guestbook-messages/{guestbookID}", func(w http.ResponseWriter, r *http.Request) {
-				guestbookID := chi.URLParam(r, "guestbookID")
-				guestbookIDUint, err := strconv.ParseUint(guestbookID, 10, 32)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				pageStr := r.URL.Query().Get("page")
-				limitStr := r.URL.Query().Get("limit")
-
-				page := 1
-				limit := 20 // Default page size
-
-				if pageStr != "" {
-					if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-						page = p
-					}
-				}
-
-				if limitStr != "" {
-					if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
-						limit = l
-					}
-				}
-
-				// Try to get from cache first
-				if cachedResponse, ok := messageCache.GetPaginatedResponse(uint(guestbookIDUint), page, limit); ok {
-					w.Header().Set("Content-Type", "application/json")
-					w.Header().Set("X-Cache", "HIT")
-					json.NewEncoder(w).Encode(cachedResponse)
-					return
-				}
-
-				offset := (page - 1) * limit
-
-				// Try to get count from cache
-				var totalCount int64
-				var countCached bool
-				if totalCount, countCached = messageCache.GetCount(uint(guestbookIDUint)); !countCached {
-					countResult := db.Model(&Message{}).Where(&Message{GuestbookID: uint(guestbookIDUint), Approved: true}).Count(&totalCount)
-					if countResult.Error != nil {
-						http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-						return
-					}
-					messageCache.SetCount(uint(guestbookIDUint), totalCount)
-				}
-
-				var messages []Message
-				result := db.Where(&Message{GuestbookID: uint(guestbookIDUint), Approved: true, ParentMessageID: nil}).
-					Order("created_at DESC").
-					Preload("Replies", "approved = ?", true).
-					Limit(limit).
-					Offset(offset).
-					Find(&messages)
-				if result.Error != nil {
-					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-					return
-				}
-
-				totalPages := int((totalCount + int64(limit) - 1) / int64(limit))
-
-				response := map[string]any{
-					"messages": messages,
-					"pagination": map[string]any{
-						"page":        page,
-						"limit":       limit,
-						"total":       totalCount,
-						"totalPages":  totalPages,
-						"hasNext":     page < totalPages,
-						"hasPrevious": page > 1,
-					},
-				}
-
-				// Store in cache
-				messageCache.SetPaginatedResponse(uint(guestbookIDUint), page, limit, response)
-
-				w.Header().Set("Content-Type", "application/json")
-				w.Header().Set("X-Cache", "MISS")
+			r.Get("/get-guestbook-messages/{guestbookID}", GetGuestbookMessagesV2)
+			r.Get("/get-guestbook-config/{guestbookID}", GetGuestbookConfigV2)
+		})
 
-				json.NewEncoder(w).Encode(response)
-			})
+		r.Route("/v3", func(r chi.Router) {
+			r.Get("/get-guestbook-messages/{guestbookID}", GetGuestbookMessagesV3)
+			r.Get("/guestbook-events/{guestbookID}", GuestbookEvents)
 		})
 	})
 
@@ -469,6 +398,12 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, which
+// streaming responses need to flush.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func (rw *responseWriter) Write(b []byte) (int, error) {
 	if !rw.wroteHeader {
 		rw.WriteHeader(http.StatusOK)
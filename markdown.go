@@ -0,0 +1,182 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// renderLimitedMarkdown renders the small Markdown subset guestbooks can opt
+// into: *emphasis*, **strong**, `inline code`, [links](https://...), "> "
+// blockquotes and line breaks. All other input is HTML-escaped, so the output
+// can only ever contain the tags produced here.
+func renderLimitedMarkdown(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+
+	var out strings.Builder
+	var quote []string
+
+	flushQuote := func() {
+		if len(quote) == 0 {
+			return
+		}
+		out.WriteString("<blockquote>")
+		writeMarkdownLines(&out, quote)
+		out.WriteString("</blockquote>")
+		quote = nil
+	}
+
+	var plain []string
+	flushPlain := func() {
+		if len(plain) == 0 {
+			return
+		}
+		writeMarkdownLines(&out, plain)
+		plain = nil
+	}
+
+	for _, line := range lines {
+		if rest, ok := strings.CutPrefix(line, ">"); ok {
+			flushPlain()
+			quote = append(quote, strings.TrimPrefix(rest, " "))
+			continue
+		}
+		if len(quote) > 0 {
+			flushQuote()
+			// the quote already ends the line, don't add an extra break
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+		}
+		plain = append(plain, line)
+	}
+	flushQuote()
+	flushPlain()
+
+	return out.String()
+}
+
+func writeMarkdownLines(out *strings.Builder, lines []string) {
+	for i, line := range lines {
+		if i > 0 {
+			out.WriteString("<br>")
+		}
+		out.WriteString(renderMarkdownInline(line, true))
+	}
+}
+
+// renderMarkdownInline renders the inline constructs of a single line.
+// allowLinks is false inside link text so links can't be nested.
+func renderMarkdownInline(s string, allowLinks bool) string {
+	var out strings.Builder
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == '`':
+			if end := indexRune(runes, '`', i+1); end > i+1 {
+				out.WriteString("<code>")
+				out.WriteString(html.EscapeString(string(runes[i+1 : end])))
+				out.WriteString("</code>")
+				i = end
+				continue
+			}
+
+		case r == '[' && allowLinks:
+			if label, href, end, ok := parseMarkdownLink(runes, i); ok {
+				out.WriteString(`<a href="`)
+				out.WriteString(html.EscapeString(href))
+				out.WriteString(`" rel="ugc nofollow" target="_blank">`)
+				out.WriteString(renderMarkdownInline(label, false))
+				out.WriteString("</a>")
+				i = end
+				continue
+			}
+
+		case r == '*' && i+1 < len(runes) && runes[i+1] == '*':
+			if end := indexDelimiter(runes, "**", i+2); end > i+2 && !unicode.IsSpace(runes[i+2]) {
+				out.WriteString("<strong>")
+				out.WriteString(renderMarkdownInline(string(runes[i+2:end]), allowLinks))
+				out.WriteString("</strong>")
+				i = end + 1
+				continue
+			}
+
+		case r == '*' || (r == '_' && (i == 0 || !isWordRune(runes[i-1]))):
+			if end := indexRune(runes, r, i+1); end > i+1 && !unicode.IsSpace(runes[i+1]) &&
+				(r != '_' || end+1 >= len(runes) || !isWordRune(runes[end+1])) {
+				out.WriteString("<em>")
+				out.WriteString(renderMarkdownInline(string(runes[i+1:end]), allowLinks))
+				out.WriteString("</em>")
+				i = end
+				continue
+			}
+		}
+
+		out.WriteString(html.EscapeString(string(r)))
+	}
+
+	return out.String()
+}
+
+// parseMarkdownLink parses "[label](href)" starting at runes[start]. Only
+// absolute http(s) and mailto links are accepted.
+func parseMarkdownLink(runes []rune, start int) (label, href string, end int, ok bool) {
+	closeLabel := indexRune(runes, ']', start+1)
+	if closeLabel <= start+1 || closeLabel+1 >= len(runes) || runes[closeLabel+1] != '(' {
+		return "", "", 0, false
+	}
+
+	closeHref := indexRune(runes, ')', closeLabel+2)
+	if closeHref < 0 {
+		return "", "", 0, false
+	}
+
+	href = strings.TrimSpace(string(runes[closeLabel+2 : closeHref]))
+	if href == "" || strings.ContainsAny(href, " \t") {
+		return "", "", 0, false
+	}
+
+	parsed, err := url.Parse(href)
+	if err != nil {
+		return "", "", 0, false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https":
+		if parsed.Host == "" {
+			return "", "", 0, false
+		}
+	case "mailto":
+	default:
+		return "", "", 0, false
+	}
+
+	return string(runes[start+1 : closeLabel]), parsed.String(), closeHref, true
+}
+
+func indexRune(runes []rune, r rune, from int) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+func indexDelimiter(runes []rune, delim string, from int) int {
+	d := []rune(delim)
+	for i := from; i+len(d) <= len(runes); i++ {
+		if string(runes[i:i+len(d)]) == delim {
+			return i
+		}
+	}
+	return -1
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
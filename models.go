@@ -12,14 +12,49 @@ type Guestbook struct {
 	AdminUserID      uint `gorm:"index"`
 	RequiresApproval bool `gorm:"default:false"`
 	PowEnabled       bool `gorm:"default:false"`
+	MarkdownEnabled  bool `gorm:"default:false"`
+
+	// Let visitors search the messages through the q parameter of the API.
+	PublicSearchEnabled bool `gorm:"default:false"`
+
+	// Let visitors reply to messages, nested up to MaxReplyDepth levels.
+	VisitorRepliesEnabled bool `gorm:"default:false"`
+	MaxReplyDepth         int
+
+	// Minutes during which visitors can edit or delete their own message, 0
+	// disables it.
+	EditWindowMinutes int
 
 	ChallengeQuestion      string
 	ChallengeAnswer        string
 	ChallengeHint          string
 	ChallengeFailedMessage string
 
+	// Gallery theme used by the guestbook page, CustomPageCSS is applied on top.
+	ThemeID *uint `gorm:"index"`
+
 	CustomPageCSS string `gorm:"type:text"`
 
+	CustomFields datatypes.JSONSlice[CustomField] `gorm:"type:json"`
+
+	// Style of the generated author avatars, avatars are disabled when empty.
+	AvatarStyle string
+
+	// Emoji visitors can react to messages with, reactions are disabled when empty.
+	ReactionEmojis datatypes.JSONSlice[string] `gorm:"type:json"`
+
+	// Whether visitors can attach a small drawing to their message.
+	DrawingsEnabled bool `gorm:"default:false"`
+
+	// Whether visitors can attach an image to their message.
+	ImagesEnabled bool `gorm:"default:false"`
+
+	// Locale visitors get when their browser doesn't ask for a shipped one.
+	Locale string
+	// Owner replacements for catalog strings, keyed by message key. They are
+	// only used for visitors that get the guestbook's own locale.
+	StringOverrides datatypes.JSONMap `gorm:"type:json"`
+
 	Messages []Message
 }
 
@@ -34,6 +69,47 @@ type Message struct {
 	Guestbook       Guestbook `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
 	ParentMessageID *uint     `gorm:"index"`
 	Replies         []Message `gorm:"foreignKey:ParentMessageID"`
+	// Pinned messages are shown before all others.
+	Pinned bool `gorm:"default:false"`
+
+	// Answers to the guestbook custom fields, keyed by field ID.
+	CustomFieldValues datatypes.JSONMap `gorm:"type:json" json:"-"`
+	// Answers resolved against the current field definitions, for display.
+	CustomFieldAnswers []CustomFieldAnswer `gorm:"-" json:",omitempty"`
+
+	// Whether the message is shallow enough to be replied to.
+	CanReply bool `gorm:"-" json:",omitempty"`
+
+	// Generated avatar of the author, only set when the guestbook has avatars.
+	AvatarURL string `gorm:"-" json:",omitempty"`
+
+	// Number of visitor reactions per emoji.
+	Reactions map[string]int64 `gorm:"-" json:",omitempty"`
+
+	// Sanitized HTML rendering of Text, only set when the guestbook allows
+	// limited Markdown formatting.
+	TextHTML string `gorm:"-" json:",omitempty"`
+
+	// Content hash of the attached drawing, if any.
+	DrawingHash string `gorm:"index" json:"-"`
+	// Public URL of the attached drawing.
+	DrawingURL string `gorm:"-" json:",omitempty"`
+
+	// File name of the attached image and the bytes it takes up in storage.
+	ImageName string `gorm:"index" json:"-"`
+	ImageSize int64  `json:"-"`
+	// Public URLs of the attached image and its thumbnail.
+	ImageURL          string `gorm:"-" json:",omitempty"`
+	ImageThumbnailURL string `gorm:"-" json:",omitempty"`
+
+	// Optional visitor email, only used to notify the visitor when the owner
+	// replies. Stored encrypted and never serialized or shown to anyone.
+	VisitorEmailEncrypted string `json:"-"`
+	VisitorEmailConfirmed bool   `gorm:"default:false" json:"-"`
+	VisitorEmailToken     string `gorm:"index" json:"-"`
+
+	// Hash of the secret token the author can edit or delete the message with.
+	EditTokenHash string `json:"-"`
 }
 
 // AdminUser represents an admin user with access to the admin panel
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// guestbookPreview is returned to the editor for every change to the
+// styling. HTML is shown in a sandboxed iframe, the violations next to the
+// CSS editor.
+type guestbookPreview struct {
+	Valid      bool           `json:"valid"`
+	Message    string         `json:"message,omitempty"`
+	Violations []CSSViolation `json:"violations"`
+	HTML       string         `json:"html"`
+}
+
+// previewMessages returns sample messages that show off the features the
+// guestbook has enabled.
+func previewMessages(guestbook *Guestbook, ownerName, hostURL string) ([]Message, error) {
+	now := time.Now()
+	website := "https://example.com"
+
+	answers := datatypes.JSONMap{}
+	for _, field := range guestbook.CustomFields {
+		switch {
+		case field.Type == CustomFieldCheckbox:
+			answers[field.ID] = "true"
+		case len(field.Options) > 0:
+			answers[field.ID] = field.Options[0]
+		default:
+			answers[field.ID] = "Sample answer"
+		}
+	}
+
+	messages := []Message{
+		{
+			Name:              "Ada",
+			Text:              "What a *lovely* site! I spent way too long reading everything.\n\n> the links page is the best part",
+			Website:           &website,
+			Pinned:            true,
+			CustomFieldValues: answers,
+			Replies: []Message{
+				{Name: ownerName, Text: "Thank you so much for visiting!"},
+			},
+		},
+		{Name: "Grace", Text: "Hello from across the web, see you around."},
+		{Name: "Linus", Text: "Found you through the webring. Great **guestbook**!"},
+	}
+	for i := range messages {
+		messages[i].CreatedAt = now.Add(-time.Duration(i+1) * 26 * time.Hour)
+		for j := range messages[i].Replies {
+			messages[i].Replies[j].CreatedAt = messages[i].CreatedAt.Add(time.Hour)
+		}
+	}
+
+	if err := decorateMessages(guestbook, messages, hostURL); err != nil {
+		return nil, err
+	}
+	if len(guestbook.ReactionEmojis) > 0 {
+		messages[0].Reactions = map[string]int64{guestbook.ReactionEmojis[0]: 3}
+	}
+	return messages, nil
+}
+
+// AdminPreviewGuestbook renders the guestbook page with the unsaved settings
+// from the editor form, so owners see their CSS before saving it. The CSS is
+// checked exactly like on save.
+func AdminPreviewGuestbook(w http.ResponseWriter, r *http.Request) {
+	currentUser := getSignedInAdminOrFail(r)
+
+	customPageCSS := strings.TrimSpace(r.FormValue("customPageCSS"))
+	valid, message := validateCSS(customPageCSS)
+	pageCSS, violations := sanitizeCSS(customPageCSS)
+	if violations == nil {
+		violations = []CSSViolation{}
+	}
+
+	// the guestbook being edited may use a theme that is no longer published
+	var currentThemeID *uint
+	if guestbookID, ok := parseID(r.FormValue("guestbookID")); ok {
+		var guestbook Guestbook
+		if err := db.First(&guestbook, guestbookID).Error; err == nil && guestbook.AdminUserID == currentUser.ID {
+			currentThemeID = guestbook.ThemeID
+		}
+	}
+	themeURL := ""
+	if themeID, err := parseThemeIDForm(r.FormValue("themeID"), currentUser.ID, currentThemeID); err == nil && themeID != nil {
+		var theme Theme
+		if err := db.First(&theme, *themeID).Error; err == nil {
+			themeURL = theme.StylesheetURL()
+		}
+	}
+
+	// invalid definitions are reported when saving, the preview just leaves
+	// them out
+	customFields, _ := parseCustomFieldsForm(r.FormValue("customFields"))
+	reactionEmojis, _ := parseReactionEmojis(r.FormValue("reactionEmojis"))
+	stringOverrides, _ := parseStringOverrides(r)
+	guestbook := Guestbook{
+		WebsiteURL:            r.FormValue("websiteURL"),
+		MarkdownEnabled:       r.FormValue("markdownEnabled") == "on",
+		VisitorRepliesEnabled: r.FormValue("visitorRepliesEnabled") == "on",
+		MaxReplyDepth:         parseMaxReplyDepth(r.FormValue("maxReplyDepth")),
+		AvatarStyle:           normalizeAvatarStyle(r.FormValue("avatarStyle")),
+		CustomFields:          customFields,
+		ReactionEmojis:        reactionEmojis,
+		Locale:                normalizeLocale(r.FormValue("locale")),
+		StringOverrides:       stringOverrides,
+	}
+
+	messages, err := previewMessages(&guestbook, currentUser.ReplyName(), publicHostURL(r))
+	if err != nil {
+		http.Error(w, "Error rendering preview", http.StatusInternalServerError)
+		return
+	}
+
+	// owners preview their guestbook as visitors of its own locale see it
+	translator := newTranslator(guestbook.Locale, guestbook.StringOverrides)
+
+	data := guestbookPageData{
+		ID:              "preview",
+		Locale:          translator.Locale,
+		WebsiteURL:      guestbook.WebsiteURL,
+		CustomPageCSS:   template.CSS(pageCSS),
+		ThemeURL:        themeURL,
+		PowEnabled:      r.FormValue("powEnabled") == "on",
+		MarkdownEnabled: guestbook.MarkdownEnabled,
+		CustomFields:    guestbook.CustomFields,
+		Messages:        messages,
+		Pagination:      PaginationInfo{Page: 1, Limit: len(messages), Total: int64(len(messages)), TotalPages: 1},
+	}
+
+	var page bytes.Buffer
+	if err := executeGuestbookTemplate(&page, data, translator); err != nil {
+		http.Error(w, "Error rendering preview", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(guestbookPreview{
+		Valid:      valid,
+		Message:    message,
+		Violations: violations,
+		HTML:       page.String(),
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"guestbook/constants"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reaction is a single visitor's emoji reaction to a message. Visitors are
+// identified by a salted hash so that no IP addresses are stored.
+type Reaction struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	MessageID   uint   `gorm:"uniqueIndex:idx_reactions_visitor"`
+	Emoji       string `gorm:"uniqueIndex:idx_reactions_visitor"`
+	VisitorHash string `gorm:"uniqueIndex:idx_reactions_visitor"`
+}
+
+// deleteReactions removes the reactions to the messages matched by query.
+// They hold visitor hashes, so they must not outlive their messages. Deletes
+// of messages are soft, so this must be called before deleting them.
+func deleteReactions(tx *gorm.DB, query *gorm.DB) error {
+	return tx.Where("message_id IN (?)", query.Model(&Message{}).Select("id")).Delete(&Reaction{}).Error
+}
+
+// parseReactionEmojis parses the space separated reaction emoji configured
+// by the guestbook owner.
+func parseReactionEmojis(raw string) (datatypes.JSONSlice[string], error) {
+	emojis := datatypes.JSONSlice[string]{}
+	for _, emoji := range strings.Fields(raw) {
+		if slices.Contains(emojis, emoji) {
+			continue
+		}
+		if len(emoji) > constants.MAX_REACTION_EMOJI_BYTES {
+			return nil, fmt.Errorf("reaction '%s' is too long", emoji)
+		}
+		for _, r := range emoji {
+			if r < 128 {
+				return nil, fmt.Errorf("reaction '%s' is not an emoji", emoji)
+			}
+		}
+		emojis = append(emojis, emoji)
+	}
+
+	if len(emojis) > constants.MAX_REACTION_EMOJIS {
+		return nil, fmt.Errorf("a guestbook can have at most %d reactions", constants.MAX_REACTION_EMOJIS)
+	}
+
+	return emojis, nil
+}
+
+// reactionVisitorHash identifies a visitor for a single message, so the same
+// visitor can't be correlated across messages.
+func reactionVisitorHash(r *http.Request, messageID uint) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	mac := hmac.New(sha256.New, deriveKey("reaction-visitor"))
+	fmt.Fprintf(mac, "%s|%d", ip, messageID)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadReactionCounts returns the number of reactions per emoji for each of
+// the given messages, limited to the emoji the guestbook currently allows.
+func loadReactionCounts(messageIDs []uint, allowedEmojis []string) (map[uint]map[string]int64, error) {
+	counts := map[uint]map[string]int64{}
+	if len(messageIDs) == 0 || len(allowedEmojis) == 0 {
+		return counts, nil
+	}
+
+	var rows []struct {
+		MessageID uint
+		Emoji     string
+		Count     int64
+	}
+	result := db.Model(&Reaction{}).
+		Select("message_id, emoji, COUNT(*) AS count").
+		Where("message_id IN ? AND emoji IN ?", messageIDs, allowedEmojis).
+		Group("message_id, emoji").
+		Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	for _, row := range rows {
+		if counts[row.MessageID] == nil {
+			counts[row.MessageID] = map[string]int64{}
+		}
+		counts[row.MessageID][row.Emoji] = row.Count
+	}
+	return counts, nil
+}
+
+// MessageReact records a visitor reaction on an approved message and returns
+// the updated reaction counts for that message.
+func MessageReact(w http.ResponseWriter, r *http.Request) {
+	guestbookID, ok := parseGuestbookIDParam(r)
+	if !ok {
+		http.Error(w, "Invalid guestbook ID", http.StatusBadRequest)
+		return
+	}
+
+	messageID, err := strconv.ParseUint(chi.URLParam(r, "messageID"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	var guestbook Guestbook
+	if result := db.First(&guestbook, guestbookID); result.Error != nil {
+		writeGuestbookLoadError(w, result.Error)
+		return
+	}
+
+	emoji := strings.TrimSpace(r.FormValue("emoji"))
+	if !slices.Contains(guestbook.ReactionEmojis, emoji) {
+		http.Error(w, "This reaction is not allowed on this guestbook", http.StatusBadRequest)
+		return
+	}
+
+	var message Message
+	result := db.Where("id = ? AND guestbook_id = ? AND approved = ?", messageID, guestbook.ID, true).First(&message)
+	if result.Error != nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	if guestbook.PowEnabled {
+		powChallenge := strings.TrimSpace(r.FormValue("powChallenge"))
+		powNonce := strings.TrimSpace(r.FormValue("powNonce"))
+		if powChallenge == "" || powNonce == "" || !powChallengeStore.VerifyPow(powChallenge, powNonce, guestbook.ID) {
+			http.Error(w, "Proof of work verification failed. Please reload the page and try again.", http.StatusForbidden)
+			return
+		}
+	}
+
+	// reacting twice with the same emoji is a no-op
+	reaction := Reaction{
+		MessageID:   message.ID,
+		Emoji:       emoji,
+		VisitorHash: reactionVisitorHash(r, message.ID),
+	}
+	result = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&reaction)
+	if result.Error != nil {
+		http.Error(w, "Error saving reaction", http.StatusInternalServerError)
+		return
+	}
+
+	if result.RowsAffected > 0 {
+		// Invalidate cache for this guestbook since the counts changed
+		messageCache.InvalidateGuestbook(guestbook.ID)
+		publishRefresh(guestbook.ID)
+	}
+
+	counts, err := loadReactionCounts([]uint{message.ID}, guestbook.ReactionEmojis)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	reactions := counts[message.ID]
+	if reactions == nil {
+		reactions = map[string]int64{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"reactions": reactions})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"guestbook/constants"
+
+	"gorm.io/gorm"
+)
+
+// ReplyDepthLimit returns how deeply replies can be nested on this guestbook.
+// Without visitor replies only the owner can reply, and only to top-level
+// messages.
+func (g Guestbook) ReplyDepthLimit() int {
+	if !g.VisitorRepliesEnabled || g.MaxReplyDepth < 1 {
+		return 1
+	}
+	return min(g.MaxReplyDepth, constants.MAX_REPLY_DEPTH)
+}
+
+// parseMaxReplyDepth parses the reply depth from the guestbook editor,
+// clamped to the supported range.
+func parseMaxReplyDepth(raw string) int {
+	depth, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || depth < 1 {
+		return 1
+	}
+	return min(depth, constants.MAX_REPLY_DEPTH)
+}
+
+// messageDepth returns the nesting depth of a message, top-level messages
+// have a depth of 0.
+func messageDepth(message Message) (int, error) {
+	depth := 0
+	for message.ParentMessageID != nil {
+		depth++
+		if depth > constants.MAX_REPLY_DEPTH {
+			return depth, nil
+		}
+
+		var parent Message
+		if result := db.Select("id, parent_message_id").First(&parent, *message.ParentMessageID); result.Error != nil {
+			return 0, result.Error
+		}
+		message = parent
+	}
+	return depth, nil
+}
+
+// preloadReplies preloads depth levels of replies below path (e.g. "Replies"
+// or "Messages.Replies"), each level filtered through scope.
+func preloadReplies(query *gorm.DB, path string, depth int, scope func(*gorm.DB) *gorm.DB) *gorm.DB {
+	for i := 0; i < depth; i++ {
+		query = query.Preload(path, scope)
+		path += ".Replies"
+	}
+	return query
+}
+
+// approvedReplies only shows approved replies, oldest first.
+func approvedReplies(db *gorm.DB) *gorm.DB {
+	return db.Where("approved = ?", true).Order("created_at ASC")
+}
+
+// markRepliable sets CanReply on messages and their replies that are shallow
+// enough to be replied to.
+func markRepliable(messages []Message, depth, limit int) {
+	for i := range messages {
+		messages[i].CanReply = depth < limit
+		markRepliable(messages[i].Replies, depth+1, limit)
+	}
+}
+
+// readParentMessageID validates the optional parentMessageID of a visitor
+// submission. It returns nil when the submission is not a reply.
+func readParentMessageID(guestbook Guestbook, r *http.Request) (*uint, error) {
+	rawParentID := strings.TrimSpace(r.FormValue("parentMessageID"))
+	if rawParentID == "" {
+		return nil, nil
+	}
+
+	if !guestbook.VisitorRepliesEnabled {
+		return nil, errors.New("Replies are not enabled on this guestbook")
+	}
+
+	parentID, err := strconv.ParseUint(rawParentID, 10, 32)
+	if err != nil {
+		return nil, errors.New("Invalid parent message")
+	}
+
+	var parent Message
+	result := db.Where("id = ? AND guestbook_id = ? AND approved = ?", parentID, guestbook.ID, true).First(&parent)
+	if result.Error != nil {
+		return nil, errors.New("The message you are replying to does not exist")
+	}
+
+	depth, err := messageDepth(parent)
+	if err != nil {
+		return nil, errors.New("The message you are replying to does not exist")
+	}
+	if depth+1 > guestbook.ReplyDepthLimit() {
+		return nil, errors.New("Replies can't be nested this deep on this guestbook")
+	}
+
+	return &parent.ID, nil
+}
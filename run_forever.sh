@@ -3,7 +3,7 @@
 # run forever, even if we fail
 while true; do
     git pull
-    go build -tags release -o guestbooks
+    go build -tags "release sqlite_fts5" -o guestbooks
     ./guestbooks
     sleep 1
 done
\ No newline at end of file
@@ -5,9 +5,32 @@ Note that this will do a HARD delete of the data. This means that the data will
 Only to be used when someone requests to be purged from the system.
 """
 
+import os
+import re
+import shutil
 import sys
 import sqlite3
 
+UPLOADS_DIR = 'uploads'
+# theme assets are stored per user under this directory
+ASSETS_DIR = os.path.join(UPLOADS_DIR, 'assets')
+DRAWINGS_DIR = os.path.join(UPLOADS_DIR, 'drawings')
+IMAGES_DIR = os.path.join(UPLOADS_DIR, 'images')
+
+DRAWING_HASH_PATTERN = re.compile(r'^[0-9a-f]{64}$')
+IMAGE_NAME_PATTERN = re.compile(r'^[0-9a-f]{64}\.(png|jpg)$')
+
+USER_MESSAGES = "SELECT id FROM messages WHERE guestbook_id IN (SELECT id FROM guestbooks WHERE admin_user_id=?)"
+
+def file_in_use(cursor, column, value):
+    """Whether a message that is not being deleted still uses the upload."""
+    cursor.execute(f"SELECT COUNT(*) FROM messages WHERE {column}=? AND deleted_at IS NULL", (value,))
+    return cursor.fetchone()[0] > 0
+
+def remove_upload(path):
+    if os.path.isfile(path):
+        os.remove(path)
+
 def main(username):
     if not username:
         print("Usage: show_all_data_for_user.py <username>")
@@ -49,6 +72,22 @@ def main(username):
 
         print(f"\t Found {len(message_rows)} messages for guestbook {row_data['id']}")
 
+    cursor.execute("SELECT name, hash, extension FROM theme_assets WHERE admin_user_id=?", (user_id,))
+    asset_rows = cursor.fetchall()
+
+    print()
+    print(f"Found {len(asset_rows)} theme assets for user {username}")
+    for name, file_hash, extension in asset_rows:
+        print(f"\t {name} ({file_hash}.{extension})")
+
+    cursor.execute("SELECT id, name, author FROM themes WHERE admin_user_id=?", (user_id,))
+    theme_rows = cursor.fetchall()
+
+    print()
+    print(f"Found {len(theme_rows)} themes for user {username}")
+    for theme_id, name, author in theme_rows:
+        print(f"\t Theme ID: {theme_id}, name: {name}, author: {author}")
+
 
     # now ask if user wants to delete all data for this user
     print()
@@ -56,11 +95,37 @@ def main(username):
     response = input("yes/no: ")
 
     if response.lower() == "yes":
-        cursor.execute("DELETE FROM admin_users WHERE id=?", (user_id,))
-        cursor.execute("DELETE FROM guestbooks WHERE admin_user_id=?", (user_id,))
+        # collect the uploads of the messages before they are gone
+        cursor.execute(f"SELECT DISTINCT drawing_hash FROM messages WHERE drawing_hash <> '' AND id IN ({USER_MESSAGES})", (user_id,))
+        drawing_hashes = [row[0] for row in cursor.fetchall()]
+        cursor.execute(f"SELECT DISTINCT image_name FROM messages WHERE image_name <> '' AND id IN ({USER_MESSAGES})", (user_id,))
+        image_names = [row[0] for row in cursor.fetchall()]
+
+        # other guestbooks may use the user's published themes, they go back
+        # to the default style
+        cursor.execute("UPDATE guestbooks SET theme_id=NULL WHERE theme_id IN (SELECT id FROM themes WHERE admin_user_id=?)", (user_id,))
+        cursor.execute("DELETE FROM themes WHERE admin_user_id=?", (user_id,))
+        cursor.execute("DELETE FROM theme_assets WHERE admin_user_id=?", (user_id,))
+        cursor.execute(f"DELETE FROM reactions WHERE message_id IN ({USER_MESSAGES})", (user_id,))
         cursor.execute("DELETE FROM messages WHERE guestbook_id IN (SELECT id FROM guestbooks WHERE admin_user_id=?)", (user_id,))
+        cursor.execute("DELETE FROM guestbooks WHERE admin_user_id=?", (user_id,))
+        cursor.execute("DELETE FROM admin_users WHERE id=?", (user_id,))
 
         conn.commit()
+
+        user_assets_dir = os.path.join(ASSETS_DIR, str(user_id))
+        if os.path.isdir(user_assets_dir):
+            shutil.rmtree(user_assets_dir)
+
+        # the same upload may be attached to another user's message
+        for drawing_hash in drawing_hashes:
+            if DRAWING_HASH_PATTERN.match(drawing_hash) and not file_in_use(cursor, 'drawing_hash', drawing_hash):
+                remove_upload(os.path.join(DRAWINGS_DIR, drawing_hash + '.png'))
+        for image_name in image_names:
+            if IMAGE_NAME_PATTERN.match(image_name) and not file_in_use(cursor, 'image_name', image_name):
+                remove_upload(os.path.join(IMAGES_DIR, image_name))
+                remove_upload(os.path.join(IMAGES_DIR, 'thumbs', image_name))
+
         print("Data deleted")
     else:
         print("Data not deleted")
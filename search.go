@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"guestbook/constants"
+
+	"gorm.io/gorm"
+)
+
+// messageSearchFTS is set when the database has SQLite's FTS5 extension
+// (build with -tags sqlite_fts5) and messages_fts indexes the name and text
+// of every message. Searches fall back to LIKE without it.
+var messageSearchFTS bool
+
+var errSearchDisabled = errors.New("search is not enabled for this guestbook")
+
+// likeEscaper escapes the wildcards of LIKE patterns, used with ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// messageSearchTriggers keep messages_fts in sync with the messages table.
+var messageSearchTriggers = map[string]string{
+	"messages_fts_insert": `CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts(rowid, name, text) VALUES (new.id, new.name, new.text);
+	END`,
+	"messages_fts_delete": `CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, name, text) VALUES ('delete', old.id, old.name, old.text);
+	END`,
+	"messages_fts_update": `CREATE TRIGGER messages_fts_update AFTER UPDATE OF name, text ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, name, text) VALUES ('delete', old.id, old.name, old.text);
+		INSERT INTO messages_fts(rowid, name, text) VALUES (new.id, new.name, new.text);
+	END`,
+}
+
+// setupMessageSearch creates the full-text index of messages when the
+// database supports it. Without FTS5 the triggers are dropped, as they would
+// make every write to messages fail, and the index is rebuilt the next time
+// the server runs with FTS5.
+func setupMessageSearch(db *gorm.DB) error {
+	messageSearchFTS = false
+	if db.Dialector.Name() != "sqlite" {
+		return nil
+	}
+
+	err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(name, text, content='messages', content_rowid='id')`).Error
+	if err != nil {
+		if !strings.Contains(err.Error(), "no such module") {
+			return err
+		}
+		log.Println("SQLite was built without FTS5, searching messages with LIKE")
+		for name := range messageSearchTriggers {
+			if err := db.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var triggers int64
+	db.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'messages_fts_%'").Scan(&triggers)
+	if triggers != int64(len(messageSearchTriggers)) {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for name, trigger := range messageSearchTriggers {
+				if err := tx.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+					return err
+				}
+				if err := tx.Exec(trigger).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Exec("INSERT INTO messages_fts(messages_fts) VALUES ('rebuild')").Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	messageSearchFTS = true
+	return nil
+}
+
+// searchMessages narrows a query on messages to the ones whose name or text
+// contain every word of search, words also match as prefixes.
+func searchMessages(query *gorm.DB, search string) *gorm.DB {
+	words := strings.Fields(search)
+	if len(words) == 0 {
+		return query
+	}
+
+	if messageSearchFTS {
+		terms := make([]string, len(words))
+		for i, word := range words {
+			// quoted so FTS5 operators in the search are matched literally
+			terms[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"*`
+		}
+		return query.Where("messages.id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)", strings.Join(terms, " "))
+	}
+
+	for _, word := range words {
+		pattern := "%" + likeEscaper.Replace(word) + "%"
+		query = query.Where(`(messages.name LIKE ? ESCAPE '\' OR messages.text LIKE ? ESCAPE '\')`, pattern, pattern)
+	}
+	return query
+}
+
+// MessageFilter narrows down the messages owners review. Zero values don't
+// filter anything.
+type MessageFilter struct {
+	Search string
+	// part of the author name
+	Author string
+	// "approved" or "pending"
+	Status string
+	// YYYY-MM-DD, both days included
+	From string
+	To   string
+	// "yes" or "no"
+	HasWebsite string
+	// "yes" or "no"
+	HasReplies string
+}
+
+// parseMessageFilter reads the filter from the query string of the admin
+// guestbook view.
+func parseMessageFilter(r *http.Request) (MessageFilter, error) {
+	query := r.URL.Query()
+	filter := MessageFilter{
+		Search: strings.TrimSpace(query.Get("q")),
+		Author: strings.TrimSpace(query.Get("author")),
+		From:   strings.TrimSpace(query.Get("from")),
+		To:     strings.TrimSpace(query.Get("to")),
+	}
+	if len(filter.Search) > constants.MAX_SEARCH_LENGTH {
+		return filter, fmt.Errorf("search is too long, maximum length is %d characters", constants.MAX_SEARCH_LENGTH)
+	}
+	if len(filter.Author) > constants.MAX_SEARCH_LENGTH {
+		return filter, fmt.Errorf("author is too long, maximum length is %d characters", constants.MAX_SEARCH_LENGTH)
+	}
+	if status := query.Get("status"); status == "approved" || status == "pending" {
+		filter.Status = status
+	}
+	if hasWebsite := query.Get("website"); hasWebsite == "yes" || hasWebsite == "no" {
+		filter.HasWebsite = hasWebsite
+	}
+	if hasReplies := query.Get("replies"); hasReplies == "yes" || hasReplies == "no" {
+		filter.HasReplies = hasReplies
+	}
+	for _, date := range []string{filter.From, filter.To} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.ParseInLocation(time.DateOnly, date, time.Local); err != nil {
+			return filter, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
+		}
+	}
+	return filter, nil
+}
+
+// Active reports whether the filter narrows anything down.
+func (f MessageFilter) Active() bool {
+	return f != MessageFilter{}
+}
+
+// Values encodes the filter as the query string parseMessageFilter reads.
+func (f MessageFilter) Values() url.Values {
+	values := url.Values{}
+	for name, value := range map[string]string{
+		"q":       f.Search,
+		"author":  f.Author,
+		"status":  f.Status,
+		"from":    f.From,
+		"to":      f.To,
+		"website": f.HasWebsite,
+		"replies": f.HasReplies,
+	} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	return values
+}
+
+// apply narrows a query on messages down to the ones matching the filter.
+func (f MessageFilter) apply(query *gorm.DB) *gorm.DB {
+	query = searchMessages(query, f.Search)
+
+	if f.Author != "" {
+		query = query.Where(`messages.name LIKE ? ESCAPE '\'`, "%"+likeEscaper.Replace(f.Author)+"%")
+	}
+
+	switch f.Status {
+	case "approved":
+		query = query.Where("messages.approved = ?", true)
+	case "pending":
+		query = query.Where("messages.approved = ?", false)
+	}
+
+	if from, err := time.ParseInLocation(time.DateOnly, f.From, time.Local); err == nil {
+		query = query.Where("messages.created_at >= ?", from)
+	}
+	if to, err := time.ParseInLocation(time.DateOnly, f.To, time.Local); err == nil {
+		query = query.Where("messages.created_at < ?", to.AddDate(0, 0, 1))
+	}
+
+	switch f.HasWebsite {
+	case "yes":
+		query = query.Where("messages.website IS NOT NULL AND messages.website != ''")
+	case "no":
+		query = query.Where("(messages.website IS NULL OR messages.website = '')")
+	}
+
+	const replies = "EXISTS (SELECT 1 FROM messages AS replies WHERE replies.parent_message_id = messages.id AND replies.deleted_at IS NULL)"
+	switch f.HasReplies {
+	case "yes":
+		query = query.Where(replies)
+	case "no":
+		query = query.Where("NOT " + replies)
+	}
+	return query
+}
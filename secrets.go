@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"guestbook/constants"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	appSecretOnce  sync.Once
+	appSecretValue []byte
+)
+
+// appSecret returns the server-wide secret used to derive keys for encrypting
+// and hashing visitor data. It is read from the `secrets.app_key` config
+// entry, falling back to a randomly generated key persisted in
+// constants.APP_SECRET_FILE so that it survives restarts.
+func appSecret() []byte {
+	appSecretOnce.Do(func() {
+		if key := strings.TrimSpace(viper.GetString("secrets.app_key")); key != "" {
+			appSecretValue = []byte(key)
+			return
+		}
+
+		content, err := os.ReadFile(constants.APP_SECRET_FILE)
+		if err == nil && len(strings.TrimSpace(string(content))) > 0 {
+			appSecretValue = []byte(strings.TrimSpace(string(content)))
+			return
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("failed to read app secret file: %v", err)
+		}
+
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			log.Fatalf("failed to generate app secret: %v", err)
+		}
+		key := hex.EncodeToString(buf)
+		if err := os.WriteFile(constants.APP_SECRET_FILE, []byte(key), 0600); err != nil {
+			log.Fatalf("failed to persist app secret: %v", err)
+		}
+		log.Printf("Generated new app secret in %s", constants.APP_SECRET_FILE)
+		appSecretValue = []byte(key)
+	})
+
+	return appSecretValue
+}
+
+// deriveKey returns a 32 byte key for the given purpose, derived from the app
+// secret. Using a different purpose per feature keeps keys independent.
+func deriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, appSecret())
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
@@ -1,290 +1,907 @@
 (function () {
-  var form = document.getElementById("guestbooks___guestbook-form");
-  var messagesContainer = document.getElementById(
-    "guestbooks___guestbook-messages-container"
-  );
-
-  // paging state
-  const pageSize = 20;
-  var currentPage = 1;
-  var isLoading = false;
-  var hasMorePages = true;
-
-  form.addEventListener("submit", async function (event) {
-    event.preventDefault();
-
-    var formData = new FormData(form);
-    const response = await fetch(form.action, {
-      method: "POST",
-      body: formData,
+  // only set while the script first runs
+  var guestbooks___script = document.currentScript;
+
+  // Text in the visitor's locale, with the owner's overrides applied
+  var guestbooks___strings = {{.StringsJSON}};
+
+  // returns the text for key with {placeholders} filled in from args
+  function guestbooks___t(key, args) {
+    var text = guestbooks___strings.hasOwnProperty(key) ? guestbooks___strings[key] : key;
+    Object.keys(args || {}).forEach(function (name) {
+      text = text.split("{" + name + "}").join(args[name]);
+    });
+    return text;
+  }
+
+  // formats dates like the server does for the guestbook page
+  function guestbooks___formatDate(date) {
+    var months = guestbooks___t("date.months").split(/\s+/);
+    return guestbooks___t("date.format", {
+      month: months[date.getMonth()],
+      day: date.getDate(),
+      year: date.getFullYear(),
     });
+  }
 
-    let errorContainer = document.querySelector("#guestbooks___error-message");
-    if (!errorContainer) {
-      errorContainer = document.createElement("div");
-      errorContainer.id = "guestbooks___error-message";
-      const submitButton = document.querySelector("#guestbooks___guestbook-form input[type='submit']");
-      submitButton.insertAdjacentElement('afterend', errorContainer);
+  // Sets up one embedded guestbook. root is the element holding its form and
+  // message list, or the whole document for embeds made without a container.
+  function guestbooks___init(root) {
+    var form = root.querySelector("#guestbooks___guestbook-form");
+    var messagesContainer = root.querySelector("#guestbooks___guestbook-messages-container");
+    if (!form || !messagesContainer || form.dataset.guestbooksInitialized) {
+      return;
     }
+    form.dataset.guestbooksInitialized = "true";
+
+    // paging state
+    const pageSize = 20;
+    var nextCursor = "";
+    var isLoading = false;
+    var hasMorePages = true;
+
+    form.addEventListener("submit", async function (event) {
+      event.preventDefault();
+
+      var formData = new FormData(form);
+      var drawing = await guestbooks___drawingBlob();
+      if (drawing) {
+        formData.append("drawing", drawing, "drawing.png");
+      }
+      const response = await fetch(form.action, {
+        method: "POST",
+        body: formData,
+        headers: { Accept: "application/json" },
+      });
+
+      let errorContainer = root.querySelector("#guestbooks___error-message");
+      if (!errorContainer) {
+        errorContainer = document.createElement("div");
+        errorContainer.id = "guestbooks___error-message";
+        const submitButton = form.querySelector("input[type='submit']");
+        submitButton.insertAdjacentElement('afterend', errorContainer);
+      }
+
+      if (response.ok) {
+        const submitted = await response.json();
+        if (submitted.editToken) {
+          guestbooks___saveEditToken(submitted.id, submitted.editToken, submitted.editableUntil);
+        }
 
-    if (response.ok) {
-      form.reset();
-      guestbooks___loadMessages(true); // clear existing messages
-      errorContainer.innerHTML = "";
-    } else {
-      const err = await response.text();
-      console.error("Error:", err);
-      if (response.status === 401) {
-        errorContainer.innerHTML = "{{.Guestbook.ChallengeFailedMessage}}";
+        form.reset();
+        guestbooks___clearDrawing();
+        guestbooks___setReplyTarget(null);
+        guestbooks___loadMessages(true); // clear existing messages
+        errorContainer.innerHTML = "";
       } else {
-        errorContainer.innerHTML = err;
+        const err = await response.text();
+        console.error("Error:", err);
+        if (response.status === 401) {
+          errorContainer.innerHTML = "{{.Guestbook.ChallengeFailedMessage}}";
+        } else {
+          errorContainer.innerHTML = err;
+        }
       }
-    }
-  });
+    });
 
-  function guestbooks___populateQuestionChallenge() {
-    const challengeQuestion = "{{.Guestbook.ChallengeQuestion}}";
-    const challengeHint = "{{.Guestbook.ChallengeHint}}";
+    function guestbooks___populateQuestionChallenge() {
+      const challengeQuestion = "{{.Guestbook.ChallengeQuestion}}";
+      const challengeHint = "{{.Guestbook.ChallengeHint}}";
 
-    if (challengeQuestion.trim().length === 0) {
-      return;
+      if (challengeQuestion.trim().length === 0) {
+        return;
+      }
+
+      let challengeContainer = root.querySelector("#guestbooks___challenge-answer-container") || root.querySelector("#guestbooks___challenge—answer—container")
+
+      // Add challenge question to the form if 
+      if (!challengeContainer) {
+        challengeContainer = document.createElement("div");
+        challengeContainer.id = "guestbooks___challenge-answer-container";
+        const websiteInput = form.querySelector("#website").parentElement;
+        websiteInput.insertAdjacentElement('afterend', challengeContainer);
+      }
+
+      challengeContainer.innerHTML = `
+      <br>
+      <div class="guestbooks___input-container">
+          <label for="challengeQuestionAnswer">${challengeQuestion}</label> <br>
+          <input placeholder="${challengeHint}" type="text" id="challengeQuestionAnswer" name="challengeQuestionAnswer" required>
+      </div>
+      `;
     }
 
-    let challengeContainer = document.querySelector("#guestbooks___challenge-answer-container") || document.querySelector("#guestbooks___challenge—answer—container")
+    // Visitors can reply to messages shallow enough to have CanReply set
+    var guestbooks___visitorRepliesEnabled = {{.Guestbook.VisitorRepliesEnabled}};
+
+    // Visitors can attach a small doodle to their message
+    var guestbooks___drawingsEnabled = {{.Guestbook.DrawingsEnabled}};
+    var guestbooks___drawingCanvas = null;
+    var guestbooks___drawingIsEmpty = true;
+
+    function guestbooks___populateDrawingCanvas() {
+      if (!guestbooks___drawingsEnabled) {
+        return;
+      }
+
+      var drawingContainer = document.createElement("div");
+      drawingContainer.id = "guestbooks___drawing-container";
+      drawingContainer.className = "guestbooks___input-container";
+
+      var canvas = document.createElement("canvas");
+      canvas.id = "guestbooks___drawing-canvas";
+      canvas.width = 300;
+      canvas.height = 150;
+      canvas.style.border = "1px solid currentColor";
+      canvas.style.touchAction = "none";
+      canvas.style.cursor = "crosshair";
+      canvas.style.maxWidth = "100%";
+      guestbooks___drawingCanvas = canvas;
 
-    // Add challenge question to the form if 
-    if (!challengeContainer) {
-      challengeContainer = document.createElement("div");
-      challengeContainer.id = "guestbooks___challenge-answer-container";
-      const websiteInput = document.querySelector("#guestbooks___guestbook-form #website").parentElement;
-      websiteInput.insertAdjacentElement('afterend', challengeContainer);
+      var context = canvas.getContext("2d");
+      context.lineWidth = 3;
+      context.lineCap = "round";
+      context.lineJoin = "round";
+
+      var colorInput = document.createElement("input");
+      colorInput.type = "color";
+      colorInput.value = "#000000";
+      colorInput.title = guestbooks___t("form.drawing_color");
+
+      var clearButton = document.createElement("button");
+      clearButton.type = "button";
+      clearButton.textContent = guestbooks___t("form.drawing_clear");
+      clearButton.addEventListener("click", guestbooks___clearDrawing);
+
+      var drawing = false;
+      function canvasPoint(event) {
+        var rect = canvas.getBoundingClientRect();
+        return {
+          x: (event.clientX - rect.left) * (canvas.width / rect.width),
+          y: (event.clientY - rect.top) * (canvas.height / rect.height),
+        };
+      }
+      canvas.addEventListener("pointerdown", function (event) {
+        drawing = true;
+        guestbooks___drawingIsEmpty = false;
+        canvas.setPointerCapture(event.pointerId);
+        var point = canvasPoint(event);
+        context.strokeStyle = colorInput.value;
+        context.beginPath();
+        context.moveTo(point.x, point.y);
+        context.lineTo(point.x, point.y);
+        context.stroke();
+      });
+      canvas.addEventListener("pointermove", function (event) {
+        if (!drawing) return;
+        var point = canvasPoint(event);
+        context.lineTo(point.x, point.y);
+        context.stroke();
+      });
+      ["pointerup", "pointercancel"].forEach(function (type) {
+        canvas.addEventListener(type, function () {
+          drawing = false;
+        });
+      });
+
+      var label = document.createElement("label");
+      label.htmlFor = canvas.id;
+      label.textContent = guestbooks___t("form.drawing");
+
+      var tools = document.createElement("div");
+      tools.className = "guestbooks___drawing-tools";
+      tools.appendChild(colorInput);
+      tools.appendChild(document.createTextNode(" "));
+      tools.appendChild(clearButton);
+
+      drawingContainer.appendChild(label);
+      drawingContainer.appendChild(document.createElement("br"));
+      drawingContainer.appendChild(canvas);
+      drawingContainer.appendChild(tools);
+
+      var textInput = form.querySelector("#text").parentElement;
+      textInput.insertAdjacentElement("afterend", drawingContainer);
+      guestbooks___clearDrawing();
     }
 
-    challengeContainer.innerHTML = `
-    <br>
-    <div class="guestbooks___input-container">
-        <label for="challengeQuestionAnswer">${challengeQuestion}</label> <br>
-        <input placeholder="${challengeHint}" type="text" id="challengeQuestionAnswer" name="challengeQuestionAnswer" required>
-    </div>
-    `;
-  }
+    // Visitors can attach one image to their message
+    var guestbooks___imagesEnabled = {{.Guestbook.ImagesEnabled}};
+
+    function guestbooks___populateImageInput() {
+      if (!guestbooks___imagesEnabled || form.querySelector("input[name='image']")) {
+        return;
+      }
 
-  function guestbooks___loadMessages(reset) {
-    // Prevent multiple simultaneous requests
-    if (isLoading) return;
+      var imageContainer = document.createElement("div");
+      imageContainer.id = "guestbooks___image-container";
+      imageContainer.className = "guestbooks___input-container";
 
-    // Don't load if we've reached the end
-    if (!hasMorePages && !reset) return;
+      var label = document.createElement("label");
+      label.htmlFor = "guestbooks___image-input";
+      label.textContent = guestbooks___t("form.image");
 
-    // Reset to first page if this is a reset
-    if (reset) {
-      currentPage = 1;
-      hasMorePages = true;
+      var input = document.createElement("input");
+      input.type = "file";
+      input.id = "guestbooks___image-input";
+      input.name = "image";
+      input.accept = "image/png,image/jpeg,image/gif";
+
+      imageContainer.appendChild(label);
+      imageContainer.appendChild(document.createElement("br"));
+      imageContainer.appendChild(input);
+
+      var textInput = form.querySelector("#text").parentElement;
+      textInput.insertAdjacentElement("afterend", imageContainer);
     }
 
-    isLoading = true;
+    function guestbooks___clearDrawing() {
+      if (!guestbooks___drawingCanvas) {
+        return;
+      }
+      var context = guestbooks___drawingCanvas.getContext("2d");
+      context.fillStyle = "#ffffff";
+      context.fillRect(0, 0, guestbooks___drawingCanvas.width, guestbooks___drawingCanvas.height);
+      guestbooks___drawingIsEmpty = true;
+    }
 
-    var apiUrl =
-      "{{.HostUrl}}/api/v2/get-guestbook-messages/{{.Guestbook.ID}}?page=" + currentPage + "&limit=" + pageSize;
-    fetch(apiUrl)
-      .then(function (response) {
-        return response.json();
-      })
-      .then(function (data) {
-        var messages = data.messages || [];
-        var pagination = data.pagination || {};
+    // resolves to the drawing as a PNG blob, or null if nothing was drawn
+    function guestbooks___drawingBlob() {
+      if (!guestbooks___drawingCanvas || guestbooks___drawingIsEmpty) {
+        return Promise.resolve(null);
+      }
+      return new Promise(function (resolve) {
+        guestbooks___drawingCanvas.toBlob(resolve, "image/png");
+      });
+    }
 
-        hasMorePages = pagination.hasNext || false;
+    // Extra questions defined by the guestbook owner
+    var guestbooks___customFields = {{.CustomFieldsJSON}};
 
-        if (messages.length === 0 && currentPage === 1) {
-          messagesContainer.innerHTML = "<p>There are no messages on this guestbook.</p>";
+    function guestbooks___populateCustomFields() {
+      if (guestbooks___customFields.length === 0) {
+        return;
+      }
+
+      var fieldsContainer = root.querySelector("#guestbooks___custom-fields-container");
+      if (!fieldsContainer) {
+        fieldsContainer = document.createElement("div");
+        fieldsContainer.id = "guestbooks___custom-fields-container";
+        var textInput = form.querySelector("#text").parentElement;
+        textInput.insertAdjacentElement("beforebegin", fieldsContainer);
+      }
+
+      // the guestbook page already renders the fields on the server
+      if (fieldsContainer.children.length > 0) {
+        return;
+      }
+
+      guestbooks___customFields.forEach(function (field) {
+        var inputContainer = document.createElement("div");
+        inputContainer.className = "guestbooks___input-container guestbooks___custom-field";
+        var inputName = "custom_" + field.id;
+        var inputId = "guestbooks___custom-field-{{.Guestbook.ID}}-" + field.id;
+
+        if (field.type === "checkbox") {
+          var checkboxLabel = document.createElement("label");
+          var checkbox = document.createElement("input");
+          checkbox.type = "checkbox";
+          checkbox.id = inputId;
+          checkbox.name = inputName;
+          checkbox.value = "true";
+          checkbox.required = field.required;
+          checkboxLabel.appendChild(checkbox);
+          checkboxLabel.appendChild(document.createTextNode(" " + field.label));
+          inputContainer.appendChild(checkboxLabel);
+        } else if (field.type === "emoji") {
+          var fieldset = document.createElement("fieldset");
+          var legend = document.createElement("legend");
+          legend.textContent = field.label;
+          fieldset.appendChild(legend);
+          field.options.forEach(function (emoji) {
+            var emojiLabel = document.createElement("label");
+            emojiLabel.className = "guestbooks___emoji-option";
+            var radio = document.createElement("input");
+            radio.type = "radio";
+            radio.name = inputName;
+            radio.value = emoji;
+            radio.required = field.required;
+            emojiLabel.appendChild(radio);
+            emojiLabel.appendChild(document.createTextNode(emoji));
+            fieldset.appendChild(emojiLabel);
+          });
+          inputContainer.appendChild(fieldset);
+        } else if (field.type === "select") {
+          var selectLabel = document.createElement("label");
+          selectLabel.htmlFor = inputId;
+          selectLabel.textContent = field.label;
+          var select = document.createElement("select");
+          select.id = inputId;
+          select.name = inputName;
+          select.required = field.required;
+          var emptyOption = document.createElement("option");
+          emptyOption.value = "";
+          emptyOption.textContent = field.required ? guestbooks___t("form.choose") : guestbooks___t("form.optional");
+          select.appendChild(emptyOption);
+          field.options.forEach(function (optionValue) {
+            var option = document.createElement("option");
+            option.value = optionValue;
+            option.textContent = optionValue;
+            select.appendChild(option);
+          });
+          inputContainer.appendChild(selectLabel);
+          inputContainer.appendChild(document.createElement("br"));
+          inputContainer.appendChild(select);
         } else {
-          // Clear container only on reset (new submission or initial load)
-          if (reset) {
-            messagesContainer.innerHTML = "";
-          }
+          var input = document.createElement("input");
+          input.type = "text";
+          input.id = inputId;
+          input.name = inputName;
+          input.placeholder = field.required ? field.label : guestbooks___t("form.optional_field", { label: field.label });
+          input.maxLength = field.maxLength;
+          input.required = field.required;
+          inputContainer.appendChild(input);
+        }
 
-          // Messages are already sorted by created_at DESC from the API
-          messages.forEach(function (message) {
-            // ignore messages that are replies (ParentMessageID not null)
-            if (message.ParentMessageID) {
-              return;
-            }
+        fieldsContainer.appendChild(inputContainer);
+      });
+    }
 
-            var messageContainer = document.createElement("div");
-            messageContainer.className = "guestbook-message";
-
-            var messageHeader = document.createElement("p");
-            var boldElement = document.createElement("b");
-
-            // add name with website (if present)
-            if (message.Website) {
-              var link = document.createElement("a");
-              link.href = message.Website ? message.Website : "#";
-              link.textContent = message.Name;
-              link.target = "_blank";
-              link.rel = "ugc nofollow noopener noreferrer";
-              boldElement.appendChild(link);
-            } else {
-              var textNode = document.createTextNode(message.Name);
-              boldElement.appendChild(textNode);
-            }
+    // Reactions visitors can leave on messages, disabled when empty
+    var guestbooks___reactionEmojis = {{.ReactionEmojisJSON}};
 
-            messageHeader.appendChild(boldElement);
+    function guestbooks___setReactionLabel(button, count) {
+      button.textContent = count > 0 ? button.dataset.emoji + " " + count : button.dataset.emoji;
+    }
 
-            // add date
-            var createdAt = new Date(message.CreatedAt);
-            var formattedDate = createdAt.toLocaleDateString("en-US", {
-              month: "short",
-              day: "numeric",
-              year: "numeric",
-            });
+    function guestbooks___createReactions(message) {
+      if (guestbooks___reactionEmojis.length === 0) {
+        return null;
+      }
 
-            var dateElement = document.createElement("small");
-            dateElement.textContent = " - " + formattedDate;
-            messageHeader.appendChild(dateElement);
+      var reactionsContainer = document.createElement("div");
+      reactionsContainer.className = "guestbooks___reactions";
+      var counts = message.Reactions || {};
 
-            // add actual quote
-            var messageBody = document.createElement("blockquote");
-            messageBody.textContent = message.Text;
+      guestbooks___reactionEmojis.forEach(function (emoji) {
+        var button = document.createElement("button");
+        button.type = "button";
+        button.className = "guestbooks___reaction";
+        button.dataset.emoji = emoji;
+        guestbooks___setReactionLabel(button, counts[emoji] || 0);
+        button.addEventListener("click", function () {
+          guestbooks___react(message.ID, reactionsContainer, button);
+        });
+        reactionsContainer.appendChild(button);
+      });
 
-            messageContainer.appendChild(messageHeader);
-            messageContainer.appendChild(messageBody);
+      return reactionsContainer;
+    }
 
-            messagesContainer.appendChild(messageContainer);
+    async function guestbooks___react(messageId, reactionsContainer, button) {
+      var buttons = reactionsContainer.querySelectorAll("button");
+      buttons.forEach(function (b) { b.disabled = true; });
 
-            // Add replies if they exist
-            if (message.Replies && message.Replies.length > 0) {
-              message.Replies.forEach(function(reply) {
-                var replyContainer = document.createElement("div");
-                replyContainer.className = "guestbook-message guestbook-message-reply";
+      try {
+        var formData = new FormData();
+        formData.append("emoji", button.dataset.emoji);
+        if (guestbooks___powEnabled) {
+          var pow = await guestbooks___solvePow();
+          formData.append("powChallenge", pow.challenge);
+          formData.append("powNonce", pow.nonce);
+        }
 
-                var replyHeader = document.createElement("p");
-                var replyBoldElement = document.createElement("b");
-                var replyTextNode = document.createTextNode(reply.Name);
-                replyBoldElement.appendChild(replyTextNode);
-                replyHeader.appendChild(replyBoldElement);
+        var response = await fetch("{{.HostUrl}}/guestbook/{{.Guestbook.ID}}/message/" + messageId + "/react", {
+          method: "POST",
+          body: formData,
+        });
+        if (!response.ok) {
+          throw new Error(await response.text());
+        }
 
-                // add reply date
-                var replyCreatedAt = new Date(reply.CreatedAt);
-                var replyFormattedDate = replyCreatedAt.toLocaleDateString("en-US", {
-                  month: "short",
-                  day: "numeric",
-                  year: "numeric",
-                });
+        var data = await response.json();
+        buttons.forEach(function (b) {
+          guestbooks___setReactionLabel(b, data.reactions[b.dataset.emoji] || 0);
+        });
+        button.classList.add("guestbooks___reaction--reacted");
+      } catch (error) {
+        console.error("Error reacting to message:", error);
+      } finally {
+        buttons.forEach(function (b) { b.disabled = false; });
+      }
+    }
 
-                var replyDateElement = document.createElement("small");
-                replyDateElement.textContent = " - " + replyFormattedDate;
-                replyHeader.appendChild(replyDateElement);
+    function guestbooks___createCustomFieldAnswers(message) {
+      if (!message.CustomFieldAnswers || message.CustomFieldAnswers.length === 0) {
+        return null;
+      }
 
-                // add reply text
-                var replyBody = document.createElement("blockquote");
-                replyBody.textContent = reply.Text;
+      var answersList = document.createElement("ul");
+      answersList.className = "guestbooks___custom-field-answers";
+      message.CustomFieldAnswers.forEach(function (answer) {
+        var item = document.createElement("li");
+        var label = document.createElement("span");
+        label.className = "guestbooks___custom-field-label";
+        label.textContent = answer.label + ": ";
+        item.appendChild(label);
+        item.appendChild(document.createTextNode(answer.value));
+        answersList.appendChild(item);
+      });
+      return answersList;
+    }
 
-                replyContainer.appendChild(replyHeader);
-                replyContainer.appendChild(replyBody);
+    // TextHTML is only present when the guestbook allows Markdown, and is
+    // sanitized on the server. Otherwise the text is shown as-is.
+    function guestbooks___setMessageText(element, message) {
+      if (message.TextHTML) {
+        element.innerHTML = message.TextHTML;
+      } else {
+        element.textContent = message.Text;
+      }
+    }
 
-                messagesContainer.appendChild(replyContainer);
-              });
-            }
-          });
+    // Secret tokens that let this visitor edit or delete their own messages for
+    // a while after posting them, keyed by message ID
+    var guestbooks___editTokensKey = "guestbooks___edit_tokens_{{.Guestbook.ID}}";
+
+    function guestbooks___loadEditTokens() {
+      try {
+        return JSON.parse(localStorage.getItem(guestbooks___editTokensKey)) || {};
+      } catch (e) {
+        return {};
+      }
+    }
+
+    function guestbooks___saveEditToken(messageId, token, editableUntil) {
+      var tokens = guestbooks___loadEditTokens();
+      Object.keys(tokens).forEach(function (id) {
+        if (new Date(tokens[id].until) <= new Date()) {
+          delete tokens[id];
         }
+      });
+      tokens[messageId] = { token: token, until: editableUntil };
+      try {
+        localStorage.setItem(guestbooks___editTokensKey, JSON.stringify(tokens));
+      } catch (e) {
+        console.error("Could not store edit token:", e);
+      }
+    }
+
+    function guestbooks___getEditToken(messageId) {
+      var entry = guestbooks___loadEditTokens()[messageId];
+      if (!entry || new Date(entry.until) <= new Date()) {
+        return null;
+      }
+      return entry.token;
+    }
+
+    async function guestbooks___changeOwnMessage(messageId, action, fields) {
+      var formData = new FormData();
+      formData.append("editToken", guestbooks___getEditToken(messageId));
+      Object.keys(fields).forEach(function (name) {
+        formData.append(name, fields[name]);
+      });
+
+      var response = await fetch("{{.HostUrl}}/guestbook/{{.Guestbook.ID}}/message/" + messageId + "/" + action, {
+        method: "POST",
+        body: formData,
+        headers: { Accept: "application/json" },
+      });
+      if (!response.ok) {
+        alert(await response.text());
+        return;
+      }
+      guestbooks___loadMessages(true);
+    }
+
+    function guestbooks___createEditControls(message, messageBody) {
+      var controls = document.createElement("div");
+      controls.className = "guestbooks___edit-controls";
 
-        // Increment page for next load
-        currentPage++;
-        isLoading = false;
+      var editButton = document.createElement("button");
+      editButton.type = "button";
+      editButton.textContent = guestbooks___t("message.edit");
+      editButton.addEventListener("click", function () {
+        var editor = document.createElement("textarea");
+        editor.className = "guestbooks___edit-text";
+        editor.value = message.Text;
+        editor.style.width = "100%";
+        editor.style.boxSizing = "border-box";
+
+        var saveButton = document.createElement("button");
+        saveButton.type = "button";
+        saveButton.textContent = guestbooks___t("message.save");
+        saveButton.addEventListener("click", function () {
+          guestbooks___changeOwnMessage(message.ID, "edit", { text: editor.value });
+        });
 
-        // Re-observe the last message for infinite scroll
-        if (window.guestbooks___observeLastMessage) {
-          window.guestbooks___observeLastMessage();
+        var cancelButton = document.createElement("button");
+        cancelButton.type = "button";
+        cancelButton.textContent = guestbooks___t("message.cancel");
+        cancelButton.addEventListener("click", function () {
+          guestbooks___setMessageText(messageBody, message);
+          controls.replaceChildren(editButton, deleteButton);
+        });
+
+        messageBody.replaceChildren(editor);
+        controls.replaceChildren(saveButton, cancelButton);
+        editor.focus();
+      });
+
+      var deleteButton = document.createElement("button");
+      deleteButton.type = "button";
+      deleteButton.textContent = guestbooks___t("message.delete");
+      deleteButton.addEventListener("click", function () {
+        if (confirm(guestbooks___t("message.delete_confirm"))) {
+          guestbooks___changeOwnMessage(message.ID, "delete", {});
         }
-      })
-      .catch(function (error) {
-        console.error("Error fetching messages:", error);
-        isLoading = false;
       });
-  }
 
-  function guestbooks___setupInfiniteScroll() {
-    var observer = new IntersectionObserver(function (entries) {
-      entries.forEach(function (entry) {
-        if (entry.isIntersecting && hasMorePages && !isLoading) {
-          guestbooks___loadMessages(false); // append to existing messages
+      controls.appendChild(editButton);
+      controls.appendChild(deleteButton);
+      return controls;
+    }
+
+    function guestbooks___createMessageElement(message, className) {
+      var messageContainer = document.createElement("div");
+      messageContainer.className = className;
+      messageContainer.dataset.messageId = message.ID;
+
+      var messageHeader = document.createElement("p");
+      var boldElement = document.createElement("b");
+
+      if (message.AvatarURL) {
+        var avatar = document.createElement("img");
+        avatar.className = "guestbooks___avatar";
+        avatar.src = message.AvatarURL;
+        avatar.alt = "";
+        avatar.width = 32;
+        avatar.height = 32;
+        avatar.loading = "lazy";
+        messageHeader.appendChild(avatar);
+      }
+
+      // add name with website (if present)
+      if (message.Website) {
+        var link = document.createElement("a");
+        link.href = message.Website;
+        link.textContent = message.Name;
+        link.target = "_blank";
+        link.rel = "ugc nofollow noopener noreferrer";
+        boldElement.appendChild(link);
+      } else {
+        boldElement.appendChild(document.createTextNode(message.Name));
+      }
+
+      messageHeader.appendChild(boldElement);
+
+      // add date
+      var createdAt = new Date(message.CreatedAt);
+      var formattedDate = guestbooks___formatDate(createdAt);
+
+      var dateElement = document.createElement("small");
+      dateElement.textContent = " - " + formattedDate;
+      messageHeader.appendChild(dateElement);
+
+      // add actual quote
+      var messageBody = document.createElement("blockquote");
+      guestbooks___setMessageText(messageBody, message);
+
+      messageContainer.appendChild(messageHeader);
+      messageContainer.appendChild(messageBody);
+
+      if (message.DrawingURL) {
+        var drawingImage = document.createElement("img");
+        drawingImage.className = "guestbooks___drawing";
+        drawingImage.src = message.DrawingURL;
+        drawingImage.alt = guestbooks___t("message.drawing_alt", { name: message.Name });
+        drawingImage.loading = "lazy";
+        messageContainer.appendChild(drawingImage);
+      }
+
+      if (message.ImageURL) {
+        var imageLink = document.createElement("a");
+        imageLink.className = "guestbooks___image";
+        imageLink.href = message.ImageURL;
+        imageLink.target = "_blank";
+        imageLink.rel = "noopener";
+        var image = document.createElement("img");
+        image.src = message.ImageThumbnailURL;
+        image.alt = guestbooks___t("message.image_alt", { name: message.Name });
+        image.loading = "lazy";
+        imageLink.appendChild(image);
+        messageContainer.appendChild(imageLink);
+      }
+
+      var answers = guestbooks___createCustomFieldAnswers(message);
+      if (answers) {
+        messageContainer.appendChild(answers);
+      }
+
+      var reactions = guestbooks___createReactions(message);
+      if (reactions) {
+        messageContainer.appendChild(reactions);
+      }
+
+      if (guestbooks___getEditToken(message.ID)) {
+        messageContainer.appendChild(guestbooks___createEditControls(message, messageBody));
+      }
+
+      if (guestbooks___visitorRepliesEnabled && message.CanReply) {
+        var replyButton = document.createElement("button");
+        replyButton.type = "button";
+        replyButton.className = "guestbooks___reply-button";
+        replyButton.textContent = guestbooks___t("message.reply");
+        replyButton.addEventListener("click", function () {
+          guestbooks___setReplyTarget(message);
+        });
+        messageContainer.appendChild(replyButton);
+      }
+
+      return messageContainer;
+    }
+
+    // ---- Live updates ----
+    // Opted in with data-live="true" on the guestbook container, or on the
+    // script tag of embeds without a container.
+    function guestbooks___liveUpdatesEnabled() {
+      var setting = root.dataset ? root.dataset.live : undefined;
+      if (setting === undefined && guestbooks___script) {
+        setting = guestbooks___script.dataset.live;
+      }
+      return setting === "true" && typeof EventSource !== "undefined";
+    }
+
+    function guestbooks___findMessageElement(id) {
+      return messagesContainer.querySelector('[data-message-id="' + id + '"]');
+    }
+
+    // New messages go right below the pinned ones, replies below the message
+    // they answer the same way guestbooks___appendReplies places them.
+    function guestbooks___insertLiveMessage(message) {
+      if (guestbooks___findMessageElement(message.ID)) {
+        return;
+      }
+
+      if (message.ParentMessageID) {
+        var parent = guestbooks___findMessageElement(message.ParentMessageID);
+        // replies to messages further down come with their message
+        if (!parent) {
+          return;
+        }
+        var reply = guestbooks___createMessageElement(message, "guestbook-message guestbook-message-reply");
+        if (parent.classList.contains("guestbook-message-reply")) {
+          parent.appendChild(reply);
+          return;
+        }
+        var last = parent;
+        while (last.nextElementSibling && last.nextElementSibling.classList.contains("guestbook-message-reply")) {
+          last = last.nextElementSibling;
+        }
+        last.insertAdjacentElement("afterend", reply);
+        return;
+      }
+
+      if (!messagesContainer.querySelector(".guestbook-message")) {
+        messagesContainer.replaceChildren();
+      }
+      var messageElement = guestbooks___createMessageElement(message, "guestbook-message");
+      var firstUnpinned = messagesContainer.querySelector(
+        ":scope > .guestbook-message:not(.guestbook-message-pinned):not(.guestbook-message-reply)"
+      );
+      messagesContainer.insertBefore(messageElement, firstUnpinned);
+    }
+
+    function guestbooks___removeLiveMessage(id) {
+      var messageElement = guestbooks___findMessageElement(id);
+      if (!messageElement) {
+        return;
+      }
+      if (!messageElement.classList.contains("guestbook-message-reply")) {
+        while (messageElement.nextElementSibling && messageElement.nextElementSibling.classList.contains("guestbook-message-reply")) {
+          messageElement.nextElementSibling.remove();
+        }
+      }
+      messageElement.remove();
+    }
+
+    function guestbooks___connectLiveUpdates() {
+      var events = new EventSource("{{.HostUrl}}/api/v3/guestbook-events/{{.Guestbook.ID}}");
+      var missedEvents = false;
+
+      // the browser reconnects by itself, reload to catch up on what was
+      // missed in between
+      events.onerror = function () {
+        missedEvents = true;
+      };
+      events.onopen = function () {
+        if (missedEvents) {
+          missedEvents = false;
+          guestbooks___loadMessages(true);
         }
+      };
+      events.addEventListener("message", function (event) {
+        guestbooks___insertLiveMessage(JSON.parse(event.data));
       });
-    }, {
-      root: null, // Use the viewport as the root
-      rootMargin: '200px', // Load when 200px away from the bottom
-      threshold: 0.1
-    });
+      events.addEventListener("delete", function (event) {
+        JSON.parse(event.data).forEach(guestbooks___removeLiveMessage);
+      });
+      events.addEventListener("refresh", function () {
+        guestbooks___loadMessages(true);
+      });
+    }
 
+    // Direct replies are placed right after their message, deeper replies are
+    // nested inside the reply they answer.
+    function guestbooks___appendReplies(parentElement, replies) {
+      (replies || []).forEach(function (reply) {
+        var replyContainer = guestbooks___createMessageElement(reply, "guestbook-message guestbook-message-reply");
+        parentElement.appendChild(replyContainer);
+        guestbooks___appendReplies(replyContainer, reply.Replies);
+      });
+    }
+
+    // Points the form at the message being replied to, or back at the
+    // guestbook itself when message is null.
+    function guestbooks___setReplyTarget(message) {
+      var parentInput = form.querySelector("input[name='parentMessageID']");
+      var replyTarget = root.querySelector("#guestbooks___reply-target");
 
-    // Re-observe the last message whenever messages are loaded
-    // Initial observation and re-observe after each load
-    window.guestbooks___observeLastMessage = function () {
-      var messages = messagesContainer.querySelectorAll('.guestbook-message');
-      if (messages.length > 0) {
-        // Stop observing previous last message
-        observer.disconnect();
-        // Observe the new last message
-        observer.observe(messages[messages.length - 1]);
+      if (!message) {
+        if (parentInput) parentInput.value = "";
+        if (replyTarget) replyTarget.remove();
+        return;
       }
-    };
-  }
 
-  guestbooks___populateQuestionChallenge();
-  guestbooks___loadMessages(true); // Initial load
-  guestbooks___setupInfiniteScroll();
-
-  // ---- Proof of Work Bot Deterrent ----
-  {{if .Guestbook.PowEnabled}}
-  (function() {
-    var powChallenge = "";
-    var powNonce = "";
-    var powReady = false;
-    var powWorker = null;
-
-    var submitBtn = form.querySelector("input[type='submit'], button[type='submit']");
-    submitBtn.disabled = true;
-
-    // Build the verification UI: checkbox with inline label
-    var powContainer = document.getElementById("guestbooks___pow-status");
-    if (!powContainer) {
-      powContainer = document.createElement("div");
-      submitBtn.parentNode.insertBefore(powContainer, submitBtn);
+      if (!parentInput) {
+        parentInput = document.createElement("input");
+        parentInput.type = "hidden";
+        parentInput.name = "parentMessageID";
+        form.appendChild(parentInput);
+      }
+      parentInput.value = message.ID;
+
+      if (!replyTarget) {
+        replyTarget = document.createElement("div");
+        replyTarget.id = "guestbooks___reply-target";
+        form.insertBefore(replyTarget, form.firstChild);
+      }
+      replyTarget.textContent = guestbooks___t("form.replying_to", { name: message.Name }) + " ";
+
+      var cancelButton = document.createElement("button");
+      cancelButton.type = "button";
+      cancelButton.textContent = guestbooks___t("message.cancel");
+      cancelButton.addEventListener("click", function () {
+        guestbooks___setReplyTarget(null);
+      });
+      replyTarget.appendChild(cancelButton);
+
+      form.scrollIntoView({ behavior: "smooth", block: "start" });
+      var textInput = form.querySelector("#text");
+      if (textInput) {
+        textInput.focus();
+      }
     }
-    powContainer.id = "guestbooks___pow-container";
-    powContainer.className = "guestbooks___pow-container";
-    powContainer.innerHTML = "";
 
-    var powLabel = document.createElement("label");
-    powLabel.className = "guestbooks___pow-checkbox-label";
+    function guestbooks___loadMessages(reset) {
+      // Prevent multiple simultaneous requests
+      if (isLoading) return;
 
-    var powCheckbox = document.createElement("input");
-    powCheckbox.type = "checkbox";
-    powCheckbox.id = "guestbooks___pow-checkbox";
+      // Don't load if we've reached the end
+      if (!hasMorePages && !reset) return;
 
-    var powLabelText = document.createElement("span");
-    powLabelText.id = "guestbooks___pow-status";
-    powLabelText.textContent = "I\u2019m not a robot";
+      // Reset to first page if this is a reset
+      if (reset) {
+        nextCursor = "";
+        hasMorePages = true;
+      }
 
-    powLabel.appendChild(powCheckbox);
-    powLabel.appendChild(powLabelText);
-    powContainer.appendChild(powLabel);
+      isLoading = true;
 
-    // Add hidden fields to carry the PoW data
-    var hiddenChallenge = document.createElement("input");
-    hiddenChallenge.type = "hidden";
-    hiddenChallenge.name = "powChallenge";
-    form.appendChild(hiddenChallenge);
+      var isFirstPage = nextCursor === "";
+      var apiUrl =
+        "{{.HostUrl}}/api/v3/get-guestbook-messages/{{.Guestbook.ID}}?limit=" + pageSize +
+        (isFirstPage ? "" : "&cursor=" + encodeURIComponent(nextCursor));
+      fetch(apiUrl)
+        .then(function (response) {
+          return response.json();
+        })
+        .then(function (data) {
+          var messages = data.messages || [];
+
+          hasMorePages = data.hasNext || false;
+          nextCursor = data.nextCursor || "";
 
-    var hiddenNonce = document.createElement("input");
-    hiddenNonce.type = "hidden";
-    hiddenNonce.name = "powNonce";
-    form.appendChild(hiddenNonce);
+          if (messages.length === 0 && isFirstPage) {
+            var emptyMessage = document.createElement("p");
+            emptyMessage.textContent = guestbooks___t("messages.empty");
+            messagesContainer.replaceChildren(emptyMessage);
+          } else {
+            // Clear container only on reset (new submission or initial load)
+            if (reset) {
+              messagesContainer.innerHTML = "";
+            }
+
+            // Messages are already sorted by created_at DESC from the API
+            messages.forEach(function (message) {
+              // ignore messages that are replies (ParentMessageID not null)
+              if (message.ParentMessageID) {
+                return;
+              }
+
+              var messageContainer = guestbooks___createMessageElement(
+                message,
+                message.Pinned ? "guestbook-message guestbook-message-pinned" : "guestbook-message"
+              );
+              messagesContainer.appendChild(messageContainer);
+
+              guestbooks___appendReplies(messagesContainer, message.Replies);
+            });
+          }
+
+          isLoading = false;
+
+          // Re-observe the last message for infinite scroll
+          if (guestbooks___observeLastMessage) {
+            guestbooks___observeLastMessage();
+          }
+        })
+        .catch(function (error) {
+          console.error("Error fetching messages:", error);
+          isLoading = false;
+        });
+    }
+
+    var guestbooks___observeLastMessage = null;
+
+    function guestbooks___setupInfiniteScroll() {
+      var observer = new IntersectionObserver(function (entries) {
+        entries.forEach(function (entry) {
+          if (entry.isIntersecting && hasMorePages && !isLoading) {
+            guestbooks___loadMessages(false); // append to existing messages
+          }
+        });
+      }, {
+        root: null, // Use the viewport as the root
+        rootMargin: '200px', // Load when 200px away from the bottom
+        threshold: 0.1
+      });
+
+
+      // Re-observe the last message whenever messages are loaded
+      // Initial observation and re-observe after each load
+      guestbooks___observeLastMessage = function () {
+        var messages = messagesContainer.querySelectorAll('.guestbook-message');
+        if (messages.length > 0) {
+          // Stop observing previous last message
+          observer.disconnect();
+          // Observe the new last message
+          observer.observe(messages[messages.length - 1]);
+        }
+      };
+    }
+
+    // The guestbook page renders its messages and no-JS pagination links on
+    // the server; from here on the script takes over with infinite scroll.
+    var serverPagination = root.querySelector("#guestbooks___guestbook-messages-pagination");
+    if (serverPagination) {
+      serverPagination.remove();
+    }
+
+    guestbooks___populateQuestionChallenge();
+    guestbooks___populateCustomFields();
+    guestbooks___populateDrawingCanvas();
+    guestbooks___populateImageInput();
+    guestbooks___loadMessages(true); // Initial load
+    guestbooks___setupInfiniteScroll();
+    if (guestbooks___liveUpdatesEnabled()) {
+      guestbooks___connectLiveUpdates();
+    }
+
+    // ---- Proof of Work Bot Deterrent ----
+    var guestbooks___powEnabled = {{.Guestbook.PowEnabled}};
 
     // Web Worker code for SHA-256 mining using SubtleCrypto
-    var workerCode = `
+    var guestbooks___powWorkerCode = `
       self.onmessage = async function(e) {
         var challenge = e.data.challenge;
         var difficulty = e.data.difficulty;
@@ -323,68 +940,135 @@
       }
     `;
 
-    function guestbooks___fetchAndSolve() {
-      powReady = false;
-      powChallenge = "";
-      powNonce = "";
-      submitBtn.disabled = true;
-      powCheckbox.disabled = true;
-      powLabelText.textContent = "Verifying\u2026";
-      powLabelText.className = "guestbooks___pow-label-text--loading";
-
-      var apiUrl = "{{.HostUrl}}/api/pow-challenge/{{.Guestbook.ID}}";
-      fetch(apiUrl)
+    // Fetches a fresh challenge and solves it in a Web Worker. Resolves with
+    // the challenge and the nonce that solves it.
+    function guestbooks___solvePow() {
+      return fetch("{{.HostUrl}}/api/pow-challenge/{{.Guestbook.ID}}")
         .then(function(resp) { return resp.json(); })
         .then(function(data) {
-          powChallenge = data.challenge;
-          var difficulty = data.difficulty;
-
-          if (powWorker) { powWorker.terminate(); }
-
-          var blob = new Blob([workerCode], { type: "application/javascript" });
-          powWorker = new Worker(URL.createObjectURL(blob));
-
-          powWorker.onmessage = function(e) {
-            if (e.data.found) {
-              powNonce = e.data.nonce;
-              powReady = true;
-              hiddenChallenge.value = powChallenge;
-              hiddenNonce.value = powNonce;
-              submitBtn.disabled = false;
-              powCheckbox.disabled = true;
-              powLabelText.textContent = "Verified \u2713";
-              powLabelText.className = "guestbooks___pow-label-text--verified";
-            }
-          };
+          return new Promise(function(resolve) {
+            var blob = new Blob([guestbooks___powWorkerCode], { type: "application/javascript" });
+            var worker = new Worker(URL.createObjectURL(blob));
 
-          powWorker.postMessage({ challenge: powChallenge, difficulty: difficulty });
-        })
-        .catch(function(err) {
-          console.error("PoW challenge fetch error:", err);
-          powCheckbox.checked = false;
-          powCheckbox.disabled = false;
-          powLabelText.textContent = "Verification failed \u2014 try again";
-          powLabelText.className = "guestbooks___pow-label-text--error";
+            worker.onmessage = function(e) {
+              if (e.data.found) {
+                worker.terminate();
+                resolve({ challenge: data.challenge, nonce: e.data.nonce });
+              }
+            };
+
+            worker.postMessage({ challenge: data.challenge, difficulty: data.difficulty });
+          });
         });
     }
 
-    // Only start PoW when the checkbox is clicked
-    powCheckbox.addEventListener("change", function() {
-      if (powCheckbox.checked) {
-        guestbooks___fetchAndSolve();
+    // The form requires a solved challenge before it can be submitted
+    {{if .Guestbook.PowEnabled}}
+    (function() {
+      var powReady = false;
+      var powAttempt = 0;
+
+      var submitBtn = form.querySelector("input[type='submit'], button[type='submit']");
+      submitBtn.disabled = true;
+
+      // Build the verification UI: checkbox with inline label
+      var powContainer = root.querySelector("#guestbooks___pow-status");
+      if (!powContainer) {
+        powContainer = document.createElement("div");
+        submitBtn.parentNode.insertBefore(powContainer, submitBtn);
       }
-    });
+      powContainer.id = "guestbooks___pow-container";
+      powContainer.className = "guestbooks___pow-container";
+      powContainer.innerHTML = "";
 
-    // After form submission, reset the checkbox for the next message
-    form.addEventListener("submit", function() {
-      setTimeout(function() {
-        powCheckbox.checked = false;
-        powCheckbox.disabled = false;
-        powLabelText.textContent = "I\u2019m not a robot";
-        powLabelText.className = "";
+      var powLabel = document.createElement("label");
+      powLabel.className = "guestbooks___pow-checkbox-label";
+
+      var powCheckbox = document.createElement("input");
+      powCheckbox.type = "checkbox";
+      powCheckbox.id = "guestbooks___pow-checkbox";
+
+      var powLabelText = document.createElement("span");
+      powLabelText.id = "guestbooks___pow-status";
+      powLabelText.textContent = guestbooks___t("pow.label");
+
+      powLabel.appendChild(powCheckbox);
+      powLabel.appendChild(powLabelText);
+      powContainer.appendChild(powLabel);
+
+      // Add hidden fields to carry the PoW data
+      var hiddenChallenge = document.createElement("input");
+      hiddenChallenge.type = "hidden";
+      hiddenChallenge.name = "powChallenge";
+      form.appendChild(hiddenChallenge);
+
+      var hiddenNonce = document.createElement("input");
+      hiddenNonce.type = "hidden";
+      hiddenNonce.name = "powNonce";
+      form.appendChild(hiddenNonce);
+
+      function guestbooks___fetchAndSolve() {
+        var attempt = ++powAttempt;
+        powReady = false;
         submitBtn.disabled = true;
-      }, 500);
-    });
-  })();
-  {{end}}
+        powCheckbox.disabled = true;
+        powLabelText.textContent = guestbooks___t("pow.verifying");
+        powLabelText.className = "guestbooks___pow-label-text--loading";
+
+        guestbooks___solvePow()
+          .then(function(solution) {
+            // ignore solutions for a challenge that was already replaced
+            if (attempt !== powAttempt) return;
+
+            powReady = true;
+            hiddenChallenge.value = solution.challenge;
+            hiddenNonce.value = solution.nonce;
+            submitBtn.disabled = false;
+            powCheckbox.disabled = true;
+            powLabelText.textContent = guestbooks___t("pow.verified");
+            powLabelText.className = "guestbooks___pow-label-text--verified";
+          })
+          .catch(function(err) {
+            console.error("PoW challenge fetch error:", err);
+            powCheckbox.checked = false;
+            powCheckbox.disabled = false;
+            powLabelText.textContent = guestbooks___t("pow.failed");
+            powLabelText.className = "guestbooks___pow-label-text--error";
+          });
+      }
+
+      // Only start PoW when the checkbox is clicked
+      powCheckbox.addEventListener("change", function() {
+        if (powCheckbox.checked) {
+          guestbooks___fetchAndSolve();
+        }
+      });
+
+      // After form submission, reset the checkbox for the next message
+      form.addEventListener("submit", function() {
+        setTimeout(function() {
+          powCheckbox.checked = false;
+          powCheckbox.disabled = false;
+          powLabelText.textContent = guestbooks___t("pow.label");
+          powLabelText.className = "";
+          submitBtn.disabled = true;
+        }, 500);
+      });
+    })();
+    {{end}}
+  }
+
+  // Every element with data-guestbook-id set to this guestbook gets its own
+  // instance, so any number of guestbooks can share a page. Loading the
+  // script again leaves instances that are already set up alone.
+  var guestbooks___containers = document.querySelectorAll('[data-guestbook-id="{{.Guestbook.ID}}"]');
+  if (guestbooks___containers.length > 0) {
+    guestbooks___containers.forEach(guestbooks___init);
+  } else {
+    // older embeds have no container, their form is the only one not in one
+    var guestbooks___form = document.querySelector("#guestbooks___guestbook-form");
+    if (guestbooks___form && !guestbooks___form.closest("[data-guestbook-id]")) {
+      guestbooks___init(document);
+    }
+  }
 })();
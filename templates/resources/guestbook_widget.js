@@ -0,0 +1,720 @@
+// <guestbook-widget guestbook-id="1"></guestbook-widget>
+//
+// Builds the guestbook form and message list inside its own Shadow DOM, so it
+// doesn't depend on (or leak styles into) the page it is placed on.
+//
+// Attributes:
+//   guestbook-id  the guestbook to show (required)
+//   page-size     messages loaded at a time, 20 by default
+//   theme         a gallery theme ID, or "none" to only use the built-in
+//                 styles. Defaults to the guestbook's own theme
+//   locale        language of the widget, e.g. "es". Defaults to the
+//                 visitor's browser language
+//
+// Every element has a part attribute (form, input, submit, message, name,
+// date, text, ...) that the page can style with guestbook-widget::part().
+(function () {
+  if (window.customElements.get("guestbook-widget")) {
+    return;
+  }
+
+  var hostUrl = "{{.HostUrl}}";
+
+  var defaultStyles = `
+    :host { display: block; }
+    :host([hidden]) { display: none; }
+    .guestbooks___input-container { margin-bottom: 0.5em; }
+    input[type="text"], input[type="url"], input[type="email"], textarea, select {
+      width: 100%;
+      box-sizing: border-box;
+      font: inherit;
+    }
+    textarea { resize: vertical; min-height: 5em; }
+    .guestbooks___avatar { vertical-align: middle; margin-right: 0.25em; }
+    .guestbooks___image img, .guestbooks___drawing { max-width: 100%; }
+    .guestbook-message-reply { margin-left: 1.5em; }
+    #guestbooks___error-message { color: #b00020; }
+  `;
+
+  // Web Worker code for SHA-256 mining using SubtleCrypto, the same as the
+  // one of the classic embed script
+  var powWorkerCode = `
+    self.onmessage = async function(e) {
+      var challenge = e.data.challenge;
+      var difficulty = e.data.difficulty;
+      var batchSize = 5000;
+      var nonce = 0;
+
+      while (true) {
+        for (var i = 0; i < batchSize; i++) {
+          var nonceHex = nonce.toString(16);
+          var input = challenge + nonceHex;
+          var encoded = new TextEncoder().encode(input);
+          var hashBuf = await crypto.subtle.digest("SHA-256", encoded);
+          var hashArr = new Uint8Array(hashBuf);
+
+          if (hasLeadingZeroBits(hashArr, difficulty)) {
+            self.postMessage({ found: true, nonce: nonceHex, hashes: nonce + 1 });
+            return;
+          }
+          nonce++;
+        }
+        self.postMessage({ found: false, hashes: nonce });
+      }
+    };
+
+    function hasLeadingZeroBits(data, n) {
+      var fullBytes = Math.floor(n / 8);
+      var remainBits = n % 8;
+      for (var i = 0; i < fullBytes; i++) {
+        if (data[i] !== 0) return false;
+      }
+      if (remainBits > 0) {
+        var mask = 0xFF << (8 - remainBits);
+        if ((data[fullBytes] & mask) !== 0) return false;
+      }
+      return true;
+    }
+  `;
+
+  // creates an element with a part name and optional text
+  function element(tag, part, text) {
+    var el = document.createElement(tag);
+    if (part) {
+      el.setAttribute("part", part);
+    }
+    if (text !== undefined) {
+      el.textContent = text;
+    }
+    return el;
+  }
+
+  class GuestbookWidget extends HTMLElement {
+    static get observedAttributes() {
+      return ["guestbook-id", "page-size", "theme", "locale"];
+    }
+
+    constructor() {
+      super();
+      this.attachShadow({ mode: "open" });
+      this.config = null;
+      this.nextCursor = "";
+      this.isLoading = false;
+      this.hasMorePages = true;
+      this.renderId = 0;
+    }
+
+    connectedCallback() {
+      this.render();
+    }
+
+    attributeChangedCallback(name, oldValue, newValue) {
+      if (this.isConnected && oldValue !== newValue) {
+        this.render();
+      }
+    }
+
+    get guestbookId() {
+      return (this.getAttribute("guestbook-id") || "").trim();
+    }
+
+    get pageSize() {
+      var size = parseInt(this.getAttribute("page-size"), 10);
+      return size > 0 ? Math.min(size, 100) : 20;
+    }
+
+    // returns the text for key with {placeholders} filled in from args
+    t(key, args) {
+      var strings = (this.config && this.config.strings) || {};
+      var text = strings.hasOwnProperty(key) ? strings[key] : key;
+      Object.keys(args || {}).forEach(function (name) {
+        text = text.split("{" + name + "}").join(args[name]);
+      });
+      return text;
+    }
+
+    formatDate(date) {
+      var months = this.t("date.months").split(/\s+/);
+      return this.t("date.format", {
+        month: months[date.getMonth()],
+        day: date.getDate(),
+        year: date.getFullYear(),
+      });
+    }
+
+    async render() {
+      var renderId = ++this.renderId;
+      if (!/^\d+$/.test(this.guestbookId)) {
+        this.shadowRoot.replaceChildren();
+        console.error("guestbook-widget: a numeric guestbook-id attribute is required");
+        return;
+      }
+
+      var configUrl = hostUrl + "/api/v2/get-guestbook-config/" + this.guestbookId;
+      var locale = this.getAttribute("locale");
+      if (locale) {
+        configUrl += "?locale=" + encodeURIComponent(locale);
+      }
+
+      var config;
+      try {
+        var response = await fetch(configUrl);
+        if (!response.ok) {
+          throw new Error(await response.text());
+        }
+        config = await response.json();
+      } catch (error) {
+        console.error("guestbook-widget: could not load the guestbook:", error);
+        return;
+      }
+
+      // attributes changed while the settings were loading
+      if (renderId !== this.renderId) {
+        return;
+      }
+      this.config = config;
+
+      var style = document.createElement("style");
+      style.textContent = defaultStyles;
+      var nodes = [style];
+
+      var themeUrl = this.themeUrl();
+      if (themeUrl) {
+        var themeLink = document.createElement("link");
+        themeLink.rel = "stylesheet";
+        themeLink.href = themeUrl;
+        nodes.push(themeLink);
+      }
+
+      this.form = this.createForm();
+      this.messagesContainer = element("div", "messages");
+      this.messagesContainer.id = "guestbooks___guestbook-messages-container";
+      this.loadMoreButton = element("button", "load-more", this.t("messages.older"));
+      this.loadMoreButton.type = "button";
+      this.loadMoreButton.hidden = true;
+      this.loadMoreButton.addEventListener("click", () => this.loadMessages(false));
+
+      var madeWith = element("small", "made-with", this.t("page.made_with") + " ");
+      var madeWithLink = element("a", null, "Guestbooks");
+      madeWithLink.href = hostUrl + "/";
+      madeWithLink.target = "_blank";
+      madeWith.appendChild(madeWithLink);
+
+      var header = element("h3", "messages-header", this.t("page.messages"));
+      header.id = "guestbooks___guestbook-messages-header";
+
+      nodes.push(this.form, madeWith, element("hr", "separator"), header, this.messagesContainer, this.loadMoreButton);
+      this.shadowRoot.replaceChildren(...nodes);
+
+      this.isLoading = false;
+      this.loadMessages(true);
+    }
+
+    // the theme attribute picks a gallery theme, otherwise the guestbook's
+    // own theme is used
+    themeUrl() {
+      var theme = (this.getAttribute("theme") || "").trim();
+      if (theme === "none") {
+        return null;
+      }
+      if (/^\d+$/.test(theme)) {
+        return hostUrl + "/theme/" + theme + "/style.css";
+      }
+      return this.config.themeURL ? hostUrl + this.config.themeURL : null;
+    }
+
+    createInput(type, name, placeholder, required) {
+      var container = element("div", "field");
+      container.className = "guestbooks___input-container";
+      var input = element(type === "textarea" ? "textarea" : "input", "input");
+      if (type !== "textarea") {
+        input.type = type;
+      }
+      input.name = name;
+      input.id = name;
+      input.placeholder = placeholder;
+      input.required = !!required;
+      container.appendChild(input);
+      return container;
+    }
+
+    createForm() {
+      var config = this.config;
+      var form = element("form", "form");
+      form.id = "guestbooks___guestbook-form";
+      form.action = hostUrl + "/guestbook/" + config.id + "/submit";
+      form.method = "post";
+
+      form.appendChild(this.createInput("text", "name", this.t("form.name"), true));
+      form.appendChild(this.createInput("url", "website", this.t("form.website")));
+      form.appendChild(this.createInput("email", "email", this.t("form.email")));
+
+      if ((config.challengeQuestion || "").trim().length > 0) {
+        var challenge = element("div", "challenge");
+        challenge.className = "guestbooks___input-container";
+        var challengeLabel = element("label", "label", config.challengeQuestion);
+        challengeLabel.htmlFor = "challengeQuestionAnswer";
+        var challengeInput = element("input", "input");
+        challengeInput.type = "text";
+        challengeInput.id = "challengeQuestionAnswer";
+        challengeInput.name = "challengeQuestionAnswer";
+        challengeInput.placeholder = config.challengeHint || "";
+        challengeInput.required = true;
+        challenge.append(challengeLabel, document.createElement("br"), challengeInput);
+        form.appendChild(challenge);
+      }
+
+      config.customFields.forEach((field) => form.appendChild(this.createCustomField(field)));
+
+      var textPlaceholder = config.markdownEnabled ? this.t("form.message_markdown") : this.t("form.message");
+      form.appendChild(this.createInput("textarea", "text", textPlaceholder, true));
+
+      if (config.imagesEnabled) {
+        var imageContainer = element("div", "field");
+        imageContainer.className = "guestbooks___input-container";
+        var imageLabel = element("label", "label", this.t("form.image"));
+        imageLabel.htmlFor = "guestbooks___image-input";
+        var imageInput = element("input", "input");
+        imageInput.type = "file";
+        imageInput.id = "guestbooks___image-input";
+        imageInput.name = "image";
+        imageInput.accept = "image/png,image/jpeg,image/gif";
+        imageContainer.append(imageLabel, document.createElement("br"), imageInput);
+        form.appendChild(imageContainer);
+      }
+
+      var submit = element("input", "submit");
+      submit.type = "submit";
+      submit.value = this.t("form.submit");
+      this.submitButton = submit;
+
+      if (config.powEnabled) {
+        form.appendChild(this.createPowCheckbox());
+      }
+      form.appendChild(submit);
+
+      this.errorContainer = element("div", "error");
+      this.errorContainer.id = "guestbooks___error-message";
+      this.errorContainer.setAttribute("role", "alert");
+      form.appendChild(this.errorContainer);
+
+      form.addEventListener("submit", (event) => {
+        event.preventDefault();
+        this.submit();
+      });
+      return form;
+    }
+
+    createCustomField(field) {
+      var container = element("div", "field");
+      container.className = "guestbooks___input-container guestbooks___custom-field";
+      var inputName = "custom_" + field.id;
+      var inputId = "guestbooks___custom-field-" + field.id;
+      var options = field.options || [];
+
+      if (field.type === "checkbox") {
+        var checkboxLabel = element("label", "label");
+        var checkbox = element("input", "input");
+        checkbox.type = "checkbox";
+        checkbox.id = inputId;
+        checkbox.name = inputName;
+        checkbox.value = "true";
+        checkbox.required = field.required;
+        checkboxLabel.append(checkbox, " " + field.label);
+        container.appendChild(checkboxLabel);
+      } else if (field.type === "emoji") {
+        var fieldset = element("fieldset", "fieldset");
+        fieldset.appendChild(element("legend", "label", field.label));
+        options.forEach(function (emoji) {
+          var emojiLabel = element("label", "emoji-option");
+          var radio = document.createElement("input");
+          radio.type = "radio";
+          radio.name = inputName;
+          radio.value = emoji;
+          radio.required = field.required;
+          emojiLabel.append(radio, emoji);
+          fieldset.appendChild(emojiLabel);
+        });
+        container.appendChild(fieldset);
+      } else if (field.type === "select") {
+        var selectLabel = element("label", "label", field.label);
+        selectLabel.htmlFor = inputId;
+        var select = element("select", "input");
+        select.id = inputId;
+        select.name = inputName;
+        select.required = field.required;
+        var emptyOption = element("option", null, field.required ? this.t("form.choose") : this.t("form.optional"));
+        emptyOption.value = "";
+        select.appendChild(emptyOption);
+        options.forEach(function (value) {
+          var option = element("option", null, value);
+          option.value = value;
+          select.appendChild(option);
+        });
+        container.append(selectLabel, document.createElement("br"), select);
+      } else {
+        var input = element("input", "input");
+        input.type = "text";
+        input.id = inputId;
+        input.name = inputName;
+        input.placeholder = field.required ? field.label : this.t("form.optional_field", { label: field.label });
+        input.maxLength = field.maxLength;
+        input.required = field.required;
+        container.appendChild(input);
+      }
+      return container;
+    }
+
+    // The form requires a solved challenge before it can be submitted, the
+    // browser only starts solving it once the visitor ticks the checkbox
+    createPowCheckbox() {
+      var container = element("div", "pow");
+      container.className = "guestbooks___pow-container";
+      var label = element("label", "pow-label");
+      label.className = "guestbooks___pow-checkbox-label";
+      var checkbox = document.createElement("input");
+      checkbox.type = "checkbox";
+      var labelText = element("span", "pow-status", this.t("pow.label"));
+      label.append(checkbox, labelText);
+      container.appendChild(label);
+
+      this.submitButton.disabled = true;
+      this.powSolution = null;
+      var attempt = 0;
+
+      this.resetPow = () => {
+        attempt++;
+        this.powSolution = null;
+        this.submitButton.disabled = true;
+        checkbox.checked = false;
+        checkbox.disabled = false;
+        labelText.textContent = this.t("pow.label");
+        labelText.className = "";
+      };
+
+      checkbox.addEventListener("change", () => {
+        if (!checkbox.checked) {
+          return;
+        }
+        var current = ++attempt;
+        checkbox.disabled = true;
+        labelText.textContent = this.t("pow.verifying");
+        labelText.className = "guestbooks___pow-label-text--loading";
+
+        this.solvePow()
+          .then((solution) => {
+            // ignore solutions for a challenge that was already replaced
+            if (current !== attempt) return;
+            this.powSolution = solution;
+            this.submitButton.disabled = false;
+            labelText.textContent = this.t("pow.verified");
+            labelText.className = "guestbooks___pow-label-text--verified";
+          })
+          .catch((error) => {
+            console.error("guestbook-widget: PoW challenge error:", error);
+            checkbox.checked = false;
+            checkbox.disabled = false;
+            labelText.textContent = this.t("pow.failed");
+            labelText.className = "guestbooks___pow-label-text--error";
+          });
+      });
+      return container;
+    }
+
+    // Fetches a fresh challenge and solves it in a Web Worker. Resolves with
+    // the challenge and the nonce that solves it.
+    solvePow() {
+      return fetch(hostUrl + "/api/pow-challenge/" + this.config.id)
+        .then(function (response) { return response.json(); })
+        .then(function (data) {
+          return new Promise(function (resolve) {
+            var blob = new Blob([powWorkerCode], { type: "application/javascript" });
+            var worker = new Worker(URL.createObjectURL(blob));
+            worker.onmessage = function (e) {
+              if (e.data.found) {
+                worker.terminate();
+                resolve({ challenge: data.challenge, nonce: e.data.nonce });
+              }
+            };
+            worker.postMessage({ challenge: data.challenge, difficulty: data.difficulty });
+          });
+        });
+    }
+
+    async submit() {
+      var formData = new FormData(this.form);
+      if (this.config.powEnabled) {
+        if (!this.powSolution) {
+          return;
+        }
+        formData.append("powChallenge", this.powSolution.challenge);
+        formData.append("powNonce", this.powSolution.nonce);
+      }
+
+      this.submitButton.disabled = true;
+      var response = await fetch(this.form.action, {
+        method: "POST",
+        body: formData,
+        headers: { Accept: "application/json" },
+      });
+
+      if (response.ok) {
+        this.form.reset();
+        this.setReplyTarget(null);
+        this.errorContainer.textContent = "";
+        this.loadMessages(true);
+      } else if (response.status === 401 && this.config.challengeFailedMessage) {
+        this.errorContainer.textContent = this.config.challengeFailedMessage;
+      } else {
+        this.errorContainer.textContent = await response.text();
+      }
+
+      // every challenge can only be used once
+      if (this.config.powEnabled) {
+        this.resetPow();
+      } else {
+        this.submitButton.disabled = false;
+      }
+    }
+
+    // Points the form at the message being replied to, or back at the
+    // guestbook itself when message is null.
+    setReplyTarget(message) {
+      var parentInput = this.form.querySelector("input[name='parentMessageID']");
+      var replyTarget = this.form.querySelector("#guestbooks___reply-target");
+
+      if (!message) {
+        if (parentInput) parentInput.remove();
+        if (replyTarget) replyTarget.remove();
+        return;
+      }
+
+      if (!parentInput) {
+        parentInput = document.createElement("input");
+        parentInput.type = "hidden";
+        parentInput.name = "parentMessageID";
+        this.form.appendChild(parentInput);
+      }
+      parentInput.value = message.ID;
+
+      if (!replyTarget) {
+        replyTarget = element("div", "reply-target");
+        replyTarget.id = "guestbooks___reply-target";
+        this.form.prepend(replyTarget);
+      }
+      var cancelButton = element("button", "cancel-reply", this.t("message.cancel"));
+      cancelButton.type = "button";
+      cancelButton.addEventListener("click", () => this.setReplyTarget(null));
+      replyTarget.replaceChildren(this.t("form.replying_to", { name: message.Name }) + " ", cancelButton);
+
+      this.form.scrollIntoView({ behavior: "smooth", block: "start" });
+      this.form.querySelector("#text").focus();
+    }
+
+    loadMessages(reset) {
+      if (this.isLoading || (!this.hasMorePages && !reset)) {
+        return;
+      }
+      if (reset) {
+        this.nextCursor = "";
+        this.hasMorePages = true;
+      }
+      this.isLoading = true;
+      var renderId = this.renderId;
+      var isFirstPage = this.nextCursor === "";
+
+      var apiUrl = hostUrl + "/api/v3/get-guestbook-messages/" + this.config.id +
+        "?limit=" + this.pageSize + (isFirstPage ? "" : "&cursor=" + encodeURIComponent(this.nextCursor));
+      fetch(apiUrl)
+        .then(function (response) { return response.json(); })
+        .then((data) => {
+          // the widget was rebuilt in the meantime
+          if (renderId !== this.renderId) {
+            return;
+          }
+          var messages = data.messages || [];
+          this.hasMorePages = data.hasNext || false;
+          this.nextCursor = data.nextCursor || "";
+
+          if (reset) {
+            this.messagesContainer.replaceChildren();
+          }
+          if (messages.length === 0 && isFirstPage) {
+            this.messagesContainer.appendChild(element("p", "empty", this.t("messages.empty")));
+          }
+
+          messages.forEach((message) => {
+            var messageElement = this.createMessageElement(message, false);
+            this.messagesContainer.appendChild(messageElement);
+            this.appendReplies(this.messagesContainer, message.Replies);
+          });
+
+          this.loadMoreButton.hidden = !this.hasMorePages;
+        })
+        .catch(function (error) {
+          console.error("guestbook-widget: could not load messages:", error);
+        })
+        .finally(() => {
+          if (renderId === this.renderId) {
+            this.isLoading = false;
+          }
+        });
+    }
+
+    // Direct replies are placed right after their message, deeper replies
+    // are nested inside the reply they answer.
+    appendReplies(parentElement, replies) {
+      (replies || []).forEach((reply) => {
+        var replyElement = this.createMessageElement(reply, true);
+        parentElement.appendChild(replyElement);
+        this.appendReplies(replyElement, reply.Replies);
+      });
+    }
+
+    createMessageElement(message, isReply) {
+      var container = element("div", isReply ? "message reply" : (message.Pinned ? "message pinned" : "message"));
+      container.className = "guestbook-message" + (isReply ? " guestbook-message-reply" : "") +
+        (message.Pinned ? " guestbook-message-pinned" : "");
+
+      var header = element("p", "message-header");
+      if (message.AvatarURL) {
+        var avatar = element("img", "avatar");
+        avatar.className = "guestbooks___avatar";
+        avatar.src = message.AvatarURL;
+        avatar.alt = "";
+        avatar.width = 32;
+        avatar.height = 32;
+        avatar.loading = "lazy";
+        header.appendChild(avatar);
+      }
+
+      var name = element("b", "name");
+      if (message.Website) {
+        var link = element("a", null, message.Name);
+        link.href = message.Website;
+        link.target = "_blank";
+        link.rel = "ugc nofollow noopener noreferrer";
+        name.appendChild(link);
+      } else {
+        name.textContent = message.Name;
+      }
+      header.appendChild(name);
+      header.appendChild(element("small", "date", " - " + this.formatDate(new Date(message.CreatedAt))));
+      container.appendChild(header);
+
+      // TextHTML is only present when the guestbook allows Markdown, and is
+      // sanitized on the server
+      var text = element("blockquote", "text");
+      if (message.TextHTML) {
+        text.innerHTML = message.TextHTML;
+      } else {
+        text.textContent = message.Text;
+      }
+      container.appendChild(text);
+
+      if (message.DrawingURL) {
+        var drawing = element("img", "drawing");
+        drawing.className = "guestbooks___drawing";
+        drawing.src = message.DrawingURL;
+        drawing.alt = this.t("message.drawing_alt", { name: message.Name });
+        drawing.loading = "lazy";
+        container.appendChild(drawing);
+      }
+
+      if (message.ImageURL) {
+        var imageLink = element("a", "image");
+        imageLink.className = "guestbooks___image";
+        imageLink.href = message.ImageURL;
+        imageLink.target = "_blank";
+        imageLink.rel = "noopener";
+        var image = document.createElement("img");
+        image.src = message.ImageThumbnailURL;
+        image.alt = this.t("message.image_alt", { name: message.Name });
+        image.loading = "lazy";
+        imageLink.appendChild(image);
+        container.appendChild(imageLink);
+      }
+
+      if (message.CustomFieldAnswers && message.CustomFieldAnswers.length > 0) {
+        var answers = element("ul", "answers");
+        answers.className = "guestbooks___custom-field-answers";
+        message.CustomFieldAnswers.forEach(function (answer) {
+          var item = element("li", "answer");
+          item.append(element("span", "answer-label", answer.label + ": "), answer.value);
+          answers.appendChild(item);
+        });
+        container.appendChild(answers);
+      }
+
+      if (this.config.reactionEmojis.length > 0) {
+        container.appendChild(this.createReactions(message));
+      }
+
+      if (this.config.visitorRepliesEnabled && message.CanReply) {
+        var replyButton = element("button", "reply-button", this.t("message.reply"));
+        replyButton.type = "button";
+        replyButton.className = "guestbooks___reply-button";
+        replyButton.addEventListener("click", () => this.setReplyTarget(message));
+        container.appendChild(replyButton);
+      }
+
+      return container;
+    }
+
+    createReactions(message) {
+      var container = element("div", "reactions");
+      container.className = "guestbooks___reactions";
+      var counts = message.Reactions || {};
+
+      this.config.reactionEmojis.forEach((emoji) => {
+        var button = element("button", "reaction");
+        button.type = "button";
+        button.className = "guestbooks___reaction";
+        button.dataset.emoji = emoji;
+        setReactionLabel(button, counts[emoji] || 0);
+        button.addEventListener("click", () => this.react(message.ID, container, button));
+        container.appendChild(button);
+      });
+      return container;
+    }
+
+    async react(messageId, container, button) {
+      var buttons = container.querySelectorAll("button");
+      buttons.forEach(function (b) { b.disabled = true; });
+
+      try {
+        var formData = new FormData();
+        formData.append("emoji", button.dataset.emoji);
+        if (this.config.powEnabled) {
+          var pow = await this.solvePow();
+          formData.append("powChallenge", pow.challenge);
+          formData.append("powNonce", pow.nonce);
+        }
+
+        var response = await fetch(hostUrl + "/guestbook/" + this.config.id + "/message/" + messageId + "/react", {
+          method: "POST",
+          body: formData,
+        });
+        if (!response.ok) {
+          throw new Error(await response.text());
+        }
+
+        var data = await response.json();
+        buttons.forEach(function (b) {
+          setReactionLabel(b, data.reactions[b.dataset.emoji] || 0);
+        });
+        button.setAttribute("part", "reaction reacted");
+      } catch (error) {
+        console.error("guestbook-widget: could not react to message:", error);
+      } finally {
+        buttons.forEach(function (b) { b.disabled = false; });
+      }
+    }
+  }
+
+  function setReactionLabel(button, count) {
+    button.textContent = count > 0 ? button.dataset.emoji + " " + count : button.dataset.emoji;
+  }
+
+  window.customElements.define("guestbook-widget", GuestbookWidget);
+})();
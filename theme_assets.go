@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"guestbook/constants"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// ThemeAsset is a font or image a user uploaded for their custom CSS.
+type ThemeAsset struct {
+	gorm.Model
+	AdminUserID uint `gorm:"index"`
+	// Original file name, only shown to the owner.
+	Name      string
+	Hash      string `gorm:"index"`
+	Extension string
+	Size      int64
+}
+
+var themeAssetFilePattern = regexp.MustCompile(`^([0-9a-f]{64})\.(png|jpg|gif|woff2|woff|ttf|otf)$`)
+
+// themeAssetURLPattern matches the URLs custom CSS can reference.
+var themeAssetURLPattern = regexp.MustCompile(`^/assets/user/[0-9]+/[0-9a-f]{64}\.(png|jpg|gif|woff2|woff|ttf|otf)$`)
+
+var themeAssetContentTypes = map[string]string{
+	"png":   "image/png",
+	"jpg":   "image/jpeg",
+	"gif":   "image/gif",
+	"woff2": "font/woff2",
+	"woff":  "font/woff",
+	"ttf":   "font/ttf",
+	"otf":   "font/otf",
+}
+
+func (a ThemeAsset) FileName() string {
+	return a.Hash + "." + a.Extension
+}
+
+func (a ThemeAsset) key() string {
+	return fmt.Sprintf("assets/%d/%s", a.AdminUserID, a.FileName())
+}
+
+// Path is the server relative URL to use in custom CSS.
+func (a ThemeAsset) Path() string {
+	return fmt.Sprintf("/assets/user/%d/%s", a.AdminUserID, a.FileName())
+}
+
+// detectThemeAssetType returns the extension for an uploaded asset based on
+// its content. Images must decode, fonts must start with their signature.
+func detectThemeAssetType(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("wOF2")):
+		return "woff2", nil
+	case bytes.HasPrefix(data, []byte("wOFF")):
+		return "woff", nil
+	case bytes.HasPrefix(data, []byte("OTTO")):
+		return "otf", nil
+	case bytes.HasPrefix(data, []byte{0x00, 0x01, 0x00, 0x00}), bytes.HasPrefix(data, []byte("true")):
+		return "ttf", nil
+	}
+
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", errors.New("Only PNG, JPEG and GIF images and WOFF2, WOFF, TTF and OTF fonts can be uploaded")
+	}
+	switch format {
+	case "png":
+		return "png", nil
+	case "jpeg":
+		return "jpg", nil
+	case "gif":
+		return "gif", nil
+	}
+	return "", fmt.Errorf("%s images can't be uploaded", strings.ToUpper(format))
+}
+
+// AdminThemeAssets lists the assets of the signed in user.
+func AdminThemeAssets(w http.ResponseWriter, r *http.Request) {
+	currentUser := getSignedInAdminOrFail(r)
+
+	var assets []ThemeAsset
+	if result := db.Where("admin_user_id = ?", currentUser.ID).Order("created_at DESC").Find(&assets); result.Error != nil {
+		http.Error(w, "Error loading assets", http.StatusInternalServerError)
+		return
+	}
+
+	used, err := userStorageUsage(currentUser.ID)
+	if err != nil {
+		http.Error(w, "Error loading assets", http.StatusInternalServerError)
+		return
+	}
+
+	renderAdminTemplate(w, r, "theme_assets", struct {
+		Assets       []ThemeAsset
+		UsedKB       int64
+		QuotaKB      int64
+		MaxAssetSize int64
+	}{
+		Assets:       assets,
+		UsedKB:       used / 1024,
+		QuotaKB:      constants.USER_STORAGE_QUOTA_BYTES / 1024,
+		MaxAssetSize: constants.MAX_THEME_ASSET_BYTES / 1024,
+	})
+}
+
+func AdminUploadThemeAsset(w http.ResponseWriter, r *http.Request) {
+	currentUser := getSignedInAdminOrFail(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, constants.MAX_THEME_ASSET_BYTES+64*1024)
+	file, header, err := r.FormFile("asset")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Assets can be at most %d KB", constants.MAX_THEME_ASSET_BYTES/1024), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Please choose a file to upload", http.StatusBadRequest)
+		}
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, constants.MAX_THEME_ASSET_BYTES+1))
+	if err != nil {
+		http.Error(w, "The file could not be read", http.StatusBadRequest)
+		return
+	}
+	if len(data) > constants.MAX_THEME_ASSET_BYTES {
+		http.Error(w, fmt.Sprintf("Assets can be at most %d KB", constants.MAX_THEME_ASSET_BYTES/1024), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	extension, err := detectThemeAssetType(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	used, err := userStorageUsage(currentUser.ID)
+	if err != nil {
+		http.Error(w, "Error uploading asset", http.StatusInternalServerError)
+		return
+	}
+	if used+int64(len(data)) > constants.USER_STORAGE_QUOTA_BYTES {
+		http.Error(w, "You have used up your storage, delete some assets first", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	asset := ThemeAsset{
+		AdminUserID: currentUser.ID,
+		Name:        filepath.Base(header.Filename),
+		Hash:        hex.EncodeToString(sum[:]),
+		Extension:   extension,
+		Size:        int64(len(data)),
+	}
+
+	// the file is stored once the row exists, and removed again if it can't
+	// be saved, so a failed upload never leaves a file behind
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&asset).Error; err != nil {
+			return err
+		}
+		if err := uploadStorage.Put(asset.key(), data); err != nil {
+			return fmt.Errorf("could not store file: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: could not upload theme asset: %v", err)
+		removeUnreferencedFiles(uploadedFiles{ThemeAssets: []ThemeAsset{asset}})
+		http.Error(w, "Error uploading asset", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("admin=%d username=%q action=upload_theme_asset asset_id=%d size=%d", currentUser.ID, currentUser.Username, asset.ID, asset.Size)
+
+	http.Redirect(w, r, "/admin/assets", http.StatusSeeOther)
+}
+
+func AdminDeleteThemeAsset(w http.ResponseWriter, r *http.Request) {
+	currentUser := getSignedInAdminOrFail(r)
+
+	var asset ThemeAsset
+	result := db.Where("id = ? AND admin_user_id = ?", chi.URLParam(r, "assetID"), currentUser.ID).First(&asset)
+	if result.Error != nil {
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return
+	}
+
+	// themes keep showing in the gallery and styling guestbooks after the
+	// asset is gone, so they have to stop using it first
+	var theme Theme
+	result = db.Where(`admin_user_id = ? AND (preview_url = ? OR css LIKE ? ESCAPE '\')`, currentUser.ID, asset.Path(), "%"+likeEscaper.Replace(asset.Path())+"%").Limit(1).Find(&theme)
+	if result.Error != nil {
+		http.Error(w, "Error deleting asset", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected > 0 {
+		http.Error(w, fmt.Sprintf("Your theme %q uses this asset, remove it from the theme or delete the theme first", theme.Name), http.StatusConflict)
+		return
+	}
+
+	if result := db.Delete(&asset); result.Error != nil {
+		http.Error(w, "Error deleting asset", http.StatusInternalServerError)
+		return
+	}
+
+	removeUnreferencedFiles(uploadedFiles{ThemeAssets: []ThemeAsset{asset}})
+
+	log.Printf("admin=%d username=%q action=delete_theme_asset asset_id=%d", currentUser.ID, currentUser.Username, asset.ID)
+
+	http.Redirect(w, r, "/admin/assets", http.StatusSeeOther)
+}
+
+// ThemeAssetHandler serves an uploaded asset. URLs contain the content hash,
+// so they can be cached forever.
+func ThemeAssetHandler(w http.ResponseWriter, r *http.Request) {
+	match := themeAssetFilePattern.FindStringSubmatch(chi.URLParam(r, "file"))
+	if match == nil {
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return
+	}
+
+	var asset ThemeAsset
+	result := db.Where("admin_user_id = ? AND hash = ? AND extension = ?", chi.URLParam(r, "userID"), match[1], match[2]).First(&asset)
+	if result.Error != nil {
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return
+	}
+
+	// fonts are loaded with CORS when the CSS is used on another site
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	serveUpload(w, r, asset.key(), themeAssetContentTypes[asset.Extension], "public, max-age=31536000, immutable")
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"guestbook/constants"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// Theme is a stylesheet guestbooks use by reference, so they get the
+// author's revisions. Built-in themes are synced from BUILT_IN_THEMES_DIR,
+// the others are published by users from their custom CSS.
+type Theme struct {
+	gorm.Model
+	Name   string
+	Author string
+	// AdminUserID is nil for built-in themes.
+	AdminUserID *uint  `gorm:"index"`
+	BuiltInFile string `gorm:"index"`
+	// One of the author's theme assets, shown in the gallery.
+	PreviewURL string
+	CSS        string `gorm:"type:text"`
+	// Unpublished themes are hidden from the gallery but keep working for
+	// guestbooks that already use them.
+	Published bool `gorm:"default:false"`
+	// Bumped on every revision so browsers fetch the new stylesheet.
+	Version int `gorm:"default:1"`
+}
+
+// StylesheetURL is the versioned URL guestbook pages link to.
+func (t Theme) StylesheetURL() string {
+	return fmt.Sprintf("/theme/%d/style.css?v=%d", t.ID, t.Version)
+}
+
+func (t Theme) IsBuiltIn() bool {
+	return t.AdminUserID == nil
+}
+
+func (t Theme) OwnedBy(userID uint) bool {
+	return t.AdminUserID != nil && *t.AdminUserID == userID
+}
+
+// builtInThemeName turns "gray-bear.css" into "Gray Bear".
+func builtInThemeName(fileName string) string {
+	words := strings.Fields(strings.ReplaceAll(strings.TrimSuffix(fileName, filepath.Ext(fileName)), "-", " "))
+	for i, word := range words {
+		words[i] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// syncBuiltInThemes makes sure every file in BUILT_IN_THEMES_DIR has a
+// Theme, and that guestbooks using it see changes made to the file.
+func syncBuiltInThemes() error {
+	files, err := os.ReadDir(constants.BUILT_IN_THEMES_DIR)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".css" {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(constants.BUILT_IN_THEMES_DIR, file.Name()))
+		if err != nil {
+			return err
+		}
+		css := strings.TrimSpace(strings.ReplaceAll(string(content), "\r\n", "\n"))
+
+		var theme Theme
+		result := db.Where("built_in_file = ? AND admin_user_id IS NULL", file.Name()).Limit(1).Find(&theme)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			theme = Theme{
+				Name:        builtInThemeName(file.Name()),
+				Author:      "Guestbooks",
+				BuiltInFile: file.Name(),
+				CSS:         css,
+				Published:   true,
+				Version:     1,
+			}
+			if err := db.Create(&theme).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if theme.CSS != css {
+			if err := db.Model(&theme).Updates(map[string]any{"css": css, "version": theme.Version + 1}).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// builtInThemeForCSS returns the built-in theme whose CSS is exactly css, or
+// nil when css doesn't match one (so it is custom CSS).
+func builtInThemeForCSS(css string) (*Theme, error) {
+	css = strings.TrimSpace(strings.ReplaceAll(css, "\r\n", "\n"))
+	if css == "" {
+		return nil, nil
+	}
+
+	var theme Theme
+	result := db.Where("admin_user_id IS NULL AND css = ?", css).Limit(1).Find(&theme)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &theme, nil
+}
+
+// builtInThemeByFile returns the Theme of a built-in theme file.
+func builtInThemeByFile(fileName string) (Theme, error) {
+	var theme Theme
+	err := db.Where("built_in_file = ? AND admin_user_id IS NULL", fileName).First(&theme).Error
+	return theme, err
+}
+
+// migrateBuiltInThemeMarkers moves guestbooks that stored a
+// "<<built__in>>name<</built__in>>" marker as their CSS over to ThemeID.
+func migrateBuiltInThemeMarkers() error {
+	var guestbooks []Guestbook
+	if err := db.Where("custom_page_css LIKE ?", "<<built__in>>%").Find(&guestbooks).Error; err != nil {
+		return err
+	}
+
+	for _, guestbook := range guestbooks {
+		// "_" matches any character in LIKE
+		if !strings.HasPrefix(guestbook.CustomPageCSS, "<<built__in>>") {
+			continue
+		}
+		fileName := strings.TrimPrefix(guestbook.CustomPageCSS, "<<built__in>>")
+		fileName = strings.TrimSuffix(fileName, "<</built__in>>")
+
+		updates := map[string]any{"custom_page_css": ""}
+		if theme, err := builtInThemeByFile(fileName); err == nil {
+			updates["theme_id"] = theme.ID
+		} else {
+			log.Printf("WARN: guestbook %d uses unknown built-in theme %q", guestbook.ID, fileName)
+		}
+		if err := db.Model(&Guestbook{}).Where("id = ?", guestbook.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// visibleThemes returns the themes a user can pick: the published ones and
+// their own.
+func visibleThemes(userID uint) ([]Theme, error) {
+	var themes []Theme
+	err := db.Where("published = ? OR admin_user_id = ?", true, userID).
+		Order("admin_user_id IS NOT NULL, name").
+		Find(&themes).Error
+	return themes, err
+}
+
+// parseID parses a database ID from a URL or form value.
+func parseID(value string) (uint, bool) {
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// loadTheme loads the theme with the ID from the themeID URL parameter.
+func loadTheme(r *http.Request) (Theme, bool) {
+	var theme Theme
+	themeID, ok := parseID(chi.URLParam(r, "themeID"))
+	if !ok {
+		return theme, false
+	}
+	return theme, db.First(&theme, themeID).Error == nil
+}
+
+// guestbookThemeOptions returns the themes offered in the guestbook form,
+// including the one the guestbook uses even if it is no longer published.
+func guestbookThemeOptions(userID uint, current *uint) ([]Theme, error) {
+	themes, err := visibleThemes(userID)
+	if err != nil || current == nil {
+		return themes, err
+	}
+	for _, theme := range themes {
+		if theme.ID == *current {
+			return themes, nil
+		}
+	}
+	var theme Theme
+	if err := db.First(&theme, *current).Error; err == nil {
+		themes = append(themes, theme)
+	}
+	return themes, nil
+}
+
+// themeUsableBy returns the theme if the user may apply it to a guestbook.
+func themeUsableBy(themeID uint, userID uint) (Theme, bool) {
+	var theme Theme
+	if err := db.First(&theme, themeID).Error; err != nil {
+		return theme, false
+	}
+	return theme, theme.Published || theme.OwnedBy(userID)
+}
+
+// parseThemeIDForm returns the theme picked in the guestbook form, nil for
+// none. The theme a guestbook already uses stays selectable even after its
+// author unpublished it.
+func parseThemeIDForm(value string, userID uint, current *uint) (*uint, error) {
+	if value == "" {
+		return nil, nil
+	}
+	themeID, ok := parseID(value)
+	if ok && current != nil && *current == themeID {
+		return current, nil
+	}
+	theme, usable := themeUsableBy(themeID, userID)
+	if !ok || !usable {
+		return nil, fmt.Errorf("The selected theme doesn't exist")
+	}
+	return &theme.ID, nil
+}
+
+// parseThemeForm reads the fields of the publish and revise forms.
+func parseThemeForm(r *http.Request, userID uint) (name, previewURL, css string, err error) {
+	name = strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return "", "", "", fmt.Errorf("Please give the theme a name")
+	}
+	if len([]rune(name)) > constants.MAX_THEME_NAME_LENGTH {
+		return "", "", "", fmt.Errorf("Theme names can be at most %d characters", constants.MAX_THEME_NAME_LENGTH)
+	}
+
+	previewURL = r.FormValue("previewURL")
+	if previewURL != "" {
+		images, err := themePreviewImages(userID)
+		if err != nil {
+			return "", "", "", err
+		}
+		found := false
+		for _, image := range images {
+			found = found || image.Path() == previewURL
+		}
+		if !found {
+			return "", "", "", fmt.Errorf("The preview must be one of your uploaded images")
+		}
+	}
+
+	css = strings.TrimSpace(r.FormValue("css"))
+	if css == "" {
+		return "", "", "", fmt.Errorf("A theme needs some CSS")
+	}
+	if ok, msg := validateCSS(css); !ok {
+		return "", "", "", fmt.Errorf("%s", msg)
+	}
+	return name, previewURL, css, nil
+}
+
+// AdminThemeGallery lists the published themes and the user's own.
+func AdminThemeGallery(w http.ResponseWriter, r *http.Request) {
+	currentUser := getSignedInAdminOrFail(r)
+
+	themes, err := visibleThemes(currentUser.ID)
+	if err != nil {
+		http.Error(w, "Error loading themes", http.StatusInternalServerError)
+		return
+	}
+
+	var guestbooks []Guestbook
+	if err := db.Where("admin_user_id = ?", currentUser.ID).Order("website_url").Find(&guestbooks).Error; err != nil {
+		http.Error(w, "Error loading themes", http.StatusInternalServerError)
+		return
+	}
+
+	renderAdminTemplate(w, r, "theme_gallery", struct {
+		Themes        []Theme
+		Guestbooks    []Guestbook
+		CurrentUserID uint
+	}{themes, guestbooks, currentUser.ID})
+}
+
+type themeFormData struct {
+	Theme
+	Images []ThemeAsset
+}
+
+// themePreviewImages returns the uploaded images a user can use as previews.
+func themePreviewImages(userID uint) ([]ThemeAsset, error) {
+	var images []ThemeAsset
+	err := db.Where("admin_user_id = ? AND extension IN ?", userID, []string{"png", "jpg", "gif"}).Order("created_at DESC").Find(&images).Error
+	return images, err
+}
+
+func renderThemeForm(w http.ResponseWriter, r *http.Request, theme Theme, userID uint) {
+	images, err := themePreviewImages(userID)
+	if err != nil {
+		http.Error(w, "Error loading assets", http.StatusInternalServerError)
+		return
+	}
+	renderAdminTemplate(w, r, "edit_theme", themeFormData{theme, images})
+}
+
+// AdminNewTheme shows the publish form, prefilled with the custom CSS of one
+// of the user's guestbooks.
+func AdminNewTheme(w http.ResponseWriter, r *http.Request) {
+	currentUser := getSignedInAdminOrFail(r)
+
+	var theme Theme
+	if guestbookID, ok := parseID(r.URL.Query().Get("guestbookID")); ok {
+		var guestbook Guestbook
+		if err := db.First(&guestbook, guestbookID).Error; err == nil && guestbook.AdminUserID == currentUser.ID {
+			theme.CSS = guestbook.CustomPageCSS
+		}
+	}
+
+	renderThemeForm(w, r, theme, currentUser.ID)
+}
+
+func AdminCreateTheme(w http.ResponseWriter, r *http.Request) {
+	currentUser := getSignedInAdminOrFail(r)
+
+	name, previewURL, css, err := parseThemeForm(r, currentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	theme := Theme{
+		Name:        name,
+		Author:      currentUser.ReplyName(),
+		AdminUserID: &currentUser.ID,
+		PreviewURL:  previewURL,
+		CSS:         css,
+		Published:   r.FormValue("published") == "on",
+		Version:     1,
+	}
+	if err := db.Create(&theme).Error; err != nil {
+		http.Error(w, "Error saving theme", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("admin=%d username=%q action=create_theme theme_id=%d", currentUser.ID, currentUser.Username, theme.ID)
+
+	http.Redirect(w, r, "/admin/themes", http.StatusSeeOther)
+}
+
+func AdminEditTheme(w http.ResponseWriter, r *http.Request) {
+	currentUser := getSignedInAdminOrFail(r)
+
+	theme, ok := loadTheme(r)
+	if !ok {
+		http.Error(w, "Theme not found", http.StatusNotFound)
+		return
+	}
+	if !theme.OwnedBy(currentUser.ID) {
+		http.Error(w, "You don't own this theme", http.StatusUnauthorized)
+		return
+	}
+
+	renderThemeForm(w, r, theme, currentUser.ID)
+}
+
+// AdminUpdateTheme saves a revision, every guestbook using the theme picks
+// it up through the new stylesheet version.
+func AdminUpdateTheme(w http.ResponseWriter, r *http.Request) {
+	currentUser := getSignedInAdminOrFail(r)
+
+	theme, ok := loadTheme(r)
+	if !ok {
+		http.Error(w, "Theme not found", http.StatusNotFound)
+		return
+	}
+	if !theme.OwnedBy(currentUser.ID) {
+		http.Error(w, "You don't own this theme", http.StatusUnauthorized)
+		return
+	}
+
+	name, previewURL, css, err := parseThemeForm(r, currentUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if css != theme.CSS {
+		theme.Version++
+	}
+	theme.Name = name
+	theme.Author = currentUser.ReplyName()
+	theme.PreviewURL = previewURL
+	theme.CSS = css
+	theme.Published = r.FormValue("published") == "on"
+	if err := db.Save(&theme).Error; err != nil {
+		http.Error(w, "Error saving theme", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("admin=%d username=%q action=update_theme theme_id=%d version=%d", currentUser.ID, currentUser.Username, theme.ID, theme.Version)
+
+	http.Redirect(w, r, "/admin/themes", http.StatusSeeOther)
+}
+
+// AdminApplyTheme makes one of the user's guestbooks use a theme.
+func AdminApplyTheme(w http.ResponseWriter, r *http.Request) {
+	currentUser := getSignedInAdminOrFail(r)
+
+	theme, ok := loadTheme(r)
+	if !ok || !(theme.Published || theme.OwnedBy(currentUser.ID)) {
+		http.Error(w, "Theme not found", http.StatusNotFound)
+		return
+	}
+
+	guestbookID, _ := parseID(r.FormValue("guestbookID"))
+	var guestbook Guestbook
+	if err := db.First(&guestbook, guestbookID).Error; err != nil {
+		http.Error(w, "Guestbook not found", http.StatusNotFound)
+		return
+	}
+	if guestbook.AdminUserID != currentUser.ID {
+		http.Error(w, "You don't own this guestbook", http.StatusUnauthorized)
+		return
+	}
+
+	if err := db.Model(&guestbook).Update("theme_id", theme.ID).Error; err != nil {
+		http.Error(w, "Error applying theme", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/guestbook/%d/edit", guestbook.ID), http.StatusSeeOther)
+}
+
+// AdminDeleteTheme deletes one of the user's themes. Guestbooks using it go
+// back to their own custom CSS.
+func AdminDeleteTheme(w http.ResponseWriter, r *http.Request) {
+	currentUser := getSignedInAdminOrFail(r)
+
+	theme, ok := loadTheme(r)
+	if !ok {
+		http.Error(w, "Theme not found", http.StatusNotFound)
+		return
+	}
+	if !theme.OwnedBy(currentUser.ID) {
+		http.Error(w, "You don't own this theme", http.StatusUnauthorized)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Guestbook{}).Where("theme_id = ?", theme.ID).Update("theme_id", nil).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&theme).Error
+	})
+	if err != nil {
+		http.Error(w, "Error deleting theme", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("admin=%d username=%q action=delete_theme theme_id=%d", currentUser.ID, currentUser.Username, theme.ID)
+
+	http.Redirect(w, r, "/admin/themes", http.StatusSeeOther)
+}
+
+// ThemeStylesheet serves the sanitized CSS of a theme. Versioned URLs never
+// change, so they can be cached forever.
+func ThemeStylesheet(w http.ResponseWriter, r *http.Request) {
+	theme, ok := loadTheme(r)
+	if !ok {
+		http.Error(w, "Theme not found", http.StatusNotFound)
+		return
+	}
+
+	css, _ := sanitizeCSS(theme.CSS)
+
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.URL.Query().Get("v") == strconv.Itoa(theme.Version) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	}
+	w.Write([]byte(css))
+}
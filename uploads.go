@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"guestbook/constants"
+
+	"gorm.io/gorm"
+)
+
+// Storage keeps the files visitors and owners upload. Keys are slash
+// separated relative paths such as "drawings/<hash>.png"; all stored files
+// are content addressed, so a key never changes its content.
+type Storage interface {
+	Put(key string, data []byte) error
+	Open(key string) (io.ReadSeekCloser, error)
+	Delete(key string) error
+}
+
+// LocalStorage stores uploads in a directory on the local disk.
+type LocalStorage struct {
+	Root string
+}
+
+var uploadStorage Storage = &LocalStorage{Root: constants.UPLOADS_DIR}
+
+func (s *LocalStorage) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.Contains(key, "\\") {
+		return "", fs.ErrInvalid
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(cleaned)), nil
+}
+
+// Put writes the file through a temporary file so readers never see a
+// partial upload. Existing keys are left untouched.
+func (s *LocalStorage) Put(key string, data []byte) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filePath); err == nil {
+		return nil
+	}
+
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filePath)
+}
+
+func (s *LocalStorage) Open(key string) (io.ReadSeekCloser, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filePath)
+}
+
+// Delete removes the file, deleting a missing file is not an error.
+func (s *LocalStorage) Delete(key string) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// serveUpload writes a stored file to the response. Uploads are immutable,
+// cacheControl only decides who may cache them and for how long.
+func serveUpload(w http.ResponseWriter, r *http.Request, key, contentType, cacheControl string) {
+	file, err := uploadStorage.Open(key)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
+
+// uploadedFiles lists uploads attached to messages or kept as theme assets.
+type uploadedFiles struct {
+	Drawings    []string
+	Images      []string
+	ThemeAssets []ThemeAsset
+}
+
+// attachedFiles returns the uploads attached to the messages matched by query.
+func attachedFiles(query *gorm.DB) (uploadedFiles, error) {
+	var files uploadedFiles
+	var attachments []Message
+	result := query.Model(&Message{}).Select("drawing_hash, image_name").
+		Where("drawing_hash <> '' OR image_name <> ''").Find(&attachments)
+	if result.Error != nil {
+		return files, result.Error
+	}
+
+	for _, attachment := range attachments {
+		if attachment.DrawingHash != "" {
+			files.Drawings = append(files.Drawings, attachment.DrawingHash)
+		}
+		if attachment.ImageName != "" {
+			files.Images = append(files.Images, attachment.ImageName)
+		}
+	}
+	return files, nil
+}
+
+// removeUnreferencedFiles deletes the uploads that no remaining message or
+// theme asset uses. It is called after messages or assets have been deleted.
+func removeUnreferencedFiles(files uploadedFiles) {
+	for _, hash := range files.Drawings {
+		if !drawingHashPattern.MatchString(hash) || fileInUse("drawing_hash", hash) {
+			continue
+		}
+		if err := uploadStorage.Delete(drawingKey(hash)); err != nil {
+			log.Printf("WARN: could not delete drawing %s: %v", hash, err)
+		}
+	}
+
+	for _, name := range files.Images {
+		if !imageNamePattern.MatchString(name) || fileInUse("image_name", name) {
+			continue
+		}
+		for _, key := range []string{imageKey(name), imageThumbnailKey(name)} {
+			if err := uploadStorage.Delete(key); err != nil {
+				log.Printf("WARN: could not delete image %s: %v", key, err)
+			}
+		}
+	}
+
+	for _, asset := range files.ThemeAssets {
+		// the same file may have been uploaded more than once
+		var count int64
+		result := db.Model(&ThemeAsset{}).Where("admin_user_id = ? AND hash = ? AND extension = ?", asset.AdminUserID, asset.Hash, asset.Extension).Count(&count)
+		if result.Error != nil || count > 0 {
+			continue
+		}
+		if err := uploadStorage.Delete(asset.key()); err != nil {
+			log.Printf("WARN: could not delete theme asset %s: %v", asset.key(), err)
+		}
+	}
+}
+
+func fileInUse(column, value string) bool {
+	var count int64
+	result := db.Model(&Message{}).Where(column+" = ?", value).Count(&count)
+	// keep the file if we can't tell
+	return result.Error != nil || count > 0
+}
+
+// userStorageUsage returns how many bytes of uploads count against the
+// quota of an admin user: images on their guestbooks and theme assets.
+func userStorageUsage(adminUserID uint) (int64, error) {
+	var images, assets int64
+	result := db.Model(&Message{}).
+		Joins("JOIN guestbooks ON guestbooks.id = messages.guestbook_id").
+		Where("guestbooks.admin_user_id = ?", adminUserID).
+		Select("COALESCE(SUM(messages.image_size), 0)").
+		Scan(&images)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	result = db.Model(&ThemeAsset{}).
+		Where("admin_user_id = ?", adminUserID).
+		Select("COALESCE(SUM(size), 0)").
+		Scan(&assets)
+	return images + assets, result.Error
+}
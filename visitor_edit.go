@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"guestbook/constants"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// SubmitResponse is returned by GuestbookSubmit to clients asking for JSON.
+type SubmitResponse struct {
+	ID            uint       `json:"id"`
+	Approved      bool       `json:"approved"`
+	EditToken     string     `json:"editToken,omitempty"`
+	EditableUntil *time.Time `json:"editableUntil,omitempty"`
+}
+
+// wantsJSON reports whether the client prefers a JSON response over a
+// redirect, which is what the embed script asks for.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func hashEditToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func editTokenCookieName(messageID uint) string {
+	return fmt.Sprintf("guestbooks_edit_%d", messageID)
+}
+
+// parseEditWindowMinutes parses the edit window from the guestbook editor,
+// 0 disables visitor edits.
+func parseEditWindowMinutes(raw string) int {
+	minutes, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || minutes < 0 {
+		return 0
+	}
+	return min(minutes, constants.MAX_EDIT_WINDOW_MINUTES)
+}
+
+// editableUntil returns until when the author can still change a message.
+func (g Guestbook) editableUntil(message Message) time.Time {
+	return message.CreatedAt.Add(time.Duration(g.EditWindowMinutes) * time.Minute)
+}
+
+// issueEditToken gives the author of a freshly submitted message a secret
+// token to edit or delete it, if the guestbook allows it. Only a hash of the
+// token is stored.
+func issueEditToken(w http.ResponseWriter, guestbook Guestbook, message *Message) (string, error) {
+	if guestbook.EditWindowMinutes <= 0 {
+		return "", nil
+	}
+
+	token, err := generateAuthToken()
+	if err != nil {
+		return "", err
+	}
+
+	message.EditTokenHash = hashEditToken(token)
+	if result := db.Model(message).Update("edit_token_hash", message.EditTokenHash); result.Error != nil {
+		return "", result.Error
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     editTokenCookieName(message.ID),
+		Value:    token,
+		Path:     fmt.Sprintf("/guestbook/%d/message/%d", guestbook.ID, message.ID),
+		MaxAge:   guestbook.EditWindowMinutes * 60,
+		HttpOnly: true,
+		Secure:   !constants.DEBUG_MODE,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return token, nil
+}
+
+// findMessageByEditToken loads the message in the URL if the request carries
+// its edit token (as a form value or cookie) and it can still be edited.
+func findMessageByEditToken(r *http.Request) (*Message, *Guestbook, int, string) {
+	guestbookID, ok := parseGuestbookIDParam(r)
+	if !ok {
+		return nil, nil, http.StatusBadRequest, "Invalid guestbook ID"
+	}
+
+	var guestbook Guestbook
+	if result := db.First(&guestbook, guestbookID); result.Error != nil {
+		return nil, nil, http.StatusNotFound, "Guestbook not found"
+	}
+
+	var message Message
+	result := db.Where("id = ? AND guestbook_id = ?", chi.URLParam(r, "messageID"), guestbook.ID).First(&message)
+	if result.Error != nil {
+		return nil, nil, http.StatusNotFound, "Message not found"
+	}
+
+	token := strings.TrimSpace(r.FormValue("editToken"))
+	if token == "" {
+		if cookie, err := r.Cookie(editTokenCookieName(message.ID)); err == nil {
+			token = cookie.Value
+		}
+	}
+
+	if token == "" || message.EditTokenHash == "" ||
+		subtle.ConstantTimeCompare([]byte(hashEditToken(token)), []byte(message.EditTokenHash)) != 1 {
+		return nil, nil, http.StatusForbidden, "You can't change this message"
+	}
+
+	if guestbook.EditWindowMinutes <= 0 || time.Now().After(guestbook.editableUntil(message)) {
+		return nil, nil, http.StatusForbidden, "This message can no longer be changed"
+	}
+
+	return &message, &guestbook, http.StatusOK, ""
+}
+
+func respondToVisitorChange(w http.ResponseWriter, r *http.Request, guestbook *Guestbook, message *Message) {
+	if wantsJSON(r) {
+		editableUntil := guestbook.editableUntil(*message)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SubmitResponse{
+			ID:            message.ID,
+			Approved:      message.Approved,
+			EditableUntil: &editableUntil,
+		})
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/guestbook/%d", guestbook.ID), http.StatusSeeOther)
+}
+
+// VisitorEditMessage lets the author change the text of their message within
+// the edit window. On guestbooks that require approval the message goes back
+// into the approval queue.
+func VisitorEditMessage(w http.ResponseWriter, r *http.Request) {
+	message, guestbook, status, errMsg := findMessageByEditToken(r)
+	if message == nil {
+		http.Error(w, errMsg, status)
+		return
+	}
+
+	text := strings.TrimSpace(r.FormValue("text"))
+	if text == "" {
+		http.Error(w, "Message text cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if len(text) > constants.MAX_MESSAGE_LENGTH {
+		http.Error(w, "Message is too long, maximum length is "+fmt.Sprint(constants.MAX_MESSAGE_LENGTH)+" characters", http.StatusBadRequest)
+		return
+	}
+
+	wasApproved := message.Approved
+	message.Text = text
+	message.Approved = !guestbook.RequiresApproval
+	result := db.Model(message).Updates(map[string]any{
+		"text":     message.Text,
+		"approved": message.Approved,
+	})
+	if result.Error != nil {
+		http.Error(w, "Error updating message", http.StatusInternalServerError)
+		return
+	}
+
+	// Invalidate cache for this guestbook since the message changed
+	messageCache.InvalidateGuestbook(guestbook.ID)
+	publishMessageChange(guestbook, *message, wasApproved, publicHostURL(r))
+
+	respondToVisitorChange(w, r, guestbook, message)
+}
+
+// VisitorDeleteMessage lets the author delete their message within the edit
+// window.
+func VisitorDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	message, guestbook, status, errMsg := findMessageByEditToken(r)
+	if message == nil {
+		http.Error(w, errMsg, status)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := clearVisitorEmails(tx.Where("id = ?", message.ID)); err != nil {
+			return err
+		}
+		if err := deleteReactions(tx, db.Where("id = ?", message.ID)); err != nil {
+			return err
+		}
+		return tx.Delete(message).Error
+	})
+	if err != nil {
+		http.Error(w, "Error deleting message", http.StatusInternalServerError)
+		return
+	}
+
+	// Invalidate cache for this guestbook since the message was deleted
+	messageCache.InvalidateGuestbook(guestbook.ID)
+	publishDeletedMessages(guestbook.ID, []uint{message.ID})
+	removeUnreferencedFiles(uploadedFiles{Drawings: []string{message.DrawingHash}, Images: []string{message.ImageName}})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   editTokenCookieName(message.ID),
+		Path:   fmt.Sprintf("/guestbook/%d/message/%d", guestbook.ID, message.ID),
+		MaxAge: -1,
+	})
+
+	if wantsJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/guestbook/%d", guestbook.ID), http.StatusSeeOther)
+}
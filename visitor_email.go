@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"guestbook/constants"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// normalizeVisitorEmail validates the optional email a visitor can leave to
+// be notified about replies. It returns an empty string if none was given.
+func normalizeVisitorEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", nil
+	}
+
+	if len(email) > constants.MAX_VISITOR_EMAIL_LENGTH {
+		return "", errors.New("email address is too long")
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", errors.New("email address is invalid")
+	}
+
+	return email, nil
+}
+
+func visitorEmailCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey("visitor-email"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptVisitorEmail encrypts an email with AES-GCM so it is never stored in
+// plain text. The nonce is prepended to the ciphertext.
+func encryptVisitorEmail(email string) (string, error) {
+	gcm, err := visitorEmailCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(email), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptVisitorEmail(encrypted string) (string, error) {
+	gcm, err := visitorEmailCipher()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted email is too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// clearVisitorEmails drops the stored visitor email (and its token) from all
+// messages matched by query. Deletes are soft, so this must be called before
+// deleting messages or the address would stay around.
+func clearVisitorEmails(query *gorm.DB) error {
+	return query.Model(&Message{}).Updates(map[string]any{
+		"visitor_email_encrypted": "",
+		"visitor_email_confirmed": false,
+		"visitor_email_token":     "",
+	}).Error
+}
+
+func visitorEmailLink(guestbookID uint, action, token string) string {
+	return fmt.Sprintf("%s/guestbook/%d/notifications/%s?token=%s", constants.PUBLIC_URL, guestbookID, action, token)
+}
+
+// requestVisitorEmailConfirmation stores the encrypted email on the message
+// and sends the double opt-in email. Notifications are only sent once the
+// visitor has clicked the confirmation link.
+func requestVisitorEmailConfirmation(guestbook Guestbook, message *Message, email string) error {
+	encrypted, err := encryptVisitorEmail(email)
+	if err != nil {
+		return err
+	}
+
+	token, err := generateAuthToken()
+	if err != nil {
+		return err
+	}
+
+	message.VisitorEmailEncrypted = encrypted
+	message.VisitorEmailConfirmed = false
+	message.VisitorEmailToken = token
+
+	result := db.Model(message).Updates(map[string]any{
+		"visitor_email_encrypted": message.VisitorEmailEncrypted,
+		"visitor_email_confirmed": false,
+		"visitor_email_token":     message.VisitorEmailToken,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	confirmLink := visitorEmailLink(guestbook.ID, "confirm", token)
+	if constants.DEBUG_MODE {
+		fmt.Println("In debug mode, not sending visitor confirmation email. Confirmation link:")
+		fmt.Println(confirmLink)
+	} else {
+		go func() {
+			if err := SendVisitorConfirmationEmail(email, guestbook.WebsiteURL, confirmLink); err != nil {
+				log.Printf("WARN: could not send confirmation email for message %d: %v", message.ID, err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// notifyVisitorOfReply emails the author of parent (if they opted in and
+// confirmed) to let them know the owner replied.
+func notifyVisitorOfReply(guestbook Guestbook, parent Message, reply Message) {
+	if parent.VisitorEmailEncrypted == "" || !parent.VisitorEmailConfirmed {
+		return
+	}
+
+	email, err := decryptVisitorEmail(parent.VisitorEmailEncrypted)
+	if err != nil {
+		log.Printf("WARN: could not decrypt visitor email for message %d: %v", parent.ID, err)
+		return
+	}
+
+	guestbookLink := fmt.Sprintf("%s/guestbook/%d", constants.PUBLIC_URL, guestbook.ID)
+	if strings.TrimSpace(guestbook.WebsiteURL) != "" {
+		guestbookLink = guestbook.WebsiteURL
+	}
+	unsubscribeLink := visitorEmailLink(guestbook.ID, "unsubscribe", parent.VisitorEmailToken)
+
+	if constants.DEBUG_MODE {
+		fmt.Println("In debug mode, not sending visitor reply email:")
+		fmt.Println(reply.Name, "replied:", reply.Text)
+		fmt.Println("Unsubscribe link:", unsubscribeLink)
+	} else {
+		go func() {
+			if err := SendVisitorReplyEmail(email, guestbook.WebsiteURL, guestbookLink, unsubscribeLink, reply.Name, reply.Text); err != nil {
+				log.Printf("WARN: could not send reply email for message %d: %v", parent.ID, err)
+			}
+		}()
+	}
+}
+
+func findMessageByVisitorEmailToken(r *http.Request, translator *Translator) (*Message, int, string) {
+	guestbookID := chi.URLParam(r, "guestbookID")
+	token := strings.TrimSpace(r.URL.Query().Get("token"))
+	if token == "" {
+		return nil, http.StatusBadRequest, translator.T("notifications.token_required")
+	}
+
+	var message Message
+	result := db.Where("guestbook_id = ? AND visitor_email_token = ?", guestbookID, token).First(&message)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, http.StatusNotFound, translator.T("notifications.invalid_link")
+		}
+		return nil, http.StatusInternalServerError, "Internal server error"
+	}
+
+	return &message, http.StatusOK, ""
+}
+
+// visitorEmailTranslator picks the locale for the notification pages, the
+// visitor's browser preference falling back to the guestbook's locale.
+func visitorEmailTranslator(r *http.Request) *Translator {
+	var guestbook Guestbook
+	db.Select("locale").First(&guestbook, chi.URLParam(r, "guestbookID"))
+	return newTranslator(negotiateLocale(r, guestbook.Locale), nil)
+}
+
+// visitorEmailPageTemplate asks visitors to confirm an action on their email
+// with a POST, so link prefetchers in mail clients can't do it for them. t is
+// replaced with the visitor's locale in renderVisitorEmailPage.
+var visitorEmailPageTemplate = template.Must(template.New("visitor_email").Funcs(newTranslator(constants.DEFAULT_LOCALE, nil).Funcs()).Parse(`<!DOCTYPE html>
+<html lang="{{.Locale}}">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{t .Title}}</title>
+</head>
+<body>
+    <p>{{t .Question}}</p>
+    <form method="post" action="?token={{.Token}}">
+        <button type="submit">{{t .Button}}</button>
+    </form>
+</body>
+</html>`))
+
+type visitorEmailPageData struct {
+	Locale   string
+	Token    string
+	Title    string
+	Question string
+	Button   string
+}
+
+func renderVisitorEmailPage(w http.ResponseWriter, translator *Translator, data visitorEmailPageData) {
+	tmpl, err := visitorEmailPageTemplate.Clone()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data.Locale = translator.Locale
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	tmpl.Funcs(translator.Funcs()).Execute(w, data)
+}
+
+// VisitorEmailConfirmHandler completes the double opt-in for reply
+// notifications. GET (the link in the email) only shows a form that confirms
+// with a POST.
+func VisitorEmailConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	translator := visitorEmailTranslator(r)
+	message, status, errMsg := findMessageByVisitorEmailToken(r, translator)
+	if message == nil {
+		http.Error(w, errMsg, status)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		renderVisitorEmailPage(w, translator, visitorEmailPageData{
+			Token:    message.VisitorEmailToken,
+			Title:    "notifications.confirm_title",
+			Question: "notifications.confirm_question",
+			Button:   "notifications.confirm_button",
+		})
+		return
+	}
+
+	result := db.Model(message).Update("visitor_email_confirmed", true)
+	if result.Error != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(translator.T("notifications.confirmed")))
+}
+
+// VisitorEmailUnsubscribeHandler removes the visitor email from the message.
+// GET (the link in the email) only shows a form that confirms with a POST,
+// which is also what one-click unsubscribe from mail clients sends.
+func VisitorEmailUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	translator := visitorEmailTranslator(r)
+	message, status, errMsg := findMessageByVisitorEmailToken(r, translator)
+	if message == nil {
+		http.Error(w, errMsg, status)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		renderVisitorEmailPage(w, translator, visitorEmailPageData{
+			Token:    message.VisitorEmailToken,
+			Title:    "notifications.unsubscribe_title",
+			Question: "notifications.unsubscribe_question",
+			Button:   "notifications.unsubscribe_button",
+		})
+		return
+	}
+
+	if err := clearVisitorEmails(db.Where("id = ?", message.ID)); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(translator.T("notifications.unsubscribed")))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const widgetScriptFile = "templates/resources/guestbook_widget.js"
+
+var widgetScriptTemplate *scriptTemplate = mustLoadScriptTemplate(widgetScriptFile)
+
+// GuestbookConfig is what the <guestbook-widget> web component builds its
+// form from. It never includes the challenge answer.
+type GuestbookConfig struct {
+	ID                     uint          `json:"id"`
+	WebsiteURL             string        `json:"websiteURL"`
+	Locale                 string        `json:"locale"`
+	Strings                Catalog       `json:"strings"`
+	ThemeURL               string        `json:"themeURL,omitempty"`
+	ChallengeQuestion      string        `json:"challengeQuestion,omitempty"`
+	ChallengeHint          string        `json:"challengeHint,omitempty"`
+	ChallengeFailedMessage string        `json:"challengeFailedMessage,omitempty"`
+	PowEnabled             bool          `json:"powEnabled"`
+	MarkdownEnabled        bool          `json:"markdownEnabled"`
+	VisitorRepliesEnabled  bool          `json:"visitorRepliesEnabled"`
+	ImagesEnabled          bool          `json:"imagesEnabled"`
+	CustomFields           []CustomField `json:"customFields"`
+	ReactionEmojis         []string      `json:"reactionEmojis"`
+}
+
+// GetGuestbookConfigV2 returns the public settings of a guestbook, with its
+// text in the visitor's locale.
+func GetGuestbookConfigV2(w http.ResponseWriter, r *http.Request) {
+	guestbookID, ok := parseGuestbookIDParam(r)
+	if !ok {
+		http.Error(w, "Invalid guestbook ID", http.StatusBadRequest)
+		return
+	}
+
+	var guestbook Guestbook
+	if result := db.First(&guestbook, guestbookID); result.Error != nil {
+		writeGuestbookLoadError(w, result.Error)
+		return
+	}
+
+	translator := guestbookTranslator(r, &guestbook)
+	config := GuestbookConfig{
+		ID:                     guestbook.ID,
+		WebsiteURL:             guestbook.WebsiteURL,
+		Locale:                 translator.Locale,
+		Strings:                translator.catalog,
+		ChallengeQuestion:      guestbook.ChallengeQuestion,
+		ChallengeHint:          guestbook.ChallengeHint,
+		ChallengeFailedMessage: guestbook.ChallengeFailedMessage,
+		PowEnabled:             guestbook.PowEnabled,
+		MarkdownEnabled:        guestbook.MarkdownEnabled,
+		VisitorRepliesEnabled:  guestbook.VisitorRepliesEnabled,
+		ImagesEnabled:          guestbook.ImagesEnabled,
+		CustomFields:           guestbook.CustomFields,
+		ReactionEmojis:         guestbook.ReactionEmojis,
+	}
+	if config.CustomFields == nil {
+		config.CustomFields = []CustomField{}
+	}
+	if config.ReactionEmojis == nil {
+		config.ReactionEmojis = []string{}
+	}
+	if guestbook.ThemeID != nil {
+		var theme Theme
+		if err := db.First(&theme, *guestbook.ThemeID).Error; err == nil {
+			config.ThemeURL = theme.StylesheetURL()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Language")
+	json.NewEncoder(w).Encode(config)
+}
+
+// GuestbookWidgetScript serves the script defining the <guestbook-widget>
+// element. It is the same for every guestbook, the element loads the
+// settings of the one it shows from GetGuestbookConfigV2. It only changes
+// with the template, so browsers revalidate it with its ETag like the embed
+// script.
+func GuestbookWidgetScript(w http.ResponseWriter, r *http.Request) {
+	script, err := currentScriptTemplate(widgetScriptTemplate, widgetScriptFile)
+	if err != nil {
+		log.Printf("Error loading guestbook widget script: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	hostUrl := publicHostURL(r)
+
+	var body bytes.Buffer
+	if err := script.template.Execute(&body, struct{ HostUrl string }{HostUrl: hostUrl}); err != nil {
+		log.Printf("Error rendering guestbook widget script: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, no-cache")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, script.version))
+	http.ServeContent(w, r, "", script.modTime, bytes.NewReader(body.Bytes()))
+}